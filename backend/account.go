@@ -0,0 +1,542 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sync"
+    "sync/atomic"
+
+    "go.mau.fi/whatsmeow/store"
+    "go.mau.fi/whatsmeow/types"
+)
+
+// The account list, in the data directory. Each account's own files live
+// in accounts/<id>.
+const accountsFile = "accounts.enc"
+const accountsDir = "accounts"
+
+var accountLog = logger("account")
+
+// accountRecord is what accounts.enc keeps per account. JID is empty until
+// the device is paired.
+type accountRecord struct {
+    ID  string `json:"id"`
+    JID string `json:"jid,omitempty"`
+    // Migrated from the single-account layout, so its media stays in the
+    // configured directories instead of a per-account subdirectory
+    LegacyMedia bool `json:"legacyMedia,omitempty"`
+}
+
+// Account is one WhatsApp device in the shared sqlstore container, with
+// its own client, data files and media directories.
+type Account struct {
+    ID          string
+    dir         string
+    legacyMedia bool
+
+    device      *store.Device // the client's store; ID is nil until paired
+    client      WAClient
+    log         *slog.Logger
+    pairCode    string
+    isConnected bool
+    // Set on the first Connected event; later ones are reconnects
+    connectedBefore bool
+    // When the running event handler started, 0 when idle; for the watchdog
+    handlingSince atomic.Int64
+
+    messages         []Message
+    msgMutex         sync.RWMutex
+    contacts         map[string]string
+    contactsMutex    sync.RWMutex
+    avatars          map[string]*AvatarInfo
+    avatarsMutex     sync.RWMutex
+    chatStates       map[string]*ChatState
+    chatStatesMutex  sync.RWMutex
+    contactInfo      map[string]*ContactInfo
+    contactInfoMutex sync.RWMutex
+
+    picturesDir  string
+    videosDir    string
+    audioDir     string
+    documentsDir string
+    avatarsDir   string
+
+    persister            *Persister
+    avatarFetcher        *AvatarFetcher
+    avatarRevalidateOnce sync.Once
+
+    // ctx ends when the account is closed, stopping downloads and
+    // background fetches. Sends have their own context, only cancelled
+    // once they have had sendDrainTimeout to finish.
+    ctx         context.Context
+    cancel      context.CancelFunc
+    sendCtx     context.Context
+    cancelSends context.CancelFunc
+    sendMutex   sync.Mutex
+    sends       sync.WaitGroup
+    closing     bool
+}
+
+// AccountInfo describes an account for GET /accounts.
+type AccountInfo struct {
+    ID        string `json:"id"`
+    Phone     string `json:"phone"`
+    Connected bool   `json:"connected"`
+    PairCode  string `json:"pairCode"`
+    Default   bool   `json:"default"`
+}
+
+// The first account is the default for requests that don't pick one
+var accounts []*Account
+var accountsMutex sync.RWMutex
+
+func newAccountID() string {
+    b := make([]byte, 4)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+// newAccount sets up an account for device and creates its directories.
+// Nothing is loaded or connected yet.
+func newAccount(rec accountRecord, device *store.Device) *Account {
+    cfg := getConfig()
+    a := &Account{
+        ID:          rec.ID,
+        dir:         filepath.Join(accountsDir, rec.ID),
+        legacyMedia: rec.LegacyMedia,
+        contacts:    make(map[string]string),
+        avatars:     make(map[string]*AvatarInfo),
+        chatStates:  make(map[string]*ChatState),
+        contactInfo: make(map[string]*ContactInfo),
+        log:         accountLog.With("account", rec.ID),
+    }
+    a.ctx, a.cancel = context.WithCancel(context.Background())
+    a.sendCtx, a.cancelSends = context.WithCancel(context.Background())
+    a.picturesDir, a.videosDir, a.audioDir = cfg.PicturesDir, cfg.VideosDir, cfg.AudioDir
+    a.documentsDir, a.avatarsDir = cfg.DocumentsDir, cfg.AvatarsDir
+    if !a.legacyMedia {
+        a.picturesDir = filepath.Join(a.picturesDir, a.ID)
+        a.videosDir = filepath.Join(a.videosDir, a.ID)
+        a.audioDir = filepath.Join(a.audioDir, a.ID)
+        a.documentsDir = filepath.Join(a.documentsDir, a.ID)
+        a.avatarsDir = filepath.Join(a.avatarsDir, a.ID)
+    }
+    os.MkdirAll(a.dir, 0700)
+    for _, dir := range []string{a.picturesDir, a.videosDir, a.audioDir, a.documentsDir, a.avatarsDir} {
+        os.MkdirAll(dir, 0755)
+    }
+
+    a.persister = newPersister(a.log, map[string]func() error{
+        messagesFile:   a.saveMessages,
+        contactsFile:   a.saveContacts,
+        avatarsFile:    a.saveAvatars,
+        chatStatesFile: a.saveChatStates,
+    })
+    a.avatarFetcher = newAvatarFetcher(a, avatarFetchWorkers)
+
+    a.device = device
+    a.client = newClient(device, newWALogger(logger("client").With("account", a.ID)))
+    a.client.AddEventHandler(a.timedEventHandler)
+    return a
+}
+
+// path returns the location of one of the account's data files.
+func (a *Account) path(name string) string {
+    return filepath.Join(a.dir, name)
+}
+
+func (a *Account) markDirty(name string) {
+    a.persister.MarkDirty(name)
+}
+
+func (a *Account) phone() string {
+    if a.device.ID != nil {
+        return a.device.ID.User
+    }
+    return ""
+}
+
+func (a *Account) record() accountRecord {
+    rec := accountRecord{ID: a.ID, LegacyMedia: a.legacyMedia}
+    if a.device.ID != nil {
+        rec.JID = a.device.ID.String()
+    }
+    return rec
+}
+
+func (a *Account) info() AccountInfo {
+    return AccountInfo{ID: a.ID, Phone: a.phone(), Connected: a.isConnected, PairCode: a.pairCode, Default: defaultAccount() == a}
+}
+
+// load reads the account's data files.
+func (a *Account) load() {
+    a.loadMessages()
+    a.loadContactsFromDisk()
+    a.loadAvatarsFromDisk()
+    a.loadChatStatesFromDisk()
+}
+
+func (a *Account) connect() {
+    if a.device.ID == nil {
+        a.log.Info("no device ID, waiting for pairing")
+    } else {
+        a.log.Info("connecting", "jid", a.device.ID.String())
+    }
+    go a.client.Connect()
+}
+
+// close disconnects the account and stops its workers. Sends in flight
+// may finish first, then background work is cancelled and data that
+// wasn't saved yet is written.
+func (a *Account) close() {
+    drainCtx, cancel := context.WithTimeout(context.Background(), sendDrainTimeout)
+    a.drainSends(drainCtx)
+    cancel()
+    a.client.RemoveEventHandlers()
+    a.cancel()
+    a.client.Disconnect()
+    if err := a.persister.FlushAll(); err != nil {
+        a.log.Warn("some data could not be saved", "err", err)
+    }
+    a.shutdown()
+}
+
+// shutdown stops the account without saving, for when its files are
+// about to be replaced or deleted.
+func (a *Account) shutdown() {
+    a.sendMutex.Lock()
+    a.closing = true
+    a.sendMutex.Unlock()
+    a.cancelSends()
+    a.client.RemoveEventHandlers()
+    a.cancel()
+    a.client.Disconnect()
+    a.avatarFetcher.Stop()
+    a.persister.Stop()
+}
+
+// beginSend registers a send or upload, unless the account is closing.
+// Each successful call must be matched by a.sends.Done().
+func (a *Account) beginSend() error {
+    a.sendMutex.Lock()
+    defer a.sendMutex.Unlock()
+    if a.closing {
+        return errShuttingDown
+    }
+    a.sends.Add(1)
+    return nil
+}
+
+// drainSends refuses new sends and waits for those in flight until ctx
+// ends, when the rest are cancelled.
+func (a *Account) drainSends(ctx context.Context) {
+    a.sendMutex.Lock()
+    a.closing = true
+    a.sendMutex.Unlock()
+    done := make(chan struct{})
+    go func() {
+        a.sends.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+        return
+    case <-ctx.Done():
+    }
+    a.log.Warn("sends still running, cancelling them")
+    a.cancelSends()
+    <-done
+}
+
+func getAccount(id string) *Account {
+    accountsMutex.RLock()
+    defer accountsMutex.RUnlock()
+    for _, a := range accounts {
+        if a.ID == id {
+            return a
+        }
+    }
+    return nil
+}
+
+func defaultAccount() *Account {
+    accountsMutex.RLock()
+    defer accountsMutex.RUnlock()
+    if len(accounts) == 0 {
+        return nil
+    }
+    return accounts[0]
+}
+
+func allAccounts() []*Account {
+    accountsMutex.RLock()
+    defer accountsMutex.RUnlock()
+    return append([]*Account(nil), accounts...)
+}
+
+func saveAccountRecords() error {
+    accountsMutex.RLock()
+    records := make([]accountRecord, len(accounts))
+    for i, a := range accounts {
+        records[i] = a.record()
+    }
+    accountsMutex.RUnlock()
+    return SaveEncrypted(accountsFile, records)
+}
+
+// Data files of the single-account layout, which lived directly in the
+// data directory
+var legacyDataFiles = []string{messagesFile, contactsFile, avatarsFile, chatStatesFile,
+    "messages.json", "contacts.json", "avatars.json"}
+
+// migrateLegacyFiles moves the data files of a single-account install
+// into the account's directory.
+func migrateLegacyFiles(dir string) bool {
+    moved := false
+    for _, name := range legacyDataFiles {
+        if _, err := os.Stat(name); err != nil {
+            continue
+        }
+        os.MkdirAll(dir, 0700)
+        if err := os.Rename(name, filepath.Join(dir, name)); err != nil {
+            accountLog.Warn("couldn't move legacy data file", "file", name, "err", err)
+            continue
+        }
+        moved = true
+    }
+    return moved
+}
+
+// loadAccounts pairs the devices in the container with the account list
+// and opens every account. A device the list doesn't know gets a new
+// account; an account whose device is gone gets a fresh one to pair, so
+// its data isn't lost. Without any account, one is created for pairing.
+func loadAccounts() error {
+    var records []accountRecord
+    err := LoadEncrypted(accountsFile, &records)
+    firstRun := os.IsNotExist(err)
+    if err != nil && !firstRun {
+        return fmt.Errorf("couldn't read account list: %v", err)
+    }
+    devices, err := container.GetAllDevices(ctx)
+    if err != nil {
+        return err
+    }
+
+    byJID := make(map[string]*store.Device, len(devices))
+    for _, d := range devices {
+        byJID[d.ID.String()] = d
+    }
+    assigned := make([]*store.Device, len(records))
+    for i, rec := range records {
+        if d, ok := byJID[rec.JID]; ok && rec.JID != "" {
+            assigned[i] = d
+            delete(byJID, rec.JID)
+        }
+    }
+    // Leftover devices, e.g. from a restored session, go to an account of
+    // the same phone number first, then to one that was never paired
+    for _, d := range devices {
+        if _, free := byJID[d.ID.String()]; !free {
+            continue
+        }
+        for _, samePhone := range []bool{true, false} {
+            idx := -1
+            for i, rec := range records {
+                if assigned[i] != nil {
+                    continue
+                }
+                jid, _ := types.ParseJID(rec.JID)
+                if (samePhone && rec.JID != "" && jid.User == d.ID.User) || (!samePhone && rec.JID == "") {
+                    idx = i
+                    break
+                }
+            }
+            if idx >= 0 {
+                assigned[idx] = d
+                delete(byJID, d.ID.String())
+                break
+            }
+        }
+    }
+    for _, d := range devices {
+        if _, free := byJID[d.ID.String()]; free {
+            records = append(records, accountRecord{ID: newAccountID(), JID: d.ID.String()})
+            assigned = append(assigned, d)
+        }
+    }
+    if len(records) == 0 {
+        records = append(records, accountRecord{ID: newAccountID()})
+        assigned = append(assigned, nil)
+    }
+
+    // The first account inherits the files of a single-account install
+    if firstRun && migrateLegacyFiles(filepath.Join(accountsDir, records[0].ID)) {
+        records[0].LegacyMedia = true
+        accountLog.Info("moved existing data to account", "account", records[0].ID)
+    }
+
+    opened := make([]*Account, len(records))
+    for i, rec := range records {
+        device := assigned[i]
+        if device == nil {
+            device = container.NewDevice()
+        }
+        a := newAccount(rec, device)
+        a.load()
+        opened[i] = a
+    }
+    accountsMutex.Lock()
+    accounts = opened
+    accountsMutex.Unlock()
+    if err := saveAccountRecords(); err != nil {
+        accountLog.Warn("couldn't save account list", "err", err)
+    }
+    for _, a := range opened {
+        a.connect()
+    }
+    accountLog.Info("accounts opened", "count", len(opened))
+    return nil
+}
+
+// closeAccounts saves and disconnects every account and forgets them,
+// along with everything decrypted into memory.
+func closeAccounts() {
+    accountsMutex.Lock()
+    closing := accounts
+    accounts = nil
+    accountsMutex.Unlock()
+    for _, a := range closing {
+        a.close()
+    }
+}
+
+// flushAccounts writes the pending changes of every account.
+func flushAccounts() error {
+    var firstErr error
+    for _, a := range allAccounts() {
+        if err := a.persister.FlushAll(); err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    return firstErr
+}
+
+// addAccount creates an account with a new device, ready for pairing.
+func addAccount() (*Account, error) {
+    if container == nil {
+        return nil, fmt.Errorf("database is not open")
+    }
+    a := newAccount(accountRecord{ID: newAccountID()}, container.NewDevice())
+    accountsMutex.Lock()
+    accounts = append(accounts, a)
+    accountsMutex.Unlock()
+    if err := saveAccountRecords(); err != nil {
+        accountLog.Warn("couldn't save account list", "err", err)
+    }
+    a.log.Info("account added")
+    a.connect()
+    return a, nil
+}
+
+// removeAccount unlinks the account's device and deletes its data and
+// cached avatars. Downloaded media stays, like it does when a chat is
+// deleted without deleteMedia.
+func removeAccount(a *Account) {
+    a.log.Info("logging out")
+    accountsMutex.Lock()
+    for i, x := range accounts {
+        if x == a {
+            accounts = append(accounts[:i], accounts[i+1:]...)
+            break
+        }
+    }
+    accountsMutex.Unlock()
+
+    if a.device.ID != nil {
+        if err := a.client.Logout(ctx); err != nil {
+            // Offline or already unlinked: at least forget the device here
+            a.log.Warn("logout failed", "err", err)
+            a.client.Disconnect()
+            a.device.Delete(ctx)
+        }
+    }
+    a.shutdown()
+    a.persister.Discard()
+    os.RemoveAll(a.dir)
+    removeFilesIn(a.avatarsDir)
+    if !a.legacyMedia {
+        // Only goes if empty, i.e. nothing was ever downloaded
+        for _, dir := range []string{a.avatarsDir, a.picturesDir, a.videosDir, a.audioDir, a.documentsDir} {
+            os.Remove(dir)
+        }
+    }
+    dismissAccountNotifications(a.ID)
+
+    if err := saveAccountRecords(); err != nil {
+        accountLog.Warn("couldn't save account list", "err", err)
+    }
+    a.log.Info("account removed")
+}
+
+// removeFilesIn deletes the files in dir but leaves subdirectories, which
+// may belong to other accounts.
+func removeFilesIn(dir string) {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return
+    }
+    for _, e := range entries {
+        if !e.IsDir() {
+            os.Remove(filepath.Join(dir, e.Name()))
+        }
+    }
+}
+
+// accountFor picks the account a request is for: the account query
+// parameter or X-Account header, or the default account.
+func accountFor(r *http.Request) (*Account, error) {
+    id := r.URL.Query().Get("account")
+    if id == "" {
+        id = r.Header.Get("X-Account")
+    }
+    if id == "" {
+        if a := defaultAccount(); a != nil {
+            return a, nil
+        }
+        return nil, apiError(http.StatusConflict, "no_account", "no account is open")
+    }
+    if a := getAccount(id); a != nil {
+        return a, nil
+    }
+    return nil, apiError(http.StatusNotFound, "unknown_account", "no account %s", id)
+}
+
+// legacyAccount is accountFor for the old routes, which answer errors in
+// plain text. It returns nil once the error is written.
+func legacyAccount(w http.ResponseWriter, r *http.Request) *Account {
+    a, err := accountFor(r)
+    if err != nil {
+        apiErr := err.(*APIError)
+        writeError(w, r, apiErr.Status, apiErr.Code, apiErr.Message)
+        return nil
+    }
+    return a
+}
+
+// legacyLoggedIn writes the not paired error for the old routes that need
+// a paired account, and reports whether a is paired.
+func legacyLoggedIn(w http.ResponseWriter, r *http.Request, a *Account) bool {
+    if err := a.requireLogin(); err != nil {
+        apiErr := err.(*APIError)
+        writeError(w, r, apiErr.Status, apiErr.Code, apiErr.Message)
+        return false
+    }
+    return true
+}
@@ -0,0 +1,1010 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "mime/multipart"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const apiPrefix = "/api/v2"
+
+var apiLog = logger("api")
+
+// APIError is the error object every /api/v2 endpoint returns:
+// {"error": {"code": "...", "message": "..."}}.
+type APIError struct {
+    Status  int    `json:"-"`
+    Code    string `json:"code"`
+    Message string `json:"message"`
+}
+
+func (e *APIError) Error() string { return e.Message }
+
+func apiError(status int, code, format string, args ...interface{}) *APIError {
+    return &APIError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func badRequest(format string, args ...interface{}) *APIError {
+    return apiError(http.StatusBadRequest, "bad_request", format, args...)
+}
+
+// upstreamError wraps a failure reported by WhatsApp itself. Errors that
+// already are API errors, like errShuttingDown, are kept.
+func upstreamError(err error) *APIError {
+    var apiErr *APIError
+    if errors.As(err, &apiErr) {
+        return apiErr
+    }
+    return apiError(http.StatusBadGateway, "whatsapp_error", "%v", err)
+}
+
+type ErrorResponse struct {
+    Error *APIError `json:"error"`
+}
+
+// writeError sends an error in the format the request's API version uses:
+// a JSON object under /api/v2, plain text on the old routes.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+    if !strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+        http.Error(w, message, status)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(ErrorResponse{&APIError{Status: status, Code: code, Message: message}})
+}
+
+// apiParam documents a query parameter.
+type apiParam struct {
+    Name        string
+    Type        string // "string", "boolean" or "integer"
+    Description string
+}
+
+// apiRoute is one /api/v2 endpoint. The same table drives the router and
+// the OpenAPI description, so the two can't drift apart.
+type apiRoute struct {
+    Method    string
+    Path      string // relative to apiPrefix, with {name} path parameters
+    Summary   string
+    Query     []apiParam
+    Body      interface{} // zero value of the JSON request body, nil if none
+    Multipart bool        // also accepts multipart/form-data with a "file" part
+    Response  interface{} // zero value of the JSON response
+    Produces  string      // content type for non-JSON responses
+    Global    bool        // not about one account, takes no account parameter
+    Handle    func(w http.ResponseWriter, r *http.Request) (interface{}, error)
+}
+
+// OKResponse is returned by endpoints that have nothing else to report.
+type OKResponse struct {
+    OK bool `json:"ok"`
+}
+
+var okResponse = OKResponse{OK: true}
+
+type StatusResponse struct {
+    Connected bool                   `json:"connected"`
+    PairCode  string                 `json:"pairCode"`
+    Phone     string                 `json:"phone"`
+    Storage   map[string]interface{} `json:"storage"`
+    Encrypted bool                   `json:"encrypted"`
+    Locked    bool                   `json:"locked"`
+}
+
+type UnlockRequest struct {
+    // Required for the passphrase lock, ignored for the device lock
+    Passphrase string `json:"passphrase,omitempty"`
+}
+
+type PairRequest struct {
+    Phone string `json:"phone"`
+}
+
+type PairResponse struct {
+    Code string `json:"code"`
+}
+
+type AccountPairResponse struct {
+    Account AccountInfo `json:"account"`
+    Code    string      `json:"code"`
+}
+
+// ChatUpdate changes a chat's flags; fields left out stay as they are.
+type ChatUpdate struct {
+    Archived     *bool `json:"archived,omitempty"`
+    Pinned       *bool `json:"pinned,omitempty"`
+    Muted        *bool `json:"muted,omitempty"`
+    MuteDuration int64 `json:"muteDuration,omitempty"` // seconds, 0 = forever
+}
+
+type ClearChatRequest struct {
+    KeepStarred bool `json:"keepStarred"`
+    DeleteMedia bool `json:"deleteMedia"`
+}
+
+type SendTextRequest struct {
+    Text string `json:"text"`
+}
+
+type SendMediaRequest struct {
+    Path    string `json:"path"`
+    Caption string `json:"caption,omitempty"`
+}
+
+// ActiveChatRequest names the chat the UI shows; an empty jid means none.
+type ActiveChatRequest struct {
+    ChatJID string `json:"jid"`
+}
+
+type StarRequest struct {
+    Starred bool `json:"starred"`
+}
+
+type LookupRequest struct {
+    Phones []string `json:"phones"`
+}
+
+type ImportRequest struct {
+    Path    string `json:"path"`
+    ChatJID string `json:"jid,omitempty"`
+    Me      string `json:"me,omitempty"`
+}
+
+type BackupRequest struct {
+    Passphrase string `json:"passphrase"`
+    Session    bool   `json:"session"`
+    Media      bool   `json:"media"`
+    Out        string `json:"out,omitempty"` // write to this file instead of the response
+}
+
+type RestoreRequest struct {
+    Path       string `json:"path"`
+    Passphrase string `json:"passphrase"`
+}
+
+type ConfigResponse struct {
+    Config          Config `json:"config"`
+    RestartRequired bool   `json:"restartRequired"`
+}
+
+type LogLevelResponse struct {
+    Level      string            `json:"level"`
+    Components map[string]string `json:"components"`
+}
+
+// An empty level with a component drops that component's override
+type LogLevelRequest struct {
+    Component string `json:"component,omitempty"`
+    Level     string `json:"level"`
+}
+
+// decodeJSON reads a JSON request body into v, refusing unknown fields so
+// typos don't go unnoticed.
+func decodeJSON(r *http.Request, v interface{}) error {
+    dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(v); err != nil {
+        if errors.Is(err, io.EOF) {
+            return apiError(http.StatusBadRequest, "invalid_json", "request body required")
+        }
+        return apiError(http.StatusBadRequest, "invalid_json", "%v", err)
+    }
+    return nil
+}
+
+func isMultipart(r *http.Request) bool {
+    return strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+}
+
+// multipartFile returns the "file" part of a multipart request.
+func multipartFile(r *http.Request) (multipart.File, *multipart.FileHeader, error) {
+    if err := r.ParseMultipartForm(100 << 20); err != nil {
+        return nil, nil, badRequest("%v", err)
+    }
+    file, header, err := r.FormFile("file")
+    if err != nil {
+        return nil, nil, badRequest("file required")
+    }
+    return file, header, nil
+}
+
+// multipartTempFile streams the "file" part of a multipart request into a
+// temporary file in the data directory, so large uploads never sit in
+// memory, and returns its path with the other form fields. The caller
+// removes the file.
+func multipartTempFile(r *http.Request) (string, map[string]string, error) {
+    mr, err := r.MultipartReader()
+    if err != nil {
+        return "", nil, badRequest("%v", err)
+    }
+    fields := make(map[string]string)
+    path := ""
+    for {
+        part, err := mr.NextPart()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            if path != "" {
+                os.Remove(path)
+            }
+            return "", nil, badRequest("%v", err)
+        }
+        if part.FormName() != "file" || path != "" {
+            value, _ := io.ReadAll(io.LimitReader(part, 64<<10))
+            fields[part.FormName()] = string(value)
+            continue
+        }
+        f, err := os.CreateTemp(".", "upload-*")
+        if err != nil {
+            return "", nil, err
+        }
+        path = f.Name()
+        _, err = io.Copy(f, part)
+        if cerr := f.Close(); err == nil {
+            err = cerr
+        }
+        if err != nil {
+            os.Remove(path)
+            return "", nil, err
+        }
+    }
+    if path == "" {
+        return "", nil, badRequest("file required")
+    }
+    return path, fields, nil
+}
+
+func queryBool(r *http.Request, name string) (bool, error) {
+    v := r.URL.Query().Get(name)
+    if v == "" {
+        return false, nil
+    }
+    b, err := strconv.ParseBool(v)
+    if err != nil {
+        return false, badRequest("%s must be true or false", name)
+    }
+    return b, nil
+}
+
+func (a *Account) requireLogin() error {
+    if a.device.ID == nil {
+        return apiError(http.StatusConflict, "not_paired", "no WhatsApp account is paired")
+    }
+    return nil
+}
+
+var apiRoutes = []apiRoute{
+    {Method: "GET", Path: "/status", Summary: "Connection and storage status",
+        Response: StatusResponse{}, Handle: apiStatus},
+    {Method: "POST", Path: "/unlock", Summary: "Unlock with the passphrase or a device lock prompt",
+        Body: UnlockRequest{}, Response: OKResponse{}, Global: true, Handle: apiUnlock},
+    {Method: "POST", Path: "/lock", Summary: "Lock now, forgetting the key and decrypted data",
+        Response: OKResponse{}, Global: true, Handle: apiLock},
+    {Method: "POST", Path: "/pair", Summary: "Request a pairing code for a phone number",
+        Body: PairRequest{}, Response: PairResponse{}, Handle: apiPair},
+    {Method: "POST", Path: "/logout", Summary: "Unlink the device and delete all local data",
+        Response: OKResponse{}, Handle: apiLogout},
+    {Method: "GET", Path: "/accounts", Summary: "List accounts, the default first",
+        Response: []AccountInfo{}, Global: true, Handle: apiAccounts},
+    {Method: "POST", Path: "/accounts", Summary: "Add an account and request its pairing code",
+        Body: PairRequest{}, Response: AccountPairResponse{}, Global: true, Handle: apiAddAccount},
+    {Method: "DELETE", Path: "/accounts/{id}", Summary: "Unlink an account and delete its data",
+        Response: OKResponse{}, Global: true, Handle: apiRemoveAccount},
+
+    {Method: "GET", Path: "/chats", Summary: "List chats, pinned first",
+        Query:    []apiParam{{"archived", "boolean", "list archived chats instead"}},
+        Response: []Chat{}, Handle: apiChats},
+    {Method: "PATCH", Path: "/chats/{jid}", Summary: "Archive, pin or mute a chat",
+        Body: ChatUpdate{}, Response: ChatState{}, Handle: apiUpdateChat},
+    {Method: "DELETE", Path: "/chats/{jid}", Summary: "Delete a chat",
+        Query:    []apiParam{{"deleteMedia", "boolean", "also delete downloaded media"}},
+        Response: OKResponse{}, Handle: apiDeleteChat},
+    {Method: "POST", Path: "/chats/{jid}/clear", Summary: "Clear a chat's messages",
+        Body: ClearChatRequest{}, Response: OKResponse{}, Handle: apiClearChat},
+    {Method: "GET", Path: "/chats/{jid}/messages", Summary: "Messages of a chat, oldest first",
+        Response: []Message{}, Handle: apiMessages},
+    {Method: "POST", Path: "/chats/{jid}/messages", Summary: "Send a text message",
+        Body: SendTextRequest{}, Response: Message{}, Handle: apiSendText},
+    {Method: "POST", Path: "/chats/{jid}/media", Summary: "Send a file, by local path or upload",
+        Body: SendMediaRequest{}, Multipart: true, Response: OKResponse{}, Handle: apiSendMedia},
+    {Method: "DELETE", Path: "/chats/{jid}/messages/{id}", Summary: "Delete a message for me",
+        Query:    []apiParam{{"deleteMedia", "boolean", "also delete the downloaded file"}},
+        Response: OKResponse{}, Handle: apiDeleteMessage},
+    {Method: "PUT", Path: "/chats/{jid}/messages/{id}/star", Summary: "Star or unstar a message",
+        Body: StarRequest{}, Response: OKResponse{}, Handle: apiStar},
+    {Method: "POST", Path: "/chats/{jid}/read", Summary: "Send read receipts for a chat",
+        Response: OKResponse{}, Handle: apiMarkRead},
+    {Method: "PUT", Path: "/active-chat", Summary: "Set the chat on screen, to suppress its notifications",
+        Body: ActiveChatRequest{}, Response: OKResponse{}, Handle: apiSetActiveChat},
+    {Method: "GET", Path: "/starred", Summary: "All starred messages",
+        Response: []Message{}, Handle: apiStarred},
+
+    {Method: "GET", Path: "/contacts", Summary: "Known contact names by JID",
+        Response: map[string]string{}, Handle: apiContacts},
+    {Method: "POST", Path: "/contacts/reload", Summary: "Reload contacts from the device store",
+        Response: OKResponse{}, Handle: apiReloadContacts},
+    {Method: "POST", Path: "/contacts/lookup", Summary: "Check phone numbers on WhatsApp",
+        Body: LookupRequest{}, Response: []ContactInfo{}, Handle: apiLookup},
+    {Method: "GET", Path: "/contacts/{jid}/avatar", Summary: "Profile picture",
+        Produces: "image/jpeg", Handle: apiAvatar},
+
+    {Method: "GET", Path: "/export", Summary: "Export one or all chats",
+        Query: []apiParam{
+            {"jid", "string", "chat to export, all chats if empty"},
+            {"format", "string", "txt, html or json"},
+            {"zip", "boolean", "zip with media"},
+            {"from", "string", "YYYY-MM-DD or unix seconds"},
+            {"to", "string", "YYYY-MM-DD or unix seconds"},
+        },
+        Produces: "application/octet-stream", Handle: apiExport},
+    {Method: "POST", Path: "/import", Summary: "Import a WhatsApp chat export",
+        Body: ImportRequest{}, Multipart: true, Response: ImportResult{}, Handle: apiImport},
+    {Method: "POST", Path: "/backup", Summary: "Create an encrypted backup",
+        Body: BackupRequest{}, Produces: "application/octet-stream", Handle: apiBackup},
+    {Method: "POST", Path: "/restore", Summary: "Restore an encrypted backup",
+        Body: RestoreRequest{}, Multipart: true, Response: RestoreResult{}, Handle: apiRestore},
+
+    {Method: "POST", Path: "/database/rekey", Summary: "Re-encrypt the database with a new key",
+        Response: OKResponse{}, Global: true, Handle: apiRekey},
+
+    {Method: "GET", Path: "/config", Summary: "Current configuration",
+        Response: Config{}, Global: true, Handle: apiGetConfig},
+    {Method: "PATCH", Path: "/config", Summary: "Change configuration settings",
+        Body: Config{}, Response: ConfigResponse{}, Global: true, Handle: apiUpdateConfig},
+    {Method: "POST", Path: "/shutdown", Summary: "Shut the backend down; it answers first, then saves and exits",
+        Response: OKResponse{}, Global: true, Handle: apiShutdown},
+
+    {Method: "GET", Path: "/debug/loglevel", Summary: "Current log levels",
+        Response: LogLevelResponse{}, Global: true, Handle: apiGetLogLevel},
+    {Method: "PUT", Path: "/debug/loglevel", Summary: "Change the log level until restart, overall or for one component",
+        Body: LogLevelRequest{}, Response: LogLevelResponse{}, Global: true, Handle: apiSetLogLevel},
+}
+
+// The description is generated from apiRoutes, so it can only be added
+// once the table exists.
+func init() {
+    apiRoutes = append(apiRoutes, apiRoute{Method: "GET", Path: "/openapi.json", Summary: "This API description",
+        Response: map[string]interface{}{}, Global: true, Handle: apiOpenAPI})
+}
+
+// registerAPIv2 adds the /api/v2 routes to mux. Routes sharing a path are
+// dispatched on the method here, so that a wrong method gets a JSON error.
+func registerAPIv2(mux *http.ServeMux) {
+    byPath := make(map[string][]apiRoute)
+    var paths []string
+    for _, route := range apiRoutes {
+        if _, seen := byPath[route.Path]; !seen {
+            paths = append(paths, route.Path)
+        }
+        byPath[route.Path] = append(byPath[route.Path], route)
+    }
+    for _, path := range paths {
+        routes := byPath[path]
+        mux.HandleFunc(apiPrefix+path, func(w http.ResponseWriter, r *http.Request) {
+            var allowed []string
+            for _, route := range routes {
+                if route.Method == r.Method {
+                    serveAPI(w, r, route)
+                    return
+                }
+                allowed = append(allowed, route.Method)
+            }
+            w.Header().Set("Allow", strings.Join(allowed, ", "))
+            writeError(w, r, http.StatusMethodNotAllowed, "method_not_allowed",
+                fmt.Sprintf("%s not allowed, use %s", r.Method, strings.Join(allowed, " or ")))
+        })
+    }
+    mux.HandleFunc(apiPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+        writeError(w, r, http.StatusNotFound, "not_found", "no such endpoint")
+    })
+}
+
+func serveAPI(w http.ResponseWriter, r *http.Request, route apiRoute) {
+    result, err := route.Handle(w, r)
+    if err != nil {
+        var apiErr *APIError
+        if !errors.As(err, &apiErr) {
+            apiErr = apiError(http.StatusInternalServerError, "internal", "%v", err)
+        }
+        writeError(w, r, apiErr.Status, apiErr.Code, apiErr.Message)
+        return
+    }
+    if result == nil {
+        // The handler wrote a non-JSON response itself
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+func apiStatus(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    phone := ""
+    if a.device.ID != nil {
+        phone = a.device.ID.User
+    }
+    plain, err := isPlaintextDatabase(dbFile)
+    encrypted := err == nil && !plain
+    return StatusResponse{Connected: a.isConnected, PairCode: a.pairCode, Phone: phone, Storage: a.persister.Status(), Encrypted: encrypted, Locked: isLocked()}, nil
+}
+
+func apiUnlock(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    var req UnlockRequest
+    if err := decodeJSON(r, &req); err != nil {
+        return nil, err
+    }
+    if err := unlockApp(req.Passphrase); err != nil {
+        return nil, err
+    }
+    return okResponse, nil
+}
+
+func apiLock(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    if err := lockApp(); err != nil {
+        return nil, err
+    }
+    return okResponse, nil
+}
+
+func apiPair(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    var req PairRequest
+    if err := decodeJSON(r, &req); err != nil {
+        return nil, err
+    }
+    if normalizePhone(req.Phone) == "" {
+        return nil, badRequest("phone required")
+    }
+    code, err := a.pairDevice(normalizePhone(req.Phone))
+    if err != nil {
+        return nil, apiError(http.StatusServiceUnavailable, "pairing_failed", "%v", err)
+    }
+    return PairResponse{Code: code}, nil
+}
+
+func apiLogout(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    logout(a)
+    return okResponse, nil
+}
+
+func apiAccounts(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    list := allAccounts()
+    result := make([]AccountInfo, len(list))
+    for i, a := range list {
+        result[i] = a.info()
+    }
+    return result, nil
+}
+
+// apiAddAccount sets up a new device in the shared store and pairs it. An
+// account whose pairing code couldn't be requested is removed again.
+func apiAddAccount(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    var req PairRequest
+    if err := decodeJSON(r, &req); err != nil {
+        return nil, err
+    }
+    phone := normalizePhone(req.Phone)
+    if phone == "" {
+        return nil, badRequest("phone required")
+    }
+    for _, a := range allAccounts() {
+        if a.phone() == phone {
+            return nil, apiError(http.StatusConflict, "account_exists", "account %s already uses this number", a.ID)
+        }
+    }
+    a, err := addAccount()
+    if err != nil {
+        return nil, apiError(http.StatusServiceUnavailable, "database_closed", "%v", err)
+    }
+    code, err := a.pairDevice(phone)
+    if err != nil {
+        removeAccount(a)
+        return nil, apiError(http.StatusServiceUnavailable, "pairing_failed", "%v", err)
+    }
+    return AccountPairResponse{Account: a.info(), Code: code}, nil
+}
+
+func apiRemoveAccount(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a := getAccount(r.PathValue("id"))
+    if a == nil {
+        return nil, apiError(http.StatusNotFound, "unknown_account", "no account %s", r.PathValue("id"))
+    }
+    logout(a)
+    return okResponse, nil
+}
+
+func apiChats(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    archived, err := queryBool(r, "archived")
+    if err != nil {
+        return nil, err
+    }
+    chats := a.getChats(archived)
+    if chats == nil {
+        chats = []Chat{}
+    }
+    return chats, nil
+}
+
+func apiUpdateChat(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    jid := r.PathValue("jid")
+    var req ChatUpdate
+    if err := decodeJSON(r, &req); err != nil {
+        return nil, err
+    }
+    if req.MuteDuration < 0 {
+        return nil, badRequest("muteDuration must not be negative")
+    }
+    if err := a.requireLogin(); err != nil {
+        return nil, err
+    }
+    if req.Archived != nil {
+        if err := a.setChatArchived(jid, *req.Archived); err != nil {
+            return nil, upstreamError(err)
+        }
+    }
+    if req.Pinned != nil {
+        if err := a.setChatPinned(jid, *req.Pinned); err != nil {
+            return nil, upstreamError(err)
+        }
+    }
+    if req.Muted != nil {
+        if err := a.setChatMuted(jid, *req.Muted, time.Duration(req.MuteDuration)*time.Second); err != nil {
+            return nil, upstreamError(err)
+        }
+    }
+    return a.getChatState(jid), nil
+}
+
+func apiDeleteChat(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    deleteMedia, err := queryBool(r, "deleteMedia")
+    if err != nil {
+        return nil, err
+    }
+    if err := a.requireLogin(); err != nil {
+        return nil, err
+    }
+    if err := a.deleteChat(r.PathValue("jid"), deleteMedia); err != nil {
+        return nil, upstreamError(err)
+    }
+    return okResponse, nil
+}
+
+func apiClearChat(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    var req ClearChatRequest
+    if err := decodeJSON(r, &req); err != nil {
+        return nil, err
+    }
+    if err := a.requireLogin(); err != nil {
+        return nil, err
+    }
+    if err := a.clearChat(r.PathValue("jid"), req.KeepStarred, req.DeleteMedia); err != nil {
+        return nil, upstreamError(err)
+    }
+    return okResponse, nil
+}
+
+func apiMessages(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    msgs := a.getMessagesForChat(r.PathValue("jid"))
+    if msgs == nil {
+        msgs = []Message{}
+    }
+    return msgs, nil
+}
+
+func apiSendText(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    var req SendTextRequest
+    if err := decodeJSON(r, &req); err != nil {
+        return nil, err
+    }
+    if req.Text == "" {
+        return nil, badRequest("text required")
+    }
+    if err := a.requireLogin(); err != nil {
+        return nil, err
+    }
+    m, err := a.sendText(r.PathValue("jid"), req.Text)
+    if err != nil {
+        return nil, upstreamError(err)
+    }
+    return m, nil
+}
+
+func apiSendMedia(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    var req SendMediaRequest
+    if isMultipart(r) {
+        file, header, err := multipartFile(r)
+        if err != nil {
+            return nil, err
+        }
+        defer file.Close()
+        if req.Path, err = a.saveUpload(file, header.Filename); err != nil {
+            return nil, err
+        }
+        req.Caption = r.FormValue("caption")
+    } else {
+        if err := decodeJSON(r, &req); err != nil {
+            return nil, err
+        }
+        if req.Path == "" {
+            return nil, badRequest("path required")
+        }
+    }
+    if err := a.requireLogin(); err != nil {
+        return nil, err
+    }
+    if err := a.sendMedia(r.PathValue("jid"), req.Path, req.Caption); err != nil {
+        return nil, upstreamError(err)
+    }
+    return okResponse, nil
+}
+
+func apiDeleteMessage(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    deleteMedia, err := queryBool(r, "deleteMedia")
+    if err != nil {
+        return nil, err
+    }
+    if err := a.requireLogin(); err != nil {
+        return nil, err
+    }
+    jid, id := r.PathValue("jid"), r.PathValue("id")
+    if _, found := a.findMessage(jid, id); !found {
+        return nil, apiError(http.StatusNotFound, "not_found", "no message %s in %s", id, jid)
+    }
+    if err := a.deleteMessageForMe(jid, id, deleteMedia); err != nil {
+        return nil, upstreamError(err)
+    }
+    return okResponse, nil
+}
+
+func apiStar(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    var req StarRequest
+    if err := decodeJSON(r, &req); err != nil {
+        return nil, err
+    }
+    if err := a.requireLogin(); err != nil {
+        return nil, err
+    }
+    jid, id := r.PathValue("jid"), r.PathValue("id")
+    if _, found := a.findMessage(jid, id); !found {
+        return nil, apiError(http.StatusNotFound, "not_found", "no message %s in %s", id, jid)
+    }
+    if err := a.setMessageStarred(jid, id, req.Starred); err != nil {
+        return nil, upstreamError(err)
+    }
+    return okResponse, nil
+}
+
+func apiMarkRead(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    if err := a.requireLogin(); err != nil {
+        return nil, err
+    }
+    if err := a.markChatRead(r.PathValue("jid")); err != nil {
+        return nil, upstreamError(err)
+    }
+    return okResponse, nil
+}
+
+func apiSetActiveChat(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    var req ActiveChatRequest
+    if err := decodeJSON(r, &req); err != nil {
+        return nil, err
+    }
+    setActiveChat(a, req.ChatJID)
+    return okResponse, nil
+}
+
+func apiStarred(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    msgs := a.getStarredMessages()
+    if msgs == nil {
+        msgs = []Message{}
+    }
+    return msgs, nil
+}
+
+func apiContacts(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    a.contactsMutex.RLock()
+    defer a.contactsMutex.RUnlock()
+    result := make(map[string]string, len(a.contacts))
+    for jid, name := range a.contacts {
+        result[jid] = name
+    }
+    return result, nil
+}
+
+func apiReloadContacts(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    a.loadContacts()
+    return okResponse, nil
+}
+
+func apiLookup(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    var req LookupRequest
+    if err := decodeJSON(r, &req); err != nil {
+        return nil, err
+    }
+    if len(req.Phones) == 0 {
+        return nil, badRequest("phones required")
+    }
+    if err := a.requireLogin(); err != nil {
+        return nil, err
+    }
+    infos, err := a.lookupContacts(req.Phones)
+    if err != nil {
+        return nil, upstreamError(err)
+    }
+    return infos, nil
+}
+
+func apiAvatar(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    jid := r.PathValue("jid")
+    path := a.getAvatar(jid)
+    if path == "" {
+        waitCtx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+        path = a.avatarFetcher.Wait(waitCtx, a.avatarFetcher.Enqueue(jid, false, true))
+        cancel()
+    }
+    if path == "" {
+        return nil, apiError(http.StatusNotFound, "not_found", "no profile picture for %s", jid)
+    }
+    http.ServeFile(w, r, path)
+    return nil, nil
+}
+
+func apiExport(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    opts, err := exportOptionsFromQuery(r.URL.Query())
+    if err != nil {
+        return nil, badRequest("%v", err)
+    }
+    a.serveExport(w, r.URL.Query().Get("jid"), opts)
+    return nil, nil
+}
+
+func apiImport(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    var req ImportRequest
+    var path string
+    if isMultipart(r) {
+        upload, fields, err := multipartTempFile(r)
+        if err != nil {
+            return nil, err
+        }
+        defer os.Remove(upload)
+        path = upload
+        req.ChatJID, req.Me = fields["jid"], fields["me"]
+    } else {
+        if err := decodeJSON(r, &req); err != nil {
+            return nil, err
+        }
+        if req.Path == "" {
+            return nil, badRequest("path required")
+        }
+        path = expandHome(req.Path)
+        if _, err := os.Stat(path); err != nil {
+            return nil, badRequest("%v", err)
+        }
+    }
+    result, err := a.importChatArchive(path, ImportOptions{ChatJID: req.ChatJID, Me: req.Me})
+    if err != nil {
+        return nil, apiError(http.StatusUnprocessableEntity, "import_failed", "%v", err)
+    }
+    return result, nil
+}
+
+func apiBackup(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    var req BackupRequest
+    if err := decodeJSON(r, &req); err != nil {
+        return nil, err
+    }
+    if req.Passphrase == "" {
+        return nil, badRequest("passphrase required")
+    }
+    opts := BackupOptions{Passphrase: req.Passphrase, Session: req.Session, Media: req.Media}
+    if req.Out != "" {
+        if err := a.writeBackupFile(expandHome(req.Out), opts); err != nil {
+            return nil, err
+        }
+        return okResponse, nil
+    }
+    w.Header().Set("Content-Type", "application/octet-stream")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+        "whatsapp-backup-"+time.Now().Format("20060102-150405")+".wabackup"))
+    if err := a.writeBackup(w, opts); err != nil {
+        apiLog.Error("backup failed", "err", err)
+    }
+    return nil, nil
+}
+
+func apiRestore(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    a, err := accountFor(r)
+    if err != nil {
+        return nil, err
+    }
+    var req RestoreRequest
+    var in io.Reader
+    if isMultipart(r) {
+        file, _, err := multipartFile(r)
+        if err != nil {
+            return nil, err
+        }
+        defer file.Close()
+        in = file
+        req.Passphrase = r.FormValue("passphrase")
+    } else {
+        if err := decodeJSON(r, &req); err != nil {
+            return nil, err
+        }
+        if req.Path == "" {
+            return nil, badRequest("path required")
+        }
+        f, err := os.Open(expandHome(req.Path))
+        if err != nil {
+            return nil, badRequest("%v", err)
+        }
+        defer f.Close()
+        in = f
+    }
+    if req.Passphrase == "" {
+        return nil, badRequest("passphrase required")
+    }
+    result, err := a.restoreBackup(in, req.Passphrase)
+    if err != nil {
+        return nil, apiError(http.StatusUnprocessableEntity, "restore_failed", "%v", err)
+    }
+    return result, nil
+}
+
+func apiRekey(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    if err := rotateDatabaseKey(); err != nil {
+        return nil, apiError(http.StatusInternalServerError, "rekey_failed", "%v", err)
+    }
+    return okResponse, nil
+}
+
+func apiGetConfig(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    return getConfig(), nil
+}
+
+func apiUpdateConfig(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+    if err != nil {
+        return nil, err
+    }
+    restartRequired, err := updateConfig(body)
+    if err != nil {
+        return nil, apiError(http.StatusBadRequest, "invalid_config", "%v", err)
+    }
+    return ConfigResponse{Config: getConfig(), RestartRequired: restartRequired}, nil
+}
+
+func currentLogLevels() LogLevelResponse {
+    return LogLevelResponse{Level: defaultLogLevel.Level().String(), Components: componentLevelOverrides()}
+}
+
+// setLogLevel changes levels at runtime only; the configured logLevel
+// applies again after a restart or a config change.
+func setLogLevel(req LogLevelRequest) error {
+    if req.Component != "" {
+        return setComponentLevel(req.Component, req.Level)
+    }
+    level, ok := logLevelNames[strings.ToUpper(req.Level)]
+    if !ok {
+        return fmt.Errorf("level must be DEBUG, INFO, WARN or ERROR")
+    }
+    defaultLogLevel.Set(level)
+    return nil
+}
+
+func apiGetLogLevel(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    return currentLogLevels(), nil
+}
+
+func apiSetLogLevel(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    var req LogLevelRequest
+    if err := decodeJSON(r, &req); err != nil {
+        return nil, err
+    }
+    if err := setLogLevel(req); err != nil {
+        return nil, badRequest("%v", err)
+    }
+    apiLog.Info("log level changed", "for", req.Component, "level", req.Level)
+    return currentLogLevels(), nil
+}
+
+func apiOpenAPI(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    return openAPISpec(), nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/hex"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+const API_TOKEN_NAME = "api-token"
+
+var apiToken string
+
+// apiTokenFile is where the UI picks up the token. It lives in the
+// per-user runtime directory, so it is gone after a reboot and only the
+// owner can read it; the token itself is kept in the key store.
+func apiTokenFile() string {
+    dir := os.Getenv("XDG_RUNTIME_DIR")
+    if dir == "" {
+        dir = getConfig().DataDir
+    }
+    return filepath.Join(dir, "harbour-whatsapp", API_TOKEN_NAME)
+}
+
+// apiTokenStoreFile keeps the token when no key store is open at startup,
+// as with a passphrase lock, whose store only opens on unlock.
+func apiTokenStoreFile() string {
+    return filepath.Join(getConfig().DataDir, API_TOKEN_NAME)
+}
+
+// initAPIToken loads the install's API token, or creates one.
+func initAPIToken() error {
+    if keyStore != nil {
+        if token, err := keyStore.Load(API_TOKEN_NAME); err == nil && len(token) == 64 {
+            apiToken = string(token)
+        }
+    } else if token, err := os.ReadFile(apiTokenStoreFile()); err == nil && len(token) == 64 {
+        apiToken = string(token)
+    }
+    if apiToken == "" {
+        b := make([]byte, 32)
+        if _, err := rand.Read(b); err != nil {
+            return err
+        }
+        apiToken = hex.EncodeToString(b)
+        storeAPIToken()
+    }
+
+    path := apiTokenFile()
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return err
+    }
+    if err := writeFileAtomic(path, []byte(apiToken)); err != nil {
+        return err
+    }
+    return os.Chmod(path, 0600)
+}
+
+// storeAPIToken saves the token in the key store, or in the data
+// directory without one.
+func storeAPIToken() {
+    var err error
+    if keyStore != nil {
+        err = keyStore.Store(API_TOKEN_NAME, []byte(apiToken))
+    } else {
+        err = writeFileAtomic(apiTokenStoreFile(), []byte(apiToken))
+    }
+    if err != nil {
+        apiLog.Warn("could not store API token", "err", err)
+    }
+}
+
+func requestToken(r *http.Request) string {
+    if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+        return strings.TrimPrefix(auth, "Bearer ")
+    }
+    if t := r.Header.Get("X-Api-Token"); t != "" {
+        return t
+    }
+    // QML Image elements can't set headers
+    return r.URL.Query().Get("token")
+}
+
+func isLoopbackHost(host string) bool {
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        host = h
+    }
+    host = strings.Trim(host, "[]")
+    if host == "localhost" {
+        return true
+    }
+    ip := net.ParseIP(host)
+    return ip != nil && ip.IsLoopback()
+}
+
+func originAllowed(origin string) bool {
+    for _, o := range getConfig().AllowedOrigins {
+        if o == "*" || strings.EqualFold(o, origin) {
+            return true
+        }
+    }
+    return false
+}
+
+// requireAPIToken guards every endpoint. Browsers always send an Origin
+// header on cross-site requests and the UI never does, so any origin not
+// explicitly allowed is refused before the token is even looked at. The
+// Host check stops DNS rebinding against the loopback listener.
+func requireAPIToken(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if isLoopbackHost(getConfig().Listen) && !isLoopbackHost(r.Host) {
+            writeError(w, r, http.StatusForbidden, "forbidden_host", "forbidden host")
+            return
+        }
+
+        if origin := r.Header.Get("Origin"); origin != "" {
+            if !originAllowed(origin) {
+                writeError(w, r, http.StatusForbidden, "forbidden_origin", "origin not allowed")
+                return
+            }
+            w.Header().Set("Access-Control-Allow-Origin", origin)
+            w.Header().Set("Access-Control-Allow-Headers", "Authorization, X-Api-Token, Content-Type")
+            w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+            w.Header().Set("Vary", "Origin")
+            if r.Method == http.MethodOptions {
+                w.WriteHeader(http.StatusNoContent)
+                return
+            }
+        }
+
+        token := requestToken(r)
+        if apiToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            writeError(w, r, http.StatusUnauthorized, "unauthorized", "missing or wrong API token")
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// listenHTTP takes the socket systemd passed in if there is one, and
+// otherwise listens on a TCP address or, with a "unix:" prefix, on a Unix
+// socket only the user can connect to.
+func listenHTTP(listen string) (net.Listener, error) {
+    if ln, err := activationListener(); ln != nil || err != nil {
+        if err == nil {
+            apiLog.Info("using the socket passed in by systemd", "addr", ln.Addr().String())
+        }
+        return ln, err
+    }
+    if path, ok := strings.CutPrefix(listen, "unix:"); ok {
+        os.Remove(path)
+        ln, err := net.Listen("unix", path)
+        if err != nil {
+            return nil, err
+        }
+        if err := os.Chmod(path, 0600); err != nil {
+            ln.Close()
+            return nil, err
+        }
+        return ln, nil
+    }
+    if !isLoopbackHost(listen) {
+        apiLog.Warn("listening on a non-loopback address, reachable from other machines", "listen", listen)
+    }
+    return net.Listen("tcp", listen)
+}
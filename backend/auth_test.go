@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestAPITokenKeptWithoutKeyStore(t *testing.T) {
+    newTestBackend(t)
+    t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+    savedStore, savedToken := keyStore, apiToken
+    defer func() { keyStore, apiToken = savedStore, savedToken }()
+
+    // With a passphrase lock no key store is open at startup
+    keyStore = nil
+    apiToken = ""
+    if err := initAPIToken(); err != nil {
+        t.Fatal(err)
+    }
+    first := apiToken
+    apiToken = ""
+    if err := initAPIToken(); err != nil {
+        t.Fatal(err)
+    }
+    if first == "" || apiToken != first {
+        t.Errorf("token changed across starts: %q, then %q", first, apiToken)
+    }
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "time"
+
+    "go.mau.fi/whatsmeow"
+)
+
+const avatarFetchWorkers = 3
+const avatarMinBackoff = 5 * time.Second
+const avatarMaxBackoff = 5 * time.Minute
+
+// avatarJob is one queued avatar fetch. Every caller asking for the same
+// JID while the job is pending shares it and waits on done. A forced
+// request for a job a worker has already taken goes to followUp, which is
+// queued once the job finishes.
+type avatarJob struct {
+    jid      string
+    force    bool
+    high     bool
+    started  bool
+    followUp *avatarJob
+    done     chan struct{}
+    path     string
+}
+
+// AvatarFetcher downloads an account's profile pictures with a fixed
+// number of workers. Requests for JIDs the UI is showing go to the high
+// priority queue, bulk prefetches to the low one. When the server reports
+// a rate limit all workers back off together.
+type AvatarFetcher struct {
+    mu       sync.Mutex
+    high     []*avatarJob
+    low      []*avatarJob
+    inflight map[string]*avatarJob
+    wake     chan struct{}
+
+    backoff      time.Duration
+    backoffUntil time.Time
+
+    account *Account
+    ctx     context.Context
+    cancel  context.CancelFunc
+}
+
+func newAvatarFetcher(account *Account, workers int) *AvatarFetcher {
+    f := &AvatarFetcher{
+        account:  account,
+        inflight: make(map[string]*avatarJob),
+        wake:     make(chan struct{}, 1),
+    }
+    f.ctx, f.cancel = context.WithCancel(account.ctx)
+    for i := 0; i < workers; i++ {
+        go f.worker()
+    }
+    return f
+}
+
+// Enqueue schedules a fetch for jid unless one is already pending, and
+// returns the job so the caller can wait for it. A high priority request
+// promotes a pending low priority job and a forced one makes it forced.
+func (f *AvatarFetcher) Enqueue(jid string, force bool, high bool) *avatarJob {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if job, ok := f.inflight[jid]; ok {
+        if force && !job.force {
+            if !job.started {
+                job.force = true
+            } else {
+                // Too late to change what the worker fetches, fetch again after
+                if job.followUp == nil {
+                    job.followUp = &avatarJob{jid: jid, force: true, done: make(chan struct{})}
+                }
+                job.followUp.high = job.followUp.high || high
+                return job.followUp
+            }
+        }
+        if high && !job.high && !job.started {
+            f.low = removeAvatarJob(f.low, job)
+            job.high = true
+            f.high = append(f.high, job)
+        }
+        return job
+    }
+
+    job := &avatarJob{jid: jid, force: force, high: high, done: make(chan struct{})}
+    if f.ctx.Err() != nil {
+        close(job.done)
+        return job
+    }
+    f.inflight[jid] = job
+    if high {
+        f.high = append(f.high, job)
+    } else {
+        f.low = append(f.low, job)
+    }
+    f.signal()
+    return job
+}
+
+// Wait blocks until the job has finished or ctx is done, and returns the
+// avatar path if there is one.
+func (f *AvatarFetcher) Wait(waitCtx context.Context, job *avatarJob) string {
+    select {
+    case <-job.done:
+        return job.path
+    case <-waitCtx.Done():
+        return ""
+    }
+}
+
+// Stop cancels in-flight downloads and drops everything still queued.
+func (f *AvatarFetcher) Stop() {
+    f.cancel()
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    for _, job := range f.inflight {
+        close(job.done)
+        if job.followUp != nil {
+            close(job.followUp.done)
+        }
+    }
+    f.inflight = make(map[string]*avatarJob)
+    f.high = nil
+    f.low = nil
+}
+
+func (f *AvatarFetcher) signal() {
+    select {
+    case f.wake <- struct{}{}:
+    default:
+    }
+}
+
+func (f *AvatarFetcher) next() *avatarJob {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    var job *avatarJob
+    if len(f.high) > 0 {
+        job, f.high = f.high[0], f.high[1:]
+    } else if len(f.low) > 0 {
+        job, f.low = f.low[0], f.low[1:]
+    }
+    if job != nil {
+        job.started = true
+    }
+    if len(f.high)+len(f.low) > 0 {
+        f.signal()
+    }
+    return job
+}
+
+// requeue puts a rate limited job back at the front of its queue.
+func (f *AvatarFetcher) requeue(job *avatarJob) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if f.ctx.Err() != nil {
+        return
+    }
+    job.started = false
+    if job.high {
+        f.high = append([]*avatarJob{job}, f.high...)
+    } else {
+        f.low = append([]*avatarJob{job}, f.low...)
+    }
+    f.signal()
+}
+
+func (f *AvatarFetcher) finish(job *avatarJob, path string) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if f.inflight[job.jid] != job {
+        // Already released by Stop
+        return
+    }
+    delete(f.inflight, job.jid)
+    job.path = path
+    close(job.done)
+    if next := job.followUp; next != nil {
+        f.inflight[next.jid] = next
+        if next.high {
+            f.high = append(f.high, next)
+        } else {
+            f.low = append(f.low, next)
+        }
+        f.signal()
+    }
+}
+
+func (f *AvatarFetcher) waitBackoff() bool {
+    f.mu.Lock()
+    until := f.backoffUntil
+    f.mu.Unlock()
+    if d := time.Until(until); d > 0 {
+        select {
+        case <-time.After(d):
+        case <-f.ctx.Done():
+            return false
+        }
+    }
+    return true
+}
+
+func (f *AvatarFetcher) rateLimited() {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if time.Now().Before(f.backoffUntil) {
+        // Another worker already backed off for this burst
+        return
+    }
+    if f.backoff == 0 {
+        f.backoff = avatarMinBackoff
+    } else if f.backoff < avatarMaxBackoff {
+        f.backoff *= 2
+        if f.backoff > avatarMaxBackoff {
+            f.backoff = avatarMaxBackoff
+        }
+    }
+    f.backoffUntil = time.Now().Add(f.backoff)
+    f.account.log.Warn("avatar fetch rate limited, backing off", "backoff", f.backoff)
+}
+
+func (f *AvatarFetcher) resetBackoff() {
+    f.mu.Lock()
+    f.backoff = 0
+    f.mu.Unlock()
+}
+
+func (f *AvatarFetcher) worker() {
+    for {
+        select {
+        case <-f.wake:
+        case <-f.ctx.Done():
+            return
+        }
+        for {
+            if !f.waitBackoff() {
+                return
+            }
+            job := f.next()
+            if job == nil {
+                break
+            }
+            path, err := f.account.fetchAvatar(f.ctx, job.jid, job.force)
+            if errors.Is(err, whatsmeow.ErrIQRateOverLimit) {
+                f.rateLimited()
+                f.requeue(job)
+                continue
+            }
+            if err == nil {
+                f.resetBackoff()
+            }
+            f.finish(job, path)
+        }
+    }
+}
+
+func removeAvatarJob(queue []*avatarJob, job *avatarJob) []*avatarJob {
+    for i, j := range queue {
+        if j == job {
+            return append(queue[:i], queue[i+1:]...)
+        }
+    }
+    return queue
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestAvatarEnqueueForce(t *testing.T) {
+    b := newTestBackend(t)
+    a, _ := b.paired("491700000000")
+    // No workers: the test takes and finishes the jobs itself
+    f := newAvatarFetcher(a, 0)
+    defer f.Stop()
+
+    // A pending job becomes forced
+    job := f.Enqueue(alice.User, false, false)
+    if again := f.Enqueue(alice.User, true, false); again != job || !job.force {
+        t.Fatalf("pending job not forced: %+v", job)
+    }
+    if next := f.next(); next != job {
+        t.Fatalf("next = %+v", next)
+    }
+    f.finish(job, "")
+
+    // A started one gets a forced fetch after it
+    job = f.Enqueue(bob.User, false, false)
+    f.next()
+    followUp := f.Enqueue(bob.User, true, true)
+    if followUp == job || !followUp.force || job.force {
+        t.Fatalf("started job changed: job %+v, follow-up %+v", job, followUp)
+    }
+    if again := f.Enqueue(bob.User, true, false); again != followUp {
+        t.Error("second forced request not sharing the follow-up")
+    }
+    if next := f.next(); next != nil {
+        t.Fatalf("follow-up queued before the job finished: %+v", next)
+    }
+    f.finish(job, "")
+    if next := f.next(); next != followUp {
+        t.Fatalf("next = %+v, want the follow-up", next)
+    }
+    f.finish(followUp, "")
+    select {
+    case <-followUp.done:
+    default:
+        t.Error("follow-up not done")
+    }
+}
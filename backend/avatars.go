@@ -0,0 +1,237 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "path/filepath"
+    "time"
+
+    "go.mau.fi/whatsmeow"
+    "go.mau.fi/whatsmeow/types"
+    "go.mau.fi/whatsmeow/types/events"
+)
+
+// How often a cached avatar is checked against the server. The check sends
+// the known picture ID, so unchanged pictures are not downloaded again.
+const avatarRevalidateInterval = 24 * time.Hour
+
+// AvatarInfo is the cached state of one profile picture. An entry with an
+// empty Path records that the contact has no (visible) picture, so we
+// don't ask the server again until the next revalidation.
+type AvatarInfo struct {
+    Path      string `json:"path,omitempty"`
+    PictureID string `json:"pictureId,omitempty"`
+    CheckedAt int64  `json:"checkedAt"`
+}
+
+func userToJID(jid string) types.JID {
+    if len(jid) > 15 {
+        return types.NewJID(jid, "g.us")
+    }
+    return types.NewJID(jid, "s.whatsapp.net")
+}
+
+func (a *Account) loadAvatarsFromDisk() {
+    a.avatarsMutex.Lock()
+    defer a.avatarsMutex.Unlock()
+
+    if err := LoadEncrypted(a.path(avatarsFile), &a.avatars); err != nil {
+        // Older versions stored a plain jid -> path map
+        var legacy map[string]string
+        if err := LoadEncrypted(a.path(avatarsFile), &legacy); err != nil {
+            data, err := os.ReadFile(a.path("avatars.json"))
+            if err != nil || json.Unmarshal(data, &legacy) != nil {
+                return
+            }
+            os.Remove(a.path("avatars.json"))
+        }
+        a.avatars = make(map[string]*AvatarInfo, len(legacy))
+        for jid, path := range legacy {
+            a.avatars[jid] = &AvatarInfo{Path: path}
+        }
+        a.log.Info("migrated avatars from old format", "count", len(a.avatars))
+        return
+    }
+    a.log.Debug("loaded avatars", "count", len(a.avatars))
+}
+
+func (a *Account) saveAvatars() error {
+    a.avatarsMutex.RLock()
+    defer a.avatarsMutex.RUnlock()
+
+    return SaveEncrypted(a.path(avatarsFile), a.avatars)
+}
+
+func (a *Account) getAvatar(jid string) string {
+    a.avatarsMutex.RLock()
+    info, ok := a.avatars[jid]
+    var path string
+    if ok {
+        path = info.Path
+    }
+    a.avatarsMutex.RUnlock()
+    if path != "" {
+        if _, err := os.Stat(path); err == nil {
+            return path
+        }
+    }
+    return ""
+}
+
+func (a *Account) setAvatar(jid string, info *AvatarInfo) {
+    a.avatarsMutex.Lock()
+    a.avatars[jid] = info
+    a.avatarsMutex.Unlock()
+    a.markDirty(avatarsFile)
+}
+
+// removeAvatar deletes the cached picture of a contact that removed or
+// hid their photo.
+func (a *Account) removeAvatar(jid string) {
+    a.avatarsMutex.RLock()
+    info, ok := a.avatars[jid]
+    a.avatarsMutex.RUnlock()
+    if ok && info.Path != "" {
+        os.Remove(info.Path)
+        a.log.Debug("removed avatar", "jid", jid)
+    }
+    a.setAvatar(jid, &AvatarInfo{CheckedAt: time.Now().Unix()})
+}
+
+// fetchAvatar returns the local path of a contact's profile picture,
+// fetching it if needed. Unless force is set, a cached entry that was
+// checked within avatarRevalidateInterval is returned as is. It is only
+// called from the avatar fetch queue, see avatarqueue.go.
+func (a *Account) fetchAvatar(fetchCtx context.Context, jid string, force bool) (string, error) {
+    a.avatarsMutex.RLock()
+    cached, ok := a.avatars[jid]
+    var existing AvatarInfo
+    if ok {
+        existing = *cached
+    }
+    a.avatarsMutex.RUnlock()
+
+    fileExists := false
+    if existing.Path != "" {
+        _, err := os.Stat(existing.Path)
+        fileExists = err == nil
+    }
+    fresh := time.Since(time.Unix(existing.CheckedAt, 0)) < avatarRevalidateInterval
+    if ok && !force && fresh && (fileExists || existing.Path == "") {
+        return existing.Path, nil
+    }
+
+    if !a.client.IsConnected() {
+        if fileExists {
+            return existing.Path, nil
+        }
+        return "", fmt.Errorf("not connected")
+    }
+
+    params := &whatsmeow.GetProfilePictureParams{}
+    if fileExists {
+        params.ExistingID = existing.PictureID
+    }
+    result := "error"
+    defer func() { avatarFetches.Inc(a.ID, result) }()
+    pic, err := a.client.GetProfilePictureInfo(fetchCtx, userToJID(jid), params)
+    if errors.Is(err, whatsmeow.ErrProfilePictureNotSet) || errors.Is(err, whatsmeow.ErrProfilePictureUnauthorized) {
+        result = "none"
+        a.removeAvatar(jid)
+        return "", nil
+    }
+    if err != nil {
+        return existing.Path, err
+    }
+    if pic == nil {
+        // Unchanged since the picture ID we sent
+        result = "unchanged"
+        existing.CheckedAt = time.Now().Unix()
+        a.setAvatar(jid, &existing)
+        return existing.Path, nil
+    }
+
+    req, err := http.NewRequestWithContext(fetchCtx, http.MethodGet, pic.URL, nil)
+    if err != nil {
+        return "", err
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return "", fmt.Errorf("avatar download failed: %s", resp.Status)
+    }
+
+    data, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return "", err
+    }
+
+    path := filepath.Join(a.avatarsDir, jid+".jpg")
+    tmpPath := path + ".tmp"
+    if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+        return "", err
+    }
+    if err := os.Rename(tmpPath, path); err != nil {
+        os.Remove(tmpPath)
+        return "", err
+    }
+
+    a.setAvatar(jid, &AvatarInfo{Path: path, PictureID: pic.ID, CheckedAt: time.Now().Unix()})
+    result = "downloaded"
+
+    a.log.Debug("downloaded avatar", "jid", jid)
+    return path, nil
+}
+
+// handlePictureEvent reacts to a contact or group changing its picture.
+func (a *Account) handlePictureEvent(v *events.Picture) {
+    jid := v.JID.User
+    if v.Remove {
+        a.removeAvatar(jid)
+        return
+    }
+    a.avatarsMutex.RLock()
+    info, ok := a.avatars[jid]
+    unchanged := ok && info.Path != "" && info.PictureID == v.PictureID
+    a.avatarsMutex.RUnlock()
+    if unchanged {
+        return
+    }
+    a.avatarFetcher.Enqueue(jid, true, false)
+}
+
+// revalidateAvatars periodically rechecks cached avatars that are older
+// than avatarRevalidateInterval.
+func (a *Account) revalidateAvatars() {
+    ticker := time.NewTicker(time.Hour)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+        case <-a.ctx.Done():
+            return
+        }
+        if !a.client.IsConnected() {
+            continue
+        }
+        var stale []string
+        a.avatarsMutex.RLock()
+        for jid, info := range a.avatars {
+            if time.Since(time.Unix(info.CheckedAt, 0)) >= avatarRevalidateInterval {
+                stale = append(stale, jid)
+            }
+        }
+        a.avatarsMutex.RUnlock()
+        for _, jid := range stale {
+            a.avatarFetcher.Enqueue(jid, false, false)
+        }
+    }
+}
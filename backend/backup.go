@@ -0,0 +1,738 @@
+package main
+
+import (
+    "archive/tar"
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "golang.org/x/crypto/argon2"
+)
+
+// Backup file layout: a header with the key derivation parameters,
+// followed by a tar archive split into AES-GCM sealed chunks. Each nonce
+// carries the chunk counter and a final-chunk flag, so reordered,
+// truncated or modified backups fail to decrypt.
+const backupMagic = "WABACKUP"
+const backupVersion = 1
+const backupChunkSize = 64 * 1024
+
+const backupArgonTime = 3
+const backupArgonMemory = 64 * 1024
+const backupArgonThreads = 4
+
+const backupHeaderSize = len(backupMagic) + 1 + 16 + 4 + 4 + 1 + 7
+
+// Consistent copy of the database, made for a session backup
+const dbSnapshotFile = "wa.db.snapshot"
+
+const restoreStagingDir = "restore-staging"
+const restoreOldDir = "restore-old"
+
+var backupLog = logger("backup")
+
+type BackupOptions struct {
+    Passphrase string
+    Session    bool // include wa.db and its key, so no new pairing is needed
+    Media      bool // include downloaded media, not just the manifest
+}
+
+type BackupFile struct {
+    Name   string `json:"name"`
+    Path   string `json:"path,omitempty"` // original location, for media
+    Size   int64  `json:"size"`
+    SHA256 string `json:"sha256"`
+}
+
+type BackupManifest struct {
+    Version   int          `json:"version"`
+    CreatedAt int64        `json:"createdAt"`
+    Phone     string       `json:"phone,omitempty"`
+    Session   bool         `json:"session"`
+    Files     []BackupFile `json:"files"`
+    Media     []BackupFile `json:"media"` // every media file messages refer to
+}
+
+type RestoreResult struct {
+    CreatedAt int64 `json:"createdAt"`
+    Files     int   `json:"files"`
+    Media     int   `json:"media"`
+    Session   bool  `json:"session"`
+}
+
+func backupNonce(prefix []byte, counter uint32, final bool) []byte {
+    nonce := make([]byte, 12)
+    copy(nonce, prefix)
+    binary.BigEndian.PutUint32(nonce[7:11], counter)
+    if final {
+        nonce[11] = 1
+    }
+    return nonce
+}
+
+func backupAEAD(passphrase string, salt []byte, t, m uint32, threads uint8) (cipher.AEAD, error) {
+    key := argon2.IDKey([]byte(passphrase), salt, t, m, threads, 32)
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// backupWriter encrypts everything written to it in fixed size chunks.
+// Close must be called to write the final chunk.
+type backupWriter struct {
+    w       io.Writer
+    aead    cipher.AEAD
+    header  []byte
+    prefix  []byte
+    counter uint32
+    buf     []byte
+}
+
+func newBackupWriter(w io.Writer, passphrase string) (*backupWriter, error) {
+    salt := make([]byte, 16)
+    prefix := make([]byte, 7)
+    if _, err := rand.Read(salt); err != nil {
+        return nil, err
+    }
+    if _, err := rand.Read(prefix); err != nil {
+        return nil, err
+    }
+    header := make([]byte, 0, backupHeaderSize)
+    header = append(header, backupMagic...)
+    header = append(header, backupVersion)
+    header = append(header, salt...)
+    header = binary.BigEndian.AppendUint32(header, backupArgonTime)
+    header = binary.BigEndian.AppendUint32(header, backupArgonMemory)
+    header = append(header, backupArgonThreads)
+    header = append(header, prefix...)
+
+    aead, err := backupAEAD(passphrase, salt, backupArgonTime, backupArgonMemory, backupArgonThreads)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := w.Write(header); err != nil {
+        return nil, err
+    }
+    return &backupWriter{w: w, aead: aead, header: header, prefix: prefix}, nil
+}
+
+func (bw *backupWriter) sealChunk(data []byte, final bool) error {
+    sealed := bw.aead.Seal(nil, backupNonce(bw.prefix, bw.counter, final), data, bw.header)
+    bw.counter++
+    var length [4]byte
+    binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+    if _, err := bw.w.Write(length[:]); err != nil {
+        return err
+    }
+    _, err := bw.w.Write(sealed)
+    return err
+}
+
+func (bw *backupWriter) Write(p []byte) (int, error) {
+    n := len(p)
+    for len(p) > 0 {
+        take := backupChunkSize - len(bw.buf)
+        if take > len(p) {
+            take = len(p)
+        }
+        bw.buf = append(bw.buf, p[:take]...)
+        p = p[take:]
+        if len(bw.buf) == backupChunkSize {
+            if err := bw.sealChunk(bw.buf, false); err != nil {
+                return 0, err
+            }
+            bw.buf = bw.buf[:0]
+        }
+    }
+    return n, nil
+}
+
+func (bw *backupWriter) Close() error {
+    return bw.sealChunk(bw.buf, true)
+}
+
+// backupReader decrypts a stream written by backupWriter. It returns an
+// error instead of io.EOF if the stream ends before the final chunk.
+type backupReader struct {
+    r       io.Reader
+    aead    cipher.AEAD
+    header  []byte
+    prefix  []byte
+    counter uint32
+    buf     []byte
+    done    bool
+}
+
+var errBackupCorrupt = errors.New("backup is corrupt or the passphrase is wrong")
+
+func newBackupReader(r io.Reader, passphrase string) (*backupReader, error) {
+    header := make([]byte, backupHeaderSize)
+    if _, err := io.ReadFull(r, header); err != nil {
+        return nil, fmt.Errorf("not a backup file")
+    }
+    if string(header[:len(backupMagic)]) != backupMagic {
+        return nil, fmt.Errorf("not a backup file")
+    }
+    p := header[len(backupMagic):]
+    if p[0] != backupVersion {
+        return nil, fmt.Errorf("unsupported backup version %d", p[0])
+    }
+    salt := p[1:17]
+    t := binary.BigEndian.Uint32(p[17:21])
+    m := binary.BigEndian.Uint32(p[21:25])
+    threads := p[25]
+    if t == 0 || t > 16 || m == 0 || m > 1024*1024 || threads == 0 {
+        return nil, fmt.Errorf("invalid backup parameters")
+    }
+    aead, err := backupAEAD(passphrase, salt, t, m, threads)
+    if err != nil {
+        return nil, err
+    }
+    return &backupReader{r: r, aead: aead, header: header, prefix: p[26:33]}, nil
+}
+
+func (br *backupReader) Read(p []byte) (int, error) {
+    for len(br.buf) == 0 {
+        if br.done {
+            return 0, io.EOF
+        }
+        var length [4]byte
+        if _, err := io.ReadFull(br.r, length[:]); err != nil {
+            return 0, errBackupCorrupt
+        }
+        n := binary.BigEndian.Uint32(length[:])
+        if n > backupChunkSize+uint32(br.aead.Overhead()) {
+            return 0, errBackupCorrupt
+        }
+        sealed := make([]byte, n)
+        if _, err := io.ReadFull(br.r, sealed); err != nil {
+            return 0, errBackupCorrupt
+        }
+        // Try as a regular chunk first, then as the final one
+        plain, err := br.aead.Open(nil, backupNonce(br.prefix, br.counter, false), sealed, br.header)
+        if err != nil {
+            plain, err = br.aead.Open(nil, backupNonce(br.prefix, br.counter, true), sealed, br.header)
+            if err != nil {
+                return 0, errBackupCorrupt
+            }
+            br.done = true
+        }
+        br.counter++
+        br.buf = plain
+    }
+    n := copy(p, br.buf)
+    br.buf = br.buf[n:]
+    return n, nil
+}
+
+// backupTar writes files into the tar stream and records their hashes.
+type backupTar struct {
+    tw    *tar.Writer
+    files []BackupFile
+}
+
+func (bt *backupTar) addBytes(name string, data []byte) error {
+    if err := bt.tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+        return err
+    }
+    if _, err := bt.tw.Write(data); err != nil {
+        return err
+    }
+    sum := sha256.Sum256(data)
+    bt.files = append(bt.files, BackupFile{Name: name, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+    return nil
+}
+
+func (bt *backupTar) addFile(name, filePath string) (BackupFile, error) {
+    f, err := os.Open(filePath)
+    if err != nil {
+        return BackupFile{}, err
+    }
+    defer f.Close()
+    st, err := f.Stat()
+    if err != nil {
+        return BackupFile{}, err
+    }
+    if err := bt.tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: st.Size(), ModTime: st.ModTime()}); err != nil {
+        return BackupFile{}, err
+    }
+    h := sha256.New()
+    if _, err := io.Copy(io.MultiWriter(bt.tw, h), io.LimitReader(f, st.Size())); err != nil {
+        return BackupFile{}, err
+    }
+    bf := BackupFile{Name: name, Path: filePath, Size: st.Size(), SHA256: hex.EncodeToString(h.Sum(nil))}
+    bt.files = append(bt.files, bf)
+    return bf, nil
+}
+
+func hashFile(filePath string) (BackupFile, error) {
+    f, err := os.Open(filePath)
+    if err != nil {
+        return BackupFile{}, err
+    }
+    defer f.Close()
+    h := sha256.New()
+    n, err := io.Copy(h, f)
+    if err != nil {
+        return BackupFile{}, err
+    }
+    return BackupFile{Name: filepath.Base(filePath), Path: filePath, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// snapshotDatabase adds a copy of wa.db made with VACUUM INTO, which
+// reads one consistent state, committed WAL contents included, and writes
+// it under the same key.
+func snapshotDatabase(bt *backupTar) error {
+    os.Remove(dbSnapshotFile)
+    defer os.Remove(dbSnapshotFile)
+    db, err := openDatabaseFile(dbFile, encryptionKey)
+    if err != nil {
+        return err
+    }
+    _, err = db.Exec(fmt.Sprintf("VACUUM INTO '%s'", dbSnapshotFile))
+    db.Close()
+    if err != nil {
+        return err
+    }
+    _, err = bt.addFile("session/wa.db", dbSnapshotFile)
+    return err
+}
+
+// writeBackup writes an encrypted backup of the current state to w.
+func (a *Account) writeBackup(w io.Writer, opts BackupOptions) error {
+    if opts.Passphrase == "" {
+        return fmt.Errorf("passphrase required")
+    }
+    // Flush in-memory state so the files are current
+    if err := a.persister.FlushAll(); err != nil {
+        return fmt.Errorf("couldn't save current data: %v", err)
+    }
+
+    bw, err := newBackupWriter(w, opts.Passphrase)
+    if err != nil {
+        return err
+    }
+    bt := &backupTar{tw: tar.NewWriter(bw)}
+    manifest := BackupManifest{Version: backupVersion, CreatedAt: time.Now().Unix(), Session: opts.Session}
+    if a.device.ID != nil {
+        manifest.Phone = a.device.ID.User
+    }
+
+    for _, name := range []string{messagesFile, contactsFile, avatarsFile, chatStatesFile} {
+        if _, err := os.Stat(a.path(name)); err != nil {
+            continue
+        }
+        if _, err := bt.addFile("data/"+name, a.path(name)); err != nil {
+            return err
+        }
+    }
+
+    a.avatarsMutex.RLock()
+    var avatarPaths []string
+    for _, info := range a.avatars {
+        if info.Path != "" {
+            avatarPaths = append(avatarPaths, info.Path)
+        }
+    }
+    a.avatarsMutex.RUnlock()
+    for _, p := range avatarPaths {
+        if _, err := os.Stat(p); err != nil {
+            continue
+        }
+        if _, err := bt.addFile("avatars/"+filepath.Base(p), p); err != nil {
+            return err
+        }
+    }
+
+    if opts.Session {
+        if err := snapshotDatabase(bt); err != nil {
+            return fmt.Errorf("couldn't back up session: %v", err)
+        }
+        if len(encryptionKey) > 0 {
+            if err := bt.addBytes("session/key", encryptionKey); err != nil {
+                return err
+            }
+        }
+    }
+
+    a.msgMutex.RLock()
+    mediaPaths := make(map[string]bool)
+    for _, m := range a.messages {
+        if m.LocalPath != "" {
+            mediaPaths[m.LocalPath] = true
+        }
+    }
+    a.msgMutex.RUnlock()
+    usedNames := make(map[string]bool)
+    for p := range mediaPaths {
+        if _, err := os.Stat(p); err != nil {
+            continue
+        }
+        if !opts.Media {
+            if bf, err := hashFile(p); err == nil {
+                manifest.Media = append(manifest.Media, bf)
+            }
+            continue
+        }
+        name := filepath.Base(p)
+        for i := 1; usedNames[name]; i++ {
+            name = fmt.Sprintf("%d_%s", i, filepath.Base(p))
+        }
+        usedNames[name] = true
+        bf, err := bt.addFile("media/"+name, p)
+        if err != nil {
+            return err
+        }
+        manifest.Media = append(manifest.Media, bf)
+    }
+
+    manifest.Files = bt.files
+    data, err := json.MarshalIndent(manifest, "", "  ")
+    if err != nil {
+        return err
+    }
+    // The manifest goes last, so it can list the hashes of everything above
+    if err := bt.tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0600, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+        return err
+    }
+    if _, err := bt.tw.Write(data); err != nil {
+        return err
+    }
+    if err := bt.tw.Close(); err != nil {
+        return err
+    }
+    if err := bw.Close(); err != nil {
+        return err
+    }
+    a.log.Info("backup written", "files", len(manifest.Files), "media", len(manifest.Media))
+    return nil
+}
+
+// extractBackup decrypts a backup into dir and checks every file against
+// the manifest. Nothing outside dir is touched.
+func extractBackup(r io.Reader, passphrase, dir string) (*BackupManifest, error) {
+    br, err := newBackupReader(r, passphrase)
+    if err != nil {
+        return nil, err
+    }
+    tr := tar.NewReader(br)
+    hashes := make(map[string]string)
+    var manifest *BackupManifest
+    for {
+        hdr, err := tr.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            if errors.Is(err, errBackupCorrupt) {
+                return nil, err
+            }
+            return nil, fmt.Errorf("invalid backup archive: %v", err)
+        }
+        name := path.Clean(hdr.Name)
+        if hdr.Typeflag != tar.TypeReg || strings.HasPrefix(name, "..") || path.IsAbs(name) {
+            return nil, fmt.Errorf("invalid entry %q in backup", hdr.Name)
+        }
+        if name == "manifest.json" {
+            var m BackupManifest
+            if err := json.NewDecoder(tr).Decode(&m); err != nil {
+                return nil, fmt.Errorf("invalid manifest: %v", err)
+            }
+            manifest = &m
+            continue
+        }
+        target := filepath.Join(dir, filepath.FromSlash(name))
+        if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+            return nil, err
+        }
+        out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+        if err != nil {
+            return nil, err
+        }
+        h := sha256.New()
+        _, err = io.Copy(io.MultiWriter(out, h), tr)
+        out.Close()
+        if err != nil {
+            return nil, err
+        }
+        hashes[name] = hex.EncodeToString(h.Sum(nil))
+    }
+    // Drain to the final chunk, so a truncated file is detected
+    if _, err := io.Copy(io.Discard, br); err != nil {
+        return nil, err
+    }
+    if manifest == nil {
+        return nil, fmt.Errorf("backup has no manifest")
+    }
+    if manifest.Version != backupVersion {
+        return nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+    }
+    for _, f := range manifest.Files {
+        if hashes[f.Name] != f.SHA256 {
+            return nil, fmt.Errorf("checksum mismatch for %s", f.Name)
+        }
+        delete(hashes, f.Name)
+    }
+    for name := range hashes {
+        return nil, fmt.Errorf("unexpected file %s in backup", name)
+    }
+    return manifest, nil
+}
+
+func moveFile(from, to string) error {
+    if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+        return err
+    }
+    return os.Rename(from, to)
+}
+
+// restoreBackup validates the backup completely before touching the data
+// directory. The current files are moved aside and put back if installing
+// the restored ones fails. The data goes into account a; a session backup
+// replaces the database, which every account shares.
+func (a *Account) restoreBackup(r io.Reader, passphrase string) (*RestoreResult, error) {
+    os.RemoveAll(restoreStagingDir)
+    defer os.RemoveAll(restoreStagingDir)
+    manifest, err := extractBackup(r, passphrase, restoreStagingDir)
+    if err != nil {
+        return nil, err
+    }
+
+    // A restored database has to open with its key before anything is
+    // replaced. Opening it may fold the staged WAL into it.
+    oldKey, restoredKey := encryptionKey, encryptionKey
+    if manifest.Session {
+        if key, err := os.ReadFile(filepath.Join(restoreStagingDir, "session", "key")); err == nil {
+            restoredKey = key
+        }
+        staged := filepath.Join(restoreStagingDir, "session", "wa.db")
+        plain, err := isPlaintextDatabase(staged)
+        if err != nil {
+            return nil, fmt.Errorf("backup has no database: %v", err)
+        }
+        key := restoredKey
+        if plain {
+            key = nil
+        }
+        if err := verifyDatabase(staged, key); err != nil {
+            return nil, fmt.Errorf("restored database can't be opened: %v", err)
+        }
+    }
+
+    dataFiles := map[string]bool{messagesFile: true, contactsFile: true, avatarsFile: true, chatStatesFile: true}
+    type move struct{ from, to string }
+    var installs []move
+    for _, f := range manifest.Files {
+        staged := filepath.Join(restoreStagingDir, filepath.FromSlash(f.Name))
+        dir, base := path.Split(f.Name)
+        switch {
+        case dir == "data/" && dataFiles[base]:
+            installs = append(installs, move{staged, a.path(base)})
+        case dir == "session/" && manifest.Session && (base == "wa.db" || base == "wa.db-wal"):
+            if _, err := os.Stat(staged); err == nil {
+                installs = append(installs, move{staged, base})
+            }
+        case dir == "avatars/":
+            installs = append(installs, move{staged, filepath.Join(a.avatarsDir, path.Base(f.Name))})
+        }
+    }
+
+    // Nothing may use the database while it is swapped. If the restore
+    // fails before the new one is in use, the old one is opened again.
+    reopenOld := false
+    if manifest.Session {
+        closeAccounts()
+        container.Close()
+        reopenOld = true
+        defer func() {
+            if !reopenOld {
+                return
+            }
+            if err := initDatabase(); err != nil {
+                backupLog.Error("database reopen failed", "err", err)
+                return
+            }
+            if err := loadAccounts(); err != nil {
+                backupLog.Error("account reload failed", "err", err)
+            }
+        }()
+    }
+
+    // Move the current files aside
+    os.RemoveAll(restoreOldDir)
+    var replaced []move
+    rollback := func() {
+        for i := len(replaced) - 1; i >= 0; i-- {
+            os.Rename(replaced[i].to, replaced[i].from)
+        }
+    }
+    for _, in := range installs {
+        if _, err := os.Stat(in.to); err != nil {
+            continue
+        }
+        aside := filepath.Join(restoreOldDir, fmt.Sprintf("%d_%s", len(replaced), filepath.Base(in.to)))
+        if err := moveFile(in.to, aside); err != nil {
+            rollback()
+            return nil, fmt.Errorf("couldn't move %s aside: %v", in.to, err)
+        }
+        replaced = append(replaced, move{in.to, aside})
+    }
+    if manifest.Session {
+        // A stale WAL from the old database must not be applied to the new one
+        for _, name := range []string{"wa.db", "wa.db-wal", "wa.db-shm"} {
+            if _, err := os.Stat(name); err == nil {
+                aside := filepath.Join(restoreOldDir, fmt.Sprintf("%d_%s", len(replaced), name))
+                if err := moveFile(name, aside); err != nil {
+                    rollback()
+                    return nil, err
+                }
+                replaced = append(replaced, move{name, aside})
+            }
+        }
+    }
+    var installed []string
+    for _, in := range installs {
+        if err := moveFile(in.from, in.to); err != nil {
+            for _, p := range installed {
+                os.Remove(p)
+            }
+            rollback()
+            return nil, fmt.Errorf("couldn't install %s: %v", in.to, err)
+        }
+        installed = append(installed, in.to)
+    }
+
+    result := &RestoreResult{CreatedAt: manifest.CreatedAt, Files: len(installs), Session: manifest.Session}
+
+    // Media is only added, never overwritten. Entries of backups without
+    // media only name the file and have nothing staged.
+    restoredMedia := make(map[string]string)
+    for _, m := range manifest.Media {
+        if !strings.HasPrefix(m.Name, "media/") {
+            continue
+        }
+        staged := filepath.Join(restoreStagingDir, filepath.FromSlash(m.Name))
+        if _, err := os.Stat(staged); err != nil {
+            continue
+        }
+        name := path.Base(m.Name)
+        target := filepath.Join(a.getMediaDir(getMimeType(name)), name)
+        if _, err := os.Stat(target); err != nil {
+            if err := moveFile(staged, target); err != nil {
+                continue
+            }
+            result.Media++
+        }
+        restoredMedia[m.Path] = target
+    }
+
+    if manifest.Session {
+        // Until the restored database is in use and its key stored, the old
+        // files and key can come back
+        keyStored := false
+        undo := func() {
+            closeAccounts()
+            if container != nil {
+                container.Close()
+            }
+            for _, p := range installed {
+                os.Remove(p)
+            }
+            os.Remove(dbFile + "-wal")
+            os.Remove(dbFile + "-shm")
+            rollback()
+            encryptionKey = oldKey
+            if keyStored && len(oldKey) > 0 {
+                if err := storeKeyConfirmed(oldKey); err != nil {
+                    backupLog.Error("couldn't put back the old database key", "err", err)
+                }
+            }
+        }
+        encryptionKey = restoredKey
+        // Backups of a plaintext database are encrypted on the way in
+        if err := prepareDatabase(); err != nil {
+            undo()
+            return nil, err
+        }
+        if err := initDatabase(); err != nil {
+            undo()
+            return nil, fmt.Errorf("restored database can't be opened: %v", err)
+        }
+        if keyStore != nil && !bytes.Equal(restoredKey, oldKey) {
+            keyStored = true
+            if err := storeKeyConfirmed(restoredKey); err != nil {
+                undo()
+                return nil, fmt.Errorf("couldn't store restored key: %v", err)
+            }
+        }
+        if err := loadAccounts(); err != nil {
+            undo()
+            return nil, fmt.Errorf("account reload failed: %v", err)
+        }
+        reopenOld = false
+        // The restored device keeps the account, see loadAccounts
+        if reopened := getAccount(a.ID); reopened != nil {
+            a = reopened
+        }
+    }
+    a.reloadRestoredState(restoredMedia)
+    os.RemoveAll(restoreOldDir)
+    backupLog.Info("restored backup", "account", a.ID, "created", time.Unix(manifest.CreatedAt, 0).Format(time.RFC3339))
+    return result, nil
+}
+
+// reloadRestoredState replaces the in-memory state with the restored files
+// and points avatars and media at their new locations.
+func (a *Account) reloadRestoredState(restoredMedia map[string]string) {
+    a.msgMutex.Lock()
+    a.messages = nil
+    a.msgMutex.Unlock()
+    a.contactsMutex.Lock()
+    a.contacts = make(map[string]string)
+    a.contactsMutex.Unlock()
+    a.avatarsMutex.Lock()
+    a.avatars = make(map[string]*AvatarInfo)
+    a.avatarsMutex.Unlock()
+    a.chatStatesMutex.Lock()
+    a.chatStates = make(map[string]*ChatState)
+    a.chatStatesMutex.Unlock()
+
+    a.loadMessages()
+    a.loadContactsFromDisk()
+    a.loadAvatarsFromDisk()
+    a.loadChatStatesFromDisk()
+
+    a.avatarsMutex.Lock()
+    for _, info := range a.avatars {
+        if info.Path != "" {
+            info.Path = filepath.Join(a.avatarsDir, filepath.Base(info.Path))
+        }
+    }
+    a.avatarsMutex.Unlock()
+
+    a.msgMutex.Lock()
+    for i := range a.messages {
+        if p, ok := restoredMedia[a.messages[i].LocalPath]; ok {
+            a.messages[i].LocalPath = p
+        }
+    }
+    a.msgMutex.Unlock()
+
+    a.markDirty(messagesFile)
+    a.markDirty(avatarsFile)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+    "bytes"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// backupWithPhoto gives the paired default account one chat message and
+// one downloaded picture.
+func backupWithPhoto(t *testing.T, b *testBackend) (*Account, string) {
+    t.Helper()
+    a, f := b.paired("491700000000")
+    f.Replay(textEvent(alice, alice, "M1", "hi there", 1000))
+    photo := filepath.Join(a.picturesDir, "M2_1001.jpg")
+    if err := os.WriteFile(photo, []byte("jpeg data"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    a.addMessage(Message{ID: "M2", Sender: alice.User, ChatJID: alice.User, Timestamp: 1001,
+        MediaType: "image", MimeType: "image/jpeg", LocalPath: photo})
+    return a, photo
+}
+
+func TestBackupRestoreWithMedia(t *testing.T) {
+    b := newTestBackend(t)
+    a, photo := backupWithPhoto(t, b)
+
+    var backup bytes.Buffer
+    if err := a.writeBackup(&backup, BackupOptions{Passphrase: "secret", Media: true}); err != nil {
+        t.Fatal(err)
+    }
+
+    // Lose the picture and the messages
+    os.Remove(photo)
+    a.msgMutex.Lock()
+    a.messages = nil
+    a.msgMutex.Unlock()
+    a.persister.FlushAll()
+
+    result, err := a.restoreBackup(bytes.NewReader(backup.Bytes()), "secret")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.Media != 1 || result.Files == 0 {
+        t.Errorf("result = %+v", result)
+    }
+    if data, err := os.ReadFile(photo); err != nil || string(data) != "jpeg data" {
+        t.Errorf("restored picture: %q, %v", data, err)
+    }
+    if _, err := os.Stat(filepath.Join(a.picturesDir, "media")); !os.IsNotExist(err) {
+        t.Errorf("restore created a media subdirectory")
+    }
+
+    msgs := a.getMessagesForChat(alice.User)
+    if len(msgs) != 2 || msgs[1].LocalPath != photo {
+        t.Errorf("messages = %+v", msgs)
+    }
+}
+
+func TestBackupRestoreSession(t *testing.T) {
+    b := newTestBackend(t)
+    a, _ := backupWithPhoto(t, b)
+
+    var backup bytes.Buffer
+    if err := a.writeBackup(&backup, BackupOptions{Passphrase: "secret", Session: true}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := os.Stat(dbSnapshotFile); !os.IsNotExist(err) {
+        t.Errorf("snapshot left behind")
+    }
+
+    result, err := a.restoreBackup(bytes.NewReader(backup.Bytes()), "secret")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !result.Session || result.Media != 0 {
+        t.Errorf("result = %+v", result)
+    }
+    // The restored database still holds the paired device
+    restored := getAccount(a.ID)
+    if restored == nil || restored.device.ID == nil || restored.device.ID.User != "491700000000" {
+        t.Fatalf("account after restore: %+v", restored)
+    }
+    if msgs := restored.getMessagesForChat(alice.User); len(msgs) != 2 {
+        t.Errorf("messages = %+v", msgs)
+    }
+}
+
+func TestBackupRestoreSessionKeyStoreFails(t *testing.T) {
+    b := newTestBackend(t)
+    a, _ := backupWithPhoto(t, b)
+    store := &dropFirstKeyStore{data: make(map[string][]byte)}
+    useEncryptedBackend(t, store)
+    a = getAccount(a.ID)
+    backupKey := encryptionKey
+
+    var backup bytes.Buffer
+    if err := a.writeBackup(&backup, BackupOptions{Passphrase: "secret", Session: true}); err != nil {
+        t.Fatal(err)
+    }
+    // The running database moves on to another key than the backup's
+    if err := rotateDatabaseKey(); err != nil {
+        t.Fatal(err)
+    }
+    currentKey := encryptionKey
+
+    store.failStores = 1
+    if _, err := getAccount(a.ID).restoreBackup(bytes.NewReader(backup.Bytes()), "secret"); err == nil {
+        t.Fatal("restore succeeded without storing the key")
+    }
+    stored, _ := store.Load(SECRET_KEY_NAME)
+    if !bytes.Equal(encryptionKey, currentKey) || !bytes.Equal(stored, currentKey) {
+        t.Error("current key not kept")
+    }
+    if err := verifyDatabase(dbFile, currentKey); err != nil {
+        t.Errorf("current database not back: %v", err)
+    }
+    if restored := getAccount(a.ID); restored == nil || len(restored.getMessagesForChat(alice.User)) != 2 {
+        t.Fatalf("account after failed restore: %+v", restored)
+    }
+
+    // With a working store the backup's key comes along
+    if _, err := getAccount(a.ID).restoreBackup(bytes.NewReader(backup.Bytes()), "secret"); err != nil {
+        t.Fatal(err)
+    }
+    stored, _ = store.Load(SECRET_KEY_NAME)
+    if !bytes.Equal(encryptionKey, backupKey) || !bytes.Equal(stored, backupKey) {
+        t.Error("restored key not in use")
+    }
+    wantNoFile(t, restoreOldDir)
+}
+
+func TestDataDirPath(t *testing.T) {
+    b := newTestBackend(t)
+    os.Mkdir(filepath.Join(b.dir, "backups"), 0700)
+    os.Symlink(t.TempDir(), filepath.Join(b.dir, "elsewhere"))
+    root, _ := filepath.EvalSymlinks(b.dir)
+    for _, c := range []struct {
+        name string
+        want string
+    }{
+        {"out.wabackup", filepath.Join(root, "out.wabackup")},
+        {"backups/out.wabackup", filepath.Join(root, "backups", "out.wabackup")},
+        {filepath.Join(b.dir, "out.wabackup"), filepath.Join(root, "out.wabackup")},
+        {"../out.wabackup", ""},
+        {"/etc/out.wabackup", ""},
+        {"elsewhere/out.wabackup", ""},
+        {".", ""},
+    } {
+        got, err := dataDirPath(c.name)
+        if got != c.want || (err == nil) != (c.want != "") {
+            t.Errorf("dataDirPath(%q) = %q, %v, want %q", c.name, got, err, c.want)
+        }
+    }
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+    "time"
+
+    "go.mau.fi/whatsmeow/appstate"
+    "go.mau.fi/whatsmeow/proto/waCommon"
+    "go.mau.fi/whatsmeow/types/events"
+    "google.golang.org/protobuf/proto"
+)
+
+// ChatState holds the per-chat flags that are synced with the phone
+// through app state: archived, pinned and muted. ReadUntil is the
+// timestamp of the newest message we've sent a read receipt for.
+type ChatState struct {
+    Archived  bool  `json:"archived,omitempty"`
+    Pinned    bool  `json:"pinned,omitempty"`
+    PinnedAt  int64 `json:"pinnedAt,omitempty"`
+    Muted     bool  `json:"muted,omitempty"`
+    MuteUntil int64 `json:"muteUntil,omitempty"` // unix seconds, 0 = forever
+    ReadUntil int64 `json:"readUntil,omitempty"`
+}
+
+var chatStatesFile = "chats.enc"
+
+func (a *Account) loadChatStatesFromDisk() {
+    a.chatStatesMutex.Lock()
+    defer a.chatStatesMutex.Unlock()
+
+    if err := LoadEncrypted(a.path(chatStatesFile), &a.chatStates); err != nil {
+        return
+    }
+    a.log.Debug("loaded chat states", "count", len(a.chatStates))
+}
+
+func (a *Account) saveChatStates() error {
+    a.chatStatesMutex.RLock()
+    defer a.chatStatesMutex.RUnlock()
+
+    return SaveEncrypted(a.path(chatStatesFile), a.chatStates)
+}
+
+// getChatState returns a copy of the chat's flags, with an expired mute
+// already cleared.
+func (a *Account) getChatState(jid string) ChatState {
+    a.chatStatesMutex.RLock()
+    defer a.chatStatesMutex.RUnlock()
+    st, ok := a.chatStates[jid]
+    if !ok {
+        return ChatState{}
+    }
+    state := *st
+    if state.Muted && state.MuteUntil > 0 && state.MuteUntil < time.Now().Unix() {
+        state.Muted = false
+        state.MuteUntil = 0
+    }
+    return state
+}
+
+func (a *Account) updateChatState(jid string, update func(*ChatState)) {
+    a.chatStatesMutex.Lock()
+    st, ok := a.chatStates[jid]
+    if !ok {
+        st = &ChatState{}
+        a.chatStates[jid] = st
+    }
+    update(st)
+    if *st == (ChatState{}) {
+        delete(a.chatStates, jid)
+    }
+    a.chatStatesMutex.Unlock()
+    a.markDirty(chatStatesFile)
+}
+
+func (a *Account) applyArchive(jid string, archived bool) {
+    a.updateChatState(jid, func(st *ChatState) {
+        st.Archived = archived
+        if archived {
+            // WhatsApp unpins archived chats
+            st.Pinned = false
+            st.PinnedAt = 0
+        }
+    })
+}
+
+func (a *Account) applyPin(jid string, pinned bool, ts time.Time) {
+    a.updateChatState(jid, func(st *ChatState) {
+        st.Pinned = pinned
+        st.PinnedAt = 0
+        if pinned {
+            st.PinnedAt = ts.Unix()
+        }
+    })
+}
+
+// applyMute records a mute change. muteEndMillis follows the app state
+// convention: -1 or 0 means muted forever.
+func (a *Account) applyMute(jid string, muted bool, muteEndMillis int64) {
+    a.updateChatState(jid, func(st *ChatState) {
+        st.Muted = muted
+        st.MuteUntil = 0
+        if muted && muteEndMillis > 0 {
+            st.MuteUntil = muteEndMillis / 1000
+        }
+    })
+}
+
+func (a *Account) handleChatStateEvent(evt interface{}) {
+    switch v := evt.(type) {
+    case *events.Archive:
+        a.applyArchive(v.JID.User, v.Action.GetArchived())
+        a.log.Debug("chat archived on another device", "chat", v.JID.User, "archived", v.Action.GetArchived())
+    case *events.Pin:
+        a.applyPin(v.JID.User, v.Action.GetPinned(), v.Timestamp)
+        a.log.Debug("chat pinned on another device", "chat", v.JID.User, "pinned", v.Action.GetPinned())
+    case *events.Mute:
+        a.applyMute(v.JID.User, v.Action.GetMuted(), v.Action.GetMuteEndTimestamp())
+        a.log.Debug("chat muted on another device", "chat", v.JID.User, "muted", v.Action.GetMuted())
+    }
+}
+
+// lastMessageKey returns the timestamp and key of the newest message in a
+// chat, which archive patches use to tell the phone which messages the
+// action covers.
+func (a *Account) lastMessageKey(jid string) (time.Time, *waCommon.MessageKey) {
+    msgs := a.getMessagesForChat(jid)
+    if len(msgs) == 0 {
+        return time.Time{}, nil
+    }
+    last := msgs[len(msgs)-1]
+    chat := userToJID(jid)
+    key := &waCommon.MessageKey{
+        RemoteJID: proto.String(chat.String()),
+        FromMe:    proto.Bool(last.FromMe),
+        ID:        proto.String(last.ID),
+    }
+    if chat.Server == "g.us" && !last.FromMe {
+        key.Participant = proto.String(userToJID(last.Sender).String())
+    }
+    return time.Unix(last.Timestamp, 0), key
+}
+
+func (a *Account) setChatArchived(jid string, archived bool) error {
+    ts, key := a.lastMessageKey(jid)
+    if err := a.client.SendAppState(a.ctx, appstate.BuildArchive(userToJID(jid), archived, ts, key)); err != nil {
+        return err
+    }
+    a.applyArchive(jid, archived)
+    return nil
+}
+
+func (a *Account) setChatPinned(jid string, pinned bool) error {
+    if err := a.client.SendAppState(a.ctx, appstate.BuildPin(userToJID(jid), pinned)); err != nil {
+        return err
+    }
+    a.applyPin(jid, pinned, time.Now())
+    return nil
+}
+
+// setChatMuted mutes a chat for the given duration, or forever if it is 0.
+func (a *Account) setChatMuted(jid string, muted bool, duration time.Duration) error {
+    if err := a.client.SendAppState(a.ctx, appstate.BuildMute(userToJID(jid), muted, duration)); err != nil {
+        return err
+    }
+    var muteEnd int64
+    if muted && duration > 0 {
+        muteEnd = time.Now().Add(duration).UnixMilli()
+    }
+    a.applyMute(jid, muted, muteEnd)
+    return nil
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "sync"
+)
+
+// AutoDownloadPolicy decides which incoming media is downloaded right away.
+type AutoDownloadPolicy struct {
+    Images    bool   `json:"images"`
+    Videos    bool   `json:"videos"`
+    Audio     bool   `json:"audio"`
+    Documents bool   `json:"documents"`
+    Stickers  bool   `json:"stickers"`
+    MaxSize   uint64 `json:"maxSize"` // bytes, 0 = no limit
+}
+
+// Config holds the backend settings. Values come from the defaults, then
+// the config file, then WA_* environment variables, then command-line
+// flags. Listen address and directories need a restart to change; the
+// rest can be updated at runtime through /config.
+type Config struct {
+    Listen       string             `json:"listen"`
+    DataDir      string             `json:"dataDir"`
+    PicturesDir  string             `json:"picturesDir"`
+    VideosDir    string             `json:"videosDir"`
+    AudioDir     string             `json:"audioDir"`
+    DocumentsDir string             `json:"documentsDir"`
+    AvatarsDir   string             `json:"avatarsDir"`
+    LogLevel     string             `json:"logLevel"`
+    DBLogLevel   string             `json:"dbLogLevel"`
+    LogFormat    string             `json:"logFormat"`         // text or json
+    LogFile      string             `json:"logFile,omitempty"` // default backend.log in the data dir, "none" for stderr only
+    LogRedact    bool               `json:"logRedact"`         // mask message texts and phone numbers
+    DeviceName   string             `json:"deviceName"`
+    AutoDownload AutoDownloadPolicy `json:"autoDownload"`
+
+    // Desktop notifications for incoming messages
+    Notifications bool `json:"notifications"`
+
+    // Web origins allowed to call the API; none by default
+    AllowedOrigins []string `json:"allowedOrigins"`
+
+    // Bus for the D-Bus service: empty for the session bus, "none" to
+    // disable it
+    DBusAddress string `json:"dbusAddress"`
+
+    // Where the database key lives: auto, sailfish, secret-service,
+    // passphrase or file. Auto takes whichever secret storage answers and
+    // never a file. The key file defaults to keys.json (file) or keys.enc
+    // (passphrase) in the data directory.
+    KeyStore       string `json:"keyStore"`
+    KeyFile        string `json:"keyFile,omitempty"`
+    PassphraseFile string `json:"passphraseFile,omitempty"`
+
+    // Start locked until /unlock: "off", "passphrase" (needs the
+    // passphrase key store) or "device" (Sailfish device lock prompt).
+    // Unlocked, the backend locks again after autoLockMinutes idle.
+    AppLock         string `json:"appLock"`
+    AutoLockMinutes int    `json:"autoLockMinutes"`
+}
+
+var config Config
+var configMutex sync.RWMutex
+var configFile string
+
+// Command-line values by the environment variable they override. They are
+// kept so the runtime config can be rebuilt after the file changes.
+var configFlags = map[string]string{}
+
+func defaultConfig() Config {
+    home := os.Getenv("HOME")
+    if home == "" {
+        home = "/home/defaultuser"
+    }
+    return Config{
+        Listen:       "127.0.0.1:8085",
+        DataDir:      filepath.Join(home, ".local", "share", "harbour-whatsapp"),
+        PicturesDir:  filepath.Join(home, "Pictures", "WhatsApp"),
+        VideosDir:    filepath.Join(home, "Videos", "WhatsApp"),
+        AudioDir:     filepath.Join(home, "Music", "WhatsApp"),
+        DocumentsDir: filepath.Join(home, "Documents", "WhatsApp"),
+        AvatarsDir:   filepath.Join(home, "Pictures", "WhatsApp", "avatars"),
+        LogLevel:     "INFO",
+        DBLogLevel:   "ERROR",
+        LogFormat:    "text",
+        LogRedact:    true,
+        DeviceName:   "Chrome (Linux)",
+        AutoDownload: AutoDownloadPolicy{Images: true, Videos: true, Audio: true, Documents: true, Stickers: true},
+
+        Notifications: true,
+        KeyStore:      "auto",
+        AppLock:       "off",
+    }
+}
+
+func defaultConfigFile() string {
+    dir := os.Getenv("XDG_CONFIG_HOME")
+    if dir == "" {
+        dir = filepath.Join(os.Getenv("HOME"), ".config")
+    }
+    return filepath.Join(dir, "harbour-whatsapp", "config.json")
+}
+
+func expandHome(path string) string {
+    if path == "~" || strings.HasPrefix(path, "~/") {
+        return filepath.Join(os.Getenv("HOME"), strings.TrimPrefix(path, "~"))
+    }
+    return path
+}
+
+// parseAutoDownload reads a policy like "images,audio" or "all"/"none".
+func parseAutoDownload(s string, policy *AutoDownloadPolicy) error {
+    maxSize := policy.MaxSize
+    *policy = AutoDownloadPolicy{MaxSize: maxSize}
+    for _, part := range strings.Split(s, ",") {
+        switch strings.TrimSpace(strings.ToLower(part)) {
+        case "", "none":
+        case "all":
+            *policy = AutoDownloadPolicy{true, true, true, true, true, maxSize}
+        case "images":
+            policy.Images = true
+        case "videos":
+            policy.Videos = true
+        case "audio":
+            policy.Audio = true
+        case "documents":
+            policy.Documents = true
+        case "stickers":
+            policy.Stickers = true
+        default:
+            return fmt.Errorf("unknown media type %q", part)
+        }
+    }
+    return nil
+}
+
+func (c *Config) validate() error {
+    if path, ok := strings.CutPrefix(c.Listen, "unix:"); ok {
+        if !filepath.IsAbs(expandHome(path)) {
+            return fmt.Errorf("listen: unix socket path must be absolute")
+        }
+        c.Listen = "unix:" + expandHome(path)
+    } else if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+        return fmt.Errorf("listen: %v", err)
+    }
+    for name, dir := range map[string]*string{
+        "dataDir": &c.DataDir, "picturesDir": &c.PicturesDir, "videosDir": &c.VideosDir,
+        "audioDir": &c.AudioDir, "documentsDir": &c.DocumentsDir, "avatarsDir": &c.AvatarsDir,
+    } {
+        *dir = expandHome(*dir)
+        if !filepath.IsAbs(*dir) {
+            return fmt.Errorf("%s must be an absolute path", name)
+        }
+    }
+    c.LogLevel = strings.ToUpper(c.LogLevel)
+    c.DBLogLevel = strings.ToUpper(c.DBLogLevel)
+    if _, ok := logLevelNames[c.LogLevel]; !ok {
+        return fmt.Errorf("logLevel must be DEBUG, INFO, WARN or ERROR")
+    }
+    if _, ok := logLevelNames[c.DBLogLevel]; !ok {
+        return fmt.Errorf("dbLogLevel must be DEBUG, INFO, WARN or ERROR")
+    }
+    c.LogFormat = strings.ToLower(c.LogFormat)
+    if c.LogFormat != "text" && c.LogFormat != "json" {
+        return fmt.Errorf("logFormat must be text or json")
+    }
+    if c.LogFile != "none" {
+        c.LogFile = expandHome(c.LogFile)
+        if c.LogFile != "" && !filepath.IsAbs(c.LogFile) {
+            return fmt.Errorf("logFile must be an absolute path")
+        }
+    }
+    validStore := false
+    for _, kind := range keyStoreKinds {
+        validStore = validStore || c.KeyStore == kind
+    }
+    if !validStore {
+        return fmt.Errorf("keyStore must be one of %s", strings.Join(keyStoreKinds, ", "))
+    }
+    for name, file := range map[string]*string{"keyFile": &c.KeyFile, "passphraseFile": &c.PassphraseFile} {
+        *file = expandHome(*file)
+        if *file != "" && !filepath.IsAbs(*file) {
+            return fmt.Errorf("%s must be an absolute path", name)
+        }
+    }
+    validLock := false
+    for _, kind := range appLockKinds {
+        validLock = validLock || c.AppLock == kind
+    }
+    if !validLock {
+        return fmt.Errorf("appLock must be one of %s", strings.Join(appLockKinds, ", "))
+    }
+    if c.AppLock == "passphrase" && c.KeyStore != "passphrase" {
+        return fmt.Errorf("appLock passphrase needs keyStore passphrase")
+    }
+    if c.AutoLockMinutes < 0 {
+        return fmt.Errorf("autoLockMinutes must not be negative")
+    }
+    c.DeviceName = strings.TrimSpace(c.DeviceName)
+    if c.DeviceName == "" || len(c.DeviceName) > 50 {
+        return fmt.Errorf("deviceName must be 1-50 characters")
+    }
+    return nil
+}
+
+// loadConfig builds the configuration from all sources. It must run
+// before anything touches the data or media directories.
+func loadConfig(args []string) error {
+    fs := flag.NewFlagSet("wa-backend", flag.ContinueOnError)
+    configPath := fs.String("config", "", "config file (default ~/.config/harbour-whatsapp/config.json)")
+    listen := fs.String("listen", "", "HTTP listen address, or unix:/path for a Unix socket")
+    dataDir := fs.String("data-dir", "", "directory for the database and data files")
+    picturesDir := fs.String("pictures-dir", "", "directory for received images")
+    videosDir := fs.String("videos-dir", "", "directory for received videos")
+    audioDir := fs.String("audio-dir", "", "directory for received audio")
+    documentsDir := fs.String("documents-dir", "", "directory for received documents")
+    avatarsDir := fs.String("avatars-dir", "", "directory for profile pictures")
+    logLevel := fs.String("log-level", "", "log level: DEBUG, INFO, WARN or ERROR")
+    dbLogLevel := fs.String("db-log-level", "", "database log level")
+    logFormat := fs.String("log-format", "", "log format: text or json")
+    logFile := fs.String("log-file", "", "log file (default backend.log in the data dir), \"none\" for stderr only")
+    deviceName := fs.String("device-name", "", "name shown in WhatsApp's linked devices")
+    dbusAddress := fs.String("dbus-address", "", "D-Bus address for the service, \"none\" to disable it")
+    keyStoreKind := fs.String("key-store", "", "key store: auto, sailfish, secret-service, passphrase or file")
+    keyFile := fs.String("key-file", "", "key file for the file and passphrase key stores")
+    passphraseFile := fs.String("passphrase-file", "", "file holding the key store passphrase")
+    appLock := fs.String("app-lock", "", "start locked: off, passphrase or device")
+    autoDownload := fs.String("auto-download", "", "media to download automatically: all, none or a list like images,audio")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+
+    configFile = firstNonEmpty(*configPath, os.Getenv("WA_CONFIG"), defaultConfigFile())
+    configFlags = map[string]string{
+        "WA_LISTEN": *listen, "WA_DATA_DIR": *dataDir, "WA_PICTURES_DIR": *picturesDir,
+        "WA_VIDEOS_DIR": *videosDir, "WA_AUDIO_DIR": *audioDir, "WA_DOCUMENTS_DIR": *documentsDir,
+        "WA_AVATARS_DIR": *avatarsDir, "WA_LOG_LEVEL": *logLevel, "WA_DB_LOG_LEVEL": *dbLogLevel,
+        "WA_LOG_FORMAT": *logFormat, "WA_LOG_FILE": *logFile, "WA_DEVICE_NAME": *deviceName,
+        "WA_DBUS_ADDRESS": *dbusAddress, "WA_KEY_STORE": *keyStoreKind, "WA_KEY_FILE": *keyFile,
+        "WA_PASSPHRASE_FILE": *passphraseFile, "WA_APP_LOCK": *appLock, "WA_AUTO_DOWNLOAD": *autoDownload,
+    }
+    cfg, err := readConfigFile()
+    if err != nil {
+        return err
+    }
+    if err := applyConfigOverrides(&cfg); err != nil {
+        return err
+    }
+    if err := cfg.validate(); err != nil {
+        return err
+    }
+    configMutex.Lock()
+    config = cfg
+    configMutex.Unlock()
+    return nil
+}
+
+// readConfigFile returns the defaults with the config file on top.
+func readConfigFile() (Config, error) {
+    cfg := defaultConfig()
+    if data, err := os.ReadFile(configFile); err == nil {
+        if err := json.Unmarshal(data, &cfg); err != nil {
+            return cfg, fmt.Errorf("%s: %v", configFile, err)
+        }
+    } else if !os.IsNotExist(err) {
+        return cfg, err
+    }
+    return cfg, nil
+}
+
+// applyConfigOverrides puts the environment, then the flags, on top of
+// the file settings.
+func applyConfigOverrides(cfg *Config) error {
+    overrides := []struct {
+        target *string
+        env    string
+    }{
+        {&cfg.Listen, "WA_LISTEN"},
+        {&cfg.DataDir, "WA_DATA_DIR"},
+        {&cfg.PicturesDir, "WA_PICTURES_DIR"},
+        {&cfg.VideosDir, "WA_VIDEOS_DIR"},
+        {&cfg.AudioDir, "WA_AUDIO_DIR"},
+        {&cfg.DocumentsDir, "WA_DOCUMENTS_DIR"},
+        {&cfg.AvatarsDir, "WA_AVATARS_DIR"},
+        {&cfg.LogLevel, "WA_LOG_LEVEL"},
+        {&cfg.DBLogLevel, "WA_DB_LOG_LEVEL"},
+        {&cfg.LogFormat, "WA_LOG_FORMAT"},
+        {&cfg.LogFile, "WA_LOG_FILE"},
+        {&cfg.DeviceName, "WA_DEVICE_NAME"},
+        {&cfg.DBusAddress, "WA_DBUS_ADDRESS"},
+        {&cfg.KeyStore, "WA_KEY_STORE"},
+        {&cfg.KeyFile, "WA_KEY_FILE"},
+        {&cfg.PassphraseFile, "WA_PASSPHRASE_FILE"},
+        {&cfg.AppLock, "WA_APP_LOCK"},
+    }
+    for _, o := range overrides {
+        if v := firstNonEmpty(configFlags[o.env], os.Getenv(o.env)); v != "" {
+            *o.target = v
+        }
+    }
+    if ad := firstNonEmpty(configFlags["WA_AUTO_DOWNLOAD"], os.Getenv("WA_AUTO_DOWNLOAD")); ad != "" {
+        if err := parseAutoDownload(ad, &cfg.AutoDownload); err != nil {
+            return fmt.Errorf("auto-download: %v", err)
+        }
+    }
+    return nil
+}
+
+func firstNonEmpty(values ...string) string {
+    for _, v := range values {
+        if v != "" {
+            return v
+        }
+    }
+    return ""
+}
+
+func getConfig() Config {
+    configMutex.RLock()
+    defer configMutex.RUnlock()
+    return config
+}
+
+func saveConfig(data []byte) error {
+    if err := os.MkdirAll(filepath.Dir(configFile), 0700); err != nil {
+        return err
+    }
+    return writeFileAtomic(configFile, data)
+}
+
+func decodeConfigJSON(data []byte) (map[string]interface{}, error) {
+    values := make(map[string]interface{})
+    dec := json.NewDecoder(bytes.NewReader(data))
+    // Numbers go back to the file as written
+    dec.UseNumber()
+    if err := dec.Decode(&values); err != nil {
+        return nil, err
+    }
+    return values, nil
+}
+
+// readConfigLayer returns only what the config file itself sets, without
+// the defaults, so they can still change in later releases.
+func readConfigLayer() (map[string]interface{}, error) {
+    data, err := os.ReadFile(configFile)
+    if os.IsNotExist(err) {
+        return make(map[string]interface{}), nil
+    } else if err != nil {
+        return nil, err
+    }
+    layer, err := decodeConfigJSON(data)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", configFile, err)
+    }
+    return layer, nil
+}
+
+// mergeConfigPatch puts patch on top of layer object by object, so that
+// changing one autoDownload field keeps the others.
+func mergeConfigPatch(layer, patch map[string]interface{}) {
+    for k, v := range patch {
+        if sub, ok := v.(map[string]interface{}); ok {
+            if dst, ok := layer[k].(map[string]interface{}); ok {
+                mergeConfigPatch(dst, sub)
+                continue
+            }
+        }
+        layer[k] = v
+    }
+}
+
+// configKeys are the settings a config file can have.
+func configKeys() map[string]bool {
+    keys := make(map[string]bool)
+    t := reflect.TypeOf(Config{})
+    for i := 0; i < t.NumField(); i++ {
+        name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+        keys[name] = true
+    }
+    return keys
+}
+
+// updateConfig applies a partial JSON update to the config file, which
+// gets only the settings it already had and the changed ones. The
+// environment and flags still win over the file, so the runtime config is
+// rebuilt from it. Runtime settings take effect immediately; the others
+// are reported as needing a restart.
+func updateConfig(patch []byte) (restartRequired bool, err error) {
+    configMutex.Lock()
+    defer configMutex.Unlock()
+    layer, err := readConfigLayer()
+    if err != nil {
+        return false, err
+    }
+    changes, err := decodeConfigJSON(patch)
+    if err != nil {
+        return false, err
+    }
+    keys := configKeys()
+    for k := range changes {
+        if !keys[k] {
+            delete(changes, k)
+        }
+    }
+    mergeConfigPatch(layer, changes)
+    data, err := json.MarshalIndent(layer, "", "  ")
+    if err != nil {
+        return false, err
+    }
+    cfg := defaultConfig()
+    if err := json.Unmarshal(data, &cfg); err != nil {
+        return false, err
+    }
+    if err := applyConfigOverrides(&cfg); err != nil {
+        return false, err
+    }
+    if err := cfg.validate(); err != nil {
+        return false, err
+    }
+    if err := saveConfig(data); err != nil {
+        return false, err
+    }
+    restartRequired = cfg.Listen != config.Listen || cfg.DataDir != config.DataDir ||
+        cfg.PicturesDir != config.PicturesDir || cfg.VideosDir != config.VideosDir ||
+        cfg.AudioDir != config.AudioDir || cfg.DocumentsDir != config.DocumentsDir ||
+        cfg.AvatarsDir != config.AvatarsDir || cfg.DBusAddress != config.DBusAddress ||
+        cfg.KeyStore != config.KeyStore || cfg.KeyFile != config.KeyFile ||
+        cfg.PassphraseFile != config.PassphraseFile || cfg.AppLock != config.AppLock ||
+        cfg.LogFormat != config.LogFormat || cfg.LogFile != config.LogFile
+    // Only the runtime settings change in the running process
+    config.LogLevel = cfg.LogLevel
+    config.DBLogLevel = cfg.DBLogLevel
+    config.LogRedact = cfg.LogRedact
+    applyLogConfig(config)
+    config.DeviceName = cfg.DeviceName
+    config.AutoDownload = cfg.AutoDownload
+    config.AllowedOrigins = cfg.AllowedOrigins
+    config.Notifications = cfg.Notifications
+    config.AutoLockMinutes = cfg.AutoLockMinutes
+    return restartRequired, nil
+}
+
+// shouldAutoDownload applies the auto-download policy to incoming media.
+func shouldAutoDownload(mediaType string, size uint64) bool {
+    policy := getConfig().AutoDownload
+    if policy.MaxSize > 0 && size > policy.MaxSize {
+        return false
+    }
+    switch mediaType {
+    case "image":
+        return policy.Images
+    case "video":
+        return policy.Videos
+    case "audio":
+        return policy.Audio
+    case "document":
+        return policy.Documents
+    case "sticker":
+        return policy.Stickers
+    }
+    return false
+}
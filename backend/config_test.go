@@ -0,0 +1,163 @@
+package main
+
+import (
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// useConfigFile points loadConfig at a config file in a temporary home and
+// puts the running config back afterwards.
+func useConfigFile(t *testing.T, content string) string {
+    t.Helper()
+    home := t.TempDir()
+    t.Setenv("HOME", home)
+    for _, env := range []string{"WA_CONFIG", "WA_LISTEN", "WA_DEVICE_NAME", "WA_LOG_LEVEL", "WA_AUTO_DOWNLOAD", "WA_KEY_STORE"} {
+        t.Setenv(env, "")
+    }
+    path := filepath.Join(home, "config.json")
+    if content != "" {
+        if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+            t.Fatal(err)
+        }
+    }
+    savedConfig, savedFile, savedFlags := getConfig(), configFile, configFlags
+    savedLevel, savedDBLevel, savedRedact := defaultLogLevel.Level(), dbLogLevel.Level(), logRedact.Load()
+    t.Cleanup(func() {
+        configMutex.Lock()
+        config, configFile, configFlags = savedConfig, savedFile, savedFlags
+        configMutex.Unlock()
+        defaultLogLevel.Set(savedLevel)
+        dbLogLevel.Set(savedDBLevel)
+        logRedact.Store(savedRedact)
+    })
+    return path
+}
+
+func TestConfigDefaults(t *testing.T) {
+    path := useConfigFile(t, "")
+    if err := loadConfig([]string{"-config", path}); err != nil {
+        t.Fatal(err)
+    }
+    cfg := getConfig()
+    want := defaultConfig()
+    if cfg.Listen != want.Listen || cfg.DataDir != want.DataDir || cfg.KeyStore != want.KeyStore {
+        t.Errorf("config = %+v", cfg)
+    }
+    if cfg.DataDir != filepath.Join(os.Getenv("HOME"), ".local", "share", "harbour-whatsapp") {
+        t.Errorf("data dir %s not under HOME", cfg.DataDir)
+    }
+}
+
+func TestConfigPrecedence(t *testing.T) {
+    path := useConfigFile(t, `{"listen": "127.0.0.1:9000", "deviceName": "File", "logLevel": "debug", "notifications": false}`)
+    t.Setenv("WA_DEVICE_NAME", "Env")
+    t.Setenv("WA_LOG_LEVEL", "WARN")
+    t.Setenv("WA_AUTO_DOWNLOAD", "images")
+    if err := loadConfig([]string{"-config", path, "-log-level", "error", "-listen", "127.0.0.1:9100"}); err != nil {
+        t.Fatal(err)
+    }
+    cfg := getConfig()
+    for _, c := range []struct{ name, got, want string }{
+        {"listen", cfg.Listen, "127.0.0.1:9100"},  // flag over file
+        {"deviceName", cfg.DeviceName, "Env"},     // environment over file
+        {"logLevel", cfg.LogLevel, "ERROR"},       // flag over environment
+        {"dbLogLevel", cfg.DBLogLevel, "ERROR"},   // default
+        {"keyStore", cfg.KeyStore, "auto"},        // default
+    } {
+        if c.got != c.want {
+            t.Errorf("%s = %q, want %q", c.name, c.got, c.want)
+        }
+    }
+    if cfg.Notifications {
+        t.Error("file setting not applied")
+    }
+    if !cfg.AutoDownload.Images || cfg.AutoDownload.Videos {
+        t.Errorf("autoDownload = %+v", cfg.AutoDownload)
+    }
+}
+
+func TestConfigInvalid(t *testing.T) {
+    path := useConfigFile(t, `{"listen": "nowhere"}`)
+    if err := loadConfig([]string{"-config", path}); err == nil {
+        t.Error("invalid listen address accepted")
+    }
+    path = useConfigFile(t, `{"appLock": "passphrase"}`)
+    if err := loadConfig([]string{"-config", path}); err == nil {
+        t.Error("passphrase lock accepted without the passphrase key store")
+    }
+    if err := loadConfig([]string{"-config", path, "-key-store", "passphrase"}); err != nil {
+        t.Errorf("passphrase lock with the key store from a flag: %v", err)
+    }
+}
+
+func TestUpdateConfigKeepsOverridesOutOfFile(t *testing.T) {
+    path := useConfigFile(t, `{"deviceName": "File", "autoLockMinutes": 5}`)
+    t.Setenv("WA_DEVICE_NAME", "Env")
+    if err := loadConfig([]string{"-config", path, "-listen", "127.0.0.1:9100"}); err != nil {
+        t.Fatal(err)
+    }
+
+    restart, err := updateConfig([]byte(`{"notifications": false, "autoLockMinutes": 10}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if restart {
+        t.Error("runtime settings reported as needing a restart")
+    }
+    cfg := getConfig()
+    if cfg.Notifications || cfg.AutoLockMinutes != 10 {
+        t.Errorf("update not applied: %+v", cfg)
+    }
+    if cfg.DeviceName != "Env" || cfg.Listen != "127.0.0.1:9100" {
+        t.Errorf("overrides lost: deviceName %q, listen %q", cfg.DeviceName, cfg.Listen)
+    }
+
+    // The file gets the update, not the environment, the flags or the
+    // defaults
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var saved map[string]interface{}
+    if err := json.Unmarshal(data, &saved); err != nil {
+        t.Fatal(err)
+    }
+    if len(saved) != 3 || saved["deviceName"] != "File" || saved["notifications"] != false || saved["autoLockMinutes"] != float64(10) {
+        t.Errorf("saved = %s", data)
+    }
+
+    // A change the environment overrides is saved but changes nothing now
+    if _, err := updateConfig([]byte(`{"deviceName": "Patched"}`)); err != nil {
+        t.Fatal(err)
+    }
+    if cfg := getConfig(); cfg.DeviceName != "Env" {
+        t.Errorf("deviceName = %q, want the environment's", cfg.DeviceName)
+    }
+
+    if _, err := updateConfig([]byte(`{"autoLockMinutes": -1}`)); err == nil {
+        t.Error("invalid update accepted")
+    }
+}
+
+func TestUpdateConfigMergesObjects(t *testing.T) {
+    path := useConfigFile(t, `{"autoDownload": {"images": true, "maxSize": 1000}}`)
+    if err := loadConfig([]string{"-config", path}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := updateConfig([]byte(`{"autoDownload": {"videos": true}, "unknown": 1}`)); err != nil {
+        t.Fatal(err)
+    }
+    if ad := getConfig().AutoDownload; !ad.Images || !ad.Videos || ad.MaxSize != 1000 {
+        t.Errorf("autoDownload = %+v", ad)
+    }
+    data, _ := os.ReadFile(path)
+    var saved map[string]interface{}
+    if err := json.Unmarshal(data, &saved); err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := saved["unknown"]; ok || len(saved) != 1 {
+        t.Errorf("saved = %s", data)
+    }
+}
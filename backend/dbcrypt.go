@@ -0,0 +1,291 @@
+package main
+
+import (
+    "bytes"
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "os"
+    "sync"
+)
+
+const (
+    dbFile = "wa.db"
+
+    // Encrypted copy being written by the plaintext migration
+    dbEncryptingFile = "wa.db.encrypting"
+    // The plaintext database while its encrypted copy is swapped in
+    dbPlaintextFile = "wa.db.plaintext"
+    // Copy of the database under its old key while it is rekeyed
+    dbRekeyBackupFile = "wa.db.rekey-backup"
+)
+
+var rekeyMutex sync.Mutex
+
+var dbLog = logger("db")
+
+// sqlKey is the SQLCipher literal for a raw 256-bit key.
+func sqlKey(key []byte) string {
+    return fmt.Sprintf("\"x'%s'\"", hex.EncodeToString(key))
+}
+
+// isPlaintextDatabase reports whether path is an unencrypted SQLite file.
+// SQLCipher files start with a random salt instead of the header.
+func isPlaintextDatabase(path string) (bool, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return false, err
+    }
+    defer f.Close()
+    header := make([]byte, 16)
+    if _, err := io.ReadFull(f, header); err != nil {
+        // Empty or truncated files are left to sqlstore
+        return false, nil
+    }
+    return bytes.Equal(header, []byte("SQLite format 3\x00")), nil
+}
+
+// openDatabaseFile opens path on a single connection, so PRAGMAs apply to
+// every statement, and checks that the key fits.
+func openDatabaseFile(path string, key []byte) (*sql.DB, error) {
+    dsn := "file:" + path + "?_foreign_keys=on"
+    if len(key) > 0 {
+        dsn += fmt.Sprintf("&_pragma_key=x'%s'&_pragma_cipher_page_size=4096", hex.EncodeToString(key))
+    }
+    db, err := sql.Open("sqlite3", dsn)
+    if err != nil {
+        return nil, err
+    }
+    db.SetMaxOpenConns(1)
+    var n int
+    if err := db.QueryRow("SELECT count(*) FROM sqlite_master").Scan(&n); err != nil {
+        db.Close()
+        return nil, err
+    }
+    return db, nil
+}
+
+func copyDatabaseFile(from, to string) error {
+    data, err := os.ReadFile(from)
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(to, data)
+}
+
+// recoverDatabase finishes or undoes a migration or rekey that was
+// interrupted, e.g. by a crash or power loss.
+func recoverDatabase(key []byte) error {
+    os.Remove(dbEncryptingFile)
+    if _, err := os.Stat(dbPlaintextFile); err == nil {
+        if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+            dbLog.Warn("restoring plaintext database after interrupted migration")
+            if err := os.Rename(dbPlaintextFile, dbFile); err != nil {
+                return err
+            }
+        } else {
+            os.Remove(dbPlaintextFile)
+        }
+    }
+    if _, err := os.Stat(dbRekeyBackupFile); err == nil {
+        // The stored key tells which side of the rekey we ended up on
+        if db, err := openDatabaseFile(dbFile, key); err == nil {
+            db.Close()
+            return os.Remove(dbRekeyBackupFile)
+        }
+        dbLog.Warn("restoring database after interrupted rekey")
+        os.Remove(dbFile + "-wal")
+        os.Remove(dbFile + "-shm")
+        return os.Rename(dbRekeyBackupFile, dbFile)
+    }
+    return nil
+}
+
+// encryptDatabase converts a plaintext wa.db into a SQLCipher database
+// with key. The copy is written and verified next to the original, which
+// is only replaced once the copy is known to be good.
+func encryptDatabase(key []byte) error {
+    plain, err := openDatabaseFile(dbFile, nil)
+    if err != nil {
+        return err
+    }
+    err = func() error {
+        defer plain.Close()
+        if _, err := plain.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+            return err
+        }
+        if _, err := plain.Exec(fmt.Sprintf("ATTACH DATABASE '%s' AS encrypted KEY %s", dbEncryptingFile, sqlKey(key))); err != nil {
+            return err
+        }
+        defer plain.Exec("DETACH DATABASE encrypted")
+        if _, err := plain.Exec("PRAGMA encrypted.cipher_page_size = 4096"); err != nil {
+            return err
+        }
+        _, err := plain.Exec("SELECT sqlcipher_export('encrypted')")
+        return err
+    }()
+    if err != nil {
+        os.Remove(dbEncryptingFile)
+        return fmt.Errorf("export failed: %v", err)
+    }
+
+    if err := verifyDatabase(dbEncryptingFile, key); err != nil {
+        os.Remove(dbEncryptingFile)
+        return fmt.Errorf("encrypted copy is broken: %v", err)
+    }
+
+    if err := os.Rename(dbFile, dbPlaintextFile); err != nil {
+        os.Remove(dbEncryptingFile)
+        return err
+    }
+    // The plaintext WAL was checkpointed and must not meet the new file
+    os.Remove(dbFile + "-wal")
+    os.Remove(dbFile + "-shm")
+    if err := os.Rename(dbEncryptingFile, dbFile); err != nil {
+        os.Rename(dbPlaintextFile, dbFile)
+        os.Remove(dbEncryptingFile)
+        return err
+    }
+    return os.Remove(dbPlaintextFile)
+}
+
+// verifyDatabase opens path with key and runs an integrity check.
+func verifyDatabase(path string, key []byte) error {
+    db, err := openDatabaseFile(path, key)
+    if err != nil {
+        return err
+    }
+    defer db.Close()
+    var result string
+    if err := db.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+        return err
+    }
+    if result != "ok" {
+        return fmt.Errorf("%s", result)
+    }
+    return nil
+}
+
+// prepareDatabase runs before the database is opened: it recovers from an
+// interrupted migration or rekey and encrypts a database that was created
+// in plaintext.
+func prepareDatabase() error {
+    if len(encryptionKey) == 0 {
+        return nil
+    }
+    if err := recoverDatabase(encryptionKey); err != nil {
+        return err
+    }
+    plain, err := isPlaintextDatabase(dbFile)
+    if os.IsNotExist(err) || (err == nil && !plain) {
+        return nil
+    } else if err != nil {
+        return err
+    }
+    dbLog.Info("encrypting plaintext database")
+    if err := encryptDatabase(encryptionKey); err != nil {
+        return fmt.Errorf("couldn't encrypt database: %v", err)
+    }
+    dbLog.Info("database encrypted")
+    return nil
+}
+
+// rekeyDatabase re-encrypts the closed database from oldKey to newKey with
+// PRAGMA rekey. A copy under the old key is kept until the caller has
+// stored newKey, so either key always opens one of the two files.
+func rekeyDatabase(oldKey, newKey []byte) error {
+    db, err := openDatabaseFile(dbFile, oldKey)
+    if err != nil {
+        return err
+    }
+    defer db.Close()
+    if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+        return err
+    }
+    if err := copyDatabaseFile(dbFile, dbRekeyBackupFile); err != nil {
+        return fmt.Errorf("couldn't back up database: %v", err)
+    }
+    if _, err := db.Exec("PRAGMA rekey = " + sqlKey(newKey)); err != nil {
+        db.Close()
+        os.Rename(dbRekeyBackupFile, dbFile)
+        return err
+    }
+    db.Close()
+    if err := verifyDatabase(dbFile, newKey); err != nil {
+        os.Remove(dbFile + "-wal")
+        os.Remove(dbFile + "-shm")
+        os.Rename(dbRekeyBackupFile, dbFile)
+        return fmt.Errorf("rekeyed database is broken: %v", err)
+    }
+    return nil
+}
+
+// rotateDatabaseKey replaces the database key of the running backend. The
+// accounts are closed while the database is and reconnect afterwards.
+func rotateDatabaseKey() error {
+    rekeyMutex.Lock()
+    defer rekeyMutex.Unlock()
+    if keyStore == nil || len(encryptionKey) == 0 {
+        return fmt.Errorf("database is not encrypted")
+    }
+    newKey := make([]byte, 32)
+    if _, err := rand.Read(newKey); err != nil {
+        return err
+    }
+
+    closeAccounts()
+    if container != nil {
+        container.Close()
+    }
+    // Whatever happens, the backend comes back up with a working key
+    defer func() {
+        if err := initDatabase(); err != nil {
+            dbLog.Error("database reopen failed", "err", err)
+            return
+        }
+        if err := loadAccounts(); err != nil {
+            dbLog.Error("account reload failed", "err", err)
+        }
+    }()
+
+    oldKey := encryptionKey
+    if err := rekeyDatabase(oldKey, newKey); err != nil {
+        return fmt.Errorf("rekey failed: %v", err)
+    }
+    if err := storeKeyConfirmed(newKey); err != nil {
+        // Storing may have dropped the old key first, as Sailfish Secrets
+        // does, so the old file only comes back once its key is back too
+        if restoreErr := storeKeyConfirmed(oldKey); restoreErr != nil {
+            // Both files stay: the new key runs the backend for now and
+            // whichever key the store ends up with opens one of them
+            encryptionKey = newKey
+            dbLog.Error("no database key is stored", "err", err, "restore_err", restoreErr)
+            return fmt.Errorf("couldn't store new key (%v) nor put back the old one (%v)", err, restoreErr)
+        }
+        os.Remove(dbFile + "-wal")
+        os.Remove(dbFile + "-shm")
+        os.Rename(dbRekeyBackupFile, dbFile)
+        return fmt.Errorf("couldn't store new key: %v", err)
+    }
+    encryptionKey = newKey
+    os.Remove(dbRekeyBackupFile)
+    dbLog.Info("database key rotated")
+    return nil
+}
+
+// storeKeyConfirmed stores key as the database key and reads it back.
+func storeKeyConfirmed(key []byte) error {
+    if err := keyStore.Store(SECRET_KEY_NAME, key); err != nil {
+        return err
+    }
+    stored, err := keyStore.Load(SECRET_KEY_NAME)
+    if err != nil {
+        return err
+    }
+    if !bytes.Equal(stored, key) {
+        return fmt.Errorf("the key store returned a different key")
+    }
+    return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "sync"
+    "testing"
+)
+
+func testKey(b byte) []byte {
+    return bytes.Repeat([]byte{b}, 32)
+}
+
+// writeTestDatabase creates wa.db in the current directory with one row.
+func writeTestDatabase(t *testing.T, key []byte) {
+    t.Helper()
+    db, err := openDatabaseFile(dbFile, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    if _, err := db.Exec("PRAGMA journal_mode = WAL"); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := db.Exec("CREATE TABLE notes (text TEXT); INSERT INTO notes VALUES ('hello')"); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// readTestDatabase returns the row written by writeTestDatabase.
+func readTestDatabase(path string, key []byte) (string, error) {
+    db, err := openDatabaseFile(path, key)
+    if err != nil {
+        return "", err
+    }
+    defer db.Close()
+    var text string
+    err = db.QueryRow("SELECT text FROM notes").Scan(&text)
+    return text, err
+}
+
+func wantDatabase(t *testing.T, key []byte) {
+    t.Helper()
+    if text, err := readTestDatabase(dbFile, key); err != nil || text != "hello" {
+        t.Errorf("database = %q, %v", text, err)
+    }
+}
+
+func wantNoFile(t *testing.T, names ...string) {
+    t.Helper()
+    for _, name := range names {
+        if _, err := os.Stat(name); !os.IsNotExist(err) {
+            t.Errorf("%s left behind", name)
+        }
+    }
+}
+
+func TestEncryptDatabase(t *testing.T) {
+    t.Chdir(t.TempDir())
+    writeTestDatabase(t, nil)
+    key := testKey(1)
+    if err := encryptDatabase(key); err != nil {
+        t.Fatal(err)
+    }
+    if plain, err := isPlaintextDatabase(dbFile); err != nil || plain {
+        t.Errorf("still plaintext: %v, %v", plain, err)
+    }
+    wantDatabase(t, key)
+    if _, err := readTestDatabase(dbFile, nil); err == nil {
+        t.Error("encrypted database opened without the key")
+    }
+    wantNoFile(t, dbEncryptingFile, dbPlaintextFile)
+}
+
+func TestRecoverInterruptedEncryption(t *testing.T) {
+    key := testKey(1)
+
+    // Stopped between moving the plaintext aside and moving the copy in
+    t.Run("before swap", func(t *testing.T) {
+        t.Chdir(t.TempDir())
+        writeTestDatabase(t, nil)
+        os.Rename(dbFile, dbPlaintextFile)
+        os.WriteFile(dbEncryptingFile, []byte("partial"), 0600)
+        if err := recoverDatabase(key); err != nil {
+            t.Fatal(err)
+        }
+        wantDatabase(t, nil)
+        wantNoFile(t, dbEncryptingFile, dbPlaintextFile)
+    })
+
+    // Stopped after the swap, before the plaintext was removed
+    t.Run("after swap", func(t *testing.T) {
+        t.Chdir(t.TempDir())
+        writeTestDatabase(t, nil)
+        if err := encryptDatabase(key); err != nil {
+            t.Fatal(err)
+        }
+        os.WriteFile(dbPlaintextFile, []byte("SQLite format 3\x00"), 0600)
+        if err := recoverDatabase(key); err != nil {
+            t.Fatal(err)
+        }
+        wantDatabase(t, key)
+        wantNoFile(t, dbPlaintextFile)
+    })
+}
+
+func TestRekeyDatabase(t *testing.T) {
+    t.Chdir(t.TempDir())
+    oldKey, newKey := testKey(1), testKey(2)
+    writeTestDatabase(t, oldKey)
+    if err := rekeyDatabase(oldKey, newKey); err != nil {
+        t.Fatal(err)
+    }
+    wantDatabase(t, newKey)
+    if _, err := readTestDatabase(dbFile, oldKey); err == nil {
+        t.Error("rekeyed database opens with the old key")
+    }
+    // Until the new key is stored the backup opens with the old one
+    if text, err := readTestDatabase(dbRekeyBackupFile, oldKey); err != nil || text != "hello" {
+        t.Errorf("backup = %q, %v", text, err)
+    }
+}
+
+func TestRecoverInterruptedRekey(t *testing.T) {
+    oldKey, newKey := testKey(1), testKey(2)
+
+    // The new key made it into the store
+    t.Run("new key stored", func(t *testing.T) {
+        t.Chdir(t.TempDir())
+        writeTestDatabase(t, oldKey)
+        if err := rekeyDatabase(oldKey, newKey); err != nil {
+            t.Fatal(err)
+        }
+        if err := recoverDatabase(newKey); err != nil {
+            t.Fatal(err)
+        }
+        wantDatabase(t, newKey)
+        wantNoFile(t, dbRekeyBackupFile)
+    })
+
+    // The store still has the old key
+    t.Run("old key stored", func(t *testing.T) {
+        t.Chdir(t.TempDir())
+        writeTestDatabase(t, oldKey)
+        if err := rekeyDatabase(oldKey, newKey); err != nil {
+            t.Fatal(err)
+        }
+        if err := recoverDatabase(oldKey); err != nil {
+            t.Fatal(err)
+        }
+        wantDatabase(t, oldKey)
+        wantNoFile(t, dbRekeyBackupFile, dbFile+"-wal")
+    })
+}
+
+// dropFirstKeyStore forgets the stored value before storing, like Sailfish
+// Secrets, and fails the next failStores stores after that.
+type dropFirstKeyStore struct {
+    mu         sync.Mutex
+    data       map[string][]byte
+    failStores int
+}
+
+func (s *dropFirstKeyStore) Name() string { return "test store" }
+
+func (s *dropFirstKeyStore) Load(name string) ([]byte, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    data, ok := s.data[name]
+    if !ok {
+        return nil, ErrSecretNotFound
+    }
+    return data, nil
+}
+
+func (s *dropFirstKeyStore) Store(name string, data []byte) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    delete(s.data, name)
+    if s.failStores > 0 {
+        s.failStores--
+        return fmt.Errorf("setSecret failed")
+    }
+    s.data[name] = append([]byte(nil), data...)
+    return nil
+}
+
+func (s *dropFirstKeyStore) Delete(name string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    delete(s.data, name)
+    return nil
+}
+
+// useEncryptedBackend reopens the test backend's database encrypted with
+// a key kept in store.
+func useEncryptedBackend(t *testing.T, store KeyStore) {
+    t.Helper()
+    saved := keyStore
+    keyStore = store
+    t.Cleanup(func() { keyStore = saved })
+    closeAccounts()
+    container.Close()
+    var err error
+    if encryptionKey, err = GetOrCreateKey(); err != nil {
+        t.Fatal(err)
+    }
+    if err := prepareDatabase(); err != nil {
+        t.Fatal(err)
+    }
+    if err := initDatabase(); err != nil {
+        t.Fatal(err)
+    }
+    if err := loadAccounts(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestRotateDatabaseKey(t *testing.T) {
+    b := newTestBackend(t)
+    b.paired("491700000000")
+    store := &dropFirstKeyStore{data: make(map[string][]byte)}
+    useEncryptedBackend(t, store)
+    oldKey := encryptionKey
+
+    if err := rotateDatabaseKey(); err != nil {
+        t.Fatal(err)
+    }
+    stored, _ := store.Load(SECRET_KEY_NAME)
+    if bytes.Equal(encryptionKey, oldKey) || !bytes.Equal(stored, encryptionKey) {
+        t.Error("key not rotated")
+    }
+    if err := verifyDatabase(dbFile, encryptionKey); err != nil {
+        t.Error(err)
+    }
+    wantNoFile(t, dbRekeyBackupFile)
+    if len(allAccounts()) != 1 {
+        t.Errorf("%d accounts after rotation", len(allAccounts()))
+    }
+}
+
+func TestRotateDatabaseKeyStoreFails(t *testing.T) {
+    b := newTestBackend(t)
+    b.paired("491700000000")
+    store := &dropFirstKeyStore{data: make(map[string][]byte)}
+    useEncryptedBackend(t, store)
+    oldKey := encryptionKey
+
+    // The new key is lost, the old one goes back and so does the old file
+    store.failStores = 1
+    if err := rotateDatabaseKey(); err == nil {
+        t.Fatal("rotation succeeded without storing the key")
+    }
+    stored, _ := store.Load(SECRET_KEY_NAME)
+    if !bytes.Equal(encryptionKey, oldKey) || !bytes.Equal(stored, oldKey) {
+        t.Error("old key not kept")
+    }
+    if err := verifyDatabase(dbFile, oldKey); err != nil {
+        t.Error(err)
+    }
+    wantNoFile(t, dbRekeyBackupFile)
+    if len(allAccounts()) != 1 {
+        t.Errorf("%d accounts after failed rotation", len(allAccounts()))
+    }
+}
+
+func TestRotateDatabaseKeyStoreBroken(t *testing.T) {
+    b := newTestBackend(t)
+    b.paired("491700000000")
+    store := &dropFirstKeyStore{data: make(map[string][]byte)}
+    useEncryptedBackend(t, store)
+    oldKey := encryptionKey
+
+    // Neither key can be stored: both files stay and the backend runs on
+    store.failStores = 2
+    if err := rotateDatabaseKey(); err == nil {
+        t.Fatal("rotation succeeded without storing the key")
+    }
+    if err := verifyDatabase(dbFile, encryptionKey); err != nil {
+        t.Errorf("running key doesn't open the database: %v", err)
+    }
+    if err := verifyDatabase(dbRekeyBackupFile, oldKey); err != nil {
+        t.Errorf("backup under the old key: %v", err)
+    }
+    if len(allAccounts()) != 1 {
+        t.Errorf("%d accounts after failed rotation", len(allAccounts()))
+    }
+
+    // Once the store has the old key again, recovery goes back to it
+    store.Store(SECRET_KEY_NAME, oldKey)
+    closeAccounts()
+    container.Close()
+    container = nil
+    if err := recoverDatabase(oldKey); err != nil {
+        t.Fatal(err)
+    }
+    if err := verifyDatabase(dbFile, oldKey); err != nil {
+        t.Error(err)
+    }
+}
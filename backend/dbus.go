@@ -0,0 +1,287 @@
+package main
+
+import (
+    "fmt"
+    "reflect"
+    "strings"
+    "sync"
+
+    "github.com/godbus/dbus/v5"
+    "github.com/godbus/dbus/v5/introspect"
+)
+
+const (
+    DBUS_NAME      = "org.harbour.whatsapp"
+    DBUS_PATH      = "/org/harbour/whatsapp"
+    DBUS_INTERFACE = "org.harbour.whatsapp.Backend"
+)
+
+// DBusService exposes the backend on the session bus. Every exported
+// method returning *dbus.Error becomes a D-Bus method, so helpers must
+// stay unexported.
+type DBusService struct {
+    conn *dbus.Conn
+}
+
+var dbusService *DBusService
+var dbusMutex sync.RWMutex
+var dbusLog = logger("dbus")
+
+var dbusSignals = []introspect.Signal{
+    {Name: "MessageReceived", Args: []introspect.Arg{{Name: "message", Type: "a{sv}"}}},
+    {Name: "ConnectionStateChanged", Args: []introspect.Arg{{Name: "state", Type: "s"}, {Name: "account", Type: "s"}}},
+    {Name: "ReceiptUpdated", Args: []introspect.Arg{
+        {Name: "chatJid", Type: "s"}, {Name: "sender", Type: "s"}, {Name: "ids", Type: "as"},
+        {Name: "type", Type: "s"}, {Name: "timestamp", Type: "x"}, {Name: "account", Type: "s"},
+    }},
+}
+
+// connectDBus connects to the bus at address, or the session bus if it is
+// empty. Tests and development setups point it at a private dbus-daemon.
+func connectDBus(address string) (*dbus.Conn, error) {
+    if address == "" {
+        return dbus.ConnectSessionBus()
+    }
+    return dbus.Connect(address)
+}
+
+// startDBusService exports the service on conn and takes the bus name.
+func startDBusService(conn *dbus.Conn) (*DBusService, error) {
+    s := &DBusService{conn: conn}
+    if err := conn.Export(s, DBUS_PATH, DBUS_INTERFACE); err != nil {
+        return nil, err
+    }
+    node := &introspect.Node{
+        Name: DBUS_PATH,
+        Interfaces: []introspect.Interface{
+            introspect.IntrospectData,
+            {Name: DBUS_INTERFACE, Methods: introspect.Methods(s), Signals: dbusSignals},
+        },
+    }
+    if err := conn.Export(introspect.NewIntrospectable(node), DBUS_PATH, "org.freedesktop.DBus.Introspectable"); err != nil {
+        return nil, err
+    }
+    reply, err := conn.RequestName(DBUS_NAME, dbus.NameFlagDoNotQueue)
+    if err != nil {
+        return nil, err
+    }
+    if reply != dbus.RequestNameReplyPrimaryOwner {
+        return nil, fmt.Errorf("%s is already taken", DBUS_NAME)
+    }
+    return s, nil
+}
+
+// initDBus starts the D-Bus service unless it is disabled in the config.
+func initDBus() error {
+    address := getConfig().DBusAddress
+    if address == "none" {
+        return nil
+    }
+    conn, err := connectDBus(address)
+    if err != nil {
+        return err
+    }
+    s, err := startDBusService(conn)
+    if err != nil {
+        conn.Close()
+        return err
+    }
+    dbusMutex.Lock()
+    dbusService = s
+    dbusMutex.Unlock()
+    dbusLog.Info("D-Bus service ready", "name", DBUS_NAME)
+    return nil
+}
+
+// closeDBus releases the service name and closes its connection.
+func closeDBus() {
+    dbusMutex.Lock()
+    s := dbusService
+    dbusService = nil
+    dbusMutex.Unlock()
+    if s != nil {
+        s.conn.Close()
+    }
+}
+
+func dbusFailed(err error) *dbus.Error {
+    return dbus.NewError(DBUS_INTERFACE+".Error.Failed", []interface{}{err.Error()})
+}
+
+func dbusInvalidArgs(msg string) *dbus.Error {
+    return dbus.NewError("org.freedesktop.DBus.Error.InvalidArgs", []interface{}{msg})
+}
+
+func dbusRequireUnlocked() *dbus.Error {
+    if isLocked() {
+        return dbus.NewError(DBUS_INTERFACE+".Error.Locked", []interface{}{"the backend is locked"})
+    }
+    return nil
+}
+
+// dbusAccount returns the default account; D-Bus clients only see that one.
+func dbusAccount() (*Account, *dbus.Error) {
+    if err := dbusRequireUnlocked(); err != nil {
+        return nil, err
+    }
+    a := defaultAccount()
+    if a == nil {
+        return nil, dbus.NewError(DBUS_INTERFACE+".Error.NotPaired", []interface{}{"no WhatsApp account is open"})
+    }
+    return a, nil
+}
+
+func dbusRequireLogin() (*Account, *dbus.Error) {
+    a, err := dbusAccount()
+    if err != nil {
+        return nil, err
+    }
+    if a.device.ID == nil {
+        return nil, dbus.NewError(DBUS_INTERFACE+".Error.NotPaired", []interface{}{"no WhatsApp account is paired"})
+    }
+    return a, nil
+}
+
+// variantMap turns a struct into a{sv} keyed by its JSON field names, so
+// D-Bus clients see the same fields as the HTTP API.
+func variantMap(v interface{}) map[string]dbus.Variant {
+    rv := reflect.ValueOf(v)
+    rt := rv.Type()
+    result := make(map[string]dbus.Variant, rt.NumField())
+    for i := 0; i < rt.NumField(); i++ {
+        f := rt.Field(i)
+        name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+        if name == "" || name == "-" {
+            continue
+        }
+        result[name] = dbus.MakeVariant(rv.Field(i).Interface())
+    }
+    return result
+}
+
+func (s *DBusService) SendMessage(chatJid string, text string) (string, *dbus.Error) {
+    if chatJid == "" || text == "" {
+        return "", dbusInvalidArgs("chatJid and text required")
+    }
+    a, derr := dbusRequireLogin()
+    if derr != nil {
+        return "", derr
+    }
+    m, err := a.sendText(chatJid, text)
+    if err != nil {
+        return "", dbusFailed(err)
+    }
+    return m.ID, nil
+}
+
+func (s *DBusService) GetChats(archived bool) ([]map[string]dbus.Variant, *dbus.Error) {
+    a, err := dbusAccount()
+    if err != nil {
+        return nil, err
+    }
+    chats := a.getChats(archived)
+    result := make([]map[string]dbus.Variant, len(chats))
+    for i, c := range chats {
+        result[i] = variantMap(c)
+    }
+    return result, nil
+}
+
+// GetMessages returns the newest limit messages of a chat, oldest first;
+// a limit of 0 returns all of them.
+func (s *DBusService) GetMessages(chatJid string, limit int32) ([]map[string]dbus.Variant, *dbus.Error) {
+    a, err := dbusAccount()
+    if err != nil {
+        return nil, err
+    }
+    msgs := a.getMessagesForChat(chatJid)
+    if limit > 0 && len(msgs) > int(limit) {
+        msgs = msgs[len(msgs)-int(limit):]
+    }
+    result := make([]map[string]dbus.Variant, len(msgs))
+    for i, m := range msgs {
+        result[i] = variantMap(m)
+    }
+    return result, nil
+}
+
+func (s *DBusService) MarkRead(chatJid string) *dbus.Error {
+    a, derr := dbusRequireLogin()
+    if derr != nil {
+        return derr
+    }
+    if err := a.markChatRead(chatJid); err != nil {
+        return dbusFailed(err)
+    }
+    return nil
+}
+
+// SetActiveChat tells the backend which chat is on screen, "" for none,
+// so no notifications are shown for it.
+func (s *DBusService) SetActiveChat(chatJid string) *dbus.Error {
+    a, err := dbusAccount()
+    if err != nil {
+        return err
+    }
+    setActiveChat(a, chatJid)
+    return nil
+}
+
+func (s *DBusService) Pair(phone string) (string, *dbus.Error) {
+    a, derr := dbusAccount()
+    if derr != nil {
+        return "", derr
+    }
+    phone = normalizePhone(phone)
+    if phone == "" {
+        return "", dbusInvalidArgs("phone required")
+    }
+    code, err := a.pairDevice(phone)
+    if err != nil {
+        return "", dbusFailed(err)
+    }
+    return code, nil
+}
+
+func (s *DBusService) Logout() *dbus.Error {
+    a, err := dbusAccount()
+    if err != nil {
+        return err
+    }
+    logout(a)
+    return nil
+}
+
+func (s *DBusService) emit(name string, values ...interface{}) {
+    if err := s.conn.Emit(DBUS_PATH, DBUS_INTERFACE+"."+name, values...); err != nil {
+        dbusLog.Warn("D-Bus signal failed", "signal", name, "err", err)
+    }
+}
+
+func getDBusService() *DBusService {
+    dbusMutex.RLock()
+    defer dbusMutex.RUnlock()
+    return dbusService
+}
+
+func emitMessageReceived(a *Account, m Message) {
+    if s := getDBusService(); s != nil {
+        values := variantMap(m)
+        values["account"] = dbus.MakeVariant(a.ID)
+        s.emit("MessageReceived", values)
+    }
+}
+
+// emitConnectionState signals "connected", "disconnected", "paired" or
+// "logged_out" for the account.
+func emitConnectionState(a *Account, state string) {
+    if s := getDBusService(); s != nil {
+        s.emit("ConnectionStateChanged", state, a.ID)
+    }
+}
+
+func emitReceiptUpdated(a *Account, chatJid, sender string, ids []string, receiptType string, ts int64) {
+    if s := getDBusService(); s != nil {
+        s.emit("ReceiptUpdated", chatJid, sender, ids, receiptType, ts, a.ID)
+    }
+}
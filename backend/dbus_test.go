@@ -0,0 +1,282 @@
+package main
+
+import (
+    "bufio"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/godbus/dbus/v5"
+    "go.mau.fi/whatsmeow/types"
+    "go.mau.fi/whatsmeow/types/events"
+)
+
+const testBusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:dir=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startTestBus runs a private dbus-daemon for the test and returns its
+// address. Tests using it are skipped where dbus-daemon isn't installed.
+func startTestBus(t *testing.T) string {
+    t.Helper()
+    daemon, err := exec.LookPath("dbus-daemon")
+    if err != nil {
+        t.Skip("dbus-daemon not installed")
+    }
+    dir := t.TempDir()
+    configPath := filepath.Join(dir, "bus.conf")
+    if err := os.WriteFile(configPath, []byte(strings.Replace(testBusConfig, "%s", dir, 1)), 0600); err != nil {
+        t.Fatal(err)
+    }
+    cmd := exec.Command(daemon, "--config-file="+configPath, "--nofork", "--print-address")
+    out, err := cmd.StdoutPipe()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := cmd.Start(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        cmd.Process.Kill()
+        cmd.Wait()
+    })
+    address, err := bufio.NewReader(out).ReadString('\n')
+    if err != nil {
+        t.Fatalf("dbus-daemon: %v", err)
+    }
+    return strings.TrimSpace(address)
+}
+
+// testDBus is a client on a private bus the test backend serves on. It
+// receives the service's signals.
+type testDBus struct {
+    t       *testing.T
+    client  *dbus.Conn
+    signals chan *dbus.Signal
+}
+
+func newTestDBus(t *testing.T) *testDBus {
+    t.Helper()
+    address := startTestBus(t)
+    conn, err := connectDBus(address)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s, err := startDBusService(conn)
+    if err != nil {
+        conn.Close()
+        t.Fatal(err)
+    }
+    dbusMutex.Lock()
+    dbusService = s
+    dbusMutex.Unlock()
+    t.Cleanup(closeDBus)
+
+    client, err := dbus.Connect(address)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { client.Close() })
+    if err := client.AddMatchSignal(dbus.WithMatchInterface(DBUS_INTERFACE)); err != nil {
+        t.Fatal(err)
+    }
+    d := &testDBus{t: t, client: client, signals: make(chan *dbus.Signal, 20)}
+    client.Signal(d.signals)
+    return d
+}
+
+func (d *testDBus) call(method string, out interface{}, args ...interface{}) error {
+    d.t.Helper()
+    call := d.client.Object(DBUS_NAME, DBUS_PATH).Call(DBUS_INTERFACE+"."+method, 0, args...)
+    if call.Err != nil || out == nil {
+        return call.Err
+    }
+    return call.Store(out)
+}
+
+// signal waits for the next signal called name, skipping others.
+func (d *testDBus) signal(name string) *dbus.Signal {
+    d.t.Helper()
+    timeout := time.After(5 * time.Second)
+    for {
+        select {
+        case sig := <-d.signals:
+            if sig.Name == DBUS_INTERFACE+"."+name {
+                return sig
+            }
+        case <-timeout:
+            d.t.Fatalf("no %s signal", name)
+            return nil
+        }
+    }
+}
+
+func dbusErrorName(err error) string {
+    if derr, ok := err.(dbus.Error); ok {
+        return derr.Name
+    }
+    return ""
+}
+
+func TestDBusSendNeedsPairing(t *testing.T) {
+    newTestBackend(t)
+    d := newTestDBus(t)
+    var id string
+    err := d.call("SendMessage", &id, alice.User, "hello")
+    if name := dbusErrorName(err); name != DBUS_INTERFACE+".Error.NotPaired" {
+        t.Errorf("unpaired SendMessage = %v", err)
+    }
+}
+
+func TestDBusSendMessage(t *testing.T) {
+    b := newTestBackend(t)
+    d := newTestDBus(t)
+    a, f := b.paired("491700000000")
+
+    var id string
+    if err := d.call("SendMessage", &id, alice.User, "hello"); err != nil {
+        t.Fatal(err)
+    }
+    sent := f.Sent()
+    if id == "" || len(sent) != 1 || sent[0].To.User != alice.User || sent[0].Message.GetConversation() != "hello" {
+        t.Errorf("id %q, sent %+v", id, sent)
+    }
+    if msgs := a.getMessagesForChat(alice.User); len(msgs) != 1 || msgs[0].ID != id {
+        t.Errorf("messages = %+v", msgs)
+    }
+    err := d.call("SendMessage", &id, "", "hello")
+    if name := dbusErrorName(err); name != "org.freedesktop.DBus.Error.InvalidArgs" {
+        t.Errorf("SendMessage without a chat = %v", err)
+    }
+}
+
+func TestDBusChatsAndMessages(t *testing.T) {
+    b := newTestBackend(t)
+    d := newTestDBus(t)
+    _, f := b.paired("491700000000")
+    f.Replay(
+        textEvent(alice, alice, "M1", "one", 1000),
+        textEvent(alice, alice, "M2", "two", 1001),
+        textEvent(bob, bob, "M3", "three", 1002),
+    )
+
+    var chats []map[string]dbus.Variant
+    if err := d.call("GetChats", &chats, false); err != nil {
+        t.Fatal(err)
+    }
+    if len(chats) != 2 || chats[0]["jid"].Value() != bob.User || chats[1]["lastMessage"].Value() != "two" {
+        t.Errorf("chats = %v", chats)
+    }
+
+    var msgs []map[string]dbus.Variant
+    if err := d.call("GetMessages", &msgs, alice.User, int32(1)); err != nil {
+        t.Fatal(err)
+    }
+    if len(msgs) != 1 || msgs[0]["id"].Value() != "M2" || msgs[0]["text"].Value() != "two" {
+        t.Errorf("last message = %v", msgs)
+    }
+    if err := d.call("GetMessages", &msgs, alice.User, int32(0)); err != nil || len(msgs) != 2 {
+        t.Errorf("all messages = %v, %v", msgs, err)
+    }
+
+    if err := d.call("MarkRead", nil, alice.User); err != nil {
+        t.Fatal(err)
+    }
+    f.mu.Lock()
+    reads := f.reads
+    f.mu.Unlock()
+    if len(reads) != 1 || len(reads[0].IDs) != 2 {
+        t.Errorf("reads = %+v", reads)
+    }
+}
+
+func TestDBusPairAndLogout(t *testing.T) {
+    b := newTestBackend(t)
+    d := newTestDBus(t)
+    a := defaultAccount()
+    f := fakeOf(t, a)
+    select {
+    case <-f.ready:
+    case <-time.After(5 * time.Second):
+        t.Fatal("account never connected")
+    }
+
+    var code string
+    if err := d.call("Pair", &code, "+49 170 0000000"); err != nil {
+        t.Fatal(err)
+    }
+    if code != "FAKE-CODE" || f.Calls("PairPhone") != 1 {
+        t.Errorf("code %q, %d PairPhone calls", code, f.Calls("PairPhone"))
+    }
+    if err := d.call("Pair", &code, ""); dbusErrorName(err) != "org.freedesktop.DBus.Error.InvalidArgs" {
+        t.Errorf("Pair without a phone = %v", err)
+    }
+
+    f.Pair(t, "491700000000")
+    if sig := d.signal("ConnectionStateChanged"); sig.Body[0] != "paired" || sig.Body[1] != a.ID {
+        t.Errorf("signal = %v", sig.Body)
+    }
+
+    // A second account keeps the database from being wiped with the last one
+    var added AccountPairResponse
+    if status := b.do("POST", "/accounts", PairRequest{Phone: "+49 170 9999999"}, &added); status != 200 {
+        t.Fatalf("add account: %d", status)
+    }
+    if err := d.call("Logout", nil); err != nil {
+        t.Fatal(err)
+    }
+    if f.Calls("Logout") != 1 || getAccount(a.ID) != nil {
+        t.Errorf("account %s not logged out", a.ID)
+    }
+}
+
+func TestDBusSignals(t *testing.T) {
+    b := newTestBackend(t)
+    d := newTestDBus(t)
+    a, f := b.paired("491700000000")
+
+    f.Replay(textEvent(alice, alice, "M1", "hi there", 1000))
+    sig := d.signal("MessageReceived")
+    values, _ := sig.Body[0].(map[string]dbus.Variant)
+    if values["id"].Value() != "M1" || values["text"].Value() != "hi there" || values["account"].Value() != a.ID {
+        t.Errorf("MessageReceived = %v", sig.Body)
+    }
+
+    f.Replay(receiptEvent(alice, alice, false, types.ReceiptTypeRead, 1001, "S1", "S2"))
+    sig = d.signal("ReceiptUpdated")
+    ids, _ := sig.Body[2].([]string)
+    if sig.Body[0] != alice.User || len(ids) != 2 || sig.Body[3] != "read" || sig.Body[4] != int64(1001) {
+        t.Errorf("ReceiptUpdated = %v", sig.Body)
+    }
+
+    f.Replay(&events.Disconnected{})
+    if sig := d.signal("ConnectionStateChanged"); sig.Body[0] != "disconnected" {
+        t.Errorf("ConnectionStateChanged = %v", sig.Body)
+    }
+}
+
+func TestDBusLocked(t *testing.T) {
+    newTestBackend(t)
+    d := newTestDBus(t)
+    useAppLock(t, "passphrase", 0)
+    if err := lockApp(); err != nil {
+        t.Fatal(err)
+    }
+    var chats []map[string]dbus.Variant
+    if err := d.call("GetChats", &chats, false); dbusErrorName(err) != DBUS_INTERFACE+".Error.Locked" {
+        t.Errorf("GetChats while locked = %v", err)
+    }
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+
+    "go.mau.fi/whatsmeow/appstate"
+    "go.mau.fi/whatsmeow/proto/waCommon"
+    "go.mau.fi/whatsmeow/proto/waSyncAction"
+    "go.mau.fi/whatsmeow/types/events"
+    "google.golang.org/protobuf/proto"
+)
+
+// isManagedMedia reports whether path is a file we downloaded into one of
+// our media directories. Messages we sent point at the user's original
+// file, which must never be deleted along with the chat.
+func (a *Account) isManagedMedia(path string) bool {
+    if path == "" {
+        return false
+    }
+    path = filepath.Clean(path)
+    for _, dir := range []string{a.picturesDir, a.videosDir, a.audioDir, a.documentsDir} {
+        if filepath.Dir(path) == filepath.Clean(dir) {
+            return true
+        }
+    }
+    return false
+}
+
+func (a *Account) deleteMediaFiles(msgs []Message) {
+    for _, m := range msgs {
+        if a.isManagedMedia(m.LocalPath) {
+            if err := os.Remove(m.LocalPath); err == nil {
+                a.log.Debug("deleted media file", "path", m.LocalPath)
+            }
+        }
+    }
+}
+
+// removeChatMessages drops the messages of a chat up to and including
+// before (unix seconds, 0 = all), optionally sparing starred ones.
+func (a *Account) removeChatMessages(jid string, before int64, keepStarred bool) []Message {
+    return a.removeMessages(func(m Message) bool {
+        if m.ChatJID != jid && !(m.ChatJID == "" && m.Sender == jid) {
+            return false
+        }
+        if before > 0 && m.Timestamp > before {
+            return false
+        }
+        return !(keepStarred && m.Starred)
+    })
+}
+
+// clearChat removes all messages of a chat but keeps the chat itself
+// (archive, pin and mute flags stay).
+func (a *Account) clearChat(jid string, keepStarred, deleteMedia bool) error {
+    ts, key := a.lastMessageKey(jid)
+    deleteStarred, withMedia := "1", "0"
+    if keepStarred {
+        deleteStarred = "0"
+    }
+    if deleteMedia {
+        withMedia = "1"
+    }
+    patch := appstate.PatchInfo{
+        Type: appstate.WAPatchRegularHigh,
+        Mutations: []appstate.MutationInfo{{
+            Index:   []string{appstate.IndexClearChat, userToJID(jid).String(), deleteStarred, withMedia},
+            Version: 6,
+            Value: &waSyncAction.SyncActionValue{
+                ClearChatAction: &waSyncAction.ClearChatAction{
+                    MessageRange: messageRange(ts, key),
+                },
+            },
+        }},
+    }
+    if err := a.client.SendAppState(a.ctx, patch); err != nil {
+        return err
+    }
+    removed := a.removeChatMessages(jid, 0, keepStarred)
+    if deleteMedia {
+        a.deleteMediaFiles(removed)
+    }
+    a.log.Info("chat cleared", "chat", jid, "messages", len(removed))
+    return nil
+}
+
+// deleteChat removes a chat with all its messages and flags.
+func (a *Account) deleteChat(jid string, deleteMedia bool) error {
+    ts, key := a.lastMessageKey(jid)
+    if err := a.client.SendAppState(a.ctx, appstate.BuildDeleteChat(userToJID(jid), ts, key)); err != nil {
+        return err
+    }
+    removed := a.removeChatMessages(jid, 0, false)
+    if deleteMedia {
+        a.deleteMediaFiles(removed)
+    }
+    a.updateChatState(jid, func(st *ChatState) { *st = ChatState{} })
+    a.log.Info("chat deleted", "chat", jid, "messages", len(removed))
+    return nil
+}
+
+// deleteMessageForMe removes a single message on this and the user's other
+// devices. The other chat members still see it.
+func (a *Account) deleteMessageForMe(chatJid, id string, deleteMedia bool) error {
+    m, ok := a.findMessage(chatJid, id)
+    if !ok {
+        return fmt.Errorf("message not found")
+    }
+    chat := userToJID(m.ChatJID)
+    fromMe, participant := "0", "0"
+    if m.FromMe {
+        fromMe = "1"
+    } else if chat.Server == "g.us" {
+        participant = userToJID(m.Sender).String()
+    }
+    patch := appstate.PatchInfo{
+        Type: appstate.WAPatchRegularHigh,
+        Mutations: []appstate.MutationInfo{{
+            Index:   []string{appstate.IndexDeleteMessageForMe, chat.String(), m.ID, fromMe, participant},
+            Version: 3,
+            Value: &waSyncAction.SyncActionValue{
+                DeleteMessageForMeAction: &waSyncAction.DeleteMessageForMeAction{
+                    DeleteMedia:      proto.Bool(deleteMedia),
+                    MessageTimestamp: proto.Int64(m.Timestamp),
+                },
+            },
+        }},
+    }
+    if err := a.client.SendAppState(a.ctx, patch); err != nil {
+        return err
+    }
+    removed := a.removeMessages(func(x Message) bool { return x.ID == m.ID && x.ChatJID == m.ChatJID })
+    if deleteMedia {
+        a.deleteMediaFiles(removed)
+    }
+    return nil
+}
+
+func messageRange(ts time.Time, key *waCommon.MessageKey) *waSyncAction.SyncActionMessageRange {
+    if ts.IsZero() {
+        ts = time.Now()
+    }
+    r := &waSyncAction.SyncActionMessageRange{LastMessageTimestamp: proto.Int64(ts.Unix())}
+    if key != nil {
+        r.Messages = []*waSyncAction.SyncActionMessage{{Key: key, Timestamp: proto.Int64(ts.Unix())}}
+    }
+    return r
+}
+
+// handleDeletionEvent applies deletions made on another device. The event
+// doesn't tell us whether starred messages were included in a clear, so
+// those are kept. Media files are only removed for single messages when
+// the other device asked for it, never for whole chats.
+func (a *Account) handleDeletionEvent(evt interface{}) {
+    switch v := evt.(type) {
+    case *events.ClearChat:
+        jid := v.JID.User
+        removed := a.removeChatMessages(jid, v.Action.GetMessageRange().GetLastMessageTimestamp(), true)
+        a.log.Info("chat cleared on another device", "chat", jid, "messages", len(removed))
+    case *events.DeleteChat:
+        jid := v.JID.User
+        removed := a.removeChatMessages(jid, v.Action.GetMessageRange().GetLastMessageTimestamp(), false)
+        if !a.hasMessages(jid) {
+            a.updateChatState(jid, func(st *ChatState) { *st = ChatState{} })
+        }
+        a.log.Info("chat deleted on another device", "chat", jid, "messages", len(removed))
+    case *events.DeleteForMe:
+        chatJid := v.ChatJID.User
+        removed := a.removeMessages(func(m Message) bool { return m.ID == v.MessageID && m.ChatJID == chatJid })
+        if v.Action.GetDeleteMedia() {
+            a.deleteMediaFiles(removed)
+        }
+    }
+}
+
+func (a *Account) hasMessages(jid string) bool {
+    a.msgMutex.RLock()
+    defer a.msgMutex.RUnlock()
+    for _, m := range a.messages {
+        if m.ChatJID == jid {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "go.mau.fi/whatsmeow/types"
+    "go.mau.fi/whatsmeow/types/events"
+)
+
+// testBackend runs the event pipeline and the /api/v2 routes on a fresh
+// data directory and database, with fake WhatsApp clients.
+type testBackend struct {
+    t      *testing.T
+    dir    string
+    server *httptest.Server
+}
+
+func newTestBackend(t *testing.T) *testBackend {
+    t.Helper()
+    dir := t.TempDir()
+    t.Chdir(dir)
+    useFakeClients(t)
+
+    cfg := defaultConfig()
+    cfg.DataDir = dir
+    cfg.PicturesDir = filepath.Join(dir, "Pictures")
+    cfg.VideosDir = filepath.Join(dir, "Videos")
+    cfg.AudioDir = filepath.Join(dir, "Music")
+    cfg.DocumentsDir = filepath.Join(dir, "Documents")
+    cfg.AvatarsDir = filepath.Join(dir, "Pictures", "avatars")
+    cfg.Notifications = false
+    cfg.DBusAddress = "none"
+    configMutex.Lock()
+    oldConfig := config
+    config = cfg
+    configMutex.Unlock()
+    oldKey := encryptionKey
+    encryptionKey = nil
+
+    t.Cleanup(func() {
+        closeAccounts()
+        if container != nil {
+            container.Close()
+            container = nil
+        }
+        encryptionKey = oldKey
+        configMutex.Lock()
+        config = oldConfig
+        configMutex.Unlock()
+    })
+
+    if err := initDatabase(); err != nil {
+        t.Fatal(err)
+    }
+    if err := loadAccounts(); err != nil {
+        t.Fatal(err)
+    }
+    mux := http.NewServeMux()
+    registerAPIv2(mux)
+    b := &testBackend{t: t, dir: dir, server: httptest.NewServer(mux)}
+    t.Cleanup(b.server.Close)
+    return b
+}
+
+// do calls the API and decodes the JSON answer into out, if given.
+func (b *testBackend) do(method, path string, body interface{}, out interface{}) int {
+    b.t.Helper()
+    var in io.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            b.t.Fatal(err)
+        }
+        in = bytes.NewReader(data)
+    }
+    req, err := http.NewRequest(method, b.server.URL+apiPrefix+path, in)
+    if err != nil {
+        b.t.Fatal(err)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        b.t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    data, _ := io.ReadAll(resp.Body)
+    if out != nil && resp.StatusCode < 300 {
+        if err := json.Unmarshal(data, out); err != nil {
+            b.t.Fatalf("%s %s: %v in %s", method, path, err, data)
+        }
+    }
+    return resp.StatusCode
+}
+
+// paired returns the default account, paired as phone.
+func (b *testBackend) paired(phone string) (*Account, *fakeClient) {
+    b.t.Helper()
+    a := defaultAccount()
+    f := fakeOf(b.t, a)
+    f.Pair(b.t, phone)
+    return a, f
+}
+
+var (
+    alice = types.NewJID("491701111111", types.DefaultUserServer)
+    bob   = types.NewJID("491702222222", types.DefaultUserServer)
+    group = types.NewJID("120363000000000001", types.GroupServer)
+)
+
+func TestIncomingMessagesReachAPI(t *testing.T) {
+    b := newTestBackend(t)
+    _, f := b.paired("491700000000")
+
+    f.Replay(
+        textEvent(alice, alice, "M1", "hi there", 1000),
+        textEvent(alice, alice, "M1", "hi there", 1000), // redelivered
+        textEvent(group, bob, "M2", "hello group", 1001),
+        textEvent(alice, alice, "M3", "still there?", 1002),
+    )
+
+    var chats []Chat
+    if code := b.do("GET", "/chats", nil, &chats); code != 200 {
+        t.Fatalf("chats: %d", code)
+    }
+    if len(chats) != 2 || chats[0].JID != alice.User || chats[1].JID != group.User {
+        t.Fatalf("chats = %+v", chats)
+    }
+    if chats[0].LastMessage != "still there?" || chats[0].Name != "Alice" || !chats[1].IsGroup {
+        t.Errorf("chats = %+v", chats)
+    }
+
+    var msgs []Message
+    b.do("GET", "/chats/"+alice.User+"/messages", nil, &msgs)
+    if len(msgs) != 2 || msgs[0].ID != "M1" || msgs[1].ID != "M3" || msgs[0].FromMe {
+        t.Fatalf("messages = %+v", msgs)
+    }
+    b.do("GET", "/chats/"+group.User+"/messages", nil, &msgs)
+    if len(msgs) != 1 || msgs[0].Sender != bob.User {
+        t.Fatalf("group messages = %+v", msgs)
+    }
+}
+
+func TestSendTextThroughAPI(t *testing.T) {
+    b := newTestBackend(t)
+    _, f := b.paired("491700000000")
+
+    var m Message
+    if code := b.do("POST", "/chats/"+alice.User+"/messages", SendTextRequest{Text: "on my way"}, &m); code != 200 {
+        t.Fatalf("send: %d", code)
+    }
+    sent := f.Sent()
+    if len(sent) != 1 || sent[0].To != alice || sent[0].Message.GetConversation() != "on my way" {
+        t.Fatalf("sent = %+v", sent)
+    }
+    if m.ID == "" || !m.FromMe || m.Sender != "491700000000" {
+        t.Errorf("message = %+v", m)
+    }
+
+    // A failing send is reported and stores nothing
+    f.Fail("SendMessage", errFakeOffline)
+    if code := b.do("POST", "/chats/"+alice.User+"/messages", SendTextRequest{Text: "lost"}, nil); code != http.StatusBadGateway {
+        t.Errorf("failed send: %d", code)
+    }
+    var msgs []Message
+    b.do("GET", "/chats/"+alice.User+"/messages", nil, &msgs)
+    if len(msgs) != 1 {
+        t.Errorf("messages = %+v", msgs)
+    }
+}
+
+func TestSendNeedsPairing(t *testing.T) {
+    b := newTestBackend(t)
+    if code := b.do("POST", "/chats/"+alice.User+"/messages", SendTextRequest{Text: "x"}, nil); code != http.StatusConflict {
+        t.Errorf("unpaired send: %d", code)
+    }
+    if n := fakeOf(t, defaultAccount()).Calls("SendMessage"); n != 0 {
+        t.Errorf("SendMessage called %d times", n)
+    }
+}
+
+func TestSendMediaRoundTrip(t *testing.T) {
+    b := newTestBackend(t)
+    a, f := b.paired("491700000000")
+
+    photo := filepath.Join(b.dir, "photo.jpg")
+    os.WriteFile(photo, []byte("jpeg data"), 0644)
+    if code := b.do("POST", "/chats/"+alice.User+"/media", SendMediaRequest{Path: photo, Caption: "look"}, nil); code != 200 {
+        t.Fatalf("send media: %d", code)
+    }
+    sent := f.Sent()
+    if len(sent) != 1 || sent[0].Message.GetImageMessage().GetCaption() != "look" {
+        t.Fatalf("sent = %+v", sent)
+    }
+
+    // The same picture coming back in is downloaded into the account's
+    // pictures directory
+    img := sent[0].Message.GetImageMessage()
+    now := time.Now().Unix()
+    f.Replay(imageEvent(alice, alice, "M9", "nice", img.GetDirectPath(), img.GetFileLength(), now+1))
+    var msgs []Message
+    b.do("GET", "/chats/"+alice.User+"/messages", nil, &msgs)
+    last := msgs[len(msgs)-1]
+    if last.ID != "M9" || last.MediaType != "image" || filepath.Dir(last.LocalPath) != a.picturesDir {
+        t.Fatalf("message = %+v", last)
+    }
+    if data, err := os.ReadFile(last.LocalPath); err != nil || string(data) != "jpeg data" {
+        t.Errorf("downloaded %q, %v", data, err)
+    }
+
+    // Missing media still gives a message, without a file
+    f.Replay(imageEvent(alice, alice, "M10", "", "/v/t62/gone", 10, now+2))
+    b.do("GET", "/chats/"+alice.User+"/messages", nil, &msgs)
+    if last := msgs[len(msgs)-1]; last.ID != "M10" || last.LocalPath != "" {
+        t.Errorf("message = %+v", last)
+    }
+}
+
+func TestReadStateFollowsEvents(t *testing.T) {
+    b := newTestBackend(t)
+    a, f := b.paired("491700000000")
+    f.Replay(
+        textEvent(alice, alice, "M1", "one", 1000),
+        textEvent(alice, alice, "M2", "two", 1001),
+    )
+
+    // Read on the phone
+    f.Replay(receiptEvent(alice, alice, true, types.ReceiptTypeReadSelf, 1001, "M1", "M2"))
+    if st := a.getChatState(alice.User); st.ReadUntil != 1001 {
+        t.Fatalf("readUntil = %d", st.ReadUntil)
+    }
+    if code := b.do("POST", "/chats/"+alice.User+"/read", nil, nil); code != 200 {
+        t.Fatalf("read: %d", code)
+    }
+    if n := f.Calls("MarkRead"); n != 0 {
+        t.Errorf("MarkRead called %d times for read messages", n)
+    }
+
+    f.Replay(textEvent(alice, alice, "M3", "three", 1002))
+    b.do("POST", "/chats/"+alice.User+"/read", nil, nil)
+    if len(f.reads) != 1 || len(f.reads[0].IDs) != 1 || f.reads[0].IDs[0] != "M3" {
+        t.Errorf("reads = %+v", f.reads)
+    }
+}
+
+func TestArchiveAndPinEvents(t *testing.T) {
+    b := newTestBackend(t)
+    _, f := b.paired("491700000000")
+    f.Replay(
+        textEvent(alice, alice, "M1", "one", 1000),
+        textEvent(bob, bob, "M2", "two", 1001),
+        &events.Archive{JID: bob, Timestamp: time.Unix(1100, 0), Action: archiveAction(true)},
+        &events.Pin{JID: alice, Timestamp: time.Unix(1100, 0), Action: pinAction(true)},
+    )
+
+    var chats []Chat
+    b.do("GET", "/chats", nil, &chats)
+    if len(chats) != 1 || chats[0].JID != alice.User || !chats[0].Pinned {
+        t.Fatalf("chats = %+v", chats)
+    }
+    b.do("GET", "/chats?archived=true", nil, &chats)
+    if len(chats) != 1 || chats[0].JID != bob.User {
+        t.Fatalf("archived chats = %+v", chats)
+    }
+
+    // Unarchiving here goes out as an app state patch
+    if code := b.do("PATCH", "/chats/"+bob.User, map[string]bool{"archived": false}, nil); code != 200 {
+        t.Fatalf("unarchive: %d", code)
+    }
+    if n := f.Calls("SendAppState"); n != 1 {
+        t.Errorf("SendAppState called %d times", n)
+    }
+}
+
+func TestAccountsArePairedAndRemovedIndependently(t *testing.T) {
+    b := newTestBackend(t)
+    first, f1 := b.paired("491700000000")
+    f1.Replay(textEvent(alice, alice, "M1", "for the first", 1000))
+
+    var added AccountPairResponse
+    if code := b.do("POST", "/accounts", PairRequest{Phone: "+49 170 9999999"}, &added); code != 200 {
+        t.Fatalf("add account: %d", code)
+    }
+    if added.Code != "FAKE-CODE" || added.Account.Default {
+        t.Fatalf("added = %+v", added)
+    }
+    second := getAccount(added.Account.ID)
+    f2 := fakeOf(t, second)
+    f2.Pair(t, "491709999999")
+    f2.Replay(textEvent(bob, bob, "M2", "for the second", 1001))
+
+    var msgs []Message
+    b.do("GET", "/chats/"+bob.User+"/messages?account="+second.ID, nil, &msgs)
+    if len(msgs) != 1 || msgs[0].ID != "M2" {
+        t.Fatalf("second account messages = %+v", msgs)
+    }
+    b.do("GET", "/chats/"+bob.User+"/messages", nil, &msgs)
+    if len(msgs) != 0 {
+        t.Fatalf("default account sees %+v", msgs)
+    }
+
+    var list []AccountInfo
+    b.do("GET", "/accounts", nil, &list)
+    if len(list) != 2 || list[0].ID != first.ID || list[1].Phone != "491709999999" {
+        t.Fatalf("accounts = %+v", list)
+    }
+
+    if code := b.do("DELETE", "/accounts/"+second.ID, nil, nil); code != 200 {
+        t.Fatalf("remove: %d", code)
+    }
+    if f2.Calls("Logout") != 1 || f1.Calls("Logout") != 0 {
+        t.Errorf("logouts: first %d, second %d", f1.Calls("Logout"), f2.Calls("Logout"))
+    }
+    if _, err := os.Stat(second.dir); !os.IsNotExist(err) {
+        t.Errorf("second account's data still there: %v", err)
+    }
+    if code := b.do("GET", "/chats?account="+second.ID, nil, nil); code != http.StatusNotFound {
+        t.Errorf("removed account: %d", code)
+    }
+    b.do("GET", "/chats/"+alice.User+"/messages", nil, &msgs)
+    if len(msgs) != 1 {
+        t.Errorf("first account lost its messages: %+v", msgs)
+    }
+}
+
+func TestAccountsSurviveRestart(t *testing.T) {
+    b := newTestBackend(t)
+    a, f := b.paired("491700000000")
+    f.Replay(textEvent(alice, alice, "M1", "keep me", 1000))
+    id := a.ID
+
+    closeAccounts()
+    if err := loadAccounts(); err != nil {
+        t.Fatal(err)
+    }
+    a = defaultAccount()
+    if a.ID != id || a.phone() != "491700000000" {
+        t.Fatalf("reopened %s as %q", a.ID, a.phone())
+    }
+    var msgs []Message
+    b.do("GET", "/chats/"+alice.User+"/messages", nil, &msgs)
+    if len(msgs) != 1 || msgs[0].Text != "keep me" {
+        t.Errorf("messages = %+v", msgs)
+    }
+    if fakeOf(t, a).Calls("Connect") != 1 {
+        t.Errorf("reopened account didn't connect")
+    }
+}
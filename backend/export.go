@@ -0,0 +1,366 @@
+package main
+
+import (
+    "archive/zip"
+    "encoding/json"
+    "fmt"
+    "html/template"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// ExportOptions selects what /export writes. From and To are unix seconds,
+// 0 leaves that end of the range open.
+type ExportOptions struct {
+    Format string // "txt", "html" or "json"
+    Zip    bool
+    From   int64
+    To     int64
+}
+
+type exportedChat struct {
+    JID      string    `json:"jid"`
+    Name     string    `json:"name"`
+    IsGroup  bool      `json:"isGroup"`
+    Messages []Message `json:"messages"`
+
+    media map[string]string // local path to the file's name in the export
+}
+
+func exportFileName(format string) string {
+    switch format {
+    case "html":
+        return "chat.html"
+    case "json":
+        return "chat.json"
+    default:
+        return "_chat.txt"
+    }
+}
+
+// exportSenderName returns the name WhatsApp would print for a message.
+func (a *Account) exportSenderName(m Message) string {
+    if m.FromMe {
+        return "You"
+    }
+    if name := a.getContactName(m.Sender); name != "" {
+        return name
+    }
+    return "+" + m.Sender
+}
+
+func (a *Account) chatDisplayName(jid string) string {
+    if name := a.getContactName(jid); name != "" {
+        return name
+    }
+    return jid
+}
+
+func (a *Account) collectExport(jids []string, opts ExportOptions) []exportedChat {
+    var chats []exportedChat
+    for _, jid := range jids {
+        var msgs []Message
+        for _, m := range a.getMessagesForChat(jid) {
+            if opts.From > 0 && m.Timestamp < opts.From {
+                continue
+            }
+            if opts.To > 0 && m.Timestamp > opts.To {
+                continue
+            }
+            msgs = append(msgs, m)
+        }
+        if len(msgs) == 0 {
+            continue
+        }
+        chats = append(chats, exportedChat{
+            JID: jid, Name: a.chatDisplayName(jid), IsGroup: len(jid) > 15, Messages: msgs,
+            media: exportMediaNames(msgs),
+        })
+    }
+    return chats
+}
+
+// exportMediaNames names the locally available media files of msgs for
+// an export. Files are named after their base name; different files with
+// the same base name get a number added.
+func exportMediaNames(msgs []Message) map[string]string {
+    names := make(map[string]string)
+    taken := make(map[string]bool)
+    for _, m := range msgs {
+        if m.LocalPath == "" || names[m.LocalPath] != "" {
+            continue
+        }
+        if _, err := os.Stat(m.LocalPath); err != nil {
+            continue
+        }
+        name := filepath.Base(m.LocalPath)
+        ext := filepath.Ext(name)
+        for i := 2; taken[name]; i++ {
+            name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(filepath.Base(m.LocalPath), ext), i, ext)
+        }
+        taken[name] = true
+        names[m.LocalPath] = name
+    }
+    return names
+}
+
+// MediaName is the file name a message's media gets inside the export, or
+// "" if the file isn't available locally.
+func (chat exportedChat) MediaName(m Message) string {
+    if m.LocalPath == "" {
+        return ""
+    }
+    return chat.media[m.LocalPath]
+}
+
+// writeChatText writes the chat in the format of WhatsApp's Android
+// "Export chat", so the file can be read back by the importer and by
+// other tools that understand _chat.txt. Media is only named when the
+// files are next to it in a zip.
+func (a *Account) writeChatText(w io.Writer, chat exportedChat, withMedia bool) error {
+    for _, m := range chat.Messages {
+        ts := time.Unix(m.Timestamp, 0).Format("02/01/2006, 15:04")
+        text := m.Text
+        if m.MediaType != "" {
+            attachment := chat.MediaName(m)
+            if attachment != "" && withMedia {
+                attachment += " (file attached)"
+            } else {
+                attachment = "<Media omitted>"
+            }
+            if text != "" {
+                text = attachment + "\n" + text
+            } else {
+                text = attachment
+            }
+        }
+        if _, err := fmt.Fprintf(w, "%s - %s: %s\n", ts, a.exportSenderName(m), text); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+var exportHTMLTemplate = template.Must(template.New("chat").Funcs(template.FuncMap{
+    "time":   func(ts int64) string { return time.Unix(ts, 0).Format("2006-01-02 15:04") },
+    "sender": func(a *Account, m Message) string { return a.exportSenderName(m) },
+    "lines":  func(s string) []string { return strings.Split(s, "\n") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<style>
+body { font-family: sans-serif; background: #ece5dd; margin: 0; padding: 1em; }
+h1 { font-size: 1.2em; }
+.msg { max-width: 70%; margin: 0.3em 0; padding: 0.4em 0.6em; border-radius: 6px; background: #fff; clear: both; }
+.me { background: #dcf8c6; float: right; }
+.other { float: left; }
+.sender { font-weight: bold; font-size: 0.85em; color: #075e54; }
+.time { font-size: 0.75em; color: #777; text-align: right; }
+img, video { max-width: 100%; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+{{range .Messages}}<div class="msg {{if .FromMe}}me{{else}}other{{end}}">
+<div class="sender">{{sender $.Account .}}</div>
+{{$m := $.MediaName .}}{{if and $m $.Zip}}{{if eq .MediaType "image" "sticker"}}<img src="{{$m}}" alt="{{$m}}">{{else if eq .MediaType "video"}}<video src="{{$m}}" controls></video>{{else if eq .MediaType "audio"}}<audio src="{{$m}}" controls></audio>{{else}}<a href="{{$m}}">{{$m}}</a>{{end}}{{else if .MediaType}}<i>[{{.MediaType}}{{with $m}}: {{.}}{{end}}]</i>{{end}}
+{{range lines .Text}}<div>{{.}}</div>{{end}}
+<div class="time">{{time .Timestamp}}</div>
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+// writeChatHTML renders a transcript with inline styles. Media is only
+// embedded when the files sit next to it in a zip.
+func (a *Account) writeChatHTML(w io.Writer, chat exportedChat, withMedia bool) error {
+    return exportHTMLTemplate.Execute(w, struct {
+        exportedChat
+        Zip     bool
+        Account *Account
+    }{chat, withMedia, a})
+}
+
+func (a *Account) writeChat(w io.Writer, chat exportedChat, opts ExportOptions) error {
+    switch opts.Format {
+    case "html":
+        return a.writeChatHTML(w, chat, opts.Zip)
+    case "json":
+        enc := json.NewEncoder(w)
+        enc.SetIndent("", "  ")
+        return enc.Encode(chat)
+    default:
+        return a.writeChatText(w, chat, opts.Zip)
+    }
+}
+
+// exportDirName gives each chat its own folder inside a zip export.
+func exportDirName(chat exportedChat) string {
+    name := strings.Map(func(r rune) rune {
+        if strings.ContainsRune(`/\:*?"<>|`, r) || r < 32 {
+            return '_'
+        }
+        return r
+    }, chat.Name)
+    if name == chat.JID {
+        return chat.JID
+    }
+    return name + " (" + chat.JID + ")"
+}
+
+func addFileToZip(zw *zip.Writer, name, path string) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    out, err := zw.Create(name)
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(out, f)
+    return err
+}
+
+// exportChats writes the selected chats to w. Without zip only a single
+// chat can be exported as text or HTML; JSON holds any number of chats.
+func (a *Account) exportChats(w io.Writer, jids []string, opts ExportOptions) error {
+    chats := a.collectExport(jids, opts)
+    if !opts.Zip {
+        if opts.Format == "json" {
+            enc := json.NewEncoder(w)
+            enc.SetIndent("", "  ")
+            if len(jids) == 1 {
+                if len(chats) == 0 {
+                    return enc.Encode(exportedChat{JID: jids[0], Name: a.chatDisplayName(jids[0]), Messages: []Message{}})
+                }
+                return enc.Encode(chats[0])
+            }
+            return enc.Encode(chats)
+        }
+        if len(jids) != 1 {
+            return fmt.Errorf("exporting several chats as %s needs zip", opts.Format)
+        }
+        if len(chats) == 0 {
+            chats = append(chats, exportedChat{JID: jids[0], Name: a.chatDisplayName(jids[0])})
+        }
+        return a.writeChat(w, chats[0], opts)
+    }
+
+    zw := zip.NewWriter(w)
+    for _, chat := range chats {
+        dir := ""
+        if len(jids) > 1 {
+            dir = exportDirName(chat) + "/"
+        }
+        out, err := zw.Create(dir + exportFileName(opts.Format))
+        if err != nil {
+            return err
+        }
+        if err := a.writeChat(out, chat, opts); err != nil {
+            return err
+        }
+        added := make(map[string]bool)
+        for _, m := range chat.Messages {
+            name := chat.MediaName(m)
+            if name == "" || added[m.LocalPath] {
+                continue
+            }
+            added[m.LocalPath] = true
+            if err := addFileToZip(zw, dir+name, m.LocalPath); err != nil {
+                a.log.Warn("export: skipping media", "path", m.LocalPath, "err", err)
+            }
+        }
+    }
+    return zw.Close()
+}
+
+// exportOptionsFromQuery reads format, zip, from and to from an export
+// request.
+func exportOptionsFromQuery(q url.Values) (ExportOptions, error) {
+    opts := ExportOptions{Format: q.Get("format"), Zip: q.Get("zip") == "1" || q.Get("zip") == "true"}
+    if opts.Format == "" {
+        opts.Format = "txt"
+    }
+    if opts.Format != "txt" && opts.Format != "html" && opts.Format != "json" {
+        return opts, fmt.Errorf("format must be txt, html or json")
+    }
+    var err error
+    if opts.From, err = parseExportDate(q.Get("from"), false); err != nil {
+        return opts, err
+    }
+    if opts.To, err = parseExportDate(q.Get("to"), true); err != nil {
+        return opts, err
+    }
+    return opts, nil
+}
+
+// serveExport streams an export of one chat, or of all chats when jid is
+// empty, as a download.
+func (a *Account) serveExport(w http.ResponseWriter, jid string, opts ExportOptions) {
+    jids := a.allChatJIDs()
+    name := "whatsapp-export"
+    if jid != "" {
+        jids = []string{jid}
+        name = "WhatsApp Chat - " + a.chatDisplayName(jid)
+    } else if opts.Format != "json" {
+        // several chats in text or HTML only make sense as a zip
+        opts.Zip = true
+    }
+    ext := "." + opts.Format
+    if opts.Zip {
+        ext = ".zip"
+        w.Header().Set("Content-Type", "application/zip")
+    } else {
+        w.Header().Set("Content-Type", getMimeType(ext))
+    }
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+ext))
+    if err := a.exportChats(w, jids, opts); err != nil {
+        a.log.Error("export failed", "err", err)
+    }
+}
+
+// parseExportDate accepts unix seconds or YYYY-MM-DD. For a date, endOfDay
+// moves the result to the last second of that day.
+func parseExportDate(s string, endOfDay bool) (int64, error) {
+    if s == "" {
+        return 0, nil
+    }
+    if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+        if endOfDay {
+            t = t.Add(24*time.Hour - time.Second)
+        }
+        return t.Unix(), nil
+    }
+    var ts int64
+    if _, err := fmt.Sscanf(s, "%d", &ts); err != nil {
+        return 0, fmt.Errorf("invalid date %q", s)
+    }
+    return ts, nil
+}
+
+func (a *Account) allChatJIDs() []string {
+    a.msgMutex.RLock()
+    defer a.msgMutex.RUnlock()
+    seen := make(map[string]bool)
+    var jids []string
+    for _, m := range a.messages {
+        jid := m.ChatJID
+        if jid == "" {
+            jid = m.Sender
+        }
+        if !seen[jid] {
+            seen[jid] = true
+            jids = append(jids, jid)
+        }
+    }
+    return jids
+}
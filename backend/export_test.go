@@ -0,0 +1,68 @@
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestExportZipMediaNames(t *testing.T) {
+    b := newTestBackend(t)
+    a, _ := b.paired("491700000000")
+    dir := t.TempDir()
+    var paths []string
+    for _, sub := range []string{"one", "two"} {
+        path := filepath.Join(dir, sub, "photo.jpg")
+        os.MkdirAll(filepath.Dir(path), 0700)
+        if err := os.WriteFile(path, []byte(sub), 0600); err != nil {
+            t.Fatal(err)
+        }
+        paths = append(paths, path)
+    }
+    a.addMessages([]Message{
+        {ID: "M1", ChatJID: alice.User, Sender: alice.User, MediaType: "image", LocalPath: paths[0], Timestamp: 1000},
+        {ID: "M2", ChatJID: alice.User, Sender: alice.User, MediaType: "image", LocalPath: paths[1], Timestamp: 1001},
+        // The same file again is the same entry
+        {ID: "M3", ChatJID: alice.User, Sender: alice.User, MediaType: "image", LocalPath: paths[0], Timestamp: 1002},
+    })
+
+    var buf bytes.Buffer
+    if err := a.exportChats(&buf, []string{alice.User}, ExportOptions{Format: "txt", Zip: true}); err != nil {
+        t.Fatal(err)
+    }
+    zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    files := make(map[string]string)
+    for _, zf := range zr.File {
+        r, err := zf.Open()
+        if err != nil {
+            t.Fatal(err)
+        }
+        data, _ := io.ReadAll(r)
+        r.Close()
+        files[zf.Name] = string(data)
+    }
+    if len(files) != 3 || files["photo.jpg"] != "one" || files["photo-2.jpg"] != "two" {
+        t.Errorf("zip entries = %v", files)
+    }
+    lines := strings.Split(strings.TrimSpace(files["_chat.txt"]), "\n")
+    if len(lines) != 3 || !strings.HasSuffix(lines[0], ": photo.jpg (file attached)") ||
+        !strings.HasSuffix(lines[1], ": photo-2.jpg (file attached)") || !strings.HasSuffix(lines[2], ": photo.jpg (file attached)") {
+        t.Errorf("transcript = %q", lines)
+    }
+
+    // Without a zip the files aren't there to name
+    buf.Reset()
+    if err := a.exportChats(&buf, []string{alice.User}, ExportOptions{Format: "txt"}); err != nil {
+        t.Fatal(err)
+    }
+    if text := buf.String(); strings.Contains(text, "file attached") || strings.Count(text, "<Media omitted>") != 3 {
+        t.Errorf("transcript without zip = %q", text)
+    }
+}
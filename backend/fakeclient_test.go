@@ -0,0 +1,421 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "errors"
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+
+    "go.mau.fi/whatsmeow"
+    "go.mau.fi/whatsmeow/appstate"
+    "go.mau.fi/whatsmeow/proto/waAdv"
+    "go.mau.fi/whatsmeow/proto/waE2E"
+    "go.mau.fi/whatsmeow/proto/waSyncAction"
+    "go.mau.fi/whatsmeow/store"
+    "go.mau.fi/whatsmeow/types"
+    "go.mau.fi/whatsmeow/types/events"
+    waLog "go.mau.fi/whatsmeow/util/log"
+    "google.golang.org/protobuf/proto"
+)
+
+// fakeClient stands in for *whatsmeow.Client. It records what the backend
+// sends and replays scripted events to the registered handlers, in order
+// and synchronously like the real client does.
+type fakeClient struct {
+    device *store.Device
+
+    mu        sync.Mutex
+    handlers  map[uint32]whatsmeow.EventHandler
+    nextID    uint32
+    connected bool
+    nextMsgID int
+    ready     chan struct{} // closed once the first Connect is done
+
+    // What the backend did
+    calls    []string
+    sent     []fakeSent
+    uploads  [][]byte
+    reads    []fakeRead
+    patches  []appstate.PatchInfo
+
+    // Scripted answers
+    pairCode string
+    media    map[string][]byte // Download contents by direct path
+    pictures map[types.JID]*types.ProfilePictureInfo
+    groups   []*types.GroupInfo
+    users    map[string]types.JID // numbers IsOnWhatsApp knows
+    errs     map[string]error     // per method name
+    sendGate chan struct{}        // while set, SendMessage waits for it
+}
+
+type fakeSent struct {
+    To      types.JID
+    Message *waE2E.Message
+}
+
+type fakeRead struct {
+    Chat types.JID
+    IDs  []types.MessageID
+}
+
+var _ WAClient = (*fakeClient)(nil)
+
+func newFakeClient(device *store.Device) *fakeClient {
+    return &fakeClient{
+        device:   device,
+        handlers: make(map[uint32]whatsmeow.EventHandler),
+        ready:    make(chan struct{}),
+        pairCode: "FAKE-CODE",
+        media:    make(map[string][]byte),
+        pictures: make(map[types.JID]*types.ProfilePictureInfo),
+        users:    make(map[string]types.JID),
+        errs:     make(map[string]error),
+    }
+}
+
+// useFakeClients makes every account opened during the test get a fake.
+func useFakeClients(t *testing.T) {
+    t.Helper()
+    old := newClient
+    newClient = func(device *store.Device, log waLog.Logger) WAClient {
+        return newFakeClient(device)
+    }
+    t.Cleanup(func() { newClient = old })
+}
+
+func fakeOf(t *testing.T, a *Account) *fakeClient {
+    t.Helper()
+    f, ok := a.client.(*fakeClient)
+    if !ok {
+        t.Fatalf("account %s has no fake client", a.ID)
+    }
+    return f
+}
+
+// call records a method call and returns the error scripted for it.
+func (f *fakeClient) call(name string) error {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.calls = append(f.calls, name)
+    return f.errs[name]
+}
+
+func (f *fakeClient) Calls(name string) int {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    n := 0
+    for _, c := range f.calls {
+        if c == name {
+            n++
+        }
+    }
+    return n
+}
+
+func (f *fakeClient) Fail(name string, err error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.errs[name] = err
+}
+
+// HoldSends makes SendMessage wait until release is called or its context
+// ends.
+func (f *fakeClient) HoldSends() (release func()) {
+    gate := make(chan struct{})
+    f.mu.Lock()
+    f.sendGate = gate
+    f.mu.Unlock()
+    return func() { close(gate) }
+}
+
+func (f *fakeClient) Sent() []fakeSent {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return append([]fakeSent(nil), f.sent...)
+}
+
+// Replay hands events to the handlers one after the other.
+func (f *fakeClient) Replay(evts ...interface{}) {
+    for _, evt := range evts {
+        f.mu.Lock()
+        handlers := make([]whatsmeow.EventHandler, 0, len(f.handlers))
+        for i := uint32(1); i <= f.nextID; i++ {
+            if h, ok := f.handlers[i]; ok {
+                handlers = append(handlers, h)
+            }
+        }
+        f.mu.Unlock()
+        for _, h := range handlers {
+            h(evt)
+        }
+    }
+}
+
+// Pair completes a pairing the way the server does: the device gets its
+// JID and is saved, then PairSuccess and Connected follow.
+func (f *fakeClient) Pair(t *testing.T, phone string) types.JID {
+    t.Helper()
+    // Accounts connect in the background; pairing happens after that
+    select {
+    case <-f.ready:
+    case <-time.After(5 * time.Second):
+        t.Fatal("account never connected")
+    }
+    jid := types.NewADJID(phone, 0, 1)
+    f.device.ID = &jid
+    f.device.PushName = "Me"
+    f.device.Account = &waAdv.ADVSignedDeviceIdentity{
+        Details: []byte{}, AccountSignature: make([]byte, 64), AccountSignatureKey: make([]byte, 32),
+        DeviceSignature: make([]byte, 64),
+    }
+    if err := f.device.Save(context.Background()); err != nil {
+        t.Fatalf("saving paired device: %v", err)
+    }
+    f.mu.Lock()
+    f.connected = true
+    f.mu.Unlock()
+    f.Replay(&events.PairSuccess{ID: jid}, &events.Connected{})
+    return jid
+}
+
+func (f *fakeClient) Connect() error {
+    if err := f.call("Connect"); err != nil {
+        return err
+    }
+    f.mu.Lock()
+    f.connected = true
+    f.mu.Unlock()
+    // Unpaired, the real client waits for pairing before it is connected
+    if f.device.ID != nil {
+        f.Replay(&events.Connected{})
+    }
+    f.mu.Lock()
+    select {
+    case <-f.ready:
+    default:
+        close(f.ready)
+    }
+    f.mu.Unlock()
+    return nil
+}
+
+func (f *fakeClient) Disconnect() {
+    f.call("Disconnect")
+    f.mu.Lock()
+    f.connected = false
+    f.mu.Unlock()
+}
+
+func (f *fakeClient) IsConnected() bool {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.connected
+}
+
+func (f *fakeClient) AddEventHandler(handler whatsmeow.EventHandler) uint32 {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.nextID++
+    f.handlers[f.nextID] = handler
+    return f.nextID
+}
+
+func (f *fakeClient) RemoveEventHandlers() {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.handlers = make(map[uint32]whatsmeow.EventHandler)
+}
+
+func (f *fakeClient) PairPhone(ctx context.Context, phone string, showPushNotification bool, clientType whatsmeow.PairClientType, clientDisplayName string) (string, error) {
+    if err := f.call("PairPhone"); err != nil {
+        return "", err
+    }
+    if !f.IsConnected() {
+        return "", whatsmeow.ErrNotConnected
+    }
+    return f.pairCode, nil
+}
+
+func (f *fakeClient) Logout(ctx context.Context) error {
+    if err := f.call("Logout"); err != nil {
+        return err
+    }
+    if f.device.ID == nil {
+        return whatsmeow.ErrNotLoggedIn
+    }
+    if !f.IsConnected() {
+        return whatsmeow.ErrNotConnected
+    }
+    f.Disconnect()
+    return f.device.Delete(ctx)
+}
+
+func (f *fakeClient) SendMessage(ctx context.Context, to types.JID, message *waE2E.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+    if err := f.call("SendMessage"); err != nil {
+        return whatsmeow.SendResponse{}, err
+    }
+    f.mu.Lock()
+    gate := f.sendGate
+    f.mu.Unlock()
+    if gate != nil {
+        select {
+        case <-gate:
+        case <-ctx.Done():
+            return whatsmeow.SendResponse{}, ctx.Err()
+        }
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.nextMsgID++
+    f.sent = append(f.sent, fakeSent{To: to, Message: message})
+    return whatsmeow.SendResponse{ID: fmt.Sprintf("SENT%04d", f.nextMsgID), Timestamp: time.Now()}, nil
+}
+
+func (f *fakeClient) MarkRead(ctx context.Context, ids []types.MessageID, timestamp time.Time, chat, sender types.JID, receiptTypeExtra ...types.ReceiptType) error {
+    if err := f.call("MarkRead"); err != nil {
+        return err
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.reads = append(f.reads, fakeRead{Chat: chat, IDs: ids})
+    return nil
+}
+
+func (f *fakeClient) SendAppState(ctx context.Context, patch appstate.PatchInfo) error {
+    if err := f.call("SendAppState"); err != nil {
+        return err
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.patches = append(f.patches, patch)
+    return nil
+}
+
+// Upload keeps the plaintext; downloading the returned direct path gives
+// it back.
+func (f *fakeClient) Upload(ctx context.Context, plaintext []byte, appInfo whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+    if err := f.call("Upload"); err != nil {
+        return whatsmeow.UploadResponse{}, err
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.uploads = append(f.uploads, plaintext)
+    sum := sha256.Sum256(plaintext)
+    path := fmt.Sprintf("/v/t62/%x", sum[:8])
+    f.media[path] = plaintext
+    return whatsmeow.UploadResponse{
+        URL: "https://mmg.example" + path, DirectPath: path,
+        MediaKey: make([]byte, 32), FileSHA256: sum[:], FileEncSHA256: sum[:],
+        FileLength: uint64(len(plaintext)),
+    }, nil
+}
+
+func (f *fakeClient) Download(ctx context.Context, msg whatsmeow.DownloadableMessage) ([]byte, error) {
+    if err := f.call("Download"); err != nil {
+        return nil, err
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    data, ok := f.media[msg.GetDirectPath()]
+    if !ok {
+        return nil, whatsmeow.ErrMediaDownloadFailedWith404
+    }
+    return data, nil
+}
+
+func (f *fakeClient) GetProfilePictureInfo(ctx context.Context, jid types.JID, params *whatsmeow.GetProfilePictureParams) (*types.ProfilePictureInfo, error) {
+    if err := f.call("GetProfilePictureInfo"); err != nil {
+        return nil, err
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    pic, ok := f.pictures[jid.ToNonAD()]
+    if !ok {
+        return nil, whatsmeow.ErrProfilePictureNotSet
+    }
+    return pic, nil
+}
+
+func (f *fakeClient) GetJoinedGroups(ctx context.Context) ([]*types.GroupInfo, error) {
+    if err := f.call("GetJoinedGroups"); err != nil {
+        return nil, err
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.groups, nil
+}
+
+func (f *fakeClient) GetUserInfo(ctx context.Context, jids []types.JID) (map[types.JID]types.UserInfo, error) {
+    if err := f.call("GetUserInfo"); err != nil {
+        return nil, err
+    }
+    result := make(map[types.JID]types.UserInfo, len(jids))
+    for _, jid := range jids {
+        result[jid] = types.UserInfo{Status: "Hey there"}
+    }
+    return result, nil
+}
+
+func (f *fakeClient) IsOnWhatsApp(ctx context.Context, phones []string) ([]types.IsOnWhatsAppResponse, error) {
+    if err := f.call("IsOnWhatsApp"); err != nil {
+        return nil, err
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    result := make([]types.IsOnWhatsAppResponse, len(phones))
+    for i, phone := range phones {
+        jid, ok := f.users[phone]
+        result[i] = types.IsOnWhatsAppResponse{Query: phone, JID: jid, IsIn: ok}
+    }
+    return result, nil
+}
+
+var errFakeOffline = errors.New("fake: offline")
+
+// Recorded events, shaped like what whatsmeow delivers
+
+func textEvent(chat, sender types.JID, id, text string, ts int64) *events.Message {
+    return &events.Message{
+        Info: types.MessageInfo{
+            MessageSource: types.MessageSource{Chat: chat, Sender: sender, IsGroup: chat.Server == types.GroupServer},
+            ID:            id,
+            PushName:      "Alice",
+            Timestamp:     time.Unix(ts, 0),
+        },
+        Message: &waE2E.Message{Conversation: proto.String(text)},
+    }
+}
+
+func imageEvent(chat, sender types.JID, id, caption, directPath string, size uint64, ts int64) *events.Message {
+    return &events.Message{
+        Info: types.MessageInfo{
+            MessageSource: types.MessageSource{Chat: chat, Sender: sender},
+            ID:            id,
+            Timestamp:     time.Unix(ts, 0),
+        },
+        Message: &waE2E.Message{ImageMessage: &waE2E.ImageMessage{
+            Mimetype: proto.String("image/jpeg"), Caption: proto.String(caption),
+            DirectPath: proto.String(directPath), FileLength: proto.Uint64(size),
+        }},
+    }
+}
+
+func receiptEvent(chat, sender types.JID, fromMe bool, typ types.ReceiptType, ts int64, ids ...types.MessageID) *events.Receipt {
+    return &events.Receipt{
+        MessageSource: types.MessageSource{Chat: chat, Sender: sender, IsFromMe: fromMe},
+        MessageIDs:    ids,
+        Timestamp:     time.Unix(ts, 0),
+        Type:          typ,
+    }
+}
+
+func archiveAction(archived bool) *waSyncAction.ArchiveChatAction {
+    return &waSyncAction.ArchiveChatAction{Archived: proto.Bool(archived)}
+}
+
+func pinAction(pinned bool) *waSyncAction.PinAction {
+    return &waSyncAction.PinAction{Pinned: proto.Bool(pinned)}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "net"
+    "path/filepath"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/godbus/dbus/v5"
+)
+
+// fakeSecretsDaemon serves the parts of the Sailfish Secrets peer-to-peer
+// API the backend uses, keeping secrets in memory.
+type fakeSecretsDaemon struct {
+    Address string
+
+    listener net.Listener
+
+    mu          sync.Mutex
+    collections map[string]bool
+    // Collections that ask for the device lock code on every read
+    relocking map[string]bool
+    secrets     map[secretIdentifier][]byte
+    calls       []string
+    // Set to make every method wait before answering
+    delay time.Duration
+    // Replaces the exported methods, to send malformed replies
+    methods map[string]interface{}
+    // Makes the user enter a wrong lock code when asked
+    denyInput bool
+    // Results returned instead of doing the work, by D-Bus method name
+    failures map[string]secretsResult
+
+    conns []*dbus.Conn
+}
+
+func newFakeSecretsDaemon(t *testing.T) *fakeSecretsDaemon {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "p2p")
+    l, err := net.Listen("unix", path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    d := &fakeSecretsDaemon{
+        Address:     "unix:path=" + path,
+        listener:    l,
+        collections: make(map[string]bool),
+        relocking:   make(map[string]bool),
+        secrets:     make(map[secretIdentifier][]byte),
+        failures:    make(map[string]secretsResult),
+    }
+    go d.serve()
+    t.Cleanup(d.Close)
+    return d
+}
+
+func (d *fakeSecretsDaemon) Close() {
+    d.listener.Close()
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    for _, c := range d.conns {
+        c.Close()
+    }
+}
+
+// D-Bus names of the exported methods
+var fakeSecretsMethods = map[string]string{
+    "CreateCollection": "createCollection",
+    "SetSecret":        "setSecret",
+    "GetSecret":        "getSecret",
+    "DeleteSecret":     "deleteSecret",
+}
+
+func (d *fakeSecretsDaemon) serve() {
+    for {
+        nc, err := d.listener.Accept()
+        if err != nil {
+            return
+        }
+        go d.serveConn(nc)
+    }
+}
+
+func (d *fakeSecretsDaemon) serveConn(nc net.Conn) {
+    if err := serverHandshake(nc); err != nil {
+        nc.Close()
+        return
+    }
+    // godbus only has the client side of the handshake. It runs against
+    // canned answers here, after which the connection is passed through.
+    conn, err := dbus.NewConn(&authShim{Conn: nc})
+    if err != nil {
+        nc.Close()
+        return
+    }
+    if err := conn.Auth([]dbus.Auth{dbus.AuthAnonymous()}); err != nil {
+        conn.Close()
+        return
+    }
+    d.mu.Lock()
+    d.conns = append(d.conns, conn)
+    methods := d.methods
+    d.mu.Unlock()
+    if methods != nil {
+        conn.ExportMethodTable(methods, SECRETS_PATH, SECRETS_INTERFACE)
+    } else {
+        conn.ExportWithMap(d, fakeSecretsMethods, SECRETS_PATH, SECRETS_INTERFACE)
+    }
+}
+
+func readAuthLine(r io.Reader) (string, error) {
+    var line []byte
+    b := make([]byte, 1)
+    for !bytes.HasSuffix(line, []byte("\r\n")) {
+        if _, err := r.Read(b); err != nil {
+            return "", err
+        }
+        if len(line) == 0 && b[0] == 0 {
+            continue
+        }
+        line = append(line, b[0])
+    }
+    return string(line[:len(line)-2]), nil
+}
+
+// serverHandshake answers the client's SASL exchange, accepting anyone.
+// It reads byte by byte so no message data is consumed.
+func serverHandshake(nc net.Conn) error {
+    nc.SetDeadline(time.Now().Add(5 * time.Second))
+    defer nc.SetDeadline(time.Time{})
+    for {
+        line, err := readAuthLine(nc)
+        if err != nil {
+            return err
+        }
+        var reply string
+        switch {
+        case line == "AUTH":
+            reply = "REJECTED EXTERNAL ANONYMOUS"
+        case bytes.HasPrefix([]byte(line), []byte("AUTH ")):
+            reply = "OK 0123456789abcdef0123456789abcdef"
+        case line == "NEGOTIATE_UNIX_FD":
+            reply = "ERROR"
+        case line == "BEGIN":
+            return nil
+        default:
+            reply = "ERROR"
+        }
+        if _, err := nc.Write([]byte(reply + "\r\n")); err != nil {
+            return err
+        }
+    }
+}
+
+// authShim answers the handshake of the server's own *dbus.Conn and then
+// passes everything through to the socket.
+type authShim struct {
+    net.Conn
+    mu      sync.Mutex
+    pending []byte
+    done    bool
+}
+
+func (a *authShim) Write(p []byte) (int, error) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if a.done {
+        return a.Conn.Write(p)
+    }
+    line := string(bytes.TrimPrefix(p, []byte{0}))
+    switch {
+    case line == "":
+    case line == "AUTH\r\n":
+        a.pending = append(a.pending, "REJECTED ANONYMOUS\r\n"...)
+    case bytes.HasPrefix(p, []byte("AUTH ")):
+        a.pending = append(a.pending, "OK 0123456789abcdef0123456789abcdef\r\n"...)
+    case line == "BEGIN\r\n":
+        a.done = true
+    }
+    return len(p), nil
+}
+
+func (a *authShim) Read(p []byte) (int, error) {
+    a.mu.Lock()
+    if len(a.pending) > 0 {
+        n := copy(p, a.pending)
+        a.pending = a.pending[n:]
+        a.mu.Unlock()
+        return n, nil
+    }
+    a.mu.Unlock()
+    return a.Conn.Read(p)
+}
+
+func (d *fakeSecretsDaemon) record(method string) {
+    d.mu.Lock()
+    d.calls = append(d.calls, method)
+    delay := d.delay
+    d.mu.Unlock()
+    time.Sleep(delay)
+}
+
+func (d *fakeSecretsDaemon) Calls() []string {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return append([]string(nil), d.calls...)
+}
+
+// Fail makes method answer with result until cleared with a succeeded one.
+func (d *fakeSecretsDaemon) Fail(method string, result secretsResult) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if result.Code == RESULT_SUCCEEDED {
+        delete(d.failures, method)
+    } else {
+        d.failures[method] = result
+    }
+}
+
+func succeeded() secretsResult {
+    return secretsResult{Code: RESULT_SUCCEEDED}
+}
+
+// failed is a failed Result with the daemon's error code for the case
+func failed(code int32, format string, args ...interface{}) secretsResult {
+    return secretsResult{Code: RESULT_FAILED, ErrorCode: code, ErrorMessage: fmt.Sprintf(format, args...)}
+}
+
+func (d *fakeSecretsDaemon) CreateCollection(name, storagePlugin, encryptionPlugin string, unlock, access secretsEnum) (secretsResult, *dbus.Error) {
+    d.record("createCollection")
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if d.collections[name] {
+        return failed(ERROR_COLLECTION_EXISTS, "collection %s exists", name), nil
+    }
+    d.collections[name] = true
+    d.relocking[name] = unlock.Value != DEVICE_LOCK_KEEP_UNLOCKED
+    return succeeded(), nil
+}
+
+func (d *fakeSecretsDaemon) SetSecret(secret sailfishSecret, params interactionParameters, mode secretsEnum, address string) (secretsResult, *dbus.Error) {
+    d.record("setSecret")
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if r, ok := d.failures["setSecret"]; ok {
+        return r, nil
+    }
+    id := secret.Identifier
+    if !d.collections[id.CollectionName] {
+        return failed(ERROR_INVALID_COLLECTION, "no collection %s", id.CollectionName), nil
+    }
+    if _, ok := d.secrets[id]; ok {
+        return failed(ERROR_SECRET_EXISTS, "secret %s exists", id.Name), nil
+    }
+    d.secrets[id] = secret.Data
+    return succeeded(), nil
+}
+
+func (d *fakeSecretsDaemon) GetSecret(id secretIdentifier, mode secretsEnum, address string) (secretsResult, sailfishSecret, *dbus.Error) {
+    d.record("getSecret")
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if r, ok := d.failures["getSecret"]; ok {
+        return r, sailfishSecret{FilterData: map[string]string{}}, nil
+    }
+    data, ok := d.secrets[id]
+    if ok && d.relocking[id.CollectionName] {
+        d.calls = append(d.calls, "prompt")
+        if d.denyInput {
+            return failed(ERROR_COLLECTION_LOCKED, "wrong lock code"), sailfishSecret{FilterData: map[string]string{}}, nil
+        }
+    }
+    if !ok {
+        return failed(ERROR_INVALID_SECRET, "no secret %s", id.Name), sailfishSecret{FilterData: map[string]string{}}, nil
+    }
+    return succeeded(), sailfishSecret{Identifier: id, Data: data, FilterData: map[string]string{}}, nil
+}
+
+func (d *fakeSecretsDaemon) DeleteSecret(id secretIdentifier, mode secretsEnum, address string) (secretsResult, *dbus.Error) {
+    d.record("deleteSecret")
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if r, ok := d.failures["deleteSecret"]; ok {
+        return r, nil
+    }
+    if _, ok := d.secrets[id]; !ok {
+        return failed(ERROR_INVALID_SECRET, "no secret %s", id.Name), nil
+    }
+    delete(d.secrets, id)
+    return succeeded(), nil
+}
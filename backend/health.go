@@ -0,0 +1,81 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "time"
+)
+
+const healthTimeout = 5 * time.Second
+
+// HealthCheck is one line of /healthz. Status is "ok", "fail" or "skip".
+type HealthCheck struct {
+    Name   string `json:"name"`
+    Status string `json:"status"`
+    Detail string `json:"detail,omitempty"`
+}
+
+type HealthResponse struct {
+    Status string        `json:"status"`
+    Checks []HealthCheck `json:"checks"`
+}
+
+// checkHealth looks at the database, each account's connection and its
+// persistence worker. While locked nothing is open, which is not a fault.
+func checkHealth(ctx context.Context) HealthResponse {
+    var checks []HealthCheck
+    add := func(name string, err error) {
+        c := HealthCheck{Name: name, Status: "ok"}
+        if err != nil {
+            c.Status, c.Detail = "fail", err.Error()
+        }
+        checks = append(checks, c)
+    }
+
+    if shuttingDown.Load() {
+        add("shutdown", fmt.Errorf("shutting down"))
+    }
+
+    if isLocked() {
+        checks = append(checks, HealthCheck{Name: "database", Status: "skip", Detail: "locked"})
+    } else if container == nil {
+        add("database", fmt.Errorf("not open"))
+    } else {
+        dbCtx, cancel := context.WithTimeout(ctx, healthTimeout)
+        _, err := container.GetAllDevices(dbCtx)
+        cancel()
+        add("database", err)
+    }
+
+    for _, a := range allAccounts() {
+        var err error
+        if !a.client.IsConnected() {
+            err = fmt.Errorf("disconnected")
+        }
+        add("connection:"+a.ID, err)
+        add("persistence:"+a.ID, a.persister.Health())
+    }
+
+    status := "ok"
+    for _, c := range checks {
+        if c.Status == "fail" {
+            status = "fail"
+        }
+    }
+    return HealthResponse{Status: status, Checks: checks}
+}
+
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "GET required", 405)
+        return
+    }
+    health := checkHealth(r.Context())
+    w.Header().Set("Content-Type", "application/json")
+    if health.Status != "ok" {
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }
+    json.NewEncoder(w).Encode(health)
+}
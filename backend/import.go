@@ -0,0 +1,442 @@
+package main
+
+import (
+    "archive/zip"
+    "bufio"
+    "crypto/sha1"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// ImportResult is what /import reports back.
+type ImportResult struct {
+    ChatJID  string   `json:"chatJid"`
+    Imported int      `json:"imported"`
+    Skipped  int      `json:"skipped"`
+    Media    int      `json:"media"`
+    Unmapped []string `json:"unmapped,omitempty"` // senders we couldn't match to a contact
+}
+
+// ImportOptions tells the importer which chat the archive belongs to and
+// which sender name is the user. Both are guessed when left empty.
+type ImportOptions struct {
+    ChatJID string
+    Me      string
+}
+
+type parsedLine struct {
+    a, b, c      int // the three date fields, order depends on locale
+    hour, minute int
+    second       int
+    sender       string
+    text         string
+}
+
+// Matches the header of a message line in both the Android
+// ("31/12/2020, 23:59 - Name: text") and the iOS
+// ("[31.12.20, 23:59:59] Name: text") export formats, with 12 or 24 hour
+// clocks.
+var importLineRe = regexp.MustCompile(`^\[?(\d{1,4})[./-](\d{1,2})[./-](\d{1,4}),? (\d{1,2})[:.](\d{2})(?:[:.](\d{2}))?\s*([AaPp]\.?\s?[Mm]\.?)?\]?(?: -|:)? (.*)$`)
+
+// Attachment markers used by the various apps and languages.
+var importAttachmentRes = []*regexp.Regexp{
+    regexp.MustCompile(`^<attached: (.+)>$`),
+    regexp.MustCompile(`^<Anhang: (.+)>$`),
+    regexp.MustCompile(`^(.+\.[A-Za-z0-9]{2,5}) \((?:file attached|Datei angehängt|archivo adjunto|fichier joint|file allegato|arquivo anexado)\)$`),
+}
+
+func cleanImportLine(s string) string {
+    s = strings.NewReplacer("\u200e", "", "\u200f", "", "\u202a", "", "\u202c", "", "\u202f", " ", "\u00a0", " ").Replace(s)
+    return strings.TrimRight(s, "\r")
+}
+
+func parseImportLines(r io.Reader) []parsedLine {
+    var lines []parsedLine
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+    for scanner.Scan() {
+        line := cleanImportLine(scanner.Text())
+        m := importLineRe.FindStringSubmatch(line)
+        if m == nil {
+            // Continuation of a multiline message
+            if len(lines) > 0 {
+                lines[len(lines)-1].text += "\n" + line
+            }
+            continue
+        }
+        var p parsedLine
+        p.a, _ = strconv.Atoi(m[1])
+        p.b, _ = strconv.Atoi(m[2])
+        p.c, _ = strconv.Atoi(m[3])
+        p.hour, _ = strconv.Atoi(m[4])
+        p.minute, _ = strconv.Atoi(m[5])
+        p.second, _ = strconv.Atoi(m[6])
+        if ampm := strings.ToLower(strings.NewReplacer(".", "", " ", "").Replace(m[7])); ampm != "" {
+            p.hour %= 12
+            if ampm == "pm" {
+                p.hour += 12
+            }
+        }
+        rest := m[8]
+        if idx := strings.Index(rest, ": "); idx > 0 {
+            p.sender = rest[:idx]
+            p.text = rest[idx+2:]
+        } else {
+            // System message ("Messages are end-to-end encrypted", ...)
+            p.text = rest
+        }
+        lines = append(lines, p)
+    }
+    return lines
+}
+
+// importDateOrder works out whether dates are year-first, day-first or
+// month-first by looking for fields that can't be a month. Day-first is
+// assumed when the file is ambiguous.
+func importDateOrder(lines []parsedLine) string {
+    monthFirst := false
+    for _, l := range lines {
+        if l.a > 31 {
+            return "ymd"
+        }
+        if l.a > 12 {
+            return "dmy"
+        }
+        if l.b > 12 {
+            monthFirst = true
+        }
+    }
+    if monthFirst {
+        return "mdy"
+    }
+    return "dmy"
+}
+
+func (p parsedLine) timestamp(order string) int64 {
+    var year, month, day int
+    switch order {
+    case "ymd":
+        year, month, day = p.a, p.b, p.c
+    case "mdy":
+        month, day, year = p.a, p.b, p.c
+    default:
+        day, month, year = p.a, p.b, p.c
+    }
+    if year < 100 {
+        year += 2000
+    }
+    return time.Date(year, time.Month(month), day, p.hour, p.minute, p.second, 0, time.Local).Unix()
+}
+
+// mapSenderToJID finds the JID for a sender name from the export, which is
+// either a contact name or a formatted phone number.
+func (a *Account) mapSenderToJID(name string) string {
+    if phone := normalizePhone(name); len(phone) >= 7 && strings.TrimLeft(name, "+0123456789 -()") == "" {
+        return phone
+    }
+    a.contactsMutex.RLock()
+    defer a.contactsMutex.RUnlock()
+    for jid, n := range a.contacts {
+        if strings.EqualFold(n, name) && len(jid) <= 15 {
+            return jid
+        }
+    }
+    return ""
+}
+
+// importMessageID derives a stable ID from a line of an export. The
+// line's position keeps repeated identical messages apart.
+func importMessageID(chatJid string, ts int64, sender, text string, line int) string {
+    sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%s|%s|%d", chatJid, ts, sender, text, line)))
+    return "import-" + hex.EncodeToString(sum[:8])
+}
+
+// importKey is what an export keeps of a message. Exports only have
+// minute precision, so timestamps are bucketed by minute.
+type importKey struct {
+    chat, sender, text, mediaType string
+    fromMe                        bool
+    minute                        int64
+}
+
+func newImportKey(m Message, minute int64) importKey {
+    return importKey{chat: m.ChatJID, sender: m.Sender, text: m.Text, mediaType: m.MediaType, fromMe: m.FromMe, minute: minute}
+}
+
+type importEntry struct {
+    id string
+    ts int64
+}
+
+// importIndex holds the messages a chat already has that no imported
+// message has matched yet, by ID and by content.
+type importIndex struct {
+    ids  map[string]importKey
+    keys map[importKey][]importEntry
+}
+
+func newImportIndex(existing []Message) *importIndex {
+    x := &importIndex{ids: make(map[string]importKey), keys: make(map[importKey][]importEntry)}
+    for _, m := range existing {
+        k := newImportKey(m, m.Timestamp/60)
+        x.ids[m.ID] = k
+        x.keys[k] = append(x.keys[k], importEntry{m.ID, m.Timestamp})
+    }
+    return x
+}
+
+func (x *importIndex) remove(k importKey, i int) {
+    entries := x.keys[k]
+    delete(x.ids, entries[i].id)
+    x.keys[k] = append(entries[:i:i], entries[i+1:]...)
+}
+
+// take finds an unmatched message the chat already has that m is a copy
+// of and marks it matched, so each one stands for one imported message
+// at most. Timestamps match within a minute, which can reach into the
+// neighbouring buckets.
+func (x *importIndex) take(m Message) bool {
+    if k, ok := x.ids[m.ID]; ok {
+        for i, e := range x.keys[k] {
+            if e.id == m.ID {
+                x.remove(k, i)
+                break
+            }
+        }
+        return true
+    }
+    for minute := m.Timestamp/60 - 1; minute <= m.Timestamp/60+1; minute++ {
+        k := newImportKey(m, minute)
+        for i, e := range x.keys[k] {
+            d := e.ts - m.Timestamp
+            if d < 0 {
+                d = -d
+            }
+            if d < 60 {
+                x.remove(k, i)
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func importMediaType(mimeType string) string {
+    switch {
+    case strings.HasPrefix(mimeType, "image/"):
+        return "image"
+    case strings.HasPrefix(mimeType, "video/"):
+        return "video"
+    case strings.HasPrefix(mimeType, "audio/"):
+        return "audio"
+    default:
+        return "document"
+    }
+}
+
+// splitAttachment separates an attachment marker from the caption that
+// may follow it on the next lines. Exports without media ("<Media
+// omitted>") are kept as plain text.
+func splitAttachment(text string) (attachment string, rest string) {
+    first, rest, _ := strings.Cut(text, "\n")
+    first = strings.TrimSpace(first)
+    for _, re := range importAttachmentRes {
+        if m := re.FindStringSubmatch(first); m != nil {
+            return m[1], rest
+        }
+    }
+    return "", text
+}
+
+// copyImportMedia stores an attachment from the archive in the media
+// directory for its type and returns the new path. Export file names
+// repeat across chats and phones, so the name gets the chat, and a file
+// already there is only reused if it has the same contents.
+func (a *Account) copyImportMedia(chatJid string, files map[string]*zip.File, name string) (string, error) {
+    f, ok := files[name]
+    if !ok {
+        return "", fmt.Errorf("not in archive")
+    }
+    sum, err := zipFileHash(f)
+    if err != nil {
+        return "", err
+    }
+    dir := a.getMediaDir(getMimeType(name))
+    base := "import_" + chatJid + "_" + filepath.Base(name)
+    ext := filepath.Ext(base)
+    path := filepath.Join(dir, base)
+    for i := 2; ; i++ {
+        existing, err := hashFile(path)
+        if os.IsNotExist(err) {
+            break
+        }
+        if err == nil && existing.SHA256 == sum {
+            return path, nil
+        }
+        path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(base, ext), i, ext))
+    }
+    in, err := f.Open()
+    if err != nil {
+        return "", err
+    }
+    defer in.Close()
+    out, err := os.Create(path)
+    if err != nil {
+        return "", err
+    }
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        os.Remove(path)
+        return "", err
+    }
+    return path, out.Close()
+}
+
+func zipFileHash(f *zip.File) (string, error) {
+    in, err := f.Open()
+    if err != nil {
+        return "", err
+    }
+    defer in.Close()
+    h := sha256.New()
+    if _, err := io.Copy(h, in); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// importChatArchive imports a WhatsApp "Export chat" archive at path:
+// either the zip with _chat.txt and media, or a bare _chat.txt. Archives
+// are read from the file as needed, never loaded whole.
+func (a *Account) importChatArchive(path string, opts ImportOptions) (*ImportResult, error) {
+    var chatText io.Reader
+    files := make(map[string]*zip.File)
+    if zr, err := zip.OpenReader(path); err == nil {
+        defer zr.Close()
+        var txt *zip.File
+        for _, f := range zr.File {
+            files[filepath.Base(f.Name)] = f
+            if strings.HasSuffix(f.Name, ".txt") && (txt == nil || filepath.Base(f.Name) == "_chat.txt") {
+                txt = f
+            }
+        }
+        if txt == nil {
+            return nil, fmt.Errorf("no chat text in archive")
+        }
+        rc, err := txt.Open()
+        if err != nil {
+            return nil, err
+        }
+        defer rc.Close()
+        chatText = rc
+    } else {
+        f, err := os.Open(path)
+        if err != nil {
+            return nil, err
+        }
+        defer f.Close()
+        chatText = f
+    }
+
+    lines := parseImportLines(chatText)
+    if len(lines) == 0 {
+        return nil, fmt.Errorf("no messages found")
+    }
+    order := importDateOrder(lines)
+
+    me := opts.Me
+    if me == "" {
+        me = a.device.PushName
+    }
+    ownJid := ""
+    if a.device.ID != nil {
+        ownJid = a.device.ID.User
+    }
+
+    result := &ImportResult{ChatJID: opts.ChatJID}
+    senders := make(map[string]string)
+    unmapped := make(map[string]bool)
+    for _, l := range lines {
+        if l.sender == "" {
+            continue
+        }
+        if _, ok := senders[l.sender]; ok {
+            continue
+        }
+        jid := a.mapSenderToJID(l.sender)
+        senders[l.sender] = jid
+        if jid == "" && l.sender != me {
+            unmapped[l.sender] = true
+        }
+    }
+    if result.ChatJID == "" {
+        // A one-to-one chat has exactly one sender besides the user
+        var others []string
+        for name, jid := range senders {
+            if name != me && jid != ownJid {
+                others = append(others, jid)
+            }
+        }
+        if len(others) != 1 || others[0] == "" {
+            return nil, fmt.Errorf("can't tell which chat this is, jid required")
+        }
+        result.ChatJID = others[0]
+    }
+    for name := range unmapped {
+        result.Unmapped = append(result.Unmapped, name)
+    }
+
+    index := newImportIndex(a.getMessagesForChat(result.ChatJID))
+    var imported []Message
+    for n, l := range lines {
+        if l.sender == "" {
+            continue
+        }
+        ts := l.timestamp(order)
+        fromMe := l.sender == me || (ownJid != "" && senders[l.sender] == ownJid)
+        sender := senders[l.sender]
+        if fromMe {
+            sender = ownJid
+        } else if sender == "" {
+            sender = l.sender
+        }
+        m := Message{Sender: sender, Timestamp: ts, FromMe: fromMe, ChatJID: result.ChatJID}
+
+        attachment, text := splitAttachment(l.text)
+        m.Text = text
+        if attachment != "" {
+            m.FileName = attachment
+            m.MimeType = getMimeType(attachment)
+            m.MediaType = importMediaType(m.MimeType)
+            if f, ok := files[attachment]; ok {
+                m.FileSize = f.UncompressedSize64
+            }
+        }
+        m.ID = importMessageID(result.ChatJID, ts, l.sender, l.text, n)
+
+        if index.take(m) {
+            result.Skipped++
+            continue
+        }
+        if attachment != "" {
+            if path, err := a.copyImportMedia(result.ChatJID, files, attachment); err == nil {
+                m.LocalPath = path
+                result.Media++
+            }
+        }
+        imported = append(imported, m)
+    }
+
+    result.Imported = a.addMessages(imported)
+    a.log.Info("chat imported", "chat", result.ChatJID, "messages", result.Imported,
+        "skipped", result.Skipped, "media", result.Media)
+    return result, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "encoding/json"
+    "mime/multipart"
+    "net/http"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// importText imports export as a bare _chat.txt.
+func importText(t *testing.T, a *Account, export string, opts ImportOptions) (*ImportResult, error) {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "_chat.txt")
+    if err := os.WriteFile(path, []byte(export), 0600); err != nil {
+        t.Fatal(err)
+    }
+    return a.importChatArchive(path, opts)
+}
+
+func TestImportSkipsKnownMessages(t *testing.T) {
+    b := newTestBackend(t)
+    a, f := b.paired("491700000000")
+    at := func(hour, min, sec int) int64 {
+        return time.Date(2024, 3, 1, hour, min, sec, 0, time.Local).Unix()
+    }
+    // Received live, with seconds the export doesn't have
+    f.Replay(
+        textEvent(group, alice, "M1", "ok", at(12, 34, 45)),
+        textEvent(group, alice, "M2", "see you", at(12, 35, 59)),
+    )
+    a.contactsMutex.Lock()
+    a.contacts[bob.User] = "Bob"
+    a.contactsMutex.Unlock()
+
+    export := "01/03/2024, 12:34 - Alice: ok\n" +
+        // Same text from someone else is a different message
+        "01/03/2024, 12:34 - Bob: ok\n" +
+        "01/03/2024, 12:34 - Me: ok\n" +
+        // Within a minute of the live one, across the minute boundary
+        "01/03/2024, 12:36 - Alice: see you\n" +
+        "01/03/2024, 12:40 - Alice: new\n"
+    result, err := importText(t, a, export, ImportOptions{ChatJID: group.User, Me: "Me"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.Imported != 3 || result.Skipped != 2 {
+        t.Errorf("result = %+v, want 3 imported and 2 skipped", result)
+    }
+
+    // Importing the same export again adds nothing
+    result, err = importText(t, a, export, ImportOptions{ChatJID: group.User, Me: "Me"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.Imported != 0 || result.Skipped != 5 {
+        t.Errorf("second import = %+v, want everything skipped", result)
+    }
+}
+
+func TestImportIndex(t *testing.T) {
+    base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC).Unix()
+    known := Message{ID: "M1", ChatJID: alice.User, Sender: alice.User, Text: "hi", Timestamp: base + 59}
+
+    for _, tc := range []struct {
+        name string
+        m    Message
+        want bool
+    }{
+        {"same id", Message{ID: "M1"}, true},
+        {"same minute", Message{ID: "i1", ChatJID: alice.User, Sender: alice.User, Text: "hi", Timestamp: base}, true},
+        {"next minute", Message{ID: "i2", ChatJID: alice.User, Sender: alice.User, Text: "hi", Timestamp: base + 60}, true},
+        {"a minute apart", Message{ID: "i3", ChatJID: alice.User, Sender: alice.User, Text: "hi", Timestamp: base + 119}, false},
+        {"other sender", Message{ID: "i4", ChatJID: alice.User, Sender: bob.User, Text: "hi", Timestamp: base + 59}, false},
+        {"other chat", Message{ID: "i5", ChatJID: bob.User, Sender: alice.User, Text: "hi", Timestamp: base + 59}, false},
+        {"other text", Message{ID: "i6", ChatJID: alice.User, Sender: alice.User, Text: "hello", Timestamp: base + 59}, false},
+    } {
+        x := newImportIndex([]Message{known})
+        if got := x.take(tc.m); got != tc.want {
+            t.Errorf("%s: take = %v, want %v", tc.name, got, tc.want)
+        }
+    }
+
+    // Each known message matches once
+    x := newImportIndex([]Message{known})
+    dup := Message{ID: "i7", ChatJID: alice.User, Sender: alice.User, Text: "hi", Timestamp: base}
+    if !x.take(dup) || x.take(dup) || x.take(known) {
+        t.Error("known message matched twice")
+    }
+}
+
+func TestImportRepeatedMessages(t *testing.T) {
+    b := newTestBackend(t)
+    a, f := b.paired("491700000000")
+    at := time.Date(2024, 3, 1, 12, 34, 10, 0, time.Local).Unix()
+    f.Replay(textEvent(alice, alice, "M1", "ok", at))
+
+    // Alice really sent "ok" three times that minute, one arrived live
+    export := "01/03/2024, 12:34 - +" + alice.User + ": ok\n" +
+        "01/03/2024, 12:34 - +" + alice.User + ": ok\n" +
+        "01/03/2024, 12:34 - +" + alice.User + ": ok\n"
+    result, err := importText(t, a, export, ImportOptions{ChatJID: alice.User})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.Imported != 2 || result.Skipped != 1 {
+        t.Errorf("result = %+v, want 2 imported and 1 skipped", result)
+    }
+    if msgs := a.getMessagesForChat(alice.User); len(msgs) != 3 {
+        t.Errorf("%d messages, want 3", len(msgs))
+    }
+
+    result, err = importText(t, a, export, ImportOptions{ChatJID: alice.User})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.Imported != 0 || result.Skipped != 3 {
+        t.Errorf("second import = %+v, want everything skipped", result)
+    }
+}
+
+func TestImportUpload(t *testing.T) {
+    b := newTestBackend(t)
+    b.paired("491700000000")
+    var archive bytes.Buffer
+    zw := zip.NewWriter(&archive)
+    w, _ := zw.Create("_chat.txt")
+    w.Write([]byte("01/03/2024, 12:34 - +" + alice.User + ": hello\n"))
+    zw.Close()
+
+    // The chat field comes after the file
+    var body bytes.Buffer
+    mw := multipart.NewWriter(&body)
+    fw, _ := mw.CreateFormFile("file", "WhatsApp Chat.zip")
+    fw.Write(archive.Bytes())
+    mw.WriteField("jid", alice.User)
+    mw.Close()
+    resp, err := http.Post(b.server.URL+apiPrefix+"/import", mw.FormDataContentType(), &body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    var result ImportResult
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || resp.StatusCode != 200 {
+        t.Fatalf("status %d, %v", resp.StatusCode, err)
+    }
+    if result.ChatJID != alice.User || result.Imported != 1 {
+        t.Errorf("result = %+v", result)
+    }
+    if uploads, _ := filepath.Glob("upload-*"); len(uploads) != 0 {
+        t.Errorf("uploads left behind: %v", uploads)
+    }
+}
+
+// importZip imports export as a zip with the given attachments.
+func importZip(t *testing.T, a *Account, export string, attachments map[string]string, opts ImportOptions) *ImportResult {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "chat.zip")
+    out, err := os.Create(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    zw := zip.NewWriter(out)
+    w, _ := zw.Create("_chat.txt")
+    w.Write([]byte(export))
+    for name, content := range attachments {
+        w, _ := zw.Create(name)
+        w.Write([]byte(content))
+    }
+    zw.Close()
+    out.Close()
+    result, err := a.importChatArchive(path, opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return result
+}
+
+func TestImportMediaPerChat(t *testing.T) {
+    b := newTestBackend(t)
+    a, _ := b.paired("491700000000")
+    line := func(sender string) string {
+        return "01/03/2024, 12:34 - +" + sender + ": IMG-20240101-WA0001.jpg (file attached)\n"
+    }
+    importZip(t, a, line(alice.User), map[string]string{"IMG-20240101-WA0001.jpg": "alice's"}, ImportOptions{ChatJID: alice.User})
+    importZip(t, a, line(bob.User), map[string]string{"IMG-20240101-WA0001.jpg": "bob's"}, ImportOptions{ChatJID: bob.User})
+    // Another export of the same chat with a different picture of that name
+    importZip(t, a, "01/03/2024, 12:40 - +"+alice.User+": IMG-20240101-WA0001.jpg (file attached)\n",
+        map[string]string{"IMG-20240101-WA0001.jpg": "alice's other"}, ImportOptions{ChatJID: alice.User})
+
+    for _, c := range []struct {
+        chat string
+        want []string
+    }{
+        {alice.User, []string{"alice's", "alice's other"}},
+        {bob.User, []string{"bob's"}},
+    } {
+        msgs := a.getMessagesForChat(c.chat)
+        if len(msgs) != len(c.want) {
+            t.Fatalf("%s: %d messages", c.chat, len(msgs))
+        }
+        for i, m := range msgs {
+            if data, err := os.ReadFile(m.LocalPath); err != nil || string(data) != c.want[i] {
+                t.Errorf("%s: media %s = %q, %v, want %q", c.chat, m.LocalPath, data, err, c.want[i])
+            }
+        }
+    }
+}
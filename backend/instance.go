@@ -0,0 +1,48 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+// Only one backend may use a data directory. It holds an exclusive lock
+// on this file for as long as it runs; the kernel drops the lock when the
+// process dies, so a stale file never blocks a start.
+const instanceLockFile = "backend.lock"
+
+var instanceLock *os.File
+
+// acquireInstanceLock takes the lock in dir and writes our PID into the
+// file. It fails when another backend holds it.
+func acquireInstanceLock(dir string) error {
+    path := filepath.Join(dir, instanceLockFile)
+    f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+    if err != nil {
+        return err
+    }
+    if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+        data, _ := os.ReadFile(path)
+        f.Close()
+        if pid := strings.TrimSpace(string(data)); pid != "" {
+            return fmt.Errorf("another backend is running (pid %s)", pid)
+        }
+        return fmt.Errorf("another backend is running")
+    }
+    f.Truncate(0)
+    f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+    instanceLock = f
+    return nil
+}
+
+// releaseInstanceLock lets go of the lock. The file stays: removing it
+// could let two new backends lock different files.
+func releaseInstanceLock() {
+    if instanceLock != nil {
+        instanceLock.Close()
+        instanceLock = nil
+    }
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+
+    "golang.org/x/crypto/argon2"
+)
+
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// fileKeyStore keeps secrets in a JSON file. Without an AEAD the file is
+// plain and only protected by its permissions, which is meant for
+// development and CI; with one it is sealed by a passphrase-derived key.
+type fileKeyStore struct {
+    path string
+    name string
+
+    mu     sync.Mutex
+    aead   cipher.AEAD
+    header *sealedKeyFile // KDF parameters, kept for rewrites
+}
+
+// sealedKeyFile is the on-disk format of the passphrase key store.
+type sealedKeyFile struct {
+    Version int    `json:"version"`
+    KDF     string `json:"kdf"`
+    Salt    []byte `json:"salt"`
+    Time    uint32 `json:"time"`
+    Memory  uint32 `json:"memory"`
+    Threads uint8  `json:"threads"`
+    Nonce   []byte `json:"nonce,omitempty"`
+    Data    []byte `json:"data,omitempty"`
+}
+
+func newFileKeyStore(path string) *fileKeyStore {
+    return &fileKeyStore{path: path, name: "key file " + path}
+}
+
+// newPassphraseKeyStore opens or creates a key file sealed with a key
+// derived from passphrase by Argon2id. A wrong passphrase is reported
+// here rather than on first use.
+func newPassphraseKeyStore(path, passphrase string) (*fileKeyStore, error) {
+    ks := &fileKeyStore{path: path, name: "passphrase key file " + path}
+    header := &sealedKeyFile{Version: 1, KDF: "argon2id", Time: backupArgonTime, Memory: backupArgonMemory, Threads: backupArgonThreads}
+    if data, err := os.ReadFile(path); err == nil {
+        if err := json.Unmarshal(data, header); err != nil {
+            return nil, fmt.Errorf("%s: %v", path, err)
+        }
+        if header.KDF != "argon2id" {
+            return nil, fmt.Errorf("%s: unsupported kdf %q", path, header.KDF)
+        }
+    } else if os.IsNotExist(err) {
+        header.Salt = make([]byte, 16)
+        if _, err := rand.Read(header.Salt); err != nil {
+            return nil, err
+        }
+    } else {
+        return nil, err
+    }
+
+    key := argon2.IDKey([]byte(passphrase), header.Salt, header.Time, header.Memory, header.Threads, 32)
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    if ks.aead, err = cipher.NewGCM(block); err != nil {
+        return nil, err
+    }
+    ks.header = header
+    if _, err := ks.read(); err != nil {
+        return nil, err
+    }
+    return ks, nil
+}
+
+func (ks *fileKeyStore) Name() string { return ks.name }
+
+func (ks *fileKeyStore) read() (map[string][]byte, error) {
+    entries := make(map[string][]byte)
+    if ks.aead == nil {
+        data, err := os.ReadFile(ks.path)
+        if os.IsNotExist(err) {
+            return entries, nil
+        } else if err != nil {
+            return nil, err
+        }
+        return entries, json.Unmarshal(data, &entries)
+    }
+    if ks.header.Data == nil {
+        return entries, nil
+    }
+    plain, err := ks.aead.Open(nil, ks.header.Nonce, ks.header.Data, ks.header.Salt)
+    if err != nil {
+        return nil, ErrWrongPassphrase
+    }
+    return entries, json.Unmarshal(plain, &entries)
+}
+
+func (ks *fileKeyStore) write(entries map[string][]byte) error {
+    data, err := json.Marshal(entries)
+    if err != nil {
+        return err
+    }
+    if ks.aead != nil {
+        nonce := make([]byte, ks.aead.NonceSize())
+        if _, err := rand.Read(nonce); err != nil {
+            return err
+        }
+        ks.header.Nonce = nonce
+        ks.header.Data = ks.aead.Seal(nil, nonce, data, ks.header.Salt)
+        if data, err = json.Marshal(ks.header); err != nil {
+            return err
+        }
+    }
+    if err := os.MkdirAll(filepath.Dir(ks.path), 0700); err != nil {
+        return err
+    }
+    if err := writeFileAtomic(ks.path, data); err != nil {
+        return err
+    }
+    return os.Chmod(ks.path, 0600)
+}
+
+func (ks *fileKeyStore) Load(name string) ([]byte, error) {
+    ks.mu.Lock()
+    defer ks.mu.Unlock()
+    entries, err := ks.read()
+    if err != nil {
+        return nil, err
+    }
+    data, ok := entries[name]
+    if !ok {
+        return nil, ErrSecretNotFound
+    }
+    return data, nil
+}
+
+func (ks *fileKeyStore) Store(name string, data []byte) error {
+    ks.mu.Lock()
+    defer ks.mu.Unlock()
+    entries, err := ks.read()
+    if err != nil {
+        return err
+    }
+    entries[name] = data
+    return ks.write(entries)
+}
+
+func (ks *fileKeyStore) Delete(name string) error {
+    ks.mu.Lock()
+    defer ks.mu.Unlock()
+    entries, err := ks.read()
+    if err != nil {
+        return err
+    }
+    if _, ok := entries[name]; !ok {
+        return ErrSecretNotFound
+    }
+    delete(entries, name)
+    return ks.write(entries)
+}
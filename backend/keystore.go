@@ -0,0 +1,146 @@
+package main
+
+import (
+    "crypto/rand"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+var ErrSecretNotFound = errors.New("secret not found")
+
+// KeyStore keeps the database key and the other small secrets the backend
+// needs, such as the API token.
+type KeyStore interface {
+    Name() string
+    // Load returns ErrSecretNotFound if nothing is stored under name
+    Load(name string) ([]byte, error)
+    Store(name string, data []byte) error
+    Delete(name string) error
+}
+
+var keyStore KeyStore
+var keysLog = logger("keys")
+
+var keyStoreKinds = []string{"auto", "sailfish", "secret-service", "passphrase", "file"}
+
+// openKeyStore opens the named key store. "auto" takes the first of
+// Sailfish Secrets and the Secret Service that answers, and fails if
+// neither does: keeping the key in a plain file has to be asked for.
+func openKeyStore(kind string) (KeyStore, error) {
+    cfg := getConfig()
+    switch kind {
+    case "sailfish":
+        if err := InitSecrets(); err != nil {
+            return nil, err
+        }
+        return secrets, nil
+    case "secret-service":
+        return newSecretServiceStore()
+    case "passphrase":
+        passphrase, err := readPassphrase(cfg)
+        if err != nil {
+            return nil, err
+        }
+        return newPassphraseKeyStore(keyFilePath(cfg, "keys.enc"), passphrase)
+    case "file":
+        return newFileKeyStore(keyFilePath(cfg, "keys.json")), nil
+    case "auto":
+        var errs []string
+        for _, k := range []string{"sailfish", "secret-service"} {
+            ks, err := openKeyStore(k)
+            if err == nil {
+                return ks, nil
+            }
+            errs = append(errs, fmt.Sprintf("%s: %v", k, err))
+        }
+        return nil, fmt.Errorf("no secret storage available (%s); set keyStore to \"file\" to keep the key in a plain file",
+            strings.Join(errs, "; "))
+    }
+    return nil, fmt.Errorf("unknown key store %q", kind)
+}
+
+func keyFilePath(cfg Config, name string) string {
+    if cfg.KeyFile != "" {
+        return cfg.KeyFile
+    }
+    return filepath.Join(cfg.DataDir, name)
+}
+
+// readPassphrase takes the passphrase from WA_PASSPHRASE or the configured
+// passphrase file.
+func readPassphrase(cfg Config) (string, error) {
+    if p := os.Getenv("WA_PASSPHRASE"); p != "" {
+        return p, nil
+    }
+    if cfg.PassphraseFile == "" {
+        return "", fmt.Errorf("passphrase key store needs WA_PASSPHRASE or passphraseFile")
+    }
+    data, err := os.ReadFile(cfg.PassphraseFile)
+    if err != nil {
+        return "", err
+    }
+    p := strings.TrimRight(string(data), "\r\n")
+    if p == "" {
+        return "", fmt.Errorf("%s is empty", cfg.PassphraseFile)
+    }
+    return p, nil
+}
+
+func initKeyStore() error {
+    ks, err := openKeyStore(getConfig().KeyStore)
+    if err != nil {
+        return err
+    }
+    keyStore = ks
+    keysLog.Info("keys stored", "store", ks.Name())
+    return nil
+}
+
+func GetOrCreateKey() ([]byte, error) {
+    if keyStore == nil {
+        return nil, fmt.Errorf("no key store")
+    }
+
+    key, err := keyStore.Load(SECRET_KEY_NAME)
+    if err == nil && len(key) == 32 {
+        keysLog.Info("encryption key loaded", "store", keyStore.Name())
+        encryptionKey = key
+        return key, nil
+    }
+    if err != nil && !errors.Is(err, ErrSecretNotFound) {
+        // Don't replace a key we merely failed to read
+        return nil, err
+    }
+
+    keysLog.Info("generating new encryption key")
+    key = make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+        return nil, err
+    }
+
+    if err := keyStore.Store(SECRET_KEY_NAME, key); err != nil {
+        return nil, fmt.Errorf("couldn't store key: %v", err)
+    }
+
+    keysLog.Info("encryption key stored", "store", keyStore.Name())
+    encryptionKey = key
+    return key, nil
+}
+
+// ClearKey forgets the database key, for when the database is deleted.
+func ClearKey() {
+    if keyStore != nil {
+        if err := keyStore.Delete(SECRET_KEY_NAME); err != nil && !errors.Is(err, ErrSecretNotFound) {
+            keysLog.Warn("couldn't delete key", "err", err)
+        }
+    }
+    encryptionKey = nil
+}
+
+func RegenerateKey() ([]byte, error) {
+    ClearKey()
+    return GetOrCreateKey()
+}
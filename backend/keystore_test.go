@@ -0,0 +1,32 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestAutoKeyStoreNeedsSecretStorage(t *testing.T) {
+    newTestBackend(t)
+    t.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path="+filepath.Join(t.TempDir(), "no-bus"))
+    saved := secrets
+    defer func() { secrets = saved }()
+
+    ks, err := openKeyStore("auto")
+    if err == nil || !strings.Contains(err.Error(), `"file"`) {
+        t.Fatalf("auto without secret storage = %v, %v", ks, err)
+    }
+    if _, err := os.Stat(keyFilePath(getConfig(), "keys.json")); !os.IsNotExist(err) {
+        t.Error("key file created")
+    }
+
+    // Asked for explicitly, the file is fine
+    ks, err = openKeyStore("file")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := ks.Store(SECRET_KEY_NAME, testKey(1)); err != nil {
+        t.Fatal(err)
+    }
+}
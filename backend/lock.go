@@ -0,0 +1,209 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+var appLockKinds = []string{"off", "passphrase", "device"}
+
+// Paths that answer while the backend is locked. Requests to them don't
+// count as activity either, so monitoring doesn't keep the app unlocked.
+var unlockedPaths = map[string]bool{
+    "/status":                   true,
+    apiPrefix + "/status":       true,
+    apiPrefix + "/unlock":       true,
+    apiPrefix + "/openapi.json": true,
+}
+
+// Monitoring paths, locked like the rest but not counted as activity
+var idlePaths = map[string]bool{
+    "/healthz": true,
+    "/metrics": true,
+}
+
+var appLocked bool
+// Set while an unlock prompts the user or opens the session, which happens
+// without holding lockMutex
+var unlocking bool
+var lockMutex sync.Mutex
+var lastActivity atomic.Int64
+var lockLog = logger("lock")
+
+// Failed unlocks are slowed down to make guessing expensive
+var unlockFailureDelay = 2 * time.Second
+
+var errWrongPassphrase = apiError(http.StatusUnauthorized, "wrong_passphrase", "wrong passphrase")
+var errUnlockInProgress = apiError(http.StatusConflict, "unlock_in_progress", "an unlock is already in progress")
+
+func isLocked() bool {
+    lockMutex.Lock()
+    defer lockMutex.Unlock()
+    return appLocked
+}
+
+func touchActivity() {
+    lastActivity.Store(time.Now().Unix())
+}
+
+// requireUnlocked answers everything but the status and unlock endpoints
+// with 423 while the backend is locked, and counts the other requests,
+// monitoring aside, as activity for the auto-lock.
+func requireUnlocked(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if unlockedPaths[r.URL.Path] {
+            next.ServeHTTP(w, r)
+            return
+        }
+        if isLocked() {
+            writeError(w, r, http.StatusLocked, "locked", "the backend is locked")
+            return
+        }
+        if !idlePaths[r.URL.Path] {
+            touchActivity()
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// unlockApp checks the passphrase or has the secrets daemon confirm the
+// device owner, then opens the session. Only one unlock runs at a time;
+// the lock state stays readable while it waits for the user.
+func unlockApp(passphrase string) error {
+    lockMutex.Lock()
+    if !appLocked {
+        lockMutex.Unlock()
+        return nil
+    }
+    if unlocking {
+        lockMutex.Unlock()
+        return errUnlockInProgress
+    }
+    unlocking = true
+    lockMutex.Unlock()
+
+    err := openLockedSession(passphrase)
+    lockMutex.Lock()
+    unlocking = false
+    if err == nil {
+        appLocked = false
+    }
+    lockMutex.Unlock()
+    if err != nil {
+        return err
+    }
+    touchActivity()
+    lockLog.Info("unlocked")
+    sdNotify("STATUS=Running")
+    return nil
+}
+
+// openLockedSession does the work of unlockApp. Nothing else touches the
+// session while the backend is locked.
+func openLockedSession(passphrase string) error {
+    cfg := getConfig()
+    switch cfg.AppLock {
+    case "passphrase":
+        if passphrase == "" {
+            return badRequest("passphrase required")
+        }
+        ks, err := newPassphraseKeyStore(keyFilePath(cfg, "keys.enc"), passphrase)
+        if err != nil {
+            time.Sleep(unlockFailureDelay)
+            if errors.Is(err, ErrWrongPassphrase) {
+                return errWrongPassphrase
+            }
+            return err
+        }
+        keyStore = ks
+    case "device":
+        if secrets == nil || !secrets.available {
+            if err := InitSecrets(); err != nil {
+                return apiError(http.StatusServiceUnavailable, "unlock_unavailable", "Sailfish Secrets not available: %v", err)
+            }
+        }
+        authCtx, cancel := context.WithTimeout(context.Background(), secretPromptTimeout)
+        err := secrets.VerifyDeviceOwner(authCtx)
+        cancel()
+        if err != nil {
+            time.Sleep(unlockFailureDelay)
+            return apiError(http.StatusUnauthorized, "authentication_failed", "%v", err)
+        }
+    }
+
+    if err := openSession(); err != nil {
+        if cfg.AppLock == "passphrase" {
+            keyStore = nil
+        }
+        return err
+    }
+    return nil
+}
+
+// lockApp closes the session and forgets the database key and everything
+// decrypted from it.
+func lockApp() error {
+    lockMutex.Lock()
+    defer lockMutex.Unlock()
+    if appLocked {
+        return nil
+    }
+    if getConfig().AppLock == "off" {
+        return apiError(http.StatusConflict, "lock_disabled", "app lock is not enabled")
+    }
+    // Closing the accounts saves their data and drops what was decrypted
+    closeAccounts()
+    if container != nil {
+        container.Close()
+    }
+    container = nil
+
+    for i := range encryptionKey {
+        encryptionKey[i] = 0
+    }
+    encryptionKey = nil
+    if getConfig().AppLock == "passphrase" {
+        keyStore = nil
+    }
+    dismissAllNotifications()
+    appLocked = true
+    lockLog.Info("locked")
+    sdNotify("STATUS=Locked, waiting for unlock")
+    return nil
+}
+
+// runAutoLock locks the backend once no request has come in for the
+// configured idle time. Only lock modes that can be unlocked again use it.
+func runAutoLock() {
+    touchActivity()
+    ticker := time.NewTicker(30 * time.Second)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+        case <-ctx.Done():
+            return
+        }
+        autoLockIfIdle()
+    }
+}
+
+// autoLockIfIdle locks once the configured idle time has passed.
+func autoLockIfIdle() {
+    cfg := getConfig()
+    minutes := cfg.AutoLockMinutes
+    if cfg.AppLock == "off" || minutes <= 0 || isLocked() {
+        return
+    }
+    idle := time.Since(time.Unix(lastActivity.Load(), 0))
+    if idle >= time.Duration(minutes)*time.Minute {
+        lockLog.Info("idle, locking", "idle", idle.Round(time.Second))
+        if err := lockApp(); err != nil {
+            lockLog.Warn("auto-lock failed", "err", err)
+        }
+    }
+}
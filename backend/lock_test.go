@@ -0,0 +1,216 @@
+package main
+
+import (
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+// useAppLock switches the test backend to the given lock mode, without the
+// delay after failed unlocks.
+func useAppLock(t *testing.T, mode string, autoLockMinutes int) {
+    t.Helper()
+    configMutex.Lock()
+    config.AppLock = mode
+    config.AutoLockMinutes = autoLockMinutes
+    configMutex.Unlock()
+    savedDelay, savedStore, savedSecrets := unlockFailureDelay, keyStore, secrets
+    unlockFailureDelay = 0
+    t.Cleanup(func() {
+        lockMutex.Lock()
+        appLocked = false
+        lockMutex.Unlock()
+        unlockFailureDelay, keyStore, secrets = savedDelay, savedStore, savedSecrets
+    })
+}
+
+func wantAPIError(t *testing.T, err error, status int) {
+    t.Helper()
+    var apiErr *APIError
+    if !errors.As(err, &apiErr) || apiErr.Status != status {
+        t.Errorf("error = %v, want status %d", err, status)
+    }
+}
+
+func TestDeviceUnlock(t *testing.T) {
+    newTestBackend(t)
+    useAppLock(t, "device", 0)
+    d := newFakeSecretsDaemon(t)
+    secrets = newTestSecrets(t, d)
+    keyStore = secrets
+
+    if err := lockApp(); err != nil {
+        t.Fatal(err)
+    }
+    // Whatever the user typed, a wrong lock code keeps the backend locked
+    d.mu.Lock()
+    d.denyInput = true
+    d.mu.Unlock()
+    wantAPIError(t, unlockApp("anything"), http.StatusUnauthorized)
+    if !isLocked() || container != nil {
+        t.Fatal("unlocked with a wrong lock code")
+    }
+
+    d.mu.Lock()
+    d.denyInput = false
+    d.mu.Unlock()
+    if err := unlockApp(""); err != nil {
+        t.Fatal(err)
+    }
+    if isLocked() || container == nil || len(allAccounts()) == 0 {
+        t.Error("session not open after unlock")
+    }
+}
+
+func TestPassphraseLockUnlock(t *testing.T) {
+    b := newTestBackend(t)
+    useAppLock(t, "passphrase", 0)
+    a, f := b.paired("491700000000")
+    f.Replay(textEvent(alice, alice, "M1", "hi there", 1000))
+
+    // The first unlock sets the passphrase and encrypts the database
+    if err := lockApp(); err != nil {
+        t.Fatal(err)
+    }
+    if err := unlockApp("secret"); err != nil {
+        t.Fatal(err)
+    }
+    if err := lockApp(); err != nil {
+        t.Fatal(err)
+    }
+    if container != nil || encryptionKey != nil || keyStore != nil || len(allAccounts()) != 0 {
+        t.Fatal("session left open after locking")
+    }
+
+    wantAPIError(t, unlockApp(""), http.StatusBadRequest)
+    wantAPIError(t, unlockApp("wrong"), http.StatusUnauthorized)
+    if !isLocked() {
+        t.Fatal("unlocked with a wrong passphrase")
+    }
+    if err := unlockApp("secret"); err != nil {
+        t.Fatal(err)
+    }
+    a = getAccount(a.ID)
+    if a == nil || len(a.getMessagesForChat(alice.User)) != 1 {
+        t.Errorf("account after unlock: %+v", a)
+    }
+}
+
+func TestLockedRequests(t *testing.T) {
+    newTestBackend(t)
+    useAppLock(t, "passphrase", 0)
+    handler := requireUnlocked(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    status := func(path string) int {
+        rec := httptest.NewRecorder()
+        handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+        return rec.Code
+    }
+
+    if err := lockApp(); err != nil {
+        t.Fatal(err)
+    }
+    for _, path := range []string{"/status", apiPrefix + "/status", apiPrefix + "/unlock"} {
+        if code := status(path); code != http.StatusOK {
+            t.Errorf("%s while locked: %d", path, code)
+        }
+    }
+    for _, path := range []string{"/metrics", "/healthz", "/shutdown", apiPrefix + "/shutdown", apiPrefix + "/chats"} {
+        if code := status(path); code != http.StatusLocked {
+            t.Errorf("%s while locked: %d, want 423", path, code)
+        }
+    }
+
+    // Once unlocked, monitoring doesn't count as activity
+    if err := unlockApp("secret"); err != nil {
+        t.Fatal(err)
+    }
+    lastActivity.Store(0)
+    status("/metrics")
+    status("/healthz")
+    if lastActivity.Load() != 0 {
+        t.Error("monitoring counted as activity")
+    }
+    status(apiPrefix + "/chats")
+    if lastActivity.Load() == 0 {
+        t.Error("API request not counted as activity")
+    }
+}
+
+func TestUnlockLeavesLockStateReadable(t *testing.T) {
+    newTestBackend(t)
+    useAppLock(t, "device", 0)
+    d := newFakeSecretsDaemon(t)
+    secrets = newTestSecrets(t, d)
+    keyStore = secrets
+    if err := lockApp(); err != nil {
+        t.Fatal(err)
+    }
+
+    // The daemon takes its time, as when the user is entering the code
+    d.mu.Lock()
+    d.delay = 100 * time.Millisecond
+    d.mu.Unlock()
+    done := make(chan error, 1)
+    go func() { done <- unlockApp("") }()
+    for {
+        lockMutex.Lock()
+        started := unlocking
+        lockMutex.Unlock()
+        if started {
+            break
+        }
+        time.Sleep(time.Millisecond)
+    }
+
+    start := time.Now()
+    if !isLocked() {
+        t.Error("unlocked before the user answered")
+    }
+    if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+        t.Errorf("isLocked waited %s for the unlock", elapsed)
+    }
+    wantAPIError(t, unlockApp(""), http.StatusConflict)
+
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+    if isLocked() {
+        t.Error("still locked after the unlock")
+    }
+}
+
+func TestAutoLock(t *testing.T) {
+    newTestBackend(t)
+    useAppLock(t, "passphrase", 5)
+    if err := lockApp(); err != nil {
+        t.Fatal(err)
+    }
+    if err := unlockApp("secret"); err != nil {
+        t.Fatal(err)
+    }
+
+    lastActivity.Store(time.Now().Add(-4 * time.Minute).Unix())
+    autoLockIfIdle()
+    if isLocked() {
+        t.Fatal("locked before the idle time")
+    }
+    lastActivity.Store(time.Now().Add(-6 * time.Minute).Unix())
+    autoLockIfIdle()
+    if !isLocked() || encryptionKey != nil || container != nil {
+        t.Fatal("not locked after the idle time")
+    }
+
+    // Auto-lock is off without an idle time
+    if err := unlockApp("secret"); err != nil {
+        t.Fatal(err)
+    }
+    configMutex.Lock()
+    config.AutoLockMinutes = 0
+    configMutex.Unlock()
+    autoLockIfIdle()
+    if isLocked() {
+        t.Error("locked with auto-lock off")
+    }
+}
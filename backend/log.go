@@ -0,0 +1,309 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "sync"
+    "sync/atomic"
+
+    waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Everything logs through slog. Each logger belongs to a component, whose
+// level is the configured logLevel (dbLogLevel for "db") unless
+// /debug/loglevel overrides it. Records go to stderr and a rotating file
+// in the data directory, as text or JSON.
+
+const logFileName = "backend.log"
+const logMaxSize = 5 << 20
+const logKeepFiles = 3
+
+var logLevelNames = map[string]slog.Level{
+    "DEBUG": slog.LevelDebug, "INFO": slog.LevelInfo, "WARN": slog.LevelWarn, "ERROR": slog.LevelError,
+}
+
+var (
+    defaultLogLevel slog.LevelVar
+    dbLogLevel      slog.LevelVar
+
+    // Runtime overrides from /debug/loglevel, by component
+    componentLevels      = make(map[string]slog.Level)
+    componentLevelsMutex sync.RWMutex
+
+    logRedact atomic.Bool
+
+    // Where records end up; stderr only until initLogging has the config
+    logHandler atomic.Pointer[slog.Handler]
+    logFile    *rotatingFile
+)
+
+func init() {
+    logRedact.Store(true)
+    setLogHandler(os.Stderr, "text")
+}
+
+func setLogHandler(w io.Writer, format string) {
+    opts := &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: redactAttr}
+    var h slog.Handler
+    if format == "json" {
+        h = slog.NewJSONHandler(w, opts)
+    } else {
+        h = slog.NewTextHandler(w, opts)
+    }
+    logHandler.Store(&h)
+}
+
+// initLogging opens the log file and applies the log settings. It runs
+// once the config is loaded.
+func initLogging() error {
+    cfg := getConfig()
+    applyLogConfig(cfg)
+    if cfg.LogFile == "none" {
+        setLogHandler(os.Stderr, cfg.LogFormat)
+        return nil
+    }
+    path := cfg.LogFile
+    if path == "" {
+        path = filepath.Join(cfg.DataDir, logFileName)
+    }
+    f, err := openRotatingFile(path, logMaxSize, logKeepFiles)
+    if err != nil {
+        setLogHandler(os.Stderr, cfg.LogFormat)
+        return err
+    }
+    logFile = f
+    setLogHandler(io.MultiWriter(os.Stderr, f), cfg.LogFormat)
+    return nil
+}
+
+func closeLogging() {
+    if logFile != nil {
+        setLogHandler(os.Stderr, getConfig().LogFormat)
+        logFile.Close()
+    }
+}
+
+// applyLogConfig takes over the settings /config can change at runtime.
+func applyLogConfig(cfg Config) {
+    defaultLogLevel.Set(logLevelNames[cfg.LogLevel])
+    dbLogLevel.Set(logLevelNames[cfg.DBLogLevel])
+    logRedact.Store(cfg.LogRedact)
+}
+
+func componentLevel(component string) slog.Level {
+    componentLevelsMutex.RLock()
+    level, ok := componentLevels[component]
+    componentLevelsMutex.RUnlock()
+    if ok {
+        return level
+    }
+    if component == "db" {
+        return dbLogLevel.Level()
+    }
+    return defaultLogLevel.Level()
+}
+
+// setComponentLevel overrides a component's level, or removes the
+// override when level is empty.
+func setComponentLevel(component, level string) error {
+    componentLevelsMutex.Lock()
+    defer componentLevelsMutex.Unlock()
+    if level == "" {
+        delete(componentLevels, component)
+        return nil
+    }
+    l, ok := logLevelNames[strings.ToUpper(level)]
+    if !ok {
+        return fmt.Errorf("level must be DEBUG, INFO, WARN or ERROR")
+    }
+    componentLevels[component] = l
+    return nil
+}
+
+func componentLevelOverrides() map[string]string {
+    componentLevelsMutex.RLock()
+    defer componentLevelsMutex.RUnlock()
+    result := make(map[string]string, len(componentLevels))
+    for c, l := range componentLevels {
+        result[c] = l.String()
+    }
+    return result
+}
+
+// logger returns the logger of a component.
+func logger(component string) *slog.Logger {
+    return slog.New(&componentHandler{component: component})
+}
+
+// componentHandler filters by its component's current level and passes
+// records on to whatever handler is installed at the time. Groups are
+// flattened; nothing here uses them.
+type componentHandler struct {
+    component string
+    attrs     []slog.Attr
+}
+
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+    return level >= componentLevel(h.component)
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+    out := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+    out.AddAttrs(slog.String("component", h.component))
+    out.AddAttrs(h.attrs...)
+    r.Attrs(func(a slog.Attr) bool {
+        out.AddAttrs(a)
+        return true
+    })
+    return (*logHandler.Load()).Handle(ctx, out)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return &componentHandler{component: h.component, attrs: append(append([]slog.Attr(nil), h.attrs...), attrs...)}
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+    return h
+}
+
+// Redaction. Attributes holding message content are replaced by their
+// length, those holding numbers keep only the last digits, and JIDs and
+// +numbers are masked wherever else they appear, e.g. in whatsmeow's
+// own messages.
+
+var contentKeys = map[string]bool{"text": true, "caption": true, "body": true, "code": true}
+var numberKeys = map[string]bool{"phone": true, "jid": true, "chat": true, "sender": true, "to": true}
+
+var numberRe = regexp.MustCompile(`\+?\d{6,}`)
+var jidRe = regexp.MustCompile(`\d{6,}(?:[.:]\d+)*@(?:s\.whatsapp\.net|lid|c\.us)|\+\d{6,}`)
+
+func maskNumber(s string) string {
+    return numberRe.ReplaceAllStringFunc(s, func(n string) string {
+        return strings.Repeat("*", len(n)-3) + n[len(n)-3:]
+    })
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+    if !logRedact.Load() || a.Value.Kind() != slog.KindString && a.Value.Kind() != slog.KindAny {
+        return a
+    }
+    s := a.Value.String()
+    switch {
+    case a.Key == slog.TimeKey || a.Key == slog.LevelKey:
+        return a
+    case contentKeys[a.Key]:
+        return slog.String(a.Key, fmt.Sprintf("[%d chars]", len(s)))
+    case numberKeys[a.Key]:
+        return slog.String(a.Key, maskNumber(s))
+    }
+    if masked := jidRe.ReplaceAllStringFunc(s, maskNumber); masked != s {
+        return slog.String(a.Key, masked)
+    }
+    return a
+}
+
+// rotatingFile is an append-only log file. Once it reaches maxSize it is
+// renamed to .1, the older ones move up and the oldest is dropped.
+type rotatingFile struct {
+    mu      sync.Mutex
+    path    string
+    maxSize int64
+    keep    int
+    f       *os.File
+    size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+    r := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+    if err := r.open(); err != nil {
+        return nil, err
+    }
+    return r, nil
+}
+
+func (r *rotatingFile) open() error {
+    f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+    if err != nil {
+        return err
+    }
+    info, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return err
+    }
+    r.f, r.size = f, info.Size()
+    return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.f == nil {
+        return 0, os.ErrClosed
+    }
+    if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+        if err := r.rotate(); err != nil {
+            return 0, err
+        }
+    }
+    n, err := r.f.Write(p)
+    r.size += int64(n)
+    return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+    r.f.Close()
+    r.f = nil
+    os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+    for i := r.keep - 1; i >= 1; i-- {
+        os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+    }
+    if r.keep > 0 {
+        os.Rename(r.path, r.path+".1")
+    } else {
+        os.Remove(r.path)
+    }
+    return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.f == nil {
+        return nil
+    }
+    err := r.f.Close()
+    r.f = nil
+    return err
+}
+
+// waLogger hands whatsmeow's log lines to a component logger, formatting
+// them only when the level is enabled.
+type waLogger struct {
+    l *slog.Logger
+}
+
+func newWALogger(l *slog.Logger) waLog.Logger {
+    return &waLogger{l: l}
+}
+
+func (w *waLogger) logf(level slog.Level, msg string, args []interface{}) {
+    if !w.l.Enabled(context.Background(), level) {
+        return
+    }
+    w.l.Log(context.Background(), level, fmt.Sprintf(msg, args...))
+}
+
+func (w *waLogger) Errorf(msg string, args ...interface{}) { w.logf(slog.LevelError, msg, args) }
+func (w *waLogger) Warnf(msg string, args ...interface{})  { w.logf(slog.LevelWarn, msg, args) }
+func (w *waLogger) Infof(msg string, args ...interface{})  { w.logf(slog.LevelInfo, msg, args) }
+func (w *waLogger) Debugf(msg string, args ...interface{}) { w.logf(slog.LevelDebug, msg, args) }
+func (w *waLogger) Sub(module string) waLog.Logger {
+    return &waLogger{l: w.l.With("module", module)}
+}
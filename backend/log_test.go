@@ -0,0 +1,97 @@
+package main
+
+import (
+    "bytes"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func captureLogs(t *testing.T, format string) *bytes.Buffer {
+    t.Helper()
+    var buf bytes.Buffer
+    setLogHandler(&buf, format)
+    t.Cleanup(func() { setLogHandler(os.Stderr, "text") })
+    return &buf
+}
+
+func TestLogRedaction(t *testing.T) {
+    buf := captureLogs(t, "text")
+    l := logger("test")
+    l.Info("message received", "chat", "491701234567@s.whatsapp.net", "text", "meet me at noon")
+    l.Warn("whatsmeow says", "err", "failed to fetch 491701234567@s.whatsapp.net (+491701234567)")
+
+    out := buf.String()
+    for _, leak := range []string{"491701234567", "meet me at noon"} {
+        if strings.Contains(out, leak) {
+            t.Errorf("log output contains %q:\n%s", leak, out)
+        }
+    }
+    for _, want := range []string{"component=test", "567@s.whatsapp.net", `text="[15 chars]"`} {
+        if !strings.Contains(out, want) {
+            t.Errorf("log output lacks %q:\n%s", want, out)
+        }
+    }
+
+    logRedact.Store(false)
+    defer logRedact.Store(true)
+    buf.Reset()
+    l.Info("message received", "text", "meet me at noon")
+    if !strings.Contains(buf.String(), "meet me at noon") {
+        t.Errorf("text redacted with redaction off:\n%s", buf.String())
+    }
+}
+
+func TestComponentLevels(t *testing.T) {
+    buf := captureLogs(t, "json")
+    defaultLogLevel.Set(logLevelNames["INFO"])
+    t.Cleanup(func() { setComponentLevel("test", "") })
+
+    l := logger("test")
+    l.Debug("hidden")
+    if err := setComponentLevel("test", "debug"); err != nil {
+        t.Fatal(err)
+    }
+    l.Debug("shown")
+    logger("other").Debug("hidden")
+    if err := setComponentLevel("test", "loud"); err == nil {
+        t.Error("unknown level accepted")
+    }
+
+    out := buf.String()
+    if strings.Contains(out, "hidden") || !strings.Contains(out, `"msg":"shown"`) {
+        t.Errorf("unexpected output:\n%s", out)
+    }
+    if got := componentLevelOverrides()["test"]; got != "DEBUG" {
+        t.Errorf("override is %q, want DEBUG", got)
+    }
+}
+
+func TestLogRotation(t *testing.T) {
+    path := filepath.Join(t.TempDir(), logFileName)
+    f, err := openRotatingFile(path, 100, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    line := []byte(strings.Repeat("x", 59) + "\n")
+    for i := 0; i < 7; i++ {
+        if _, err := f.Write(line); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    for _, name := range []string{path, path + ".1", path + ".2"} {
+        info, err := os.Stat(name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if info.Size() > 100 {
+            t.Errorf("%s has %d bytes", name, info.Size())
+        }
+    }
+    if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+        t.Errorf("more than 2 old files kept")
+    }
+}
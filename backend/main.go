@@ -4,17 +4,16 @@ import (
     "context"
     "encoding/hex"
     "encoding/json"
+    "errors"
     "fmt"
     "io"
     "net/http"
     "os"
     "path/filepath"
     "sort"
+    "strconv"
     "strings"
-    "sync"
-    "syscall"
     "time"
-    "os/signal"
 
     _ "github.com/mutecomm/go-sqlcipher/v4"
     "go.mau.fi/whatsmeow"
@@ -22,31 +21,23 @@ import (
     "go.mau.fi/whatsmeow/store/sqlstore"
     "go.mau.fi/whatsmeow/types"
     "go.mau.fi/whatsmeow/types/events"
-    waLog "go.mau.fi/whatsmeow/util/log"
     "google.golang.org/protobuf/proto"
 )
 
-var client *whatsmeow.Client
 var container *sqlstore.Container
-var ctx = context.Background()
-var messages []Message
-var msgMutex sync.RWMutex
-var contacts = make(map[string]string)
-var contactsMutex sync.RWMutex
-var avatars = make(map[string]string)
-var avatarsMutex sync.RWMutex
-var pairCode string
-var isConnected bool
-
-// Paths - homeDir for media, current dir for data
+// ctx is cancelled on shutdown, ending background work not tied to an
+// account
+var ctx, stopBackground = context.WithCancel(context.Background())
+var mainLog = logger("main")
+
+// How long after connecting the contact list is loaded, giving the
+// initial app state sync a head start
+var contactsLoadDelay = 2 * time.Second
+
+// homeDir for expanding ~ in paths, current dir for data
 var homeDir string
-var picturesDir string
-var videosDir string
-var audioDir string
-var documentsDir string
-var avatarsDir string
 
-// Data files in current working directory
+// Data files, in each account's directory
 var messagesFile = "messages.enc"
 var contactsFile = "contacts.enc"
 var avatarsFile = "avatars.enc"
@@ -115,6 +106,7 @@ type Message struct {
     FileName  string `json:"fileName,omitempty"`
     FileSize  uint64 `json:"fileSize,omitempty"`
     LocalPath string `json:"localPath,omitempty"`
+    Starred   bool   `json:"starred,omitempty"`
 }
 
 type Chat struct {
@@ -125,33 +117,79 @@ type Chat struct {
     FromMe      bool   `json:"fromMe"`
     IsGroup     bool   `json:"isGroup"`
     Avatar      string `json:"avatar,omitempty"`
+    Archived    bool   `json:"archived"`
+    Pinned      bool   `json:"pinned"`
+    Muted       bool   `json:"muted"`
+    MuteUntil   int64  `json:"muteUntil,omitempty"`
 }
 
+// writeFileAtomic replaces filename with data so that a crash leaves
+// either the old or the new contents: write a temp file in the same
+// directory, fsync it, rename it over the target and fsync the directory.
 func writeFileAtomic(filename string, data []byte) error {
-    return os.WriteFile(filename, data, 0600)
+    dir := filepath.Dir(filename)
+    tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".tmp*")
+    if err != nil {
+        return err
+    }
+    tmpName := tmp.Name()
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        os.Remove(tmpName)
+        return err
+    }
+    if err := tmp.Chmod(0600); err != nil {
+        tmp.Close()
+        os.Remove(tmpName)
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        os.Remove(tmpName)
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        os.Remove(tmpName)
+        return err
+    }
+    if err := os.Rename(tmpName, filename); err != nil {
+        os.Remove(tmpName)
+        return err
+    }
+    if d, err := os.Open(dir); err == nil {
+        d.Sync()
+        d.Close()
+    }
+    return nil
 }
 
 func readFileBytes(filename string) ([]byte, error) {
     return os.ReadFile(filename)
 }
 
-func initPaths() {
+func initPaths() error {
     homeDir = os.Getenv("HOME")
     if homeDir == "" {
         homeDir = "/home/defaultuser"
     }
     
-    picturesDir = filepath.Join(homeDir, "Pictures", "WhatsApp")
-    videosDir = filepath.Join(homeDir, "Videos", "WhatsApp")
-    audioDir = filepath.Join(homeDir, "Music", "WhatsApp")
-    documentsDir = filepath.Join(homeDir, "Documents", "WhatsApp")
-    avatarsDir = filepath.Join(homeDir, "Pictures", "WhatsApp", "avatars")
+    cfg := getConfig()
+    
+    // Data files are relative to the data dir
+    if err := os.MkdirAll(cfg.DataDir, 0700); err != nil {
+        return err
+    }
+    if err := os.Chdir(cfg.DataDir); err != nil {
+        return err
+    }
     
-    os.MkdirAll(picturesDir, 0755)
-    os.MkdirAll(videosDir, 0755)
-    os.MkdirAll(audioDir, 0755)
-    os.MkdirAll(documentsDir, 0755)
-    os.MkdirAll(avatarsDir, 0755)
+    // Each account gets its own subdirectories in these
+    os.MkdirAll(cfg.PicturesDir, 0755)
+    os.MkdirAll(cfg.VideosDir, 0755)
+    os.MkdirAll(cfg.AudioDir, 0755)
+    os.MkdirAll(cfg.DocumentsDir, 0755)
+    os.MkdirAll(cfg.AvatarsDir, 0755)
+    return nil
 }
 
 func getDBConnectionString() string {
@@ -163,102 +201,85 @@ func getDBConnectionString() string {
 }
 
 func initDatabase() error {
-    dbLog := waLog.Stdout("DB", "ERROR", true)
     var err error
-    container, err = sqlstore.New(ctx, "sqlite3", getDBConnectionString(), dbLog)
+    container, err = sqlstore.New(ctx, "sqlite3", getDBConnectionString(), newWALogger(dbLog))
     if err != nil {
         return fmt.Errorf("database error: %v", err)
     }
     return nil
 }
 
-func initClient() error {
-    device, err := container.GetFirstDevice(ctx)
+// openSession loads the database key, opens the database and connects
+// every account. It runs at startup, or on unlock in lock mode.
+func openSession() error {
+    var err error
+    encryptionKey, err = GetOrCreateKey()
     if err != nil {
-        return err
+        return fmt.Errorf("could not get encryption key: %v", err)
     }
-    clientLog := waLog.Stdout("Client", "WARN", true)
-    client = whatsmeow.NewClient(device, clientLog)
-    client.AddEventHandler(eventHandler)
-    return nil
-}
-
-func loadMessages() {
-    msgMutex.Lock()
-    defer msgMutex.Unlock()
-    
-    if err := LoadEncrypted(messagesFile, &messages); err != nil {
-        data, err := os.ReadFile("messages.json")
-        if err == nil {
-            json.Unmarshal(data, &messages)
-            fmt.Printf("📂 Migrated %d messages from unencrypted file\n", len(messages))
-            os.Remove("messages.json")
-            return
-        }
-        return
+    if err := prepareDatabase(); err != nil {
+        return fmt.Errorf("database error: %v", err)
     }
-    fmt.Printf("📂 Loaded %d messages (encrypted)\n", len(messages))
-}
 
-func saveMessages() {
-    msgMutex.RLock()
-    defer msgMutex.RUnlock()
+    // Initialize encrypted database
+    if err := initDatabase(); err != nil {
+        return err
+    }
+    dbLog.Info("database opened", "encrypted", len(encryptionKey) > 0)
     
-    if err := SaveEncrypted(messagesFile, messages); err != nil {
-        fmt.Printf("⚠️ Failed to save messages: %v\n", err)
+    // One client per device in the database, each with its own data files
+    if err := loadAccounts(); err != nil {
+        return fmt.Errorf("account error: %v", err)
     }
+    return nil
 }
 
-func loadContactsFromDisk() {
-    contactsMutex.Lock()
-    defer contactsMutex.Unlock()
+func (a *Account) loadMessages() {
+    a.msgMutex.Lock()
+    defer a.msgMutex.Unlock()
     
-    if err := LoadEncrypted(contactsFile, &contacts); err != nil {
-        data, err := os.ReadFile("contacts.json")
+    if err := LoadEncrypted(a.path(messagesFile), &a.messages); err != nil {
+        data, err := os.ReadFile(a.path("messages.json"))
         if err == nil {
-            json.Unmarshal(data, &contacts)
-            fmt.Printf("📂 Migrated %d contacts from unencrypted file\n", len(contacts))
-            os.Remove("contacts.json")
+            json.Unmarshal(data, &a.messages)
+            a.log.Info("migrated messages from unencrypted file", "count", len(a.messages))
+            os.Remove(a.path("messages.json"))
             return
         }
         return
     }
-    fmt.Printf("📂 Loaded %d contacts (encrypted)\n", len(contacts))
+    a.log.Debug("loaded messages", "count", len(a.messages))
 }
 
-func saveContacts() {
-    contactsMutex.RLock()
-    defer contactsMutex.RUnlock()
+func (a *Account) saveMessages() error {
+    a.msgMutex.RLock()
+    defer a.msgMutex.RUnlock()
     
-    if err := SaveEncrypted(contactsFile, contacts); err != nil {
-        fmt.Printf("⚠️ Failed to save contacts: %v\n", err)
-    }
+    return SaveEncrypted(a.path(messagesFile), a.messages)
 }
 
-func loadAvatarsFromDisk() {
-    avatarsMutex.Lock()
-    defer avatarsMutex.Unlock()
+func (a *Account) loadContactsFromDisk() {
+    a.contactsMutex.Lock()
+    defer a.contactsMutex.Unlock()
     
-    if err := LoadEncrypted(avatarsFile, &avatars); err != nil {
-        data, err := os.ReadFile("avatars.json")
+    if err := LoadEncrypted(a.path(contactsFile), &a.contacts); err != nil {
+        data, err := os.ReadFile(a.path("contacts.json"))
         if err == nil {
-            json.Unmarshal(data, &avatars)
-            fmt.Printf("📂 Migrated %d avatars from unencrypted file\n", len(avatars))
-            os.Remove("avatars.json")
+            json.Unmarshal(data, &a.contacts)
+            a.log.Info("migrated contacts from unencrypted file", "count", len(a.contacts))
+            os.Remove(a.path("contacts.json"))
             return
         }
         return
     }
-    fmt.Printf("📂 Loaded %d avatars (encrypted)\n", len(avatars))
+    a.log.Debug("loaded contacts", "count", len(a.contacts))
 }
 
-func saveAvatars() {
-    avatarsMutex.RLock()
-    defer avatarsMutex.RUnlock()
+func (a *Account) saveContacts() error {
+    a.contactsMutex.RLock()
+    defer a.contactsMutex.RUnlock()
     
-    if err := SaveEncrypted(avatarsFile, avatars); err != nil {
-        fmt.Printf("⚠️ Failed to save avatars: %v\n", err)
-    }
+    return SaveEncrypted(a.path(contactsFile), a.contacts)
 }
 
 func getMimeType(filename string) string {
@@ -276,144 +297,79 @@ func getExtFromMime(mimeType string) string {
     return ".bin"
 }
 
-func getMediaDir(mimeType string) string {
+func (a *Account) getMediaDir(mimeType string) string {
     switch {
     case strings.HasPrefix(mimeType, "image/"):
-        return picturesDir
+        return a.picturesDir
     case strings.HasPrefix(mimeType, "video/"):
-        return videosDir
+        return a.videosDir
     case strings.HasPrefix(mimeType, "audio/"):
-        return audioDir
+        return a.audioDir
     default:
-        return documentsDir
+        return a.documentsDir
     }
 }
 
-func downloadAvatar(jid string) string {
-    avatarsMutex.RLock()
-    if path, ok := avatars[jid]; ok {
-        avatarsMutex.RUnlock()
-        if _, err := os.Stat(path); err == nil {
-            return path
-        }
-    }
-    avatarsMutex.RUnlock()
-
-    if client == nil || !client.IsConnected() {
-        return ""
-    }
-
-    var fullJid types.JID
-    if len(jid) > 15 {
-        fullJid = types.NewJID(jid, "g.us")
-    } else {
-        fullJid = types.NewJID(jid, "s.whatsapp.net")
-    }
-
-    pic, err := client.GetProfilePictureInfo(ctx, fullJid, &whatsmeow.GetProfilePictureParams{})
-    if err != nil || pic == nil {
-        return ""
-    }
-
-    resp, err := http.Get(pic.URL)
-    if err != nil {
-        return ""
-    }
-    defer resp.Body.Close()
-
-    data, err := io.ReadAll(resp.Body)
-    if err != nil {
-        return ""
-    }
-
-    path := filepath.Join(avatarsDir, jid+".jpg")
-    err = os.WriteFile(path, data, 0644)
-    if err != nil {
-        return ""
-    }
-
-    avatarsMutex.Lock()
-    avatars[jid] = path
-    avatarsMutex.Unlock()
-    go saveAvatars()
-
-    fmt.Printf("🖼️ Downloaded avatar for %s\n", jid)
-    return path
-}
-
-func loadContacts() {
-    if client.Store.ID == nil {
+func (a *Account) loadContacts() {
+    if a.device.ID == nil {
         return
     }
-    contactsMutex.Lock()
-    allContacts, _ := client.Store.Contacts.GetAllContacts(ctx)
+    a.contactsMutex.Lock()
+    allContacts, _ := a.device.Contacts.GetAllContacts(a.ctx)
     for jid, info := range allContacts {
         name := info.PushName
         if info.FullName != "" {
             name = info.FullName
         }
         if name != "" {
-            contacts[jid.User] = name
+            a.contacts[jid.User] = name
         }
     }
-    contactsMutex.Unlock()
+    a.contactsMutex.Unlock()
     
-    groups, _ := client.GetJoinedGroups(ctx)
-    contactsMutex.Lock()
+    groups, _ := a.client.GetJoinedGroups(a.ctx)
+    a.contactsMutex.Lock()
     for _, group := range groups {
-        contacts[group.JID.User] = group.Name
+        a.contacts[group.JID.User] = group.Name
     }
-    contactsMutex.Unlock()
+    a.contactsMutex.Unlock()
     
-    fmt.Printf("📇 Loaded %d contacts/groups\n", len(contacts))
-    go saveContacts()
+    a.log.Info("contacts and groups loaded", "count", len(a.contacts))
+    a.markDirty(contactsFile)
 
-    go func() {
-        contactsMutex.RLock()
-        jids := make([]string, 0, len(contacts))
-        for jid := range contacts {
-            jids = append(jids, jid)
-        }
-        contactsMutex.RUnlock()
-
-        for _, jid := range jids {
-            avatarsMutex.RLock()
-            _, hasAvatar := avatars[jid]
-            avatarsMutex.RUnlock()
-            if !hasAvatar {
-                downloadAvatar(jid)
-                time.Sleep(100 * time.Millisecond)
-            }
-        }
-    }()
-}
+    a.contactsMutex.RLock()
+    jids := make([]string, 0, len(a.contacts))
+    for jid := range a.contacts {
+        jids = append(jids, jid)
+    }
+    a.contactsMutex.RUnlock()
 
-func getContactName(jid string) string {
-    contactsMutex.RLock()
-    defer contactsMutex.RUnlock()
-    if name, ok := contacts[jid]; ok {
-        return name
+    for _, jid := range jids {
+        a.avatarsMutex.RLock()
+        _, hasAvatar := a.avatars[jid]
+        a.avatarsMutex.RUnlock()
+        if !hasAvatar {
+            a.avatarFetcher.Enqueue(jid, false, false)
+        }
     }
-    return ""
 }
 
-func getAvatar(jid string) string {
-    avatarsMutex.RLock()
-    path, ok := avatars[jid]
-    avatarsMutex.RUnlock()
-    if ok {
-        if _, err := os.Stat(path); err == nil {
-            return path
-        }
+func (a *Account) getContactName(jid string) string {
+    a.contactsMutex.RLock()
+    defer a.contactsMutex.RUnlock()
+    if name, ok := a.contacts[jid]; ok {
+        return name
     }
     return ""
 }
 
-func downloadMedia(msgID string, msg whatsmeow.DownloadableMessage, mimeType string, origFileName string) (string, error) {
-    data, err := client.Download(ctx, msg)
+func (a *Account) downloadMedia(msgID string, msg whatsmeow.DownloadableMessage, mimeType string, origFileName string) (string, error) {
+    data, err := a.client.Download(a.ctx, msg)
     if err != nil {
+        mediaDownloadErrors.Inc(a.ID)
         return "", err
     }
+    mediaDownloadBytes.Add(float64(len(data)), a.ID)
     ext := getExtFromMime(mimeType)
     var filename string
     if origFileName != "" {
@@ -421,30 +377,107 @@ func downloadMedia(msgID string, msg whatsmeow.DownloadableMessage, mimeType str
     } else {
         filename = fmt.Sprintf("%s_%d%s", msgID, time.Now().Unix(), ext)
     }
-    dir := getMediaDir(mimeType)
+    dir := a.getMediaDir(mimeType)
     path := filepath.Join(dir, filename)
     err = os.WriteFile(path, data, 0644)
     if err != nil {
         return "", err
     }
-    fmt.Printf("📥 Downloaded: %s (%d bytes)\n", path, len(data))
+    a.log.Debug("media downloaded", "path", path, "bytes", len(data))
     return path, nil
 }
 
-func addMessage(m Message) {
-    msgMutex.Lock()
-    for _, existing := range messages {
+func (a *Account) addMessage(m Message) {
+    a.msgMutex.Lock()
+    for _, existing := range a.messages {
         if existing.ID == m.ID {
-            msgMutex.Unlock()
+            a.msgMutex.Unlock()
             return
         }
     }
-    messages = append(messages, m)
-    msgMutex.Unlock()
-    go saveMessages()
+    a.messages = append(a.messages, m)
+    a.msgMutex.Unlock()
+    a.markDirty(messagesFile)
+}
+
+// addMessages stores a batch of messages with a single save, skipping IDs
+// we already have. It returns how many were added.
+func (a *Account) addMessages(ms []Message) int {
+    a.msgMutex.Lock()
+    known := make(map[string]bool, len(a.messages))
+    for _, existing := range a.messages {
+        known[existing.ID] = true
+    }
+    added := 0
+    for _, m := range ms {
+        if known[m.ID] {
+            continue
+        }
+        known[m.ID] = true
+        a.messages = append(a.messages, m)
+        added++
+    }
+    a.msgMutex.Unlock()
+    if added > 0 {
+        a.markDirty(messagesFile)
+    }
+    return added
+}
+
+// findMessage returns a copy of the stored message with the given ID.
+// An empty chatJid matches any chat.
+func (a *Account) findMessage(chatJid, id string) (Message, bool) {
+    a.msgMutex.RLock()
+    defer a.msgMutex.RUnlock()
+    for _, m := range a.messages {
+        if m.ID == id && (m.ChatJID == chatJid || chatJid == "") {
+            return m, true
+        }
+    }
+    return Message{}, false
 }
 
-func eventHandler(evt interface{}) {
+// removeMessages drops every stored message matching the filter and
+// returns the removed ones.
+func (a *Account) removeMessages(match func(Message) bool) []Message {
+    a.msgMutex.Lock()
+    var removed []Message
+    kept := a.messages[:0]
+    for _, m := range a.messages {
+        if match(m) {
+            removed = append(removed, m)
+        } else {
+            kept = append(kept, m)
+        }
+    }
+    a.messages = kept
+    a.msgMutex.Unlock()
+    if len(removed) > 0 {
+        a.markDirty(messagesFile)
+    }
+    return removed
+}
+
+// updateMessage applies fn to the stored message with the given ID and
+// reports whether it was found. An empty chatJid matches any chat.
+func (a *Account) updateMessage(chatJid, id string, fn func(*Message)) bool {
+    a.msgMutex.Lock()
+    found := false
+    for i := range a.messages {
+        if a.messages[i].ID == id && (chatJid == "" || a.messages[i].ChatJID == chatJid) {
+            fn(&a.messages[i])
+            found = true
+            break
+        }
+    }
+    a.msgMutex.Unlock()
+    if found {
+        a.markDirty(messagesFile)
+    }
+    return found
+}
+
+func (a *Account) eventHandler(evt interface{}) {
     switch v := evt.(type) {
     case *events.Message:
         var text string
@@ -466,8 +499,10 @@ func eventHandler(evt interface{}) {
             if c := msg.ImageMessage.GetCaption(); c != "" {
                 text = c
             }
-            if path, err := downloadMedia(v.Info.ID, msg.ImageMessage, mimeType, ""); err == nil {
-                localPath = path
+            if shouldAutoDownload(mediaType, fileSize) {
+                if path, err := a.downloadMedia(v.Info.ID, msg.ImageMessage, mimeType, ""); err == nil {
+                    localPath = path
+                }
             }
         }
         
@@ -478,8 +513,10 @@ func eventHandler(evt interface{}) {
             if c := msg.VideoMessage.GetCaption(); c != "" {
                 text = c
             }
-            if path, err := downloadMedia(v.Info.ID, msg.VideoMessage, mimeType, ""); err == nil {
-                localPath = path
+            if shouldAutoDownload(mediaType, fileSize) {
+                if path, err := a.downloadMedia(v.Info.ID, msg.VideoMessage, mimeType, ""); err == nil {
+                    localPath = path
+                }
             }
         }
         
@@ -487,8 +524,10 @@ func eventHandler(evt interface{}) {
             mediaType = "audio"
             mimeType = msg.AudioMessage.GetMimetype()
             fileSize = msg.AudioMessage.GetFileLength()
-            if path, err := downloadMedia(v.Info.ID, msg.AudioMessage, mimeType, ""); err == nil {
-                localPath = path
+            if shouldAutoDownload(mediaType, fileSize) {
+                if path, err := a.downloadMedia(v.Info.ID, msg.AudioMessage, mimeType, ""); err == nil {
+                    localPath = path
+                }
             }
         }
         
@@ -500,71 +539,112 @@ func eventHandler(evt interface{}) {
             if c := msg.DocumentMessage.GetCaption(); c != "" {
                 text = c
             }
-            if path, err := downloadMedia(v.Info.ID, msg.DocumentMessage, mimeType, fileName); err == nil {
-                localPath = path
+            if shouldAutoDownload(mediaType, fileSize) {
+                if path, err := a.downloadMedia(v.Info.ID, msg.DocumentMessage, mimeType, fileName); err == nil {
+                    localPath = path
+                }
             }
         }
         
         if msg.StickerMessage != nil {
             mediaType = "sticker"
             mimeType = msg.StickerMessage.GetMimetype()
-            if path, err := downloadMedia(v.Info.ID, msg.StickerMessage, mimeType, ""); err == nil {
-                localPath = path
+            if shouldAutoDownload(mediaType, 0) {
+                if path, err := a.downloadMedia(v.Info.ID, msg.StickerMessage, mimeType, ""); err == nil {
+                    localPath = path
+                }
             }
         }
         
         chatJid := v.Info.Chat.User
         sender := v.Info.Sender.User
         if v.Info.IsFromMe {
-            sender = client.Store.ID.User
+            sender = a.device.ID.User
         }
         if v.Info.PushName != "" && !v.Info.IsFromMe {
-            contactsMutex.Lock()
-            contacts[sender] = v.Info.PushName
-            contactsMutex.Unlock()
-            go saveContacts()
+            a.contactsMutex.Lock()
+            a.contacts[sender] = v.Info.PushName
+            a.contactsMutex.Unlock()
+            a.markDirty(contactsFile)
         }
         
         if text != "" || mediaType != "" {
-            addMessage(Message{
+            m := Message{
                 ID: v.Info.ID, Sender: sender, Text: text, Timestamp: v.Info.Timestamp.Unix(),
                 FromMe: v.Info.IsFromMe, ChatJID: chatJid, MediaType: mediaType,
                 MimeType: mimeType, FileName: fileName, FileSize: fileSize, LocalPath: localPath,
-            })
+            }
+            a.addMessage(m)
             if mediaType != "" {
-                fmt.Printf("📩 %s: [%s] %s\n", chatJid, mediaType, text)
+                messagesReceived.Inc(a.ID, mediaType)
             } else {
-                fmt.Printf("📩 %s: %s\n", chatJid, text)
+                messagesReceived.Inc(a.ID, "text")
             }
+            emitMessageReceived(a, m)
+            notifyMessage(a, m)
+            a.log.Info("message received", "chat", chatJid, "id", m.ID, "media", mediaType, "text", text)
         }
         
     case *events.Connected:
-        isConnected = true
-        fmt.Println("✅ Connected")
+        a.isConnected = true
+        if a.connectedBefore {
+            reconnects.Inc(a.ID)
+        }
+        a.connectedBefore = true
+        a.log.Info("connected")
+        emitConnectionState(a, "connected")
         go func() {
-            time.Sleep(2 * time.Second)
-            loadContacts()
+            select {
+            case <-time.After(contactsLoadDelay):
+                a.loadContacts()
+            case <-a.ctx.Done():
+            }
         }()
+        a.avatarRevalidateOnce.Do(func() { go a.revalidateAvatars() })
+
+    case *events.Disconnected:
+        a.isConnected = false
+        emitConnectionState(a, "disconnected")
+
+    case *events.Receipt:
+        a.handleReceipt(v)
+
+    case *events.Picture:
+        a.handlePictureEvent(v)
+
+    case *events.Archive, *events.Pin, *events.Mute:
+        a.handleChatStateEvent(v)
+
+    case *events.Star:
+        a.handleStarEvent(v)
+
+    case *events.ClearChat, *events.DeleteChat, *events.DeleteForMe:
+        a.handleDeletionEvent(v)
         
     case *events.PairSuccess:
-        isConnected = true
-        pairCode = ""
-        fmt.Println("✅ Paired!")
+        a.isConnected = true
+        a.pairCode = ""
+        a.log.Info("paired", "phone", v.ID.User)
+        if err := saveAccountRecords(); err != nil {
+            a.log.Warn("couldn't save account list", "err", err)
+        }
+        emitConnectionState(a, "paired")
         
     case *events.LoggedOut:
-        isConnected = false
-        pairCode = ""
-        fmt.Println("❌ Logged out by server")
+        a.isConnected = false
+        a.pairCode = ""
+        a.log.Warn("logged out by server")
+        emitConnectionState(a, "logged_out")
         
     case *events.HistorySync:
-        fmt.Printf("📜 History sync: %d conversations\n", len(v.Data.Conversations))
+        a.log.Info("history sync", "conversations", len(v.Data.Conversations))
         for _, conv := range v.Data.Conversations {
             jidStr := conv.GetID()
             name := conv.GetName()
             if name != "" {
-                contactsMutex.Lock()
-                contacts[jidStr] = name
-                contactsMutex.Unlock()
+                a.contactsMutex.Lock()
+                a.contacts[jidStr] = name
+                a.contactsMutex.Unlock()
             }
             chatJid := jidStr
             if idx := strings.Index(jidStr, "@"); idx > 0 {
@@ -585,23 +665,25 @@ func eventHandler(evt interface{}) {
                     fromMe := hm.Message.GetKey().GetFromMe()
                     ts := int64(hm.Message.GetMessageTimestamp())
                     msgID := hm.Message.GetKey().GetID()
-                    addMessage(Message{
+                    a.addMessage(Message{
                         ID: msgID, Sender: chatJid, Text: text, Timestamp: ts,
                         FromMe: fromMe, ChatJID: chatJid,
                     })
                 }
             }
         }
-        go saveContacts()
-        fmt.Printf("📜 Total messages: %d\n", len(messages))
+        a.markDirty(contactsFile)
+        a.log.Debug("history sync done", "messages", len(a.messages))
     }
 }
 
-func getChats() []Chat {
-    msgMutex.RLock()
-    defer msgMutex.RUnlock()
+// getChats returns either the archived or the regular chats, pinned chats
+// first (most recently pinned on top), then by last message time.
+func (a *Account) getChats(archived bool) []Chat {
+    a.msgMutex.RLock()
+    defer a.msgMutex.RUnlock()
     chatMap := make(map[string]*Chat)
-    for _, msg := range messages {
+    for _, msg := range a.messages {
         jid := msg.ChatJID
         if jid == "" {
             jid = msg.Sender
@@ -619,25 +701,40 @@ func getChats() []Chat {
             }
         } else {
             chatMap[jid] = &Chat{
-                JID: jid, Name: getContactName(jid), LastMessage: lastMsg,
+                JID: jid, Name: a.getContactName(jid), LastMessage: lastMsg,
                 LastTime: msg.Timestamp, FromMe: msg.FromMe, IsGroup: isGroup,
-                Avatar: getAvatar(jid),
+                Avatar: a.getAvatar(jid),
             }
         }
     }
     chats := make([]Chat, 0, len(chatMap))
+    pinnedAt := make(map[string]int64)
     for _, c := range chatMap {
+        st := a.getChatState(c.JID)
+        if st.Archived != archived {
+            continue
+        }
+        c.Archived, c.Pinned, c.Muted, c.MuteUntil = st.Archived, st.Pinned, st.Muted, st.MuteUntil
+        pinnedAt[c.JID] = st.PinnedAt
         chats = append(chats, *c)
     }
-    sort.Slice(chats, func(i, j int) bool { return chats[i].LastTime > chats[j].LastTime })
+    sort.Slice(chats, func(i, j int) bool {
+        if chats[i].Pinned != chats[j].Pinned {
+            return chats[i].Pinned
+        }
+        if chats[i].Pinned && pinnedAt[chats[i].JID] != pinnedAt[chats[j].JID] {
+            return pinnedAt[chats[i].JID] > pinnedAt[chats[j].JID]
+        }
+        return chats[i].LastTime > chats[j].LastTime
+    })
     return chats
 }
 
-func getMessagesForChat(jid string) []Message {
-    msgMutex.RLock()
-    defer msgMutex.RUnlock()
+func (a *Account) getMessagesForChat(jid string) []Message {
+    a.msgMutex.RLock()
+    defer a.msgMutex.RUnlock()
     var result []Message
-    for _, msg := range messages {
+    for _, msg := range a.messages {
         if msg.ChatJID == jid || msg.Sender == jid {
             result = append(result, msg)
         }
@@ -646,7 +743,11 @@ func getMessagesForChat(jid string) []Message {
     return result
 }
 
-func sendMedia(to string, filePath string, caption string) error {
+func (a *Account) sendMedia(to string, filePath string, caption string) error {
+    if err := a.beginSend(); err != nil {
+        return err
+    }
+    defer a.sends.Done()
     data, err := os.ReadFile(filePath)
     if err != nil {
         return err
@@ -674,8 +775,9 @@ func sendMedia(to string, filePath string, caption string) error {
         mediaType = whatsmeow.MediaDocument
         mediaTypeStr = "document"
     }
-    uploaded, err := client.Upload(ctx, data, mediaType)
+    uploaded, err := a.client.Upload(a.sendCtx, data, mediaType)
     if err != nil {
+        sendFailures.Inc(a.ID, mediaTypeStr)
         return fmt.Errorf("upload failed: %v", err)
     }
     var msg *waE2E.Message
@@ -706,177 +808,390 @@ func sendMedia(to string, filePath string, caption string) error {
             FileLength: &fileLen, FileName: &fileName, Caption: &caption,
         }}
     }
-    resp, err := client.SendMessage(ctx, jid, msg)
+    resp, err := a.client.SendMessage(a.sendCtx, jid, msg)
     if err != nil {
+        sendFailures.Inc(a.ID, mediaTypeStr)
         return err
     }
-    addMessage(Message{
-        ID: resp.ID, Sender: client.Store.ID.User, Text: caption, Timestamp: time.Now().Unix(),
+    messagesSent.Inc(a.ID, mediaTypeStr)
+    a.addMessage(Message{
+        ID: resp.ID, Sender: a.device.ID.User, Text: caption, Timestamp: time.Now().Unix(),
         FromMe: true, ChatJID: to, MediaType: mediaTypeStr, MimeType: mimeType,
         FileName: fileName, FileSize: fileLen, LocalPath: filePath,
     })
-    fmt.Printf("📤 Sent %s to %s\n", fileName, to)
+    a.log.Info("media sent", "to", to, "file", fileName)
     return nil
 }
 
-func main() {
-    // Initialize paths first
-    initPaths()
-    
-    // Initialize Sailfish Secrets
-    if err := InitSecrets(); err != nil {
-        fmt.Printf("⚠️ Sailfish Secrets not available: %v\n", err)
-        fmt.Println("⚠️ Running without encryption (development mode)")
+// pairDevice requests a pairing code for phone, waiting up to 15 seconds
+// for the connection to the WhatsApp servers first.
+func (a *Account) pairDevice(phone string) (string, error) {
+    for i := 0; i < 30; i++ {
+        if a.client.IsConnected() {
+            break
+        }
+        time.Sleep(500 * time.Millisecond)
+    }
+    if !a.client.IsConnected() {
+        return "", fmt.Errorf("not connected to WhatsApp servers")
+    }
+    code, err := a.client.PairPhone(ctx, phone, true, whatsmeow.PairClientChrome, getConfig().DeviceName)
+    if err != nil {
+        return "", err
+    }
+    a.pairCode = code
+    a.log.Info("pairing code requested", "phone", phone, "code", code)
+    return code, nil
+}
+
+// logout unlinks the account's device and deletes its data. When it was
+// the last account the database is wiped and the key replaced too, and a
+// fresh account is set up, ready for a new pairing.
+func logout(a *Account) {
+    removeAccount(a)
+    if len(allAccounts()) > 0 {
+        return
     }
     
-    // Get or create encryption key
-    var err error
-    encryptionKey, err = GetOrCreateKey()
+    container.Close()
+    ClearKey()
+    os.Remove(dbFile)
+    os.Remove(dbFile + "-shm")
+    os.Remove(dbFile + "-wal")
+    
+    mainLog.Info("last account logged out, database wiped")
+    
+    go func() {
+        time.Sleep(time.Second)
+        
+        encryptionKey, _ = RegenerateKey()
+        
+        if err := initDatabase(); err != nil {
+            dbLog.Error("database reinit failed", "err", err)
+            return
+        }
+        
+        if _, err := addAccount(); err != nil {
+            accountLog.Error("account reinit failed", "err", err)
+            return
+        }
+        mainLog.Info("ready for new pairing")
+    }()
+}
+
+func (a *Account) sendText(to string, text string) (Message, error) {
+    if err := a.beginSend(); err != nil {
+        return Message{}, err
+    }
+    defer a.sends.Done()
+    var jid types.JID
+    if len(to) > 15 {
+        jid = types.NewJID(to, "g.us")
+    } else {
+        jid = types.NewJID(to, "s.whatsapp.net")
+    }
+    msg := &waE2E.Message{Conversation: proto.String(text)}
+    resp, err := a.client.SendMessage(a.sendCtx, jid, msg)
+    if err != nil {
+        sendFailures.Inc(a.ID, "text")
+        return Message{}, err
+    }
+    messagesSent.Inc(a.ID, "text")
+    m := Message{
+        ID: resp.ID, Sender: a.device.ID.User, Text: text,
+        Timestamp: time.Now().Unix(), FromMe: true, ChatJID: to,
+    }
+    a.addMessage(m)
+    return m, nil
+}
+
+// saveUpload stores a file posted by the UI so it can be sent from disk.
+func (a *Account) saveUpload(file io.Reader, name string) (string, error) {
+    path := filepath.Join(a.documentsDir, "upload_"+filepath.Base(name))
+    out, err := os.Create(path)
+    if err != nil {
+        return "", err
+    }
+    if _, err := io.Copy(out, file); err != nil {
+        out.Close()
+        os.Remove(path)
+        return "", err
+    }
+    return path, out.Close()
+}
+
+// writeBackupFile writes a backup to a local file, replacing it only once
+// the backup is complete.
+func (a *Account) writeBackupFile(out string, opts BackupOptions) error {
+    f, err := os.OpenFile(out+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+    if err != nil {
+        return err
+    }
+    err = a.writeBackup(f, opts)
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Rename(out+".tmp", out)
+    }
+    if err != nil {
+        os.Remove(out + ".tmp")
+    }
+    return err
+}
+
+// dataDirPath resolves a path given to a legacy route, relative to the data
+// directory, and refuses anything outside it.
+func dataDirPath(name string) (string, error) {
+    root, err := filepath.EvalSymlinks(getConfig().DataDir)
+    if err != nil {
+        return "", err
+    }
+    if !filepath.IsAbs(name) {
+        name = filepath.Join(root, name)
+    }
+    dir, err := filepath.EvalSymlinks(filepath.Dir(name))
     if err != nil {
-        fmt.Printf("⚠️ Could not get encryption key: %v\n", err)
+        return "", err
+    }
+    name = filepath.Join(dir, filepath.Base(name))
+    if rel, err := filepath.Rel(root, name); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+        return "", fmt.Errorf("%s is outside the data directory", name)
+    }
+    return name, nil
+}
+
+func main() {
+    // Configuration and paths first
+    if err := loadConfig(os.Args[1:]); err != nil {
+        mainLog.Error("config error", "err", err)
+        os.Exit(2)
+    }
+    if err := initPaths(); err != nil {
+        mainLog.Error("data directory error", "err", err)
+        os.Exit(1)
+    }
+    if err := acquireInstanceLock(getConfig().DataDir); err != nil {
+        // Its own exit code, so systemd doesn't keep restarting us
+        mainLog.Error("can't start", "err", err)
+        os.Exit(3)
     }
+    defer releaseInstanceLock()
+    if err := initLogging(); err != nil {
+        mainLog.Warn("log file not available, logging to stderr only", "err", err)
+    }
+    defer closeLogging()
     
-    // Initialize encrypted database
-    if err := initDatabase(); err != nil {
-        fmt.Printf("❌ Database error: %v\n", err)
-        return
+    // Open the key store holding the database key. With a passphrase
+    // lock the passphrase opens it, so that waits for /unlock.
+    cfg := getConfig()
+    if cfg.AppLock != "passphrase" {
+        if err := initKeyStore(); err != nil {
+            mainLog.Error("key store error", "err", err)
+            return
+        }
     }
-    fmt.Println("🔐 Database initialized with encryption")
     
-    // Initialize WhatsApp client
-    if err := initClient(); err != nil {
-        fmt.Printf("❌ Client error: %v\n", err)
+    if err := initAPIToken(); err != nil {
+        mainLog.Error("API token error", "err", err)
         return
     }
-    
-    // Load encrypted data files
-    loadMessages()
-    loadContactsFromDisk()
-    loadAvatarsFromDisk()
 
-    if client.Store.ID == nil {
-        fmt.Println("📱 No device ID - need to pair")
-    } else {
-        fmt.Println("📱 Device ID found, connecting...")
+    if err := initDBus(); err != nil {
+        mainLog.Warn("D-Bus service not available", "err", err)
+    }
+    if err := initNotifications(); err != nil {
+        mainLog.Warn("notifications not available", "err", err)
     }
-    go client.Connect()
+
+    if cfg.AppLock != "off" {
+        appLocked = true
+        lockLog.Info("locked, waiting for /unlock")
+    } else if err := openSession(); err != nil {
+        mainLog.Error("could not open the session", "err", err)
+        return
+    }
+    go runAutoLock()
 
     http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+        status := map[string]interface{}{
+            "connected": false,
+            "locked":    isLocked(),
+            "pairCode":  "",
+            "phone":     "",
+            "storage":   nil,
+        }
+        // Locked, there is no account to report on
+        a, err := accountFor(r)
+        if err == nil {
+            status["connected"] = a.isConnected
+            status["pairCode"] = a.pairCode
+            status["phone"] = a.phone()
+            status["storage"] = a.persister.Status()
+        } else if err.(*APIError).Code == "unknown_account" {
+            http.Error(w, err.Error(), 404)
+            return
+        }
         w.Header().Set("Content-Type", "application/json")
-        phone := ""
-        if client.Store.ID != nil {
-            phone = client.Store.ID.User
-        }
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "connected": isConnected,
-            "pairCode":  pairCode,
-            "phone":     phone,
-        })
+        json.NewEncoder(w).Encode(status)
     })
 
     http.HandleFunc("/pair", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
         phone := r.URL.Query().Get("phone")
         if phone == "" {
             http.Error(w, "phone required", 400)
             return
         }
-        for i := 0; i < 30; i++ {
-            if client.IsConnected() {
-                break
-            }
-            time.Sleep(500 * time.Millisecond)
-        }
-        if !client.IsConnected() {
-            http.Error(w, "not connected to WhatsApp servers", 500)
-            return
-        }
-        code, err := client.PairPhone(ctx, phone, true, whatsmeow.PairClientChrome, "Chrome (Linux)")
+        code, err := a.pairDevice(phone)
         if err != nil {
             http.Error(w, err.Error(), 500)
             return
         }
-        pairCode = code
-        fmt.Printf("📱 Pairing code: %s\n", code)
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(map[string]string{"code": code})
     })
 
     http.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
-        fmt.Println("🚪 Logging out...")
-        client.Disconnect()
-        if client.Store.ID != nil {
-            client.Logout(ctx)
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
         }
-        isConnected = false
-        pairCode = ""
-        
-        msgMutex.Lock()
-        messages = []Message{}
-        msgMutex.Unlock()
-        
-        contactsMutex.Lock()
-        contacts = make(map[string]string)
-        contactsMutex.Unlock()
-        
-        avatarsMutex.Lock()
-        avatars = make(map[string]string)
-        avatarsMutex.Unlock()
-        
-        ClearAllSecrets()
-        
-        os.Remove("wa.db")
-        os.Remove("wa.db-shm")
-        os.Remove("wa.db-wal")
-        os.Remove(messagesFile)
-        os.Remove(contactsFile)
-        os.Remove(avatarsFile)
-        os.RemoveAll(avatarsDir)
-        os.MkdirAll(avatarsDir, 0755)
-        
-        fmt.Println("✅ Logged out successfully")
+        logout(a)
         w.Write([]byte("ok"))
-        
-        go func() {
-            time.Sleep(time.Second)
-            
-            encryptionKey, _ = RegenerateKey()
-            
-            if err := initDatabase(); err != nil {
-                fmt.Printf("❌ Database reinit error: %v\n", err)
-                return
-            }
-            
-            if err := initClient(); err != nil {
-                fmt.Printf("❌ Client reinit error: %v\n", err)
-                return
-            }
-            
-            client.Connect()
-            fmt.Println("📱 Ready for new pairing")
-        }()
     })
 
     http.HandleFunc("/chats", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
         w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(getChats())
+        archived := r.URL.Query().Get("archived") == "1"
+        json.NewEncoder(w).Encode(a.getChats(archived))
+    })
+
+    http.HandleFunc("/archive", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
+        if !legacyLoggedIn(w, r, a) {
+            return
+        }
+        jid := r.URL.Query().Get("jid")
+        if jid == "" {
+            http.Error(w, "jid required", 400)
+            return
+        }
+        if err := a.setChatArchived(jid, r.URL.Query().Get("archive") != "0"); err != nil {
+            http.Error(w, err.Error(), 500)
+            return
+        }
+        w.Write([]byte("ok"))
+    })
+
+    http.HandleFunc("/pin", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
+        if !legacyLoggedIn(w, r, a) {
+            return
+        }
+        jid := r.URL.Query().Get("jid")
+        if jid == "" {
+            http.Error(w, "jid required", 400)
+            return
+        }
+        if err := a.setChatPinned(jid, r.URL.Query().Get("pin") != "0"); err != nil {
+            http.Error(w, err.Error(), 500)
+            return
+        }
+        w.Write([]byte("ok"))
+    })
+
+    http.HandleFunc("/mute", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
+        if !legacyLoggedIn(w, r, a) {
+            return
+        }
+        jid := r.URL.Query().Get("jid")
+        if jid == "" {
+            http.Error(w, "jid required", 400)
+            return
+        }
+        // duration in seconds, 0 or missing mutes forever
+        var duration time.Duration
+        if d := r.URL.Query().Get("duration"); d != "" {
+            secs, err := strconv.Atoi(d)
+            if err != nil || secs < 0 {
+                http.Error(w, "invalid duration", 400)
+                return
+            }
+            duration = time.Duration(secs) * time.Second
+        }
+        if err := a.setChatMuted(jid, r.URL.Query().Get("mute") != "0", duration); err != nil {
+            http.Error(w, err.Error(), 500)
+            return
+        }
+        w.Write([]byte("ok"))
     })
 
     http.HandleFunc("/contacts", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
         w.Header().Set("Content-Type", "application/json")
-        contactsMutex.RLock()
-        json.NewEncoder(w).Encode(contacts)
-        contactsMutex.RUnlock()
+        a.contactsMutex.RLock()
+        json.NewEncoder(w).Encode(a.contacts)
+        a.contactsMutex.RUnlock()
+    })
+
+    http.HandleFunc("/lookup", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
+        var phones []string
+        for _, p := range r.URL.Query()["phone"] {
+            phones = append(phones, strings.Split(p, ",")...)
+        }
+        if len(phones) == 0 {
+            http.Error(w, "phone required", 400)
+            return
+        }
+        infos, err := a.lookupContacts(phones)
+        if err != nil {
+            http.Error(w, err.Error(), 500)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(infos)
     })
 
     http.HandleFunc("/avatar/", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
         jid := strings.TrimPrefix(r.URL.Path, "/avatar/")
         if jid == "" {
             http.Error(w, "jid required", 400)
             return
         }
-        path := getAvatar(jid)
+        path := a.getAvatar(jid)
         if path == "" {
-            path = downloadAvatar(jid)
+            waitCtx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+            path = a.avatarFetcher.Wait(waitCtx, a.avatarFetcher.Enqueue(jid, false, true))
+            cancel()
         }
         if path != "" {
             http.ServeFile(w, r, path)
@@ -886,44 +1201,261 @@ func main() {
     })
 
     http.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
         jid := r.URL.Query().Get("jid")
         w.Header().Set("Content-Type", "application/json")
         if jid != "" {
-            json.NewEncoder(w).Encode(getMessagesForChat(jid))
+            json.NewEncoder(w).Encode(a.getMessagesForChat(jid))
         } else {
-            msgMutex.RLock()
-            json.NewEncoder(w).Encode(messages)
-            msgMutex.RUnlock()
+            a.msgMutex.RLock()
+            json.NewEncoder(w).Encode(a.messages)
+            a.msgMutex.RUnlock()
         }
     })
 
+    http.HandleFunc("/clearchat", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
+        if !legacyLoggedIn(w, r, a) {
+            return
+        }
+        jid := r.URL.Query().Get("jid")
+        if jid == "" {
+            http.Error(w, "jid required", 400)
+            return
+        }
+        q := r.URL.Query()
+        if err := a.clearChat(jid, q.Get("keepStarred") == "1", q.Get("media") == "1"); err != nil {
+            http.Error(w, err.Error(), 500)
+            return
+        }
+        w.Write([]byte("ok"))
+    })
+
+    http.HandleFunc("/deletechat", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
+        if !legacyLoggedIn(w, r, a) {
+            return
+        }
+        jid := r.URL.Query().Get("jid")
+        if jid == "" {
+            http.Error(w, "jid required", 400)
+            return
+        }
+        if err := a.deleteChat(jid, r.URL.Query().Get("media") == "1"); err != nil {
+            http.Error(w, err.Error(), 500)
+            return
+        }
+        w.Write([]byte("ok"))
+    })
+
+    http.HandleFunc("/deletemessage", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
+        if !legacyLoggedIn(w, r, a) {
+            return
+        }
+        id := r.URL.Query().Get("id")
+        if id == "" {
+            http.Error(w, "id required", 400)
+            return
+        }
+        if err := a.deleteMessageForMe(r.URL.Query().Get("jid"), id, r.URL.Query().Get("media") == "1"); err != nil {
+            http.Error(w, err.Error(), 500)
+            return
+        }
+        w.Write([]byte("ok"))
+    })
+
+    http.HandleFunc("/star", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
+        if !legacyLoggedIn(w, r, a) {
+            return
+        }
+        jid := r.URL.Query().Get("jid")
+        id := r.URL.Query().Get("id")
+        if id == "" {
+            http.Error(w, "id required", 400)
+            return
+        }
+        if err := a.setMessageStarred(jid, id, r.URL.Query().Get("star") != "0"); err != nil {
+            http.Error(w, err.Error(), 500)
+            return
+        }
+        w.Write([]byte("ok"))
+    })
+
+    http.HandleFunc("/starred", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(a.getStarredMessages())
+    })
+
+    http.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
+        opts, err := exportOptionsFromQuery(r.URL.Query())
+        if err != nil {
+            http.Error(w, err.Error(), 400)
+            return
+        }
+        a.serveExport(w, r.URL.Query().Get("jid"), opts)
+    })
+
+    http.HandleFunc("/import", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
+        if r.Method != "POST" {
+            http.Error(w, "POST required", 405)
+            return
+        }
+        opts := ImportOptions{ChatJID: r.URL.Query().Get("jid"), Me: r.URL.Query().Get("me")}
+        filePath := r.URL.Query().Get("file")
+        if filePath == "" {
+            upload, _, err := multipartTempFile(r)
+            if err != nil {
+                http.Error(w, err.Error(), 400)
+                return
+            }
+            defer os.Remove(upload)
+            filePath = upload
+        }
+        result, err := a.importChatArchive(filePath, opts)
+        if err != nil {
+            http.Error(w, err.Error(), 400)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(result)
+    })
+
+    http.HandleFunc("/backup", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
+        // The passphrase only comes in the body, never in the URL
+        if r.Method != "POST" {
+            http.Error(w, "POST required", 405)
+            return
+        }
+        opts := BackupOptions{
+            Passphrase: r.PostFormValue("passphrase"),
+            Session:    r.FormValue("session") == "1",
+            Media:      r.FormValue("media") == "1",
+        }
+        if opts.Passphrase == "" {
+            http.Error(w, "passphrase required", 400)
+            return
+        }
+        // With out= the backup is written to a file in the data directory
+        // instead of the response
+        if out := r.FormValue("out"); out != "" {
+            out, err := dataDirPath(out)
+            if err != nil {
+                http.Error(w, err.Error(), 400)
+                return
+            }
+            if err := a.writeBackupFile(out, opts); err != nil {
+                http.Error(w, err.Error(), 500)
+                return
+            }
+            w.Write([]byte("ok"))
+            return
+        }
+        w.Header().Set("Content-Type", "application/octet-stream")
+        w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+            "whatsapp-backup-"+time.Now().Format("20060102-150405")+".wabackup"))
+        if err := a.writeBackup(w, opts); err != nil {
+            a.log.Error("backup failed", "err", err)
+        }
+    })
+
+    http.HandleFunc("/restore", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
+        if r.Method != "POST" {
+            http.Error(w, "POST required", 405)
+            return
+        }
+        var in io.Reader
+        if filePath := r.URL.Query().Get("file"); filePath != "" {
+            f, err := os.Open(filePath)
+            if err != nil {
+                http.Error(w, err.Error(), 400)
+                return
+            }
+            defer f.Close()
+            in = f
+        } else {
+            r.ParseMultipartForm(100 << 20)
+            file, _, err := r.FormFile("file")
+            if err != nil {
+                http.Error(w, "file required", 400)
+                return
+            }
+            defer file.Close()
+            in = file
+        }
+        passphrase := r.FormValue("passphrase")
+        if passphrase == "" {
+            http.Error(w, "passphrase required", 400)
+            return
+        }
+        result, err := a.restoreBackup(in, passphrase)
+        if err != nil {
+            http.Error(w, err.Error(), 500)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(result)
+    })
+
     http.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
         to := r.URL.Query().Get("to")
         text := r.URL.Query().Get("text")
         if to == "" || text == "" {
             http.Error(w, "to and text required", 400)
             return
         }
-        var jid types.JID
-        if len(to) > 15 {
-            jid = types.NewJID(to, "g.us")
-        } else {
-            jid = types.NewJID(to, "s.whatsapp.net")
-        }
-        msg := &waE2E.Message{Conversation: proto.String(text)}
-        resp, err := client.SendMessage(ctx, jid, msg)
-        if err != nil {
+        if _, err := a.sendText(to, text); err != nil {
             http.Error(w, err.Error(), 500)
             return
         }
-        addMessage(Message{
-            ID: resp.ID, Sender: client.Store.ID.User, Text: text,
-            Timestamp: time.Now().Unix(), FromMe: true, ChatJID: to,
-        })
         w.Write([]byte("ok"))
     })
 
     http.HandleFunc("/sendmedia", func(w http.ResponseWriter, r *http.Request) {
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
         if r.Method != "POST" {
             http.Error(w, "POST required", 405)
             return
@@ -932,7 +1464,7 @@ func main() {
         caption := r.URL.Query().Get("caption")
         filePath := r.URL.Query().Get("file")
         if filePath != "" {
-            err := sendMedia(to, filePath, caption)
+            err := a.sendMedia(to, filePath, caption)
             if err != nil {
                 http.Error(w, err.Error(), 500)
                 return
@@ -947,15 +1479,12 @@ func main() {
             return
         }
         defer file.Close()
-        tempPath := filepath.Join(documentsDir, "upload_"+header.Filename)
-        out, err := os.Create(tempPath)
+        tempPath, err := a.saveUpload(file, header.Filename)
         if err != nil {
             http.Error(w, err.Error(), 500)
             return
         }
-        io.Copy(out, file)
-        out.Close()
-        err = sendMedia(to, tempPath, caption)
+        err = a.sendMedia(to, tempPath, caption)
         if err != nil {
             http.Error(w, err.Error(), 500)
             return
@@ -964,18 +1493,89 @@ func main() {
     })
 
     http.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
-        loadContacts()
+        a := legacyAccount(w, r)
+        if a == nil {
+            return
+        }
+        a.loadContacts()
         w.Write([]byte("ok"))
     })
 
-    fmt.Println("🚀 Backend running on http://localhost:8085")
-    go http.ListenAndServe(":8085", nil)
+    http.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        switch r.Method {
+        case http.MethodGet:
+            json.NewEncoder(w).Encode(getConfig())
+        case http.MethodPost, http.MethodPut:
+            body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+            if err != nil {
+                http.Error(w, err.Error(), 400)
+                return
+            }
+            restartRequired, err := updateConfig(body)
+            if err != nil {
+                http.Error(w, err.Error(), 400)
+                return
+            }
+            json.NewEncoder(w).Encode(map[string]interface{}{
+                "config":          getConfig(),
+                "restartRequired": restartRequired,
+            })
+        default:
+            http.Error(w, "GET or POST required", 405)
+        }
+    })
+
+    http.HandleFunc("/debug/loglevel", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodPost || r.Method == http.MethodPut {
+            var req LogLevelRequest
+            if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&req); err != nil {
+                http.Error(w, err.Error(), 400)
+                return
+            }
+            if err := setLogLevel(req); err != nil {
+                http.Error(w, err.Error(), 400)
+                return
+            }
+        } else if r.Method != http.MethodGet {
+            http.Error(w, "GET or PUT required", 405)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(currentLogLevels())
+    })
+
+    http.HandleFunc("/healthz", serveHealth)
+    http.HandleFunc("/shutdown", serveShutdown)
+    http.HandleFunc("/metrics", serveMetrics)
+
+    registerAPIv2(http.DefaultServeMux)
+
+    // The database is open, or waits for /unlock; once the API listens
+    // the backend is ready
+    listen := getConfig().Listen
+    ln, err := listenHTTP(listen)
+    if err != nil {
+        mainLog.Error("can't listen", "listen", listen, "err", err)
+        shutdownBackend("no listening socket")
+        closeLogging()
+        releaseInstanceLock()
+        os.Exit(1)
+    }
+    httpServer = &http.Server{Handler: requireAPIToken(requireUnlocked(http.DefaultServeMux))}
+    go func() {
+        if err := httpServer.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+            mainLog.Error("HTTP server failed", "err", err)
+            requestShutdown("HTTP server failed")
+        }
+    }()
+    mainLog.Info("backend running", "listen", ln.Addr().String())
+    status := "STATUS=Running"
+    if isLocked() {
+        status = "STATUS=Locked, waiting for unlock"
+    }
+    sdNotify("READY=1\n" + status)
+    go runWatchdog()
 
-    c := make(chan os.Signal, 1)
-    signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-    <-c
-    saveMessages()
-    saveContacts()
-    saveAvatars()
-    client.Disconnect()
+    shutdownBackend(waitForShutdown())
 }
@@ -0,0 +1,287 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "io/fs"
+    "math"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// /metrics serves counters, gauges and histograms in the Prometheus text
+// format. Counters and histograms are updated where things happen; gauges
+// are read from the accounts when scraped.
+
+type metric interface {
+    write(w io.Writer)
+}
+
+var metrics []metric
+
+var (
+    messagesReceived = newCounter("whatsapp_messages_received_total",
+        "Messages received, including those sent from the phone", "account", "type")
+    messagesSent = newCounter("whatsapp_messages_sent_total",
+        "Messages sent from this device", "account", "type")
+    sendFailures = newCounter("whatsapp_send_failures_total",
+        "Messages that could not be uploaded or sent", "account", "type")
+    mediaDownloadBytes = newCounter("whatsapp_media_download_bytes_total",
+        "Bytes of media downloaded", "account")
+    mediaDownloadErrors = newCounter("whatsapp_media_download_errors_total",
+        "Media downloads that failed", "account")
+    avatarFetches = newCounter("whatsapp_avatar_fetches_total",
+        "Profile picture lookups, by result", "account", "result")
+    reconnects = newCounter("whatsapp_reconnects_total",
+        "Connections after the first one", "account")
+    eventSeconds = newHistogram("whatsapp_event_handler_seconds",
+        "Time spent handling a WhatsApp event", []float64{.001, .005, .025, .1, .5, 2.5, 10}, "event")
+)
+
+func init() {
+    metrics = append(metrics, &gaugeFunc{
+        name: "whatsapp_connected", help: "Whether the account is connected to WhatsApp",
+        labels: []string{"account"},
+        collect: func(emit func(float64, ...string)) {
+            for _, a := range allAccounts() {
+                emit(boolValue(a.client.IsConnected()), a.ID)
+            }
+        },
+    }, &gaugeFunc{
+        name: "whatsapp_store_messages", help: "Messages kept by the account",
+        labels: []string{"account"},
+        collect: func(emit func(float64, ...string)) {
+            for _, a := range allAccounts() {
+                a.msgMutex.RLock()
+                n := len(a.messages)
+                a.msgMutex.RUnlock()
+                emit(float64(n), a.ID)
+            }
+        },
+    }, &gaugeFunc{
+        name: "whatsapp_store_bytes", help: "Size of the data files, by account, or of the shared database",
+        labels: []string{"store"},
+        collect: func(emit func(float64, ...string)) {
+            emit(float64(fileSize(dbFile)+fileSize(dbFile+"-wal")), "database")
+            for _, a := range allAccounts() {
+                emit(float64(dirSize(a.dir)), a.ID)
+            }
+        },
+    }, &gaugeFunc{
+        name: "whatsapp_persist_pending", help: "Data files waiting to be written",
+        labels: []string{"account"},
+        collect: func(emit func(float64, ...string)) {
+            for _, a := range allAccounts() {
+                pending, _ := a.persister.Counts()
+                emit(float64(pending), a.ID)
+            }
+        },
+    }, &gaugeFunc{
+        name: "whatsapp_persist_failing", help: "Data files whose last write failed",
+        labels: []string{"account"},
+        collect: func(emit func(float64, ...string)) {
+            for _, a := range allAccounts() {
+                _, failing := a.persister.Counts()
+                emit(float64(failing), a.ID)
+            }
+        },
+    })
+}
+
+func boolValue(b bool) float64 {
+    if b {
+        return 1
+    }
+    return 0
+}
+
+func fileSize(path string) int64 {
+    info, err := os.Stat(path)
+    if err != nil {
+        return 0
+    }
+    return info.Size()
+}
+
+func dirSize(dir string) int64 {
+    var total int64
+    filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+        if err == nil && d.Type().IsRegular() {
+            if info, err := d.Info(); err == nil {
+                total += info.Size()
+            }
+        }
+        return nil
+    })
+    return total
+}
+
+// timedEventHandler is the handler registered with the client; it times
+// eventHandler by event type and tells the watchdog while it runs.
+func (a *Account) timedEventHandler(evt interface{}) {
+    start := time.Now()
+    a.handlingSince.Store(start.UnixNano())
+    a.eventHandler(evt)
+    a.handlingSince.Store(0)
+    name := strings.TrimPrefix(fmt.Sprintf("%T", evt), "*events.")
+    eventSeconds.Observe(time.Since(start).Seconds(), name)
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "GET required", 405)
+        return
+    }
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    for _, m := range metrics {
+        m.write(w)
+    }
+}
+
+// Label values are kept joined by labelSep, which can't occur in them
+const labelSep = "\xff"
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelKey(values []string) string {
+    return strings.Join(values, labelSep)
+}
+
+func formatLabels(names []string, key string, extra ...string) string {
+    var parts []string
+    if len(names) > 0 {
+        for i, v := range strings.Split(key, labelSep) {
+            parts = append(parts, names[i]+`="`+labelEscaper.Replace(v)+`"`)
+        }
+    }
+    for i := 0; i+1 < len(extra); i += 2 {
+        parts = append(parts, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+    }
+    if len(parts) == 0 {
+        return ""
+    }
+    return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+    if math.IsInf(v, 1) {
+        return "+Inf"
+    }
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type counter struct {
+    name, help string
+    labels     []string
+    mu         sync.Mutex
+    values     map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+    c := &counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+    metrics = append(metrics, c)
+    return c
+}
+
+func (c *counter) Add(v float64, labelValues ...string) {
+    key := labelKey(labelValues)
+    c.mu.Lock()
+    c.values[key] += v
+    c.mu.Unlock()
+}
+
+func (c *counter) Inc(labelValues ...string) {
+    c.Add(1, labelValues...)
+}
+
+func (c *counter) write(w io.Writer) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+    keys := make([]string, 0, len(c.values))
+    for k := range c.values {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, k), formatValue(c.values[k]))
+    }
+}
+
+type histogram struct {
+    name, help string
+    labels     []string
+    buckets    []float64
+    mu         sync.Mutex
+    series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+    counts []uint64 // per bucket, not cumulative
+    sum    float64
+    count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+    h := &histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+    metrics = append(metrics, h)
+    return h
+}
+
+func (h *histogram) Observe(v float64, labelValues ...string) {
+    key := labelKey(labelValues)
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    s, ok := h.series[key]
+    if !ok {
+        s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+        h.series[key] = s
+    }
+    if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+        s.counts[i]++
+    }
+    s.sum += v
+    s.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+    keys := make([]string, 0, len(h.series))
+    for k := range h.series {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        s := h.series[k]
+        var cumulative uint64
+        for i, le := range h.buckets {
+            cumulative += s.counts[i]
+            fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", formatValue(le)), cumulative)
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", "+Inf"), s.count)
+        fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, k), formatValue(s.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, k), s.count)
+    }
+}
+
+// gaugeFunc reads its values when scraped.
+type gaugeFunc struct {
+    name, help string
+    labels     []string
+    collect    func(emit func(value float64, labelValues ...string))
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+    g.collect(func(v float64, labelValues ...string) {
+        fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, labelKey(labelValues)), formatValue(v))
+    })
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "go.mau.fi/whatsmeow/types/events"
+)
+
+func scrape(t *testing.T) string {
+    t.Helper()
+    rec := httptest.NewRecorder()
+    serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+    if rec.Code != 200 {
+        t.Fatalf("metrics: %d", rec.Code)
+    }
+    return rec.Body.String()
+}
+
+func health(t *testing.T) (int, HealthResponse) {
+    t.Helper()
+    rec := httptest.NewRecorder()
+    serveHealth(rec, httptest.NewRequest("GET", "/healthz", nil))
+    var h HealthResponse
+    if err := json.Unmarshal(rec.Body.Bytes(), &h); err != nil {
+        t.Fatal(err)
+    }
+    return rec.Code, h
+}
+
+func TestMetricsCountTraffic(t *testing.T) {
+    b := newTestBackend(t)
+    a, f := b.paired("491700000000")
+
+    f.Replay(
+        textEvent(alice, alice, "M1", "hi", 1000),
+        imageEvent(alice, alice, "M2", "", "/missing", 10, 1001),
+        &events.Disconnected{},
+        &events.Connected{},
+    )
+    b.do("POST", "/chats/"+alice.User+"/messages", SendTextRequest{Text: "yes"}, nil)
+    f.Fail("SendMessage", errFakeOffline)
+    b.do("POST", "/chats/"+alice.User+"/messages", SendTextRequest{Text: "lost"}, nil)
+
+    out := scrape(t)
+    for _, want := range []string{
+        `whatsapp_messages_received_total{account="` + a.ID + `",type="text"} 1`,
+        `whatsapp_messages_received_total{account="` + a.ID + `",type="image"} 1`,
+        `whatsapp_messages_sent_total{account="` + a.ID + `",type="text"} 1`,
+        `whatsapp_send_failures_total{account="` + a.ID + `",type="text"} 1`,
+        `whatsapp_media_download_errors_total{account="` + a.ID + `"} 1`,
+        `whatsapp_reconnects_total{account="` + a.ID + `"} 1`,
+        `whatsapp_connected{account="` + a.ID + `"} 1`,
+        `whatsapp_store_messages{account="` + a.ID + `"} 3`,
+        `whatsapp_event_handler_seconds_bucket{event="Message",le="+Inf"}`,
+        "# TYPE whatsapp_event_handler_seconds histogram",
+    } {
+        if !strings.Contains(out, want) {
+            t.Errorf("metrics lack %q", want)
+        }
+    }
+}
+
+func TestHealthReportsConnectionAndPersistence(t *testing.T) {
+    b := newTestBackend(t)
+    a, f := b.paired("491700000000")
+
+    code, h := health(t)
+    if code != 200 || h.Status != "ok" || len(h.Checks) != 3 {
+        t.Fatalf("healthy backend: %d %+v", code, h)
+    }
+
+    f.Disconnect()
+    a.persister.Stop()
+    code, h = health(t)
+    if code != http.StatusServiceUnavailable || h.Status != "fail" {
+        t.Fatalf("unhealthy backend: %d %+v", code, h)
+    }
+    failed := map[string]string{}
+    for _, c := range h.Checks {
+        if c.Status == "fail" {
+            failed[c.Name] = c.Detail
+        }
+    }
+    if failed["connection:"+a.ID] != "disconnected" || failed["persistence:"+a.ID] != "worker stopped" || len(failed) != 2 {
+        t.Errorf("failed checks = %v", failed)
+    }
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/godbus/dbus/v5"
+)
+
+const (
+    NOTIFY_NAME      = "org.freedesktop.Notifications"
+    NOTIFY_PATH      = "/org/freedesktop/Notifications"
+    NOTIFY_INTERFACE = "org.freedesktop.Notifications"
+
+    // Lines kept in a chat's notification body
+    notifyMaxLines = 5
+)
+
+// Notify runs in the event handler, so a notification server that doesn't
+// answer may only hold it up this long
+var notifyCallTimeout = 2 * time.Second
+
+// chatNotification is the one notification shown per chat; new messages
+// replace it with an updated body.
+type chatNotification struct {
+    id    uint32
+    count int
+    lines []string
+}
+
+// notifyKey identifies a chat of one account.
+type notifyKey struct {
+    account string
+    jid     string
+}
+
+// Notifier posts incoming messages to org.freedesktop.Notifications and
+// handles the reply and mark-read actions.
+type Notifier struct {
+    conn *dbus.Conn
+
+    mu         sync.Mutex
+    chats      map[notifyKey]*chatNotification
+    byID       map[uint32]notifyKey // notification id -> chat
+    activeChat notifyKey
+}
+
+var notifier *Notifier
+var notifyLog = logger("notify")
+
+func newNotifier(conn *dbus.Conn) (*Notifier, error) {
+    n := &Notifier{
+        conn:  conn,
+        chats: make(map[notifyKey]*chatNotification),
+        byID:  make(map[uint32]notifyKey),
+    }
+    for _, member := range []string{"ActionInvoked", "NotificationClosed", "NotificationReplied"} {
+        if err := conn.AddMatchSignal(
+            dbus.WithMatchObjectPath(NOTIFY_PATH),
+            dbus.WithMatchInterface(NOTIFY_INTERFACE),
+            dbus.WithMatchMember(member),
+        ); err != nil {
+            return nil, err
+        }
+    }
+    signals := make(chan *dbus.Signal, 16)
+    conn.Signal(signals)
+    go n.run(signals)
+    return n, nil
+}
+
+// initNotifications connects to the session bus for notifications. They
+// are always shown on the session bus, whatever bus the service uses.
+func initNotifications() error {
+    conn, err := dbus.ConnectSessionBus()
+    if err != nil {
+        return err
+    }
+    n, err := newNotifier(conn)
+    if err != nil {
+        conn.Close()
+        return err
+    }
+    notifier = n
+    return nil
+}
+
+func (n *Notifier) run(signals chan *dbus.Signal) {
+    for sig := range signals {
+        if len(sig.Body) < 2 {
+            continue
+        }
+        id, _ := sig.Body[0].(uint32)
+        n.mu.Lock()
+        key, ok := n.byID[id]
+        n.mu.Unlock()
+        if !ok {
+            continue
+        }
+        switch sig.Name {
+        case NOTIFY_INTERFACE + ".ActionInvoked":
+            action, _ := sig.Body[1].(string)
+            go n.handleAction(key, action)
+        case NOTIFY_INTERFACE + ".NotificationReplied":
+            text, _ := sig.Body[1].(string)
+            go n.handleReply(key, text)
+        case NOTIFY_INTERFACE + ".NotificationClosed":
+            n.forget(key)
+        }
+    }
+}
+
+func (n *Notifier) handleAction(key notifyKey, action string) {
+    switch action {
+    case "mark-read":
+        a := getAccount(key.account)
+        if a == nil {
+            break
+        }
+        if err := a.markChatRead(key.jid); err != nil {
+            notifyLog.Warn("mark read from notification failed", "err", err)
+        }
+    case "default":
+        // Opening the app is up to the notification server
+    }
+    n.Dismiss(key)
+}
+
+func (n *Notifier) handleReply(key notifyKey, text string) {
+    a := getAccount(key.account)
+    if a == nil || strings.TrimSpace(text) == "" {
+        return
+    }
+    if _, err := a.sendText(key.jid, text); err != nil {
+        notifyLog.Warn("reply from notification failed", "err", err)
+        return
+    }
+    a.markChatRead(key.jid)
+    n.Dismiss(key)
+}
+
+func (n *Notifier) forget(key notifyKey) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    if cn, ok := n.chats[key]; ok {
+        delete(n.byID, cn.id)
+        delete(n.chats, key)
+    }
+}
+
+// shouldNotify applies the suppression rules: no notifications for our own
+// messages, muted chats, messages already read, or the chat on screen.
+func (n *Notifier) shouldNotify(a *Account, m Message) bool {
+    if m.FromMe || !getConfig().Notifications || isLocked() {
+        return false
+    }
+    st := a.getChatState(m.ChatJID)
+    if st.Muted || m.Timestamp <= st.ReadUntil {
+        return false
+    }
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    return n.activeChat != notifyKey{a.ID, m.ChatJID}
+}
+
+func notificationLine(a *Account, m Message) string {
+    text := m.Text
+    if m.MediaType != "" {
+        label := map[string]string{
+            "image": "📷 Photo", "video": "🎥 Video", "audio": "🎵 Audio",
+            "document": "📄 " + m.FileName, "sticker": "Sticker",
+        }[m.MediaType]
+        if text != "" {
+            text = label + ": " + text
+        } else {
+            text = label
+        }
+    }
+    if userToJID(m.ChatJID).Server == "g.us" {
+        name := a.getContactName(m.Sender)
+        if name == "" {
+            name = "+" + m.Sender
+        }
+        text = name + ": " + text
+    }
+    return text
+}
+
+// Notify shows or updates the notification for the message's chat.
+func (n *Notifier) Notify(a *Account, m Message) {
+    if !n.shouldNotify(a, m) {
+        return
+    }
+    key := notifyKey{a.ID, m.ChatJID}
+    n.mu.Lock()
+    cn, ok := n.chats[key]
+    if !ok {
+        cn = &chatNotification{}
+        n.chats[key] = cn
+    }
+    cn.count++
+    cn.lines = append(cn.lines, notificationLine(a, m))
+    if len(cn.lines) > notifyMaxLines {
+        cn.lines = cn.lines[len(cn.lines)-notifyMaxLines:]
+    }
+    replaces := cn.id
+    count := cn.count
+    body := strings.Join(cn.lines, "\n")
+    n.mu.Unlock()
+
+    summary := a.getContactName(m.ChatJID)
+    if summary == "" {
+        summary = "+" + m.ChatJID
+        if userToJID(m.ChatJID).Server == "g.us" {
+            summary = "Group"
+        }
+    }
+    if count > 1 {
+        summary = fmt.Sprintf("%s (%d messages)", summary, count)
+    }
+    icon := a.getAvatar(m.ChatJID)
+    hints := map[string]dbus.Variant{
+        "category":               dbus.MakeVariant("im.received"),
+        "desktop-entry":          dbus.MakeVariant("harbour-whatsapp"),
+        "x-nemo-preview-summary": dbus.MakeVariant(summary),
+        "x-nemo-preview-body":    dbus.MakeVariant(notificationLine(a, m)),
+        "x-nemo-item-count":      dbus.MakeVariant(int32(count)),
+    }
+    if icon != "" {
+        hints["image-path"] = dbus.MakeVariant(icon)
+    }
+    actions := []string{"default", "Open", "inline-reply", "Reply", "mark-read", "Mark as read"}
+
+    var id uint32
+    callCtx, cancel := context.WithTimeout(context.Background(), notifyCallTimeout)
+    err := n.conn.Object(NOTIFY_NAME, NOTIFY_PATH).CallWithContext(callCtx, NOTIFY_INTERFACE+".Notify", 0,
+        "WhatsApp", replaces, icon, summary, body, actions, hints, int32(-1)).Store(&id)
+    cancel()
+    if err != nil {
+        notifyLog.Warn("notification failed", "err", err)
+        return
+    }
+    n.mu.Lock()
+    if cn, ok := n.chats[key]; ok {
+        delete(n.byID, cn.id)
+        cn.id = id
+        n.byID[id] = key
+    }
+    n.mu.Unlock()
+}
+
+// Dismiss closes the chat's notification, e.g. once it has been read.
+func (n *Notifier) Dismiss(key notifyKey) {
+    n.mu.Lock()
+    cn, ok := n.chats[key]
+    if ok {
+        delete(n.byID, cn.id)
+        delete(n.chats, key)
+    }
+    n.mu.Unlock()
+    if ok && cn.id != 0 {
+        callCtx, cancel := context.WithTimeout(context.Background(), notifyCallTimeout)
+        n.conn.Object(NOTIFY_NAME, NOTIFY_PATH).CallWithContext(callCtx, NOTIFY_INTERFACE+".CloseNotification", 0, cn.id)
+        cancel()
+    }
+}
+
+// SetActiveChat records the chat the UI has on screen, or an empty jid
+// for none. Its notification goes away and no new ones are shown for it.
+func (n *Notifier) SetActiveChat(key notifyKey) {
+    n.mu.Lock()
+    n.activeChat = key
+    n.mu.Unlock()
+    if key.jid != "" {
+        n.Dismiss(key)
+    }
+}
+
+// DismissMatching closes the notifications the filter selects; a nil
+// filter closes every one, e.g. when the app locks.
+func (n *Notifier) DismissMatching(filter func(notifyKey) bool) {
+    n.mu.Lock()
+    var keys []notifyKey
+    for key := range n.chats {
+        if filter == nil || filter(key) {
+            keys = append(keys, key)
+        }
+    }
+    n.mu.Unlock()
+    for _, key := range keys {
+        n.Dismiss(key)
+    }
+}
+
+func notifyMessage(a *Account, m Message) {
+    if notifier != nil {
+        notifier.Notify(a, m)
+    }
+}
+
+func dismissNotification(a *Account, jid string) {
+    if notifier != nil {
+        notifier.Dismiss(notifyKey{a.ID, jid})
+    }
+}
+
+func dismissAllNotifications() {
+    if notifier != nil {
+        notifier.DismissMatching(nil)
+    }
+}
+
+// dismissAccountNotifications closes the notifications of a removed account.
+func dismissAccountNotifications(id string) {
+    if notifier != nil {
+        notifier.DismissMatching(func(key notifyKey) bool { return key.account == id })
+    }
+}
+
+func setActiveChat(a *Account, jid string) {
+    if notifier != nil {
+        notifier.SetActiveChat(notifyKey{a.ID, jid})
+    }
+}
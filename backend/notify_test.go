@@ -0,0 +1,115 @@
+package main
+
+import (
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/godbus/dbus/v5"
+)
+
+// fakeNotifications is a notification server that can be made to hang.
+type fakeNotifications struct {
+    mu        sync.Mutex
+    summaries []string
+    closed    []uint32
+    hang      chan struct{}
+}
+
+func (f *fakeNotifications) Notify(app string, replaces uint32, icon, summary, body string, actions []string, hints map[string]dbus.Variant, timeout int32) (uint32, *dbus.Error) {
+    f.mu.Lock()
+    hang := f.hang
+    f.mu.Unlock()
+    if hang != nil {
+        <-hang
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.summaries = append(f.summaries, summary)
+    return uint32(len(f.summaries)), nil
+}
+
+func (f *fakeNotifications) CloseNotification(id uint32) *dbus.Error {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.closed = append(f.closed, id)
+    return nil
+}
+
+// newTestNotifier serves fake notifications on a private bus and returns
+// a notifier talking to them.
+func newTestNotifier(t *testing.T) (*Notifier, *fakeNotifications) {
+    t.Helper()
+    address := startTestBus(t)
+    server, err := dbus.Connect(address)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { server.Close() })
+    f := &fakeNotifications{}
+    if err := server.Export(f, NOTIFY_PATH, NOTIFY_INTERFACE); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := server.RequestName(NOTIFY_NAME, dbus.NameFlagDoNotQueue); err != nil {
+        t.Fatal(err)
+    }
+    conn, err := dbus.Connect(address)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    n, err := newNotifier(conn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    configMutex.Lock()
+    config.Notifications = true
+    configMutex.Unlock()
+    return n, f
+}
+
+func TestNotify(t *testing.T) {
+    b := newTestBackend(t)
+    a, _ := b.paired("491700000000")
+    n, f := newTestNotifier(t)
+
+    n.Notify(a, Message{ID: "M1", ChatJID: alice.User, Sender: alice.User, Text: "one", Timestamp: time.Now().Unix()})
+    n.Notify(a, Message{ID: "M2", ChatJID: alice.User, Sender: alice.User, Text: "two", Timestamp: time.Now().Unix()})
+    // Our own messages don't notify
+    n.Notify(a, Message{ID: "M3", ChatJID: alice.User, Sender: a.device.ID.User, Text: "three", FromMe: true, Timestamp: time.Now().Unix()})
+    f.mu.Lock()
+    summaries := append([]string(nil), f.summaries...)
+    f.mu.Unlock()
+    if len(summaries) != 2 || summaries[1] != "+"+alice.User+" (2 messages)" {
+        t.Errorf("summaries = %q", summaries)
+    }
+
+    n.Dismiss(notifyKey{a.ID, alice.User})
+    f.mu.Lock()
+    closed := append([]uint32(nil), f.closed...)
+    f.mu.Unlock()
+    if len(closed) != 1 || closed[0] != 2 {
+        t.Errorf("closed = %v", closed)
+    }
+}
+
+func TestNotifyDoesNotHangOnServer(t *testing.T) {
+    b := newTestBackend(t)
+    a, _ := b.paired("491700000000")
+    n, f := newTestNotifier(t)
+    saved := notifyCallTimeout
+    notifyCallTimeout = 100 * time.Millisecond
+    defer func() { notifyCallTimeout = saved }()
+
+    hang := make(chan struct{})
+    defer close(hang)
+    f.mu.Lock()
+    f.hang = hang
+    f.mu.Unlock()
+
+    start := time.Now()
+    n.Notify(a, Message{ID: "M1", ChatJID: alice.User, Sender: alice.User, Text: "one", Timestamp: time.Now().Unix()})
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Errorf("Notify took %s with a hanging server", elapsed)
+    }
+}
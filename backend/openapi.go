@@ -0,0 +1,178 @@
+package main
+
+import (
+    "reflect"
+    "regexp"
+    "strings"
+)
+
+var pathParamRe = regexp.MustCompile(`\{(\w+)\}`)
+
+// openAPIBuilder turns the route table into an OpenAPI 3 document. Named
+// struct types become components so they're described once.
+type openAPIBuilder struct {
+    schemas map[string]interface{}
+}
+
+func (b *openAPIBuilder) schema(t reflect.Type) map[string]interface{} {
+    for t.Kind() == reflect.Ptr {
+        t = t.Elem()
+    }
+    switch t.Kind() {
+    case reflect.Bool:
+        return map[string]interface{}{"type": "boolean"}
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return map[string]interface{}{"type": "integer"}
+    case reflect.Float32, reflect.Float64:
+        return map[string]interface{}{"type": "number"}
+    case reflect.String:
+        return map[string]interface{}{"type": "string"}
+    case reflect.Slice, reflect.Array:
+        if t.Elem().Kind() == reflect.Uint8 {
+            return map[string]interface{}{"type": "string", "format": "byte"}
+        }
+        return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+    case reflect.Map:
+        return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+    case reflect.Interface:
+        return map[string]interface{}{}
+    case reflect.Struct:
+        ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+        if _, done := b.schemas[t.Name()]; done {
+            return ref
+        }
+        // Placeholder first, in case the type refers to itself
+        b.schemas[t.Name()] = nil
+        props := make(map[string]interface{})
+        for i := 0; i < t.NumField(); i++ {
+            f := t.Field(i)
+            if !f.IsExported() {
+                continue
+            }
+            name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+            if name == "-" {
+                continue
+            }
+            if name == "" {
+                name = f.Name
+            }
+            props[name] = b.schema(f.Type)
+        }
+        b.schemas[t.Name()] = map[string]interface{}{"type": "object", "properties": props}
+        return ref
+    }
+    return map[string]interface{}{}
+}
+
+func (b *openAPIBuilder) operation(route apiRoute) map[string]interface{} {
+    var params []interface{}
+    for _, m := range pathParamRe.FindAllStringSubmatch(route.Path, -1) {
+        params = append(params, map[string]interface{}{
+            "name": m[1], "in": "path", "required": true,
+            "schema": map[string]interface{}{"type": "string"},
+        })
+    }
+    for _, q := range route.Query {
+        params = append(params, map[string]interface{}{
+            "name": q.Name, "in": "query", "description": q.Description,
+            "schema": map[string]interface{}{"type": q.Type},
+        })
+    }
+    if !route.Global {
+        params = append(params, map[string]interface{}{
+            "name": "account", "in": "query", "description": "account ID, the default account if empty; also read from X-Account",
+            "schema": map[string]interface{}{"type": "string"},
+        })
+    }
+
+    op := map[string]interface{}{
+        "summary":     route.Summary,
+        "operationId": strings.ToLower(route.Method) + operationName(route.Path),
+        "responses": map[string]interface{}{
+            "default": map[string]interface{}{
+                "description": "Error",
+                "content": map[string]interface{}{
+                    "application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(ErrorResponse{}))},
+                },
+            },
+        },
+    }
+    if len(params) > 0 {
+        op["parameters"] = params
+    }
+
+    if route.Body != nil {
+        content := map[string]interface{}{
+            "application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(route.Body))},
+        }
+        if route.Multipart {
+            content["multipart/form-data"] = map[string]interface{}{
+                "schema": map[string]interface{}{
+                    "type": "object",
+                    "properties": map[string]interface{}{
+                        "file": map[string]interface{}{"type": "string", "format": "binary"},
+                    },
+                },
+            }
+        }
+        op["requestBody"] = map[string]interface{}{"required": true, "content": content}
+    }
+
+    var content map[string]interface{}
+    if route.Produces != "" {
+        content = map[string]interface{}{
+            route.Produces: map[string]interface{}{
+                "schema": map[string]interface{}{"type": "string", "format": "binary"},
+            },
+        }
+    } else {
+        content = map[string]interface{}{
+            "application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(route.Response))},
+        }
+    }
+    op["responses"].(map[string]interface{})["200"] = map[string]interface{}{
+        "description": "OK",
+        "content":     content,
+    }
+    return op
+}
+
+// operationName makes "/chats/{jid}/messages" into "ChatsJidMessages".
+func operationName(path string) string {
+    var b strings.Builder
+    for _, part := range strings.FieldsFunc(path, func(r rune) bool {
+        return r == '/' || r == '{' || r == '}' || r == '.'
+    }) {
+        b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+    }
+    return b.String()
+}
+
+func openAPISpec() map[string]interface{} {
+    b := &openAPIBuilder{schemas: make(map[string]interface{})}
+    paths := make(map[string]interface{})
+    for _, route := range apiRoutes {
+        item, _ := paths[apiPrefix+route.Path].(map[string]interface{})
+        if item == nil {
+            item = make(map[string]interface{})
+            paths[apiPrefix+route.Path] = item
+        }
+        item[strings.ToLower(route.Method)] = b.operation(route)
+    }
+    return map[string]interface{}{
+        "openapi": "3.0.3",
+        "info": map[string]interface{}{
+            "title":   "harbour-whatsapp backend",
+            "version": "2",
+        },
+        "paths": paths,
+        "components": map[string]interface{}{
+            "schemas": b.schemas,
+            "securitySchemes": map[string]interface{}{
+                "token": map[string]interface{}{"type": "http", "scheme": "bearer"},
+            },
+        },
+        "security": []interface{}{map[string]interface{}{"token": []string{}}},
+    }
+}
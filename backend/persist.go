@@ -0,0 +1,205 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Changes are collected for persistDebounce before anything is written,
+// so a burst of messages (history sync, imports) costs one write per file.
+// Everything still dirty is written at least every persistInterval.
+const persistDebounce = 500 * time.Millisecond
+const persistInterval = 30 * time.Second
+
+// Persister is the single goroutine that writes an account's data files.
+// Code that changes in-memory state calls markDirty instead of saving
+// directly.
+type Persister struct {
+    mu       sync.Mutex
+    dirty    map[string]bool
+    errors   map[string]string
+    lastSave int64
+    kick     chan struct{}
+    stop     chan struct{}
+    targets  map[string]func() error
+    log      *slog.Logger
+
+    // When the worker last went round its loop, for /healthz
+    heartbeat atomic.Int64
+    stopped   atomic.Bool
+
+    // Held while files are written, so Flush callers don't interleave
+    saveMu sync.Mutex
+}
+
+func newPersister(log *slog.Logger, targets map[string]func() error) *Persister {
+    p := &Persister{
+        log:     log,
+        dirty:   make(map[string]bool),
+        errors:  make(map[string]string),
+        kick:    make(chan struct{}, 1),
+        stop:    make(chan struct{}),
+        targets: targets,
+    }
+    p.heartbeat.Store(time.Now().Unix())
+    go p.run()
+    return p
+}
+
+func (p *Persister) MarkDirty(name string) {
+    p.mu.Lock()
+    p.dirty[name] = true
+    p.mu.Unlock()
+    select {
+    case p.kick <- struct{}{}:
+    default:
+    }
+}
+
+// Discard forgets pending writes, for when the files are about to be
+// deleted anyway.
+func (p *Persister) Discard() {
+    p.mu.Lock()
+    p.dirty = make(map[string]bool)
+    p.errors = make(map[string]string)
+    p.mu.Unlock()
+}
+
+// Stop ends the background saving. Pending changes are not written.
+func (p *Persister) Stop() {
+    if !p.stopped.Swap(true) {
+        close(p.stop)
+    }
+}
+
+func (p *Persister) run() {
+    ticker := time.NewTicker(persistInterval)
+    defer ticker.Stop()
+    var debounce <-chan time.Time
+    for {
+        p.heartbeat.Store(time.Now().Unix())
+        select {
+        case <-p.kick:
+            if debounce == nil {
+                debounce = time.After(persistDebounce)
+            }
+        case <-debounce:
+            debounce = nil
+            p.Flush()
+        case <-ticker.C:
+            p.Flush()
+        case <-p.stop:
+            return
+        }
+    }
+}
+
+// Flush writes every dirty file now. Files that fail stay dirty and are
+// retried on the next flush; the first error is returned.
+func (p *Persister) Flush() error {
+    p.saveMu.Lock()
+    defer p.saveMu.Unlock()
+
+    p.mu.Lock()
+    pending := p.dirty
+    p.dirty = make(map[string]bool)
+    p.mu.Unlock()
+
+    var firstErr error
+    for name := range pending {
+        save, ok := p.targets[name]
+        if !ok {
+            continue
+        }
+        err := save()
+        p.mu.Lock()
+        if err != nil {
+            p.dirty[name] = true
+            p.errors[name] = err.Error()
+        } else {
+            delete(p.errors, name)
+            p.lastSave = time.Now().Unix()
+        }
+        p.mu.Unlock()
+        if err != nil {
+            p.log.Warn("failed to save data file", "file", name, "err", err)
+            if firstErr == nil {
+                firstErr = err
+            }
+        }
+    }
+    return firstErr
+}
+
+// FlushAll marks every file dirty and writes them, used on shutdown and
+// before backups.
+func (p *Persister) FlushAll() error {
+    p.mu.Lock()
+    for name := range p.targets {
+        p.dirty[name] = true
+    }
+    p.mu.Unlock()
+    return p.Flush()
+}
+
+// Status reports the persistence state for /status.
+func (p *Persister) Status() map[string]interface{} {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    errs := make(map[string]string, len(p.errors))
+    for k, v := range p.errors {
+        errs[k] = v
+    }
+    return map[string]interface{}{
+        "pending":  len(p.dirty),
+        "lastSave": p.lastSave,
+        "errors":   errs,
+    }
+}
+
+// Counts returns how many files are waiting to be written and how many of
+// those failed last time.
+func (p *Persister) Counts() (pending, failing int) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return len(p.dirty), len(p.errors)
+}
+
+// stuckFor returns how long the worker has not gone round its loop, if
+// that is longer than it should. The ticker wakes it every persistInterval
+// at the latest.
+func (p *Persister) stuckFor() time.Duration {
+    if p.stopped.Load() {
+        return 0
+    }
+    if since := time.Since(time.Unix(p.heartbeat.Load(), 0)); since > 2*persistInterval {
+        return since
+    }
+    return 0
+}
+
+// Health fails when the worker is stopped or stuck, or a file can't be
+// written.
+func (p *Persister) Health() error {
+    if p.stopped.Load() {
+        return fmt.Errorf("worker stopped")
+    }
+    if stuck := p.stuckFor(); stuck > 0 {
+        return fmt.Errorf("worker stuck for %v", stuck.Round(time.Second))
+    }
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if len(p.errors) > 0 {
+        names := make([]string, 0, len(p.errors))
+        for name := range p.errors {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        return fmt.Errorf("saving %s failed: %s", names[0], p.errors[names[0]])
+    }
+    return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+    "strings"
+    "time"
+
+    "go.mau.fi/whatsmeow/types"
+    "go.mau.fi/whatsmeow/types/events"
+)
+
+// receiptTypeName maps a receipt type to the name used by the API and
+// D-Bus signals.
+func receiptTypeName(t types.ReceiptType) string {
+    switch t {
+    case types.ReceiptTypeDelivered:
+        return "delivered"
+    case types.ReceiptTypeRead, types.ReceiptTypeReadSelf:
+        return "read"
+    case types.ReceiptTypePlayed, types.ReceiptTypePlayedSelf:
+        return "played"
+    }
+    return string(t)
+}
+
+// markChatRead sends read receipts for every incoming message newer than
+// the chat's read marker and moves the marker forward.
+func (a *Account) markChatRead(jid string) error {
+    readUntil := a.getChatState(jid).ReadUntil
+    chat := userToJID(jid)
+
+    // Receipts in groups are sent per sender
+    unread := make(map[string][]types.MessageID)
+    var last int64
+    for _, m := range a.getMessagesForChat(jid) {
+        if m.FromMe || m.Timestamp <= readUntil || isImportedMessage(m) {
+            continue
+        }
+        sender := ""
+        if chat.Server == types.GroupServer {
+            sender = m.Sender
+        }
+        unread[sender] = append(unread[sender], m.ID)
+        if m.Timestamp > last {
+            last = m.Timestamp
+        }
+    }
+    if len(unread) == 0 {
+        dismissNotification(a, jid)
+        return nil
+    }
+    for sender, ids := range unread {
+        var senderJID types.JID
+        if sender != "" {
+            senderJID = types.NewJID(sender, types.DefaultUserServer)
+        }
+        if err := a.client.MarkRead(a.ctx, ids, time.Now(), chat, senderJID); err != nil {
+            return err
+        }
+    }
+    a.applyReadUntil(jid, last)
+    dismissNotification(a, jid)
+    return nil
+}
+
+func (a *Account) applyReadUntil(jid string, ts int64) {
+    a.updateChatState(jid, func(st *ChatState) {
+        if ts > st.ReadUntil {
+            st.ReadUntil = ts
+        }
+    })
+}
+
+func isImportedMessage(m Message) bool {
+    return strings.HasPrefix(m.ID, "import-")
+}
+
+func (a *Account) handleReceipt(v *events.Receipt) {
+    chatJid := v.Chat.User
+    if v.IsFromMe && (v.Type == types.ReceiptTypeRead || v.Type == types.ReceiptTypeReadSelf) {
+        // Read on one of our other devices
+        a.applyReadUntil(chatJid, v.Timestamp.Unix())
+        dismissNotification(a, chatJid)
+    }
+    ids := make([]string, len(v.MessageIDs))
+    for i, id := range v.MessageIDs {
+        ids[i] = string(id)
+    }
+    emitReceiptUpdated(a, chatJid, v.Sender.User, ids, receiptTypeName(v.Type), v.Timestamp.Unix())
+    if v.Type == types.ReceiptTypeRead {
+        a.log.Debug("messages read", "chat", chatJid, "sender", v.Sender.User, "count", len(ids))
+    }
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+    "context"
     "crypto/rand"
     "encoding/json"
+    "errors"
     "fmt"
     "os"
+    "sync"
     "time"
 
     "github.com/godbus/dbus/v5"
@@ -15,206 +18,335 @@ const (
     SECRET_KEY_NAME = "encryption-key"
     DEFAULT_PLUGIN  = "org.sailfishos.secrets.plugin.encryptedstorage.sqlcipher"
 
+    // The device unlock reads this secret from a collection that relocks
+    // with the device, so the daemon asks for the lock code to release it
+    UNLOCK_COLLECTION_NAME = "harbour-whatsapp-unlock"
+    UNLOCK_SECRET_NAME     = "unlock-check"
+
+    SECRETS_PATH      = "/Sailfish/Secrets"
+    SECRETS_INTERFACE = "org.sailfishos.secrets"
+
+    RESULT_SUCCEEDED = 0
+    RESULT_PENDING   = 1
+    RESULT_FAILED    = 2
+
+    // Result::ErrorCode values the backend tells apart
+    ERROR_INVALID_SECRET       = 20
+    ERROR_INVALID_SECRET_ID    = 21
+    ERROR_INVALID_COLLECTION   = 23
+    ERROR_COLLECTION_EXISTS    = 26
+    ERROR_SECRET_EXISTS        = 27
+    ERROR_COLLECTION_LOCKED    = 30
+    ERROR_INTERACTION_CANCELED = 42
+
     USER_INTERACTION_SYSTEM   = 2
     DEVICE_LOCK_KEEP_UNLOCKED = 0
+    DEVICE_LOCK_RELOCK        = 2
     ACCESS_CONTROL_OWNER_ONLY = 0
+
+    // Default deadline for calls that need no user interaction
+    secretsCallTimeout = 3 * time.Second
 )
 
+// secretsEnum is how the daemon marshals its enums: a struct of one int.
+type secretsEnum struct {
+    Value int32
+}
+
+// secretsResult is the Sailfish::Secrets::Result every method returns first.
+type secretsResult struct {
+    Code         int32
+    ErrorCode    int32
+    ErrorMessage string
+}
+
+// SecretsError is a failed Result from the daemon.
+type SecretsError struct {
+    Method string
+    Result secretsResult
+}
+
+func (e *SecretsError) Error() string {
+    return fmt.Sprintf("%s failed (%d): %s", e.Method, e.Result.ErrorCode, e.Result.ErrorMessage)
+}
+
+// secretsErrorCode returns the daemon's error code, or -1 when err isn't
+// a failed Result.
+func secretsErrorCode(err error) int32 {
+    var serr *SecretsError
+    if errors.As(err, &serr) {
+        return serr.Result.ErrorCode
+    }
+    return -1
+}
+
+// isSecretMissing tells whether the daemon failed because the secret or
+// its collection doesn't exist. Any other failure may hide a stored
+// secret and must not be taken for a missing one.
+func isSecretMissing(err error) bool {
+    switch secretsErrorCode(err) {
+    case ERROR_INVALID_SECRET, ERROR_INVALID_SECRET_ID, ERROR_INVALID_COLLECTION:
+        return true
+    }
+    return false
+}
+
+type secretIdentifier struct {
+    Name              string
+    CollectionName    string
+    StoragePluginName string
+}
+
+type sailfishSecret struct {
+    Identifier secretIdentifier
+    Data       []byte
+    FilterData map[string]string
+}
+
+type interactionParameters struct {
+    SecretName               string
+    CollectionName           string
+    PluginName               string
+    ApplicationID            string
+    Operation                secretsEnum
+    AuthenticationPluginName string
+    PromptText               map[int32]string
+    InputType                secretsEnum
+    EchoMode                 secretsEnum
+}
+
+var systemInteraction = secretsEnum{USER_INTERACTION_SYSTEM}
+
+// SailfishSecrets talks to the secrets daemon over its peer-to-peer
+// socket. One connection is kept and replaced when it breaks.
 type SailfishSecrets struct {
     p2pAddress         string
     pluginName         string
     available          bool
     collectionVerified bool
+
+    mu   sync.Mutex
+    conn *dbus.Conn
 }
 
 var secrets *SailfishSecrets
 var encryptionKey []byte
 
-func (s *SailfishSecrets) getConnection() (*dbus.Conn, error) {
+func newSailfishSecrets(p2pAddress string) *SailfishSecrets {
+    return &SailfishSecrets{p2pAddress: p2pAddress, pluginName: DEFAULT_PLUGIN}
+}
+
+// connection returns the open connection or dials a new one. The
+// handshake is abandoned when ctx ends.
+func (s *SailfishSecrets) connection(ctx context.Context) (*dbus.Conn, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.conn != nil && s.conn.Connected() {
+        return s.conn, nil
+    }
     conn, err := dbus.Dial(s.p2pAddress)
     if err != nil {
         return nil, err
     }
+    stop := context.AfterFunc(ctx, func() { conn.Close() })
     err = conn.Auth(nil)
+    if !stop() {
+        return nil, ctx.Err()
+    }
     if err != nil {
         conn.Close()
         return nil, err
     }
+    s.conn = conn
     return conn, nil
 }
 
-func (s *SailfishSecrets) callWithTimeout(method string, timeout time.Duration, args ...interface{}) ([]interface{}, error) {
-    type result struct {
-        body []interface{}
-        err  error
+func (s *SailfishSecrets) Close() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.conn != nil {
+        s.conn.Close()
+        s.conn = nil
     }
-    done := make(chan result, 1)
+}
 
-    go func() {
-        conn, err := s.getConnection()
-        if err != nil {
-            done <- result{nil, err}
-            return
-        }
-        defer conn.Close()
+// call invokes method and stores the reply in out after the Result. A
+// reply of the wrong shape is an error, never a panic.
+func (s *SailfishSecrets) call(ctx context.Context, method string, args []interface{}, out ...interface{}) error {
+    conn, err := s.connection(ctx)
+    if err != nil {
+        return err
+    }
+    call := conn.Object("", SECRETS_PATH).CallWithContext(ctx, SECRETS_INTERFACE+"."+method, 0, args...)
+    if call.Err != nil {
+        return call.Err
+    }
+    var result secretsResult
+    if err := call.Store(append([]interface{}{&result}, out...)...); err != nil {
+        return fmt.Errorf("%s: unexpected reply: %v", method, err)
+    }
+    if result.Code != RESULT_SUCCEEDED {
+        return &SecretsError{Method: method, Result: result}
+    }
+    return nil
+}
 
-        obj := conn.Object("", "/Sailfish/Secrets")
-        call := obj.Call("org.sailfishos.secrets."+method, 0, args...)
-        done <- result{call.Body, call.Err}
-    }()
+func (s *SailfishSecrets) identifier(name string) secretIdentifier {
+    return secretIdentifier{Name: name, CollectionName: COLLECTION_NAME, StoragePluginName: s.pluginName}
+}
 
-    select {
-    case r := <-done:
-        return r.body, r.err
-    case <-time.After(timeout):
-        return nil, fmt.Errorf("timeout")
+// discoverSecrets asks the daemon on the session bus for its socket.
+func discoverSecrets(ctx context.Context) (string, error) {
+    bus, err := dbus.ConnectSessionBus(dbus.WithContext(ctx))
+    if err != nil {
+        return "", err
     }
+    defer bus.Close()
+    var address string
+    err = bus.Object("org.sailfishos.secrets.daemon.discovery", "/Sailfish/Secrets/Discovery").
+        CallWithContext(ctx, "org.sailfishos.secrets.daemon.discovery.peerToPeerAddress", 0).Store(&address)
+    return address, err
 }
 
 func InitSecrets() error {
-    secrets = &SailfishSecrets{pluginName: DEFAULT_PLUGIN}
-
-    done := make(chan error, 1)
-    go func() {
-        sessionBus, err := dbus.SessionBus()
-        if err != nil {
-            done <- err
-            return
-        }
-        defer sessionBus.Close()
-
-        obj := sessionBus.Object("org.sailfishos.secrets.daemon.discovery", "/Sailfish/Secrets/Discovery")
-        err = obj.Call("org.sailfishos.secrets.daemon.discovery.peerToPeerAddress", 0).Store(&secrets.p2pAddress)
-        done <- err
-    }()
-
-    select {
-    case err := <-done:
-        if err != nil {
-            return err
-        }
-    case <-time.After(3 * time.Second):
-        return fmt.Errorf("timeout connecting to secrets daemon")
+    ctx, cancel := context.WithTimeout(context.Background(), secretsCallTimeout)
+    defer cancel()
+    address, err := discoverSecrets(ctx)
+    if err != nil {
+        return fmt.Errorf("secrets daemon not found: %v", err)
     }
+    keysLog.Debug("Sailfish Secrets peer-to-peer socket", "address", address)
 
-    fmt.Printf("🔐 P2P socket: %s\n", secrets.p2pAddress)
-
-    testDone := make(chan error, 1)
-    go func() {
-        conn, err := secrets.getConnection()
-        if err != nil {
-            testDone <- err
-            return
-        }
-        conn.Close()
-        testDone <- nil
-    }()
-
-    select {
-    case err := <-testDone:
-        if err != nil {
-            return err
-        }
-    case <-time.After(2 * time.Second):
-        return fmt.Errorf("timeout testing secrets connection")
+    s := newSailfishSecrets(address)
+    if _, err := s.connection(ctx); err != nil {
+        return fmt.Errorf("secrets connection failed: %v", err)
     }
-
-    secrets.available = true
-    fmt.Println("🔐 Sailfish Secrets ready")
+    s.available = true
+    secrets = s
+    keysLog.Info("Sailfish Secrets ready")
     return nil
 }
 
-func (s *SailfishSecrets) ensureCollection() error {
-    if !s.available || s.collectionVerified {
-        return nil
-    }
-    s.callWithTimeout("createCollection", 2*time.Second,
+// CreateCollection creates the app's collection. It fails harmlessly if
+// the collection exists.
+func (s *SailfishSecrets) CreateCollection(ctx context.Context) error {
+    return s.call(ctx, "createCollection", []interface{}{
         COLLECTION_NAME, s.pluginName, s.pluginName,
-        []interface{}{int32(DEVICE_LOCK_KEEP_UNLOCKED)},
-        []interface{}{int32(ACCESS_CONTROL_OWNER_ONLY)})
-    s.collectionVerified = true
-    return nil
+        secretsEnum{DEVICE_LOCK_KEEP_UNLOCKED}, secretsEnum{ACCESS_CONTROL_OWNER_ONLY},
+    })
+}
+
+func (s *SailfishSecrets) ensureCollection(ctx context.Context) {
+    if s.collectionVerified {
+        return
+    }
+    if err := s.CreateCollection(ctx); err == nil || secretsErrorCode(err) == ERROR_COLLECTION_EXISTS {
+        s.collectionVerified = true
+    }
 }
 
-func (s *SailfishSecrets) StoreSecret(name string, data []byte) error {
+func (s *SailfishSecrets) SetSecret(ctx context.Context, name string, data []byte) error {
     if !s.available {
         return fmt.Errorf("not available")
     }
-    s.ensureCollection()
-
-    secretId := []interface{}{name, COLLECTION_NAME, s.pluginName}
-    s.callWithTimeout("deleteSecret", 2*time.Second, secretId, []interface{}{int32(USER_INTERACTION_SYSTEM)}, "")
+    s.ensureCollection(ctx)
 
-    secret := []interface{}{secretId, data, map[string]interface{}{}}
-    uiParams := []interface{}{"", "", "", "", []interface{}{int32(0)}, "", map[int32]string{}, []interface{}{int32(0)}, []interface{}{int32(0)}}
-
-    _, err := s.callWithTimeout("setSecret", 3*time.Second, secret, uiParams, []interface{}{int32(USER_INTERACTION_SYSTEM)}, "")
-    if err != nil {
-        return fmt.Errorf("couldn't store key: %v", err)
+    // setSecret doesn't overwrite, so drop any old value first
+    if err := s.DeleteSecret(ctx, name); err != nil && !isSecretMissing(err) {
+        return err
     }
-    return nil
+    secret := sailfishSecret{Identifier: s.identifier(name), Data: data, FilterData: map[string]string{}}
+    return s.call(ctx, "setSecret", []interface{}{secret, interactionParameters{PromptText: map[int32]string{}}, systemInteraction, ""})
 }
 
-func (s *SailfishSecrets) RetrieveSecret(name string) ([]byte, error) {
+// GetSecret returns ErrSecretNotFound when the daemon reports a missing
+// secret or collection, and any other failure as it is.
+func (s *SailfishSecrets) GetSecret(ctx context.Context, name string) ([]byte, error) {
     if !s.available {
         return nil, fmt.Errorf("not available")
     }
-
-    body, err := s.callWithTimeout("getSecret", 3*time.Second,
-        []interface{}{name, COLLECTION_NAME, s.pluginName},
-        []interface{}{int32(USER_INTERACTION_SYSTEM)}, "")
-    if err != nil {
+    var secret sailfishSecret
+    err := s.call(ctx, "getSecret", []interface{}{s.identifier(name), systemInteraction, ""}, &secret)
+    if isSecretMissing(err) {
+        return nil, fmt.Errorf("%w: %v", ErrSecretNotFound, err)
+    } else if err != nil {
         return nil, err
     }
-
-    if len(body) >= 2 {
-        resultCode := body[0].([]interface{})
-        if resultCode[0].(int32) == 0 {
-            secret := body[1].([]interface{})
-            return secret[1].([]byte), nil
-        }
-    }
-    return nil, fmt.Errorf("failed")
+    return secret.Data, nil
 }
 
-func ClearAllSecrets() {
-    if secrets != nil && secrets.available {
-        secretId := []interface{}{SECRET_KEY_NAME, COLLECTION_NAME, secrets.pluginName}
-        secrets.callWithTimeout("deleteSecret", 2*time.Second, secretId, []interface{}{int32(USER_INTERACTION_SYSTEM)}, "")
-        secrets.callWithTimeout("deleteCollection", 2*time.Second, COLLECTION_NAME, secrets.pluginName, []interface{}{int32(USER_INTERACTION_SYSTEM)}, "")
+func (s *SailfishSecrets) DeleteSecret(ctx context.Context, name string) error {
+    if !s.available {
+        return fmt.Errorf("not available")
     }
-    encryptionKey = nil
+    return s.call(ctx, "deleteSecret", []interface{}{s.identifier(name), systemInteraction, ""})
 }
 
-func GetOrCreateKey() ([]byte, error) {
-    if secrets == nil || !secrets.available {
-        return nil, fmt.Errorf("Sailfish Secrets not available")
+// VerifyDeviceOwner reads the check secret from the unlock collection.
+// The collection relocks with the device, so the daemon only releases
+// the secret after the user has entered the lock code or fingerprint. A
+// missing secret is created and then read, which asks all the same.
+func (s *SailfishSecrets) VerifyDeviceOwner(ctx context.Context) error {
+    if !s.available {
+        return fmt.Errorf("not available")
     }
-    
-    if key, err := secrets.RetrieveSecret(SECRET_KEY_NAME); err == nil && len(key) == 32 {
-        fmt.Println("🔐 Encryption key loaded from Sailfish Secrets")
-        encryptionKey = key
-        return key, nil
+    err := s.call(ctx, "createCollection", []interface{}{
+        UNLOCK_COLLECTION_NAME, s.pluginName, s.pluginName,
+        secretsEnum{DEVICE_LOCK_RELOCK}, secretsEnum{ACCESS_CONTROL_OWNER_ONLY},
+    })
+    if err != nil && secretsErrorCode(err) != ERROR_COLLECTION_EXISTS {
+        return err
     }
-
-    fmt.Println("🔐 Generating new encryption key...")
-    key := make([]byte, 32)
-    if _, err := rand.Read(key); err != nil {
-        return nil, err
+    id := secretIdentifier{Name: UNLOCK_SECRET_NAME, CollectionName: UNLOCK_COLLECTION_NAME, StoragePluginName: s.pluginName}
+    var secret sailfishSecret
+    err = s.call(ctx, "getSecret", []interface{}{id, systemInteraction, ""}, &secret)
+    if isSecretMissing(err) {
+        check := make([]byte, 32)
+        if _, err := rand.Read(check); err != nil {
+            return err
+        }
+        created := sailfishSecret{Identifier: id, Data: check, FilterData: map[string]string{}}
+        if err := s.call(ctx, "setSecret", []interface{}{created, interactionParameters{PromptText: map[int32]string{}}, systemInteraction, ""}); err != nil {
+            return err
+        }
+        err = s.call(ctx, "getSecret", []interface{}{id, systemInteraction, ""}, &secret)
     }
-
-    if err := secrets.StoreSecret(SECRET_KEY_NAME, key); err != nil {
-        return nil, fmt.Errorf("couldn't store key: %v", err)
+    if err != nil {
+        return err
+    }
+    if len(secret.Data) == 0 {
+        return fmt.Errorf("getSecret: empty unlock check")
     }
+    return nil
+}
+
+// The KeyStore methods bound each call with secretsCallTimeout.
 
-    fmt.Println("🔐 Encryption key stored in Sailfish Secrets")
-    encryptionKey = key
-    return key, nil
+func (s *SailfishSecrets) Name() string { return "Sailfish Secrets" }
+
+func (s *SailfishSecrets) Load(name string) ([]byte, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), secretsCallTimeout)
+    defer cancel()
+    return s.GetSecret(ctx, name)
+}
+
+func (s *SailfishSecrets) Store(name string, data []byte) error {
+    ctx, cancel := context.WithTimeout(context.Background(), secretsCallTimeout)
+    defer cancel()
+    if err := s.SetSecret(ctx, name, data); err != nil {
+        return fmt.Errorf("couldn't store secret: %v", err)
+    }
+    return nil
 }
 
-func RegenerateKey() ([]byte, error) {
-    ClearAllSecrets()
-    return GetOrCreateKey()
+func (s *SailfishSecrets) Delete(name string) error {
+    ctx, cancel := context.WithTimeout(context.Background(), secretsCallTimeout)
+    defer cancel()
+    err := s.DeleteSecret(ctx, name)
+    if isSecretMissing(err) {
+        return fmt.Errorf("%w: %v", ErrSecretNotFound, err)
+    }
+    return err
 }
 
 // LoadEncrypted - plain JSON (no encryption)
@@ -232,5 +364,5 @@ func SaveEncrypted(filename string, v interface{}) error {
     if err != nil {
         return err
     }
-    return os.WriteFile(filename, data, 0600)
+    return writeFileAtomic(filename, data)
 }
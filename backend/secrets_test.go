@@ -0,0 +1,271 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/godbus/dbus/v5"
+)
+
+func newTestSecrets(t *testing.T, d *fakeSecretsDaemon) *SailfishSecrets {
+    t.Helper()
+    s := newSailfishSecrets(d.Address)
+    s.available = true
+    t.Cleanup(s.Close)
+    return s
+}
+
+func TestSecretsRoundTrip(t *testing.T) {
+    d := newFakeSecretsDaemon(t)
+    s := newTestSecrets(t, d)
+
+    if _, err := s.Load("token"); !errors.Is(err, ErrSecretNotFound) {
+        t.Fatalf("Load before Store = %v, want ErrSecretNotFound", err)
+    }
+    if err := s.Store("token", []byte("one")); err != nil {
+        t.Fatal(err)
+    }
+    // Storing again replaces the value
+    if err := s.Store("token", []byte("two")); err != nil {
+        t.Fatal(err)
+    }
+    data, err := s.Load("token")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(data, []byte("two")) {
+        t.Errorf("Load = %q, want %q", data, "two")
+    }
+    if err := s.Delete("token"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Delete("token"); !errors.Is(err, ErrSecretNotFound) {
+        t.Errorf("second Delete = %v, want ErrSecretNotFound", err)
+    }
+    if _, err := s.Load("token"); !errors.Is(err, ErrSecretNotFound) {
+        t.Errorf("Load after Delete = %v, want ErrSecretNotFound", err)
+    }
+
+    creates := 0
+    for _, c := range d.Calls() {
+        if c == "createCollection" {
+            creates++
+        }
+    }
+    if creates != 1 {
+        t.Errorf("createCollection called %d times, want 1", creates)
+    }
+}
+
+func TestSecretsKeepsConnection(t *testing.T) {
+    d := newFakeSecretsDaemon(t)
+    s := newTestSecrets(t, d)
+    for i := 0; i < 5; i++ {
+        s.Load("missing")
+    }
+    d.mu.Lock()
+    conns := len(d.conns)
+    d.mu.Unlock()
+    if conns != 1 {
+        t.Errorf("%d connections for 5 calls, want 1", conns)
+    }
+}
+
+func TestSecretsReconnects(t *testing.T) {
+    d := newFakeSecretsDaemon(t)
+    s := newTestSecrets(t, d)
+    if err := s.Store("key", []byte("value")); err != nil {
+        t.Fatal(err)
+    }
+    // Drop the connection from the daemon's side
+    d.mu.Lock()
+    for _, c := range d.conns {
+        c.Close()
+    }
+    d.mu.Unlock()
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        s.mu.Lock()
+        connected := s.conn.Connected()
+        s.mu.Unlock()
+        if !connected || time.Now().After(deadline) {
+            break
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    if _, err := s.Load("key"); err != nil {
+        t.Fatalf("Load after reconnect: %v", err)
+    }
+}
+
+func TestSecretsContextCancel(t *testing.T) {
+    d := newFakeSecretsDaemon(t)
+    s := newTestSecrets(t, d)
+    d.mu.Lock()
+    d.delay = time.Second
+    d.mu.Unlock()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    _, err := s.GetSecret(ctx, "slow")
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatalf("GetSecret = %v, want context.DeadlineExceeded", err)
+    }
+    if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+        t.Errorf("GetSecret returned after %s, not at the deadline", elapsed)
+    }
+
+    // The connection is still usable once the daemon answers again
+    d.mu.Lock()
+    d.delay = 0
+    d.mu.Unlock()
+    if err := s.Store("fast", []byte("x")); err != nil {
+        t.Errorf("Store after cancelled call: %v", err)
+    }
+}
+
+func TestSecretsMalformedReply(t *testing.T) {
+    d := newFakeSecretsDaemon(t)
+    d.methods = map[string]interface{}{
+        "getSecret": func(id secretIdentifier, mode secretsEnum, address string) (string, *dbus.Error) {
+            return "not a result", nil
+        },
+        "deleteSecret": func(id secretIdentifier, mode secretsEnum, address string) (secretsResult, string, *dbus.Error) {
+            return succeeded(), "unexpected extra value", nil
+        },
+    }
+    s := newTestSecrets(t, d)
+
+    if _, err := s.Load("key"); err == nil || errors.Is(err, ErrSecretNotFound) {
+        t.Errorf("Load with a malformed reply = %v, want a reply error", err)
+    }
+    if err := s.Delete("key"); err == nil {
+        t.Error("Delete with a malformed reply succeeded")
+    }
+}
+
+func TestSecretsDaemonError(t *testing.T) {
+    d := newFakeSecretsDaemon(t)
+    d.methods = map[string]interface{}{
+        "getSecret": func(id secretIdentifier, mode secretsEnum, address string) (secretsResult, sailfishSecret, *dbus.Error) {
+            return secretsResult{}, sailfishSecret{}, dbus.MakeFailedError(errors.New("daemon broke"))
+        },
+    }
+    s := newTestSecrets(t, d)
+    _, err := s.Load("key")
+    if err == nil || errors.Is(err, ErrSecretNotFound) {
+        t.Errorf("Load = %v, want the D-Bus error", err)
+    }
+}
+
+func TestSecretsVerifyDeviceOwner(t *testing.T) {
+    d := newFakeSecretsDaemon(t)
+    s := newTestSecrets(t, d)
+    ctx := context.Background()
+    // The first check creates the secret, and every check asks for the code
+    for i := 0; i < 2; i++ {
+        if err := s.VerifyDeviceOwner(ctx); err != nil {
+            t.Fatalf("VerifyDeviceOwner = %v", err)
+        }
+    }
+    prompts := 0
+    for _, c := range d.Calls() {
+        if c == "prompt" {
+            prompts++
+        }
+    }
+    if prompts != 2 {
+        t.Errorf("%d lock code prompts, want 2", prompts)
+    }
+
+    d.mu.Lock()
+    d.denyInput = true
+    d.mu.Unlock()
+    if err := s.VerifyDeviceOwner(ctx); secretsErrorCode(err) != ERROR_COLLECTION_LOCKED {
+        t.Errorf("VerifyDeviceOwner with a wrong code = %v", err)
+    }
+}
+
+func TestSecretsUnavailable(t *testing.T) {
+    s := newSailfishSecrets("unix:path=/nonexistent/p2p")
+    if _, err := s.Load("key"); err == nil {
+        t.Error("Load without a daemon succeeded")
+    }
+    s.available = true
+    if err := s.Store("key", []byte("x")); err == nil {
+        t.Error("Store without a daemon succeeded")
+    }
+}
+
+func TestGetOrCreateKeyWithSecrets(t *testing.T) {
+    d := newFakeSecretsDaemon(t)
+    s := newTestSecrets(t, d)
+    saved := keyStore
+    keyStore = s
+    defer func() { keyStore = saved; encryptionKey = nil }()
+
+    key, err := GetOrCreateKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(key) != 32 {
+        t.Fatalf("key is %d bytes, want 32", len(key))
+    }
+    again, err := GetOrCreateKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(key, again) {
+        t.Error("second GetOrCreateKey made a new key")
+    }
+    fresh, err := RegenerateKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if bytes.Equal(key, fresh) {
+        t.Error("RegenerateKey returned the old key")
+    }
+}
+
+func TestGetOrCreateKeyKeepsUnreadableKey(t *testing.T) {
+    d := newFakeSecretsDaemon(t)
+    s := newTestSecrets(t, d)
+    saved := keyStore
+    keyStore = s
+    defer func() { keyStore = saved; encryptionKey = nil }()
+
+    key, err := GetOrCreateKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    // A locked collection fails the lookup without the key being gone
+    locked := failed(ERROR_COLLECTION_LOCKED, "collection is locked")
+    d.Fail("getSecret", locked)
+    before := len(d.Calls())
+    if _, err := GetOrCreateKey(); err == nil || errors.Is(err, ErrSecretNotFound) {
+        t.Fatalf("GetOrCreateKey = %v, want the daemon's error", err)
+    }
+    for _, c := range d.Calls()[before:] {
+        if c == "setSecret" || c == "deleteSecret" {
+            t.Errorf("%s called after a failed lookup", c)
+        }
+    }
+    d.Fail("deleteSecret", locked)
+    if err := s.Delete(SECRET_KEY_NAME); err == nil || errors.Is(err, ErrSecretNotFound) {
+        t.Errorf("Delete = %v, want the daemon's error", err)
+    }
+    d.Fail("deleteSecret", succeeded())
+
+    d.Fail("getSecret", succeeded())
+    again, err := GetOrCreateKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(key, again) {
+        t.Error("the stored key was replaced")
+    }
+}
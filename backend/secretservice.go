@@ -0,0 +1,171 @@
+package main
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/godbus/dbus/v5"
+)
+
+const (
+    SECRET_SERVICE_NAME = "org.freedesktop.secrets"
+    SECRET_SERVICE_PATH = "/org/freedesktop/secrets"
+    SECRET_DEFAULT_PATH = "/org/freedesktop/secrets/aliases/default"
+
+    // How long to wait for the user to answer an unlock prompt
+    secretPromptTimeout = 2 * time.Minute
+)
+
+// SecretServiceStore keeps secrets in the freedesktop Secret Service
+// (GNOME Keyring, KWallet, KeePassXC) default collection.
+type SecretServiceStore struct {
+    conn    *dbus.Conn
+    session dbus.ObjectPath
+}
+
+// secretValue is the Secret struct of the Secret Service API, (oayays).
+type secretValue struct {
+    Session     dbus.ObjectPath
+    Parameters  []byte
+    Value       []byte
+    ContentType string
+}
+
+func newSecretServiceStore() (*SecretServiceStore, error) {
+    conn, err := dbus.ConnectSessionBus()
+    if err != nil {
+        return nil, err
+    }
+    var output dbus.Variant
+    var session dbus.ObjectPath
+    err = conn.Object(SECRET_SERVICE_NAME, SECRET_SERVICE_PATH).
+        Call("org.freedesktop.Secret.Service.OpenSession", 0, "plain", dbus.MakeVariant("")).
+        Store(&output, &session)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return &SecretServiceStore{conn: conn, session: session}, nil
+}
+
+func (s *SecretServiceStore) Name() string { return "Secret Service" }
+
+func secretAttributes(name string) map[string]string {
+    return map[string]string{"application": "harbour-whatsapp", "name": name}
+}
+
+// prompt shows a Secret Service prompt and waits for the user.
+func (s *SecretServiceStore) prompt(path dbus.ObjectPath) error {
+    if path == "/" {
+        return nil
+    }
+    match := []dbus.MatchOption{
+        dbus.WithMatchObjectPath(path),
+        dbus.WithMatchInterface("org.freedesktop.Secret.Prompt"),
+        dbus.WithMatchMember("Completed"),
+    }
+    if err := s.conn.AddMatchSignal(match...); err != nil {
+        return err
+    }
+    defer s.conn.RemoveMatchSignal(match...)
+    signals := make(chan *dbus.Signal, 1)
+    s.conn.Signal(signals)
+    defer s.conn.RemoveSignal(signals)
+
+    if err := s.conn.Object(SECRET_SERVICE_NAME, path).Call("org.freedesktop.Secret.Prompt.Prompt", 0, "").Err; err != nil {
+        return err
+    }
+    timeout := time.After(secretPromptTimeout)
+    for {
+        select {
+        case sig := <-signals:
+            if sig.Path != path || len(sig.Body) == 0 {
+                continue
+            }
+            if dismissed, _ := sig.Body[0].(bool); dismissed {
+                return fmt.Errorf("prompt dismissed")
+            }
+            return nil
+        case <-timeout:
+            return fmt.Errorf("timeout waiting for prompt")
+        }
+    }
+}
+
+func (s *SecretServiceStore) unlock(paths []dbus.ObjectPath) error {
+    var unlocked []dbus.ObjectPath
+    var prompt dbus.ObjectPath
+    err := s.conn.Object(SECRET_SERVICE_NAME, SECRET_SERVICE_PATH).
+        Call("org.freedesktop.Secret.Service.Unlock", 0, paths).Store(&unlocked, &prompt)
+    if err != nil {
+        return err
+    }
+    return s.prompt(prompt)
+}
+
+func (s *SecretServiceStore) find(name string) (dbus.ObjectPath, error) {
+    var unlocked, locked []dbus.ObjectPath
+    err := s.conn.Object(SECRET_SERVICE_NAME, SECRET_SERVICE_PATH).
+        Call("org.freedesktop.Secret.Service.SearchItems", 0, secretAttributes(name)).Store(&unlocked, &locked)
+    if err != nil {
+        return "", err
+    }
+    if len(unlocked) > 0 {
+        return unlocked[0], nil
+    }
+    if len(locked) > 0 {
+        if err := s.unlock(locked[:1]); err != nil {
+            return "", err
+        }
+        return locked[0], nil
+    }
+    return "", ErrSecretNotFound
+}
+
+func (s *SecretServiceStore) Load(name string) ([]byte, error) {
+    item, err := s.find(name)
+    if err != nil {
+        return nil, err
+    }
+    var secret secretValue
+    err = s.conn.Object(SECRET_SERVICE_NAME, item).
+        Call("org.freedesktop.Secret.Item.GetSecret", 0, s.session).Store(&secret)
+    if err != nil {
+        return nil, err
+    }
+    return secret.Value, nil
+}
+
+func (s *SecretServiceStore) Store(name string, data []byte) error {
+    collection := s.conn.Object(SECRET_SERVICE_NAME, SECRET_DEFAULT_PATH)
+    if locked, err := collection.GetProperty("org.freedesktop.Secret.Collection.Locked"); err == nil {
+        if v, _ := locked.Value().(bool); v {
+            if err := s.unlock([]dbus.ObjectPath{SECRET_DEFAULT_PATH}); err != nil {
+                return err
+            }
+        }
+    }
+    props := map[string]dbus.Variant{
+        "org.freedesktop.Secret.Item.Label":      dbus.MakeVariant("WhatsApp " + name),
+        "org.freedesktop.Secret.Item.Attributes": dbus.MakeVariant(secretAttributes(name)),
+    }
+    secret := secretValue{Session: s.session, Value: data, ContentType: "application/octet-stream"}
+    var item, prompt dbus.ObjectPath
+    err := collection.Call("org.freedesktop.Secret.Collection.CreateItem", 0, props, secret, true).Store(&item, &prompt)
+    if err != nil {
+        return err
+    }
+    return s.prompt(prompt)
+}
+
+func (s *SecretServiceStore) Delete(name string) error {
+    item, err := s.find(name)
+    if err != nil {
+        return err
+    }
+    var prompt dbus.ObjectPath
+    if err := s.conn.Object(SECRET_SERVICE_NAME, item).Call("org.freedesktop.Secret.Item.Delete", 0).Store(&prompt); err != nil {
+        return err
+    }
+    return s.prompt(prompt)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "os"
+    "os/signal"
+    "sync/atomic"
+    "syscall"
+    "time"
+)
+
+// Sends and uploads in flight get sendDrainTimeout to finish when an
+// account closes. On shutdown the HTTP server gets the same time for the
+// requests it is still serving.
+const sendDrainTimeout = 10 * time.Second
+
+var errShuttingDown = apiError(http.StatusServiceUnavailable, "shutting_down", "the backend is shutting down")
+
+var shuttingDown atomic.Bool
+var shutdownRequests = make(chan string, 1)
+
+// httpServer is set by main before it starts serving
+var httpServer *http.Server
+
+// requestShutdown asks main to shut down, e.g. from /shutdown.
+func requestShutdown(reason string) {
+    select {
+    case shutdownRequests <- reason:
+    default:
+    }
+}
+
+// waitForShutdown blocks until a signal or a shutdown request comes in
+// and returns the reason. A second signal ends the process at once.
+func waitForShutdown() string {
+    signals := make(chan os.Signal, 2)
+    signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+    var reason string
+    select {
+    case sig := <-signals:
+        reason = sig.String()
+    case reason = <-shutdownRequests:
+    }
+    go func() {
+        <-signals
+        mainLog.Warn("second signal, exiting without cleanup")
+        os.Exit(1)
+    }()
+    return reason
+}
+
+// shutdownBackend stops everything in order: no new requests or sends
+// are taken, those in flight get until the drain deadline, then the
+// accounts save and disconnect and the database and buses are closed.
+func shutdownBackend(reason string) {
+    mainLog.Info("shutting down", "reason", reason)
+    shuttingDown.Store(true)
+    sdNotify("STOPPING=1")
+    drainCtx, cancel := context.WithTimeout(context.Background(), sendDrainTimeout)
+    defer cancel()
+
+    httpDone := make(chan error, 1)
+    if httpServer != nil {
+        go func() { httpDone <- httpServer.Shutdown(drainCtx) }()
+    } else {
+        httpDone <- nil
+    }
+    for _, a := range allAccounts() {
+        a.drainSends(drainCtx)
+    }
+    if err := <-httpDone; err != nil {
+        mainLog.Warn("requests still running, closing their connections", "err", err)
+        httpServer.Close()
+    }
+
+    stopBackground()
+    closeAccounts()
+    closeDBus()
+    if container != nil {
+        if err := container.Close(); err != nil {
+            dbLog.Warn("closing the database failed", "err", err)
+        }
+    }
+    mainLog.Info("shutdown complete")
+}
+
+// serveShutdown answers before shutting down, since the server waits for
+// this very request to finish.
+func serveShutdown(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "POST required", 405)
+        return
+    }
+    requestShutdown("requested over HTTP")
+    w.Write([]byte("ok"))
+}
+
+func apiShutdown(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+    requestShutdown("requested over the API")
+    return okResponse, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "testing"
+    "time"
+)
+
+// sendInBackground posts a text message and delivers the status code once
+// the call returns, after the fake has seen the send.
+func sendInBackground(t *testing.T, b *testBackend, f *fakeClient) <-chan int {
+    t.Helper()
+    before := f.Calls("SendMessage")
+    result := make(chan int, 1)
+    go func() {
+        result <- b.do("POST", "/chats/"+alice.User+"/messages", SendTextRequest{Text: "in flight"}, nil)
+    }()
+    waitFor(t, "send to start", func() bool { return f.Calls("SendMessage") > before })
+    return result
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) {
+            t.Fatalf("timed out waiting for %s", what)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+func TestDrainWaitsForSends(t *testing.T) {
+    b := newTestBackend(t)
+    a, f := b.paired("491700000000")
+    release := f.HoldSends()
+    inFlight := sendInBackground(t, b, f)
+
+    drained := make(chan struct{})
+    go func() {
+        a.drainSends(context.Background())
+        close(drained)
+    }()
+    waitFor(t, "account to refuse sends", func() bool {
+        a.sendMutex.Lock()
+        defer a.sendMutex.Unlock()
+        return a.closing
+    })
+
+    // New sends are refused while the running one may finish
+    if code := b.do("POST", "/chats/"+alice.User+"/messages", SendTextRequest{Text: "late"}, nil); code != http.StatusServiceUnavailable {
+        t.Errorf("send while draining: %d", code)
+    }
+    select {
+    case <-drained:
+        t.Fatal("drain returned with a send in flight")
+    case <-time.After(50 * time.Millisecond):
+    }
+
+    release()
+    if code := <-inFlight; code != 200 {
+        t.Errorf("in-flight send: %d", code)
+    }
+    <-drained
+    if len(f.Sent()) != 1 {
+        t.Errorf("sent = %+v", f.Sent())
+    }
+}
+
+func TestDrainCancelsStuckSends(t *testing.T) {
+    b := newTestBackend(t)
+    a, f := b.paired("491700000000")
+    defer f.HoldSends()()
+    inFlight := sendInBackground(t, b, f)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    a.drainSends(ctx)
+    if code := <-inFlight; code != http.StatusBadGateway {
+        t.Errorf("cancelled send: %d", code)
+    }
+    if len(f.Sent()) != 0 {
+        t.Errorf("sent = %+v", f.Sent())
+    }
+}
+
+func TestShutdownEndpoint(t *testing.T) {
+    b := newTestBackend(t)
+    if code := b.do("POST", "/shutdown", nil, nil); code != 200 {
+        t.Fatalf("shutdown: %d", code)
+    }
+    select {
+    case reason := <-shutdownRequests:
+        if reason == "" {
+            t.Error("no reason given")
+        }
+    default:
+        t.Error("no shutdown requested")
+    }
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+
+    "go.mau.fi/whatsmeow/appstate"
+    "go.mau.fi/whatsmeow/types"
+    "go.mau.fi/whatsmeow/types/events"
+)
+
+func (a *Account) applyStar(chatJid, id string, starred bool) bool {
+    return a.updateMessage(chatJid, id, func(m *Message) {
+        m.Starred = starred
+    })
+}
+
+// setMessageStarred stars or unstars a message and syncs it to the other
+// devices.
+func (a *Account) setMessageStarred(chatJid, id string, starred bool) error {
+    if err := a.requireLogin(); err != nil {
+        return err
+    }
+    m, ok := a.findMessage(chatJid, id)
+    if !ok {
+        return fmt.Errorf("message not found")
+    }
+    chat := userToJID(m.ChatJID)
+    var sender types.JID
+    if m.FromMe {
+        sender = a.device.ID.ToNonAD()
+    } else {
+        sender = userToJID(m.Sender)
+    }
+    if err := a.client.SendAppState(a.ctx, appstate.BuildStar(chat, sender, m.ID, m.FromMe, starred)); err != nil {
+        return err
+    }
+    a.applyStar(m.ChatJID, m.ID, starred)
+    return nil
+}
+
+func (a *Account) handleStarEvent(v *events.Star) {
+    if a.applyStar(v.ChatJID.User, v.MessageID, v.Action.GetStarred()) {
+        a.log.Debug("message starred on another device", "chat", v.ChatJID.User, "id", v.MessageID, "starred", v.Action.GetStarred())
+    }
+}
+
+// getStarredMessages lists starred messages across all chats, newest first.
+func (a *Account) getStarredMessages() []Message {
+    a.msgMutex.RLock()
+    defer a.msgMutex.RUnlock()
+    result := []Message{}
+    for _, m := range a.messages {
+        if m.Starred {
+            result = append(result, m)
+        }
+    }
+    sort.Slice(result, func(i, j int) bool { return result[i].Timestamp > result[j].Timestamp })
+    return result
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+)
+
+func TestStarNeedsPairing(t *testing.T) {
+    newTestBackend(t)
+    a := defaultAccount()
+    a.addMessage(Message{ID: "M1", ChatJID: alice.User, FromMe: true, Text: "hi", Timestamp: 1000})
+    wantAPIError(t, a.setMessageStarred(alice.User, "M1", true), http.StatusConflict)
+    if calls := fakeOf(t, a).Calls("SendAppState"); calls != 0 {
+        t.Errorf("%d app state patches sent", calls)
+    }
+}
@@ -1,23 +1,54 @@
 import subprocess
 import os
+import shutil
+import socket
+import tempfile
 import time
 
 backend_process = None
 
+def wait_ready(notify, process, timeout):
+    # The backend sends READY=1 over the systemd notify protocol once its
+    # database is open and the API listens
+    notify.settimeout(0.2)
+    deadline = time.time() + timeout
+    while time.time() < deadline and process.poll() is None:
+        try:
+            data = notify.recv(4096)
+        except socket.timeout:
+            continue
+        if b"READY=1" in data.split(b"\n"):
+            return True
+    return False
+
 def start():
     global backend_process
     if backend_process is None or backend_process.poll() is not None:
         data_dir = os.path.expanduser("~/.local/share/harbour-whatsapp")
         os.makedirs(data_dir, exist_ok=True)
-        backend_process = subprocess.Popen(
-            ["/usr/share/harbour-whatsapp/wa-backend"],
-            cwd=data_dir
-        )
-        time.sleep(1)
+        notify_dir = tempfile.mkdtemp(prefix="harbour-whatsapp-")
+        notify_path = os.path.join(notify_dir, "notify")
+        notify = socket.socket(socket.AF_UNIX, socket.SOCK_DGRAM)
+        try:
+            notify.bind(notify_path)
+            backend_process = subprocess.Popen(
+                ["/usr/share/harbour-whatsapp/wa-backend"],
+                cwd=data_dir,
+                env=dict(os.environ, NOTIFY_SOCKET=notify_path)
+            )
+            return wait_ready(notify, backend_process, 30)
+        finally:
+            notify.close()
+            shutil.rmtree(notify_dir, ignore_errors=True)
     return True
 
 def stop():
     global backend_process
     if backend_process:
+        # SIGTERM shuts the backend down in order; give it time to save
         backend_process.terminate()
+        try:
+            backend_process.wait(timeout=15)
+        except subprocess.TimeoutExpired:
+            backend_process.kill()
         backend_process = None
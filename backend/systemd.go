@@ -0,0 +1,134 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// systemd support without linking libsystemd: readiness and watchdog
+// notifications over $NOTIFY_SOCKET, and a listening socket handed over
+// through $LISTEN_FDS. Outside systemd the variables are unset and all of
+// this does nothing.
+
+// An event handler running longer than this counts as hung, and the
+// watchdog is no longer fed
+const eventStallTimeout = 2 * time.Minute
+
+const listenFDsStart = 3
+
+// sdNotify sends a state like "READY=1" to the service manager. It
+// reports false when there is none to tell.
+func sdNotify(state string) bool {
+    socket := os.Getenv("NOTIFY_SOCKET")
+    if socket == "" {
+        return false
+    }
+    // A leading @ means an abstract socket
+    if strings.HasPrefix(socket, "@") {
+        socket = "\x00" + socket[1:]
+    }
+    conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+    if err != nil {
+        mainLog.Debug("service manager notification failed", "state", state, "err", err)
+        return false
+    }
+    defer conn.Close()
+    if _, err := conn.Write([]byte(state)); err != nil {
+        mainLog.Debug("service manager notification failed", "state", state, "err", err)
+        return false
+    }
+    return true
+}
+
+// watchdogInterval returns how often systemd expects WATCHDOG=1, or 0
+// when the watchdog is off or meant for another process.
+func watchdogInterval() time.Duration {
+    usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+    if err != nil || usec <= 0 {
+        return 0
+    }
+    if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+        return 0
+    }
+    return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog feeds the watchdog at half its interval for as long as the
+// event handlers and persistence workers keep moving. Once one hangs the
+// pings stop and systemd restarts the backend.
+func runWatchdog() {
+    interval := watchdogInterval()
+    if interval == 0 {
+        return
+    }
+    mainLog.Info("watchdog enabled", "interval", interval)
+    ticker := time.NewTicker(interval / 2)
+    defer ticker.Stop()
+    stalled := false
+    for {
+        select {
+        case <-ticker.C:
+        case <-ctx.Done():
+            return
+        }
+        if err := checkLiveness(); err != nil {
+            if !stalled {
+                mainLog.Error("backend hung, no longer feeding the watchdog", "err", err)
+            }
+            stalled = true
+            continue
+        }
+        if stalled {
+            mainLog.Info("backend moving again")
+            stalled = false
+        }
+        sdNotify("WATCHDOG=1")
+    }
+}
+
+// checkLiveness fails when an account's event handler or persistence
+// worker has been stuck for too long.
+func checkLiveness() error {
+    for _, a := range allAccounts() {
+        if since := a.handlingSince.Load(); since != 0 {
+            if busy := time.Since(time.Unix(0, since)); busy > eventStallTimeout {
+                return fmt.Errorf("account %s: event handler busy for %v", a.ID, busy.Round(time.Second))
+            }
+        }
+        if stuck := a.persister.stuckFor(); stuck > 0 {
+            return fmt.Errorf("account %s: persistence worker stuck for %v", a.ID, stuck.Round(time.Second))
+        }
+    }
+    return nil
+}
+
+// activationListener returns the socket systemd passed in, or nil when
+// the backend wasn't socket activated. Only the first socket is used.
+func activationListener() (net.Listener, error) {
+    pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+    if err != nil || pid != os.Getpid() {
+        return nil, nil
+    }
+    n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+    if err != nil || n < 1 {
+        return nil, nil
+    }
+    // Not for children, should there ever be any
+    os.Unsetenv("LISTEN_PID")
+    os.Unsetenv("LISTEN_FDS")
+    os.Unsetenv("LISTEN_FDNAMES")
+    if n > 1 {
+        apiLog.Warn("several sockets passed in, using the first", "count", n)
+    }
+    f := os.NewFile(uintptr(listenFDsStart), "systemd-socket")
+    defer f.Close()
+    ln, err := net.FileListener(f)
+    if err != nil {
+        return nil, fmt.Errorf("socket from systemd: %v", err)
+    }
+    return ln, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestSDNotify(t *testing.T) {
+    t.Setenv("NOTIFY_SOCKET", "")
+    if sdNotify("READY=1") {
+        t.Error("notified without a socket")
+    }
+
+    path := filepath.Join(t.TempDir(), "notify")
+    conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    t.Setenv("NOTIFY_SOCKET", path)
+    if !sdNotify("READY=1\nSTATUS=Running") {
+        t.Fatal("notification not sent")
+    }
+    buf := make([]byte, 256)
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    n, err := conn.Read(buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := string(buf[:n]); got != "READY=1\nSTATUS=Running" {
+        t.Errorf("received %q", got)
+    }
+}
+
+func TestWatchdogInterval(t *testing.T) {
+    t.Setenv("WATCHDOG_USEC", "")
+    if d := watchdogInterval(); d != 0 {
+        t.Errorf("interval without watchdog: %v", d)
+    }
+    t.Setenv("WATCHDOG_USEC", "30000000")
+    t.Setenv("WATCHDOG_PID", "")
+    if d := watchdogInterval(); d != 30*time.Second {
+        t.Errorf("interval = %v", d)
+    }
+    t.Setenv("WATCHDOG_PID", "1")
+    if d := watchdogInterval(); d != 0 {
+        t.Errorf("interval for another process: %v", d)
+    }
+}
+
+func TestLivenessNoticesHungHandler(t *testing.T) {
+    b := newTestBackend(t)
+    a, _ := b.paired("491700000000")
+    if err := checkLiveness(); err != nil {
+        t.Fatal(err)
+    }
+    a.handlingSince.Store(time.Now().Add(-eventStallTimeout - time.Second).UnixNano())
+    defer a.handlingSince.Store(0)
+    if err := checkLiveness(); err == nil || !strings.Contains(err.Error(), "event handler") {
+        t.Errorf("hung handler: %v", err)
+    }
+}
+
+func TestSingleInstance(t *testing.T) {
+    dir := t.TempDir()
+    if err := acquireInstanceLock(dir); err != nil {
+        t.Fatal(err)
+    }
+    defer releaseInstanceLock()
+
+    // A second lock on the file conflicts even within this process
+    err := acquireInstanceLock(dir)
+    if err == nil || !strings.Contains(err.Error(), strconv.Itoa(os.Getpid())) {
+        t.Errorf("second instance: %v", err)
+    }
+
+    releaseInstanceLock()
+    if err := acquireInstanceLock(dir); err != nil {
+        t.Errorf("after release: %v", err)
+    }
+}
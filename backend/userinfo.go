@@ -0,0 +1,149 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "time"
+
+    "go.mau.fi/whatsmeow/types"
+)
+
+// How long lookup results stay valid. Numbers that are not on WhatsApp
+// are rechecked sooner, since people register all the time.
+const contactInfoTTL = 6 * time.Hour
+const contactInfoNegativeTTL = 10 * time.Minute
+
+type ContactInfo struct {
+    Phone        string   `json:"phone"`
+    JID          string   `json:"jid,omitempty"`
+    OnWhatsApp   bool     `json:"onWhatsApp"`
+    About        string   `json:"about,omitempty"`
+    BusinessName string   `json:"businessName,omitempty"`
+    IsBusiness   bool     `json:"isBusiness"`
+    PictureID    string   `json:"pictureId,omitempty"`
+    Devices      []string `json:"devices,omitempty"`
+    FetchedAt    int64    `json:"fetchedAt"`
+}
+
+// normalizePhone strips everything but digits, so "+49 170 123-45" and
+// "4917012345" hit the same cache entry.
+func normalizePhone(phone string) string {
+    var b strings.Builder
+    for _, r := range phone {
+        if r >= '0' && r <= '9' {
+            b.WriteRune(r)
+        }
+    }
+    return b.String()
+}
+
+func (ci *ContactInfo) expired() bool {
+    ttl := contactInfoTTL
+    if !ci.OnWhatsApp {
+        ttl = contactInfoNegativeTTL
+    }
+    return time.Since(time.Unix(ci.FetchedAt, 0)) > ttl
+}
+
+func (a *Account) getCachedContactInfo(phone string) *ContactInfo {
+    a.contactInfoMutex.RLock()
+    defer a.contactInfoMutex.RUnlock()
+    if ci, ok := a.contactInfo[phone]; ok && !ci.expired() {
+        return ci
+    }
+    return nil
+}
+
+// lookupContacts checks which phone numbers are registered on WhatsApp and
+// fetches about text, business name and devices for the ones that are.
+// Cached entries are reused until they expire.
+func (a *Account) lookupContacts(phones []string) ([]ContactInfo, error) {
+    result := make([]ContactInfo, 0, len(phones))
+    var missing []string
+    seen := make(map[string]bool)
+    for _, p := range phones {
+        phone := normalizePhone(p)
+        if phone == "" || seen[phone] {
+            continue
+        }
+        seen[phone] = true
+        if ci := a.getCachedContactInfo(phone); ci != nil {
+            result = append(result, *ci)
+        } else {
+            missing = append(missing, phone)
+        }
+    }
+    if len(missing) == 0 {
+        return result, nil
+    }
+
+    if !a.client.IsConnected() {
+        return nil, fmt.Errorf("not connected")
+    }
+
+    queries := make([]string, len(missing))
+    for i, phone := range missing {
+        queries[i] = "+" + phone
+    }
+    resp, err := a.client.IsOnWhatsApp(ctx, queries)
+    if err != nil {
+        return nil, fmt.Errorf("lookup failed: %v", err)
+    }
+
+    now := time.Now().Unix()
+    fetched := make(map[string]*ContactInfo, len(missing))
+    for _, phone := range missing {
+        fetched[phone] = &ContactInfo{Phone: phone, FetchedAt: now}
+    }
+    var registered []types.JID
+    byJID := make(map[types.JID]*ContactInfo)
+    for _, r := range resp {
+        phone := normalizePhone(r.Query)
+        ci, ok := fetched[phone]
+        if !ok {
+            continue
+        }
+        ci.OnWhatsApp = r.IsIn
+        if r.VerifiedName != nil {
+            ci.IsBusiness = true
+            ci.BusinessName = r.VerifiedName.Details.GetVerifiedName()
+        }
+        if r.IsIn {
+            ci.JID = r.JID.User
+            registered = append(registered, r.JID)
+            byJID[r.JID] = ci
+        }
+    }
+
+    if len(registered) > 0 {
+        infos, err := a.client.GetUserInfo(ctx, registered)
+        if err != nil {
+            a.log.Warn("failed to get user info", "err", err)
+        }
+        for jid, info := range infos {
+            ci, ok := byJID[jid]
+            if !ok {
+                continue
+            }
+            ci.About = info.Status
+            ci.PictureID = info.PictureID
+            if info.VerifiedName != nil {
+                ci.IsBusiness = true
+                ci.BusinessName = info.VerifiedName.Details.GetVerifiedName()
+            }
+            ci.Devices = make([]string, 0, len(info.Devices))
+            for _, dev := range info.Devices {
+                ci.Devices = append(ci.Devices, dev.String())
+            }
+        }
+    }
+
+    a.contactInfoMutex.Lock()
+    for _, phone := range missing {
+        ci := fetched[phone]
+        a.contactInfo[phone] = ci
+        result = append(result, *ci)
+    }
+    a.contactInfoMutex.Unlock()
+    return result, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+    "context"
+    "time"
+
+    "go.mau.fi/whatsmeow"
+    "go.mau.fi/whatsmeow/appstate"
+    "go.mau.fi/whatsmeow/proto/waE2E"
+    "go.mau.fi/whatsmeow/store"
+    "go.mau.fi/whatsmeow/types"
+    waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// WAClient is the part of *whatsmeow.Client the backend uses. Accounts
+// only talk to WhatsApp through it, so tests can give them a fake. The
+// device store is kept by the account itself, since the client exposes
+// it as a field.
+type WAClient interface {
+    Connect() error
+    Disconnect()
+    IsConnected() bool
+    AddEventHandler(handler whatsmeow.EventHandler) uint32
+    RemoveEventHandlers()
+
+    PairPhone(ctx context.Context, phone string, showPushNotification bool, clientType whatsmeow.PairClientType, clientDisplayName string) (string, error)
+    Logout(ctx context.Context) error
+
+    SendMessage(ctx context.Context, to types.JID, message *waE2E.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error)
+    MarkRead(ctx context.Context, ids []types.MessageID, timestamp time.Time, chat, sender types.JID, receiptTypeExtra ...types.ReceiptType) error
+    SendAppState(ctx context.Context, patch appstate.PatchInfo) error
+    Upload(ctx context.Context, plaintext []byte, appInfo whatsmeow.MediaType) (whatsmeow.UploadResponse, error)
+    Download(ctx context.Context, msg whatsmeow.DownloadableMessage) ([]byte, error)
+
+    GetProfilePictureInfo(ctx context.Context, jid types.JID, params *whatsmeow.GetProfilePictureParams) (*types.ProfilePictureInfo, error)
+    GetJoinedGroups(ctx context.Context) ([]*types.GroupInfo, error)
+    GetUserInfo(ctx context.Context, jids []types.JID) (map[types.JID]types.UserInfo, error)
+    IsOnWhatsApp(ctx context.Context, phones []string) ([]types.IsOnWhatsAppResponse, error)
+}
+
+var _ WAClient = (*whatsmeow.Client)(nil)
+
+// ClientFactory creates the client for an account's device.
+type ClientFactory func(device *store.Device, log waLog.Logger) WAClient
+
+func newWhatsmeowClient(device *store.Device, log waLog.Logger) WAClient {
+    return whatsmeow.NewClient(device, log)
+}
+
+// newClient is used for every account opened or added; tests swap it for
+// a fake before loading accounts.
+var newClient ClientFactory = newWhatsmeowClient
@@ -10,10 +10,14 @@ ApplicationWindow {
     cover: undefined
 
     property bool connected: false
+    property bool locked: false
+    property string unlockError: ""
     property string pairCode: ""
     property string phone: ""
     property var chats: []
     property var waContacts: []
+    property string backendUrl: "http://127.0.0.1:8085"
+    property string apiToken: ""
 
     // Python backend starter
     Python {
@@ -22,7 +26,9 @@ ApplicationWindow {
         Component.onCompleted: {
             addImportPath(Qt.resolvedUrl('..'))
             
-            setHandler('backendReady', function(success) {
+            setHandler('backendReady', function(success, url, token) {
+                backendUrl = url
+                apiToken = token
                 if (success) {
                     console.log("Backend ready")
                     checkStatus()
@@ -87,11 +93,13 @@ ApplicationWindow {
 
     function checkStatus() {
         var xhr = new XMLHttpRequest()
-        xhr.open("GET", "http://localhost:8085/status")
+        xhr.open("GET", backendUrl + "/api/v2/status")
+        xhr.setRequestHeader("Authorization", "Bearer " + apiToken)
         xhr.onreadystatechange = function() {
             if (xhr.readyState === 4 && xhr.status === 200) {
                 var data = JSON.parse(xhr.responseText)
                 var wasConnected = connected
+                locked = data.locked || false
                 connected = data.connected
                 pairCode = data.pairCode || ""
                 phone = data.phone || ""
@@ -104,12 +112,48 @@ ApplicationWindow {
         xhr.send()
     }
 
+    function unlock(passphrase) {
+        var xhr = new XMLHttpRequest()
+        xhr.open("POST", backendUrl + "/api/v2/unlock")
+        xhr.setRequestHeader("Authorization", "Bearer " + apiToken)
+        xhr.setRequestHeader("Content-Type", "application/json")
+        xhr.onreadystatechange = function() {
+            if (xhr.readyState === 4) {
+                if (xhr.status === 200) {
+                    unlockError = ""
+                    checkStatus()
+                } else {
+                    try {
+                        unlockError = JSON.parse(xhr.responseText).error.message
+                    } catch (e) {
+                        unlockError = "Unlock failed"
+                    }
+                }
+            }
+        }
+        xhr.send(JSON.stringify({ passphrase: passphrase }))
+    }
+
+    // Tell the backend which chat is on screen so it doesn't notify for it
+    function setActiveChat(jid) {
+        var xhr = new XMLHttpRequest()
+        xhr.open("PUT", backendUrl + "/api/v2/active-chat")
+        xhr.setRequestHeader("Authorization", "Bearer " + apiToken)
+        xhr.setRequestHeader("Content-Type", "application/json")
+        xhr.send(JSON.stringify({ jid: jid }))
+    }
+
     function loadChats() {
         var xhr = new XMLHttpRequest()
-        xhr.open("GET", "http://localhost:8085/chats")
+        xhr.open("GET", backendUrl + "/api/v2/chats")
+        xhr.setRequestHeader("Authorization", "Bearer " + apiToken)
         xhr.onreadystatechange = function() {
             if (xhr.readyState === 4 && xhr.status === 200) {
                 chats = JSON.parse(xhr.responseText) || []
+            } else if (xhr.readyState === 4 && xhr.status === 423) {
+                // Locked after being idle
+                locked = true
+                connected = false
             }
         }
         xhr.send()
@@ -117,7 +161,8 @@ ApplicationWindow {
 
     function loadWAContacts() {
         var xhr = new XMLHttpRequest()
-        xhr.open("GET", "http://localhost:8085/contacts")
+        xhr.open("GET", backendUrl + "/api/v2/contacts")
+        xhr.setRequestHeader("Authorization", "Bearer " + apiToken)
         xhr.onreadystatechange = function() {
             if (xhr.readyState === 4 && xhr.status === 200) {
                 var data = JSON.parse(xhr.responseText) || {}
@@ -134,7 +179,8 @@ ApplicationWindow {
 
     function doLogout() {
         var xhr = new XMLHttpRequest()
-        xhr.open("GET", "http://localhost:8085/logout")
+        xhr.open("POST", backendUrl + "/api/v2/logout")
+        xhr.setRequestHeader("Authorization", "Bearer " + apiToken)
         xhr.onreadystatechange = function() {
             if (xhr.readyState === 4) {
                 connected = false
@@ -206,7 +252,7 @@ ApplicationWindow {
                 id: avatarImage
                 anchors.fill: parent
                 fillMode: Image.PreserveAspectCrop
-                source: jid ? "http://localhost:8085/avatar/" + jid : ""
+                source: jid && apiToken ? backendUrl + "/api/v2/contacts/" + jid + "/avatar?token=" + apiToken : ""
                 visible: status === Image.Ready
                 
                 layer.enabled: true
@@ -245,7 +291,8 @@ ApplicationWindow {
                     visible: connected
                     onClicked: {
                         var xhr = new XMLHttpRequest()
-                        xhr.open("GET", "http://localhost:8085/reload")
+                        xhr.open("POST", backendUrl + "/api/v2/contacts/reload")
+                        xhr.setRequestHeader("Authorization", "Bearer " + apiToken)
                         xhr.onreadystatechange = function() {
                             if (xhr.readyState === 4) {
                                 loadWAContacts()
@@ -269,11 +316,44 @@ ApplicationWindow {
 
                 PageHeader { 
                     title: "WhatsApp"
-                    description: connected ? "+" + phone : "Not connected"
+                    description: locked ? "Locked" : (connected ? "+" + phone : "Not connected")
+                }
+
+                Column {
+                    visible: locked
+                    width: parent.width
+                    spacing: Theme.paddingLarge
+
+                    PasswordField {
+                        id: unlockField
+                        width: parent.width
+                        label: "Passphrase"
+                        EnterKey.onClicked: unlock(text)
+                    }
+
+                    Button {
+                        text: "Unlock"
+                        anchors.horizontalCenter: parent.horizontalCenter
+                        onClicked: {
+                            unlock(unlockField.text)
+                            unlockField.text = ""
+                        }
+                    }
+
+                    Label {
+                        visible: unlockError !== ""
+                        x: Theme.horizontalPageMargin
+                        width: parent.width - 2*x
+                        wrapMode: Text.Wrap
+                        horizontalAlignment: Text.AlignHCenter
+                        text: unlockError
+                        color: Theme.errorColor
+                        font.pixelSize: Theme.fontSizeSmall
+                    }
                 }
 
                 Column {
-                    visible: !connected
+                    visible: !connected && !locked
                     width: parent.width
                     spacing: Theme.paddingLarge
 
@@ -291,13 +371,15 @@ ApplicationWindow {
                         anchors.horizontalCenter: parent.horizontalCenter
                         onClicked: {
                             var xhr = new XMLHttpRequest()
-                            xhr.open("GET", "http://localhost:8085/pair?phone=" + phoneField.text)
+                            xhr.open("POST", backendUrl + "/api/v2/pair")
+                            xhr.setRequestHeader("Authorization", "Bearer " + apiToken)
+                            xhr.setRequestHeader("Content-Type", "application/json")
                             xhr.onreadystatechange = function() {
                                 if (xhr.readyState === 4 && xhr.status === 200) {
                                     pairCode = JSON.parse(xhr.responseText).code
                                 }
                             }
-                            xhr.send()
+                            xhr.send(JSON.stringify({ phone: phoneField.text }))
                         }
                     }
 
@@ -601,7 +683,8 @@ ApplicationWindow {
 
             function load() {
                 var xhr = new XMLHttpRequest()
-                xhr.open("GET", "http://localhost:8085/messages?jid=" + chatJid)
+                xhr.open("GET", backendUrl + "/api/v2/chats/" + chatJid + "/messages")
+                xhr.setRequestHeader("Authorization", "Bearer " + apiToken)
                 xhr.onreadystatechange = function() {
                     if (xhr.readyState === 4 && xhr.status === 200) {
                         msgs = JSON.parse(xhr.responseText) || []
@@ -613,7 +696,9 @@ ApplicationWindow {
             function send() {
                 if (input.text === "") return
                 var xhr = new XMLHttpRequest()
-                xhr.open("GET", "http://localhost:8085/send?to=" + chatJid + "&text=" + encodeURIComponent(input.text))
+                xhr.open("POST", backendUrl + "/api/v2/chats/" + chatJid + "/messages")
+                xhr.setRequestHeader("Authorization", "Bearer " + apiToken)
+                xhr.setRequestHeader("Content-Type", "application/json")
                 xhr.onreadystatechange = function() {
                     if (xhr.readyState === 4 && xhr.status === 200) {
                         input.text = ""
@@ -621,24 +706,35 @@ ApplicationWindow {
                         loadChats()
                     }
                 }
-                xhr.send()
+                xhr.send(JSON.stringify({ text: input.text }))
             }
 
             function sendFile(path) {
                 var xhr = new XMLHttpRequest()
-                xhr.open("POST", "http://localhost:8085/sendmedia?to=" + chatJid + "&file=" + encodeURIComponent(path) + "&caption=")
+                xhr.open("POST", backendUrl + "/api/v2/chats/" + chatJid + "/media")
+                xhr.setRequestHeader("Authorization", "Bearer " + apiToken)
+                xhr.setRequestHeader("Content-Type", "application/json")
                 xhr.onreadystatechange = function() {
                     if (xhr.readyState === 4) {
                         load()
                         loadChats()
                     }
                 }
-                xhr.send()
+                xhr.send(JSON.stringify({ path: path }))
             }
 
             Timer { interval: 2000; running: true; repeat: true; onTriggered: load() }
             Component.onCompleted: load()
 
+            function updateActiveChat() {
+                setActiveChat(status === PageStatus.Active && Qt.application.active ? chatJid : "")
+            }
+            onStatusChanged: updateActiveChat()
+            Connections {
+                target: Qt.application
+                onActiveChanged: chatPageItem.updateActiveChat()
+            }
+
             Component {
                 id: imagePicker
                 ImagePickerPage {
@@ -1,51 +1,111 @@
 import subprocess
 import os
+import shutil
+import socket
+import tempfile
 import time
 import urllib.request
 import pyotherside
 
 backend_process = None
 
+BACKEND_URL = "http://127.0.0.1:8085"
+DATA_DIR = os.path.expanduser("~/.local/share/harbour-whatsapp")
+
+def api_token():
+    # Written by the backend on startup, readable only by us
+    runtime_dir = os.environ.get("XDG_RUNTIME_DIR") or DATA_DIR
+    try:
+        with open(os.path.join(runtime_dir, "harbour-whatsapp", "api-token")) as f:
+            return f.read().strip()
+    except OSError:
+        return ""
+
+def backend_up():
+    token = api_token()
+    if not token:
+        return ""
+    req = urllib.request.Request(BACKEND_URL + "/api/v2/status", headers={"Authorization": "Bearer " + token})
+    try:
+        urllib.request.urlopen(req, timeout=1)
+        return token
+    except:
+        return ""
+
+def wait_ready(notify, process, timeout):
+    # The backend speaks the systemd notify protocol: READY=1 comes once
+    # the database is open and the API listens
+    notify.settimeout(0.2)
+    deadline = time.time() + timeout
+    while time.time() < deadline and process.poll() is None:
+        try:
+            data = notify.recv(4096)
+        except socket.timeout:
+            continue
+        if b"READY=1" in data.split(b"\n"):
+            return True
+    return False
+
+def spawn_backend():
+    notify_dir = tempfile.mkdtemp(prefix="harbour-whatsapp-")
+    notify_path = os.path.join(notify_dir, "notify")
+    notify = socket.socket(socket.AF_UNIX, socket.SOCK_DGRAM)
+    try:
+        notify.bind(notify_path)
+        process = subprocess.Popen(
+            ["/usr/share/harbour-whatsapp/wa-backend"],
+            cwd=DATA_DIR,
+            env=dict(os.environ, NOTIFY_SOCKET=notify_path),
+            stdout=subprocess.DEVNULL,
+            stderr=subprocess.DEVNULL
+        )
+        return process, wait_ready(notify, process, 30)
+    finally:
+        notify.close()
+        shutil.rmtree(notify_dir, ignore_errors=True)
+
 def start():
     global backend_process
-    data_dir = os.path.expanduser("~/.local/share/harbour-whatsapp")
-    os.makedirs(data_dir, exist_ok=True)
+    os.makedirs(DATA_DIR, exist_ok=True)
     
     # Check if already running
-    try:
-        urllib.request.urlopen("http://localhost:8085/status", timeout=1)
-        pyotherside.send('backendReady', True)
+    token = backend_up()
+    if token:
+        pyotherside.send('backendReady', True, BACKEND_URL, token)
         return True
-    except:
-        pass
     
     # Start backend
     if backend_process is None or backend_process.poll() is not None:
-        backend_process = subprocess.Popen(
-            ["/usr/share/harbour-whatsapp/wa-backend"],
-            cwd=data_dir,
-            stdout=subprocess.DEVNULL,
-            stderr=subprocess.DEVNULL
-        )
-        
-        # Wait for backend to be ready
-        for i in range(50):
-            try:
-                urllib.request.urlopen("http://localhost:8085/status", timeout=1)
-                pyotherside.send('backendReady', True)
-                return True
-            except:
-                time.sleep(0.1)
+        backend_process, ready = spawn_backend()
+        token = api_token()
+        if ready and token:
+            pyotherside.send('backendReady', True, BACKEND_URL, token)
+            return True
     
-    pyotherside.send('backendReady', False)
+    pyotherside.send('backendReady', False, BACKEND_URL, "")
     return False
 
+def request_shutdown():
+    # The backend answers first, then finishes sends and saves its data
+    token = api_token()
+    if not token:
+        return False
+    req = urllib.request.Request(BACKEND_URL + "/api/v2/shutdown", data=b"", method="POST",
+                                 headers={"Authorization": "Bearer " + token})
+    try:
+        urllib.request.urlopen(req, timeout=2)
+        return True
+    except:
+        return False
+
 def stop():
     global backend_process
     if backend_process:
-        backend_process.terminate()
+        if not request_shutdown():
+            backend_process.terminate()
         try:
-            backend_process.wait(timeout=2)
+            # Sends in flight get up to 10s before the backend gives up on them
+            backend_process.wait(timeout=15)
         except:
             backend_process.kill()
         backend_process = None